@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coder/websocket"
+)
+
+// options every websocket is accepted with, from the originPatterns,
+// insecureSkipOriginVerify, subprotocols, and compression flags
+var websocketAcceptOptions = &websocket.AcceptOptions{}
+
+// permessage-deflate mode of the compression flag, for accepted and
+// client mode websockets
+var compressionMode = websocket.CompressionDisabled
+
+// parseCompressionMode parses the compression flag.
+func parseCompressionMode(mode string) (websocket.CompressionMode, error) {
+	switch mode {
+	case "disabled":
+		return websocket.CompressionDisabled, nil
+	case "context-takeover":
+		return websocket.CompressionContextTakeover, nil
+	case "no-context-takeover":
+		return websocket.CompressionNoContextTakeover, nil
+	}
+	return websocket.CompressionDisabled, fmt.Errorf("invalid compression %q, must be disabled, context-takeover, or no-context-takeover", mode)
+}
+
+// splitCommaList splits a comma-separated flag value, dropping empty items.
+func splitCommaList(value string) []string {
+	var items []string
+	for item := range strings.SplitSeq(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newWebsocketAcceptOptions builds the accept options for originPatterns,
+// insecureSkipOriginVerify, subprotocols, and compression.
+func newWebsocketAcceptOptions() (*websocket.AcceptOptions, error) {
+	acceptOptions := &websocket.AcceptOptions{
+		OriginPatterns:       splitCommaList(*originPatterns),
+		InsecureSkipVerify:   *insecureSkipOriginVerify,
+		Subprotocols:         splitCommaList(*subprotocols),
+		CompressionMode:      compressionMode,
+		CompressionThreshold: *compressionThreshold,
+	}
+
+	if acceptOptions.InsecureSkipVerify && len(acceptOptions.OriginPatterns) > 0 {
+		return nil, errors.New("originPatterns has no effect with insecureSkipOriginVerify")
+	}
+
+	if len(acceptOptions.Subprotocols) > 0 && *backendURL != "" {
+		return nil, errors.New("subprotocols is not supported with backendURL, which negotiates the backend's subprotocol")
+	}
+
+	return acceptOptions, nil
+}
+
+// websocketBackendAcceptOptions returns the accept options with the
+// subprotocol the websocket backend selected, if any.
+func websocketBackendAcceptOptions(subprotocol string) *websocket.AcceptOptions {
+	acceptOptions := *websocketAcceptOptions
+	if subprotocol != "" {
+		acceptOptions.Subprotocols = []string{subprotocol}
+	}
+	return &acceptOptions
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// named accessLogFormat templates. The bytes of clf and combined are those
+// sent to the client, as in an http server's access log.
+var namedAccessLogFormats = map[string]string{
+	"clf":      `{{.ClientIP}} - - [{{clfTime .Time}}] {{quote .Request}} {{.Status}} {{.BytesTcpToWs}}`,
+	"combined": `{{.ClientIP}} - - [{{clfTime .Time}}] {{quote .Request}} {{.Status}} {{.BytesTcpToWs}} {{quote .Referer}} {{quote .UserAgent}}`,
+}
+
+var accessLogTemplateFuncs = template.FuncMap{
+	"clfTime": func(t time.Time) string {
+		return t.Format("02/Jan/2006:15:04:05 -0700")
+	},
+	// quote quotes s with Go escaping, so a header cannot forge a log line,
+	// or returns "-" when s is empty as an http server's access log does.
+	"quote": func(s string) string {
+		if s == "" {
+			return `"-"`
+		}
+		return strconv.Quote(s)
+	},
+}
+
+// accessLogEntry is a connectionRecord with the request fields of an access log line.
+type accessLogEntry struct {
+	connectionRecord
+
+	RemoteAddr string
+	Request    string
+	Status     int
+	Referer    string
+	UserAgent  string
+}
+
+func newAccessLogEntry(
+	r *http.Request,
+	record connectionRecord,
+) accessLogEntry {
+	return accessLogEntry{
+		connectionRecord: record,
+		RemoteAddr:       r.RemoteAddr,
+		Request:          r.Method + " " + r.URL.RequestURI() + " " + r.Proto,
+		Status:           http.StatusSwitchingProtocols,
+		Referer:          r.Referer(),
+		UserAgent:        r.UserAgent(),
+	}
+}
+
+// accessLog writes one line per connection, formatted by a template,
+// to a file separate from the operational log.
+type accessLog struct {
+	template *template.Template
+
+	mutex  sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+// connection access log, nil if accessLogFile is unset
+var connectionAccessLog *accessLog
+
+// parseAccessLogFormat parses format as a named format or a text/template.
+func parseAccessLogFormat(format string) (*template.Template, error) {
+	if named, ok := namedAccessLogFormats[format]; ok {
+		format = named
+	}
+
+	tmpl, err := template.New("accessLogFormat").Funcs(accessLogTemplateFuncs).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("template.Parse error: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+func openAccessLog(
+	path string,
+	format string,
+) (*accessLog, error) {
+
+	tmpl, err := parseAccessLogFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile error: %w", err)
+	}
+
+	return &accessLog{
+		template: tmpl,
+		file:     file,
+	}, nil
+}
+
+func (al *accessLog) record(entry accessLogEntry) {
+	var line bytes.Buffer
+	if err := al.template.Execute(&line, entry); err != nil {
+		slog.Warn("accessLog template.Execute error",
+			"error", err,
+		)
+		return
+	}
+
+	if !bytes.HasSuffix(line.Bytes(), []byte("\n")) {
+		line.WriteByte('\n')
+	}
+
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.closed {
+		return
+	}
+
+	if _, err := al.file.Write(line.Bytes()); err != nil {
+		slog.Warn("accessLog file.Write error",
+			"error", err,
+		)
+	}
+}
+
+func (al *accessLog) close() {
+	al.mutex.Lock()
+	defer al.mutex.Unlock()
+
+	if al.closed {
+		return
+	}
+	al.closed = true
+
+	if err := al.file.Close(); err != nil {
+		slog.Warn("accessLog file.Close error",
+			"error", err,
+		)
+	}
+}
+
+// recordAccessLog writes the access log line for record if accessLogFile is configured.
+func recordAccessLog(
+	r *http.Request,
+	record connectionRecord,
+) {
+
+	if connectionAccessLog != nil {
+		connectionAccessLog.record(newAccessLogEntry(r, record))
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns the autocert manager that obtains and renews
+// certificates for acmeDomains, caching them in acmeCacheDir so restarts
+// do not request new ones.
+func newACMEManager() (*autocert.Manager, error) {
+	domains := splitCommaList(*acmeDomains)
+	if len(domains) == 0 {
+		return nil, errors.New("acmeDomains is empty")
+	}
+	if *acmeCacheDir == "" {
+		return nil, errors.New("acmeCacheDir must be set with acmeDomains")
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(*acmeCacheDir),
+		Email:      *acmeEmail,
+	}
+	if *acmeDirectoryURL != "" {
+		manager.Client = &acme.Client{
+			DirectoryURL: *acmeDirectoryURL,
+		}
+	}
+
+	return manager, nil
+}
+
+// acmeTLSConfig returns the tls config serving manager's certificates,
+// which also answers tls-alpn-01 challenges on the tls listeners.
+func acmeTLSConfig(manager *autocert.Manager) *tls.Config {
+	config := manager.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+	return config
+}
+
+// startACMEChallengeServer serves http-01 challenges for manager on listener,
+// redirecting other plain http requests to https.
+func startACMEChallengeServer(
+	listener net.Listener,
+	manager *autocert.Manager,
+) {
+
+	challengeServer := &http.Server{
+		Handler:           manager.HTTPHandler(nil),
+		IdleTimeout:       1 * time.Minute,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("starting acme challenge server",
+		"acmeHTTPListenAddr", listener.Addr().String(),
+		"acmeDomains", splitCommaList(*acmeDomains),
+	)
+
+	closeOnShutdown(challengeServer)
+
+	go func() {
+		err := challengeServer.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		slog.Error("challengeServer.Serve error",
+			"error", err,
+		)
+	}()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var errBackendNotAllowed = errors.New("backend not allowed")
+
+// normalized host:port values from backendAllowlist, nil if unset
+var backendAllowlistSet map[string]bool
+
+// normalizeHostAndPort lowercases the host of hostAndPort
+// and brackets IPv6 hosts, so equal addresses compare equal.
+// unix: socket paths are compared as given.
+func normalizeHostAndPort(hostAndPort string) (string, error) {
+	if strings.HasPrefix(hostAndPort, unixAddressPrefix) {
+		return hostAndPort, nil
+	}
+
+	host, port, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+// parseBackendAllowlist parses the comma-separated host:port values of backendAllowlist.
+func parseBackendAllowlist(allowlist string) (map[string]bool, error) {
+	allowed := make(map[string]bool)
+
+	for hostAndPort := range strings.SplitSeq(allowlist, ",") {
+		if hostAndPort = strings.TrimSpace(hostAndPort); hostAndPort == "" {
+			continue
+		}
+
+		normalized, err := normalizeHostAndPort(hostAndPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backendAllowlist entry %q: %w", hostAndPort, err)
+		}
+		allowed[normalized] = true
+	}
+
+	return allowed, nil
+}
+
+// checkBackendAllowed returns errBackendNotAllowed if backendAllowlist is set
+// and does not contain hostAndPort.
+func checkBackendAllowed(hostAndPort string) error {
+	if backendAllowlistSet == nil {
+		return nil
+	}
+
+	normalized, err := normalizeHostAndPort(hostAndPort)
+	if err != nil || !backendAllowlistSet[normalized] {
+		return fmt.Errorf("%w: %q", errBackendNotAllowed, hostAndPort)
+	}
+
+	return nil
+}
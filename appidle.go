@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runIdleTimeout calls onIdle with the idle time if no application data moves
+// in either direction of a connection for timeout, until ctx is done. Only
+// proxied bytes reach byteCounts, so pings, pongs, and other control frames
+// do not count as activity.
+func runIdleTimeout(
+	ctx context.Context,
+	timeout time.Duration,
+	byteCounts *connectionByteCounts,
+	onIdle func(idle time.Duration),
+) {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			idle := time.Since(byteCounts.lastActivity())
+			if idle < timeout {
+				timer.Reset(timeout - idle)
+				continue
+			}
+
+			onIdle(idle)
+			return
+		}
+	}
+}
+
+// logProxyIdleTimeout logs a connection closed by proxyIdleTimeout.
+func logProxyIdleTimeout(
+	idle time.Duration,
+	txLogger *slog.Logger,
+) {
+	txLogger.Info("proxy idle timeout",
+		"proxyIdleTimeout", proxyIdleTimeout.String(),
+		"idle", idle.String(),
+	)
+}
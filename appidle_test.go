@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestProxyIdleTimeoutClosesIdleTcpSession(t *testing.T) {
+	defer func(timeout time.Duration) { *proxyIdleTimeout = timeout }(*proxyIdleTimeout)
+	*proxyIdleTimeout = 300 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	server := startProxyServer(t)
+
+	clientConn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("websocket.Dial error: %v", err)
+	}
+	defer clientConn.CloseNow()
+
+	startTime := time.Now()
+
+	// traffic within the timeout keeps the session open
+	for range 3 {
+		time.Sleep(*proxyIdleTimeout / 2)
+
+		if err := clientConn.Write(ctx, websocket.MessageBinary, []byte("hi")); err != nil {
+			t.Fatalf("clientConn.Write error: %v", err)
+		}
+		if _, _, err := clientConn.Read(ctx); err != nil {
+			t.Fatalf("clientConn.Read error: %v", err)
+		}
+	}
+
+	// then the idle session is closed
+	_, _, err = clientConn.Read(ctx)
+	var closeError websocket.CloseError
+	if !errors.As(err, &closeError) || closeError.Code != websocket.StatusGoingAway || closeError.Reason != "proxy idle timeout" {
+		t.Fatalf("clientConn.Read error = %v, want close status 1001 for the proxy idle timeout", err)
+	}
+
+	if elapsed := time.Since(startTime); elapsed < 3*(*proxyIdleTimeout/2)+*proxyIdleTimeout {
+		t.Errorf("session closed after %v, before being idle for %v", elapsed, *proxyIdleTimeout)
+	}
+}
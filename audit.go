@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// connectionRecord describes a connection when it closes.
+type connectionRecord struct {
+	Time            time.Time `json:"time"`
+	TxID            string    `json:"txID"`
+	ClientIP        string    `json:"clientIP"`
+	Backend         string    `json:"backend"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	BytesWsToTcp    int64     `json:"bytesWsToTcp"`
+	BytesTcpToWs    int64     `json:"bytesTcpToWs"`
+	CloseReason     string    `json:"closeReason,omitempty"`
+	CloseClass      string    `json:"closeClass,omitempty"`
+}
+
+// auditSink batches connectionRecords and POSTs them as NDJSON to an http endpoint.
+// Records are buffered in memory up to maxBuffered, dropping the oldest on overflow,
+// so a slow or failing endpoint never blocks the proxy path.
+type auditSink struct {
+	url         string
+	client      *http.Client
+	maxBuffered int
+
+	mutex   sync.Mutex
+	records []connectionRecord
+	dropped uint64
+}
+
+// sink for connection records, nil if auditSink is unset
+var connectionAuditSink *auditSink
+
+func newAuditSink(
+	url string,
+	maxBuffered int,
+) *auditSink {
+	return &auditSink{
+		url: url,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		maxBuffered: maxBuffered,
+	}
+}
+
+// add buffers records at the end of the queue, or the front when requeuing
+// records that failed to send, then drops the oldest records over maxBuffered.
+func (as *auditSink) add(
+	records []connectionRecord,
+	front bool,
+) {
+
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	if front {
+		as.records = append(records, as.records...)
+	} else {
+		as.records = append(as.records, records...)
+	}
+
+	if overflow := len(as.records) - as.maxBuffered; overflow > 0 {
+		as.records = as.records[overflow:]
+		as.dropped += uint64(overflow)
+
+		slog.Warn("auditSink buffer full, dropped oldest records",
+			"dropped", overflow,
+			"totalDropped", as.dropped,
+		)
+	}
+}
+
+func (as *auditSink) record(record connectionRecord) {
+	as.add([]connectionRecord{record}, false)
+}
+
+var connectionDurationHistogram = newHistogram(
+	"wsproxy_connection_duration_seconds",
+	"How long websocket connections lasted, from accept to close.",
+	[]float64{0.1, 1, 10, 60, 300, 1800, 3600, 4 * 3600, 24 * 3600},
+)
+
+// recordConnection sends record to the audit sink and event log if configured,
+// and records its duration in connectionDurationHistogram and for statsd.
+func recordConnection(record connectionRecord) {
+	recordTiming("wsproxy_connection_duration", time.Duration(record.DurationSeconds*float64(time.Second)))
+	connectionDurationHistogram.observe(record.DurationSeconds)
+
+	if connectionAuditSink != nil {
+		connectionAuditSink.record(record)
+	}
+	if connectionEventLog != nil {
+		connectionEventLog.record(record)
+	}
+}
+
+// recordConnectionEnd records a connection that has closed, as
+// recordConnection does, in the access log and close class metric as well,
+// and logs its access record.
+func recordConnectionEnd(
+	r *http.Request,
+	record connectionRecord,
+) {
+
+	recordConnection(record)
+	recordAccessLog(r, record)
+
+	if record.CloseClass != "" {
+		connectionCloses.inc(record.CloseClass)
+	}
+
+	slog.Info("access record",
+		"txID", record.TxID,
+		"clientIP", record.ClientIP,
+		"backend", record.Backend,
+		"durationSeconds", record.DurationSeconds,
+		"bytesWsToTcp", record.BytesWsToTcp,
+		"bytesTcpToWs", record.BytesTcpToWs,
+		"closeReason", record.CloseReason,
+		"closeClass", record.CloseClass,
+	)
+}
+
+func (as *auditSink) takeBatch() []connectionRecord {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+
+	batch := as.records
+	as.records = nil
+
+	return batch
+}
+
+func (as *auditSink) post(
+	ctx context.Context,
+	batch []connectionRecord,
+) error {
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+
+	for _, record := range batch {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("encoder.Encode error: %w", err)
+		}
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, as.url, &body)
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext error: %w", err)
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+
+	response, err := as.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("client.Do error: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %v", response.Status)
+	}
+
+	return nil
+}
+
+// run flushes buffered records every flushInterval.
+// A batch that fails to send is requeued and retried on the next flush.
+func (as *auditSink) run(
+	ctx context.Context,
+	flushInterval time.Duration,
+) {
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			batch := as.takeBatch()
+			if len(batch) == 0 {
+				continue
+			}
+
+			if err := as.post(ctx, batch); err != nil {
+				slog.Warn("auditSink post error, will retry",
+					"records", len(batch),
+					"error", err,
+				)
+				as.add(batch, true)
+				continue
+			}
+
+			slog.Debug("auditSink posted records",
+				"records", len(batch),
+			)
+		}
+	}
+}
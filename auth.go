@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	errAuthMissingToken = errors.New("missing bearer token")
+	errAuthUnknownToken = errors.New("unknown bearer token")
+	errJWTMalformed     = errors.New("malformed jwt")
+	errJWTAlgorithm     = errors.New("jwt alg is not HS256")
+	errJWTSignature     = errors.New("jwt signature mismatch")
+	errJWTExpired       = errors.New("jwt expired")
+	errJWTNotYetValid   = errors.New("jwt not yet valid")
+	errJWTIssuer        = errors.New("jwt issuer mismatch")
+)
+
+// sha256 of the tokens from authToken and authTokenFile,
+// so lookups do not compare token bytes directly
+var authTokenHashes = make(map[[sha256.Size]byte]bool)
+
+// hmac key JWTs are verified with, nil if jwtSigningKeyFile is unset
+var jwtSigningKey []byte
+
+// authEnabled reports whether connections must present a bearer token.
+func authEnabled() bool {
+	return len(authTokenHashes) > 0 || jwtSigningKey != nil
+}
+
+// loadAuthTokens adds token and the tokens in tokenFile, one per line,
+// to authTokenHashes. Blank lines and lines starting with # are ignored.
+func loadAuthTokens(
+	token string,
+	tokenFile string,
+) error {
+
+	if token != "" {
+		authTokenHashes[sha256.Sum256([]byte(token))] = true
+	}
+
+	if tokenFile == "" {
+		return nil
+	}
+
+	contents, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile error: %w", err)
+	}
+
+	for line := range strings.Lines(string(contents)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		authTokenHashes[sha256.Sum256([]byte(line))] = true
+	}
+
+	return nil
+}
+
+// loadJWTSigningKey reads the hmac key from keyFile, trimming a trailing newline.
+func loadJWTSigningKey(keyFile string) ([]byte, error) {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile error: %w", err)
+	}
+
+	key = bytes.TrimRight(key, "\r\n")
+	if len(key) == 0 {
+		return nil, errors.New("jwt signing key is empty")
+	}
+
+	return key, nil
+}
+
+// authenticateRequest checks the request's "Authorization: Bearer" token
+// against the static tokens, then as an HS256 JWT when jwtSigningKeyFile is set.
+// It returns the sub claim of a JWT, empty for a static token.
+func authenticateRequest(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return "", errAuthMissingToken
+	}
+
+	if authTokenHashes[sha256.Sum256([]byte(token))] {
+		return "", nil
+	}
+
+	if jwtSigningKey != nil && strings.Count(token, ".") == 2 {
+		return verifyJWT(token, jwtSigningKey, *jwtIssuer, time.Now())
+	}
+
+	return "", errAuthUnknownToken
+}
+
+// jwtClaims are the registered claims checked by verifyJWT.
+type jwtClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	ExpiresAt *int64 `json:"exp"`
+	NotBefore *int64 `json:"nbf"`
+}
+
+// verifyJWT verifies an HS256 signed JWT with key, and its exp and nbf claims
+// when present, allowing no clock skew. A non-empty issuer must match iss.
+// It returns the sub claim.
+func verifyJWT(
+	token string,
+	key []byte,
+	issuer string,
+	now time.Time,
+) (string, error) {
+
+	encodedHeader, rest, _ := strings.Cut(token, ".")
+	encodedPayload, encodedSignature, _ := strings.Cut(rest, ".")
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(encodedHeader)
+	if err != nil {
+		return "", errJWTMalformed
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return "", errJWTMalformed
+	}
+	if header.Algorithm != "HS256" {
+		return "", errJWTAlgorithm
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return "", errJWTMalformed
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encodedHeader + "." + encodedPayload))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errJWTSignature
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", errJWTMalformed
+	}
+
+	var claims jwtClaims
+	if err := json.Unmarshal(payloadJSON, &claims); err != nil {
+		return "", errJWTMalformed
+	}
+
+	if claims.ExpiresAt != nil && now.Unix() >= *claims.ExpiresAt {
+		return "", errJWTExpired
+	}
+	if claims.NotBefore != nil && now.Unix() < *claims.NotBefore {
+		return "", errJWTNotYetValid
+	}
+	if issuer != "" && claims.Issuer != issuer {
+		return "", errJWTIssuer
+	}
+
+	return claims.Subject, nil
+}
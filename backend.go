@@ -0,0 +1,353 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tcpOptions are the socket options of a backend connection.
+type tcpOptions struct {
+	noDelay           *bool
+	keepAliveInterval time.Duration
+	keepAliveCount    int
+	sendBuffer        int
+	recvBuffer        int
+}
+
+type backend struct {
+	hostAndPort    string
+	weight         int
+	maxConnections int
+
+	// 0 for backendDialTimeout
+	dialTimeout time.Duration
+
+	// local address dialed from, nil for backendSourceIP
+	sourceAddr *net.TCPAddr
+
+	// tcp4 or tcp6 to dial one ip family, empty for backendIPFamily
+	tcpNetwork string
+
+	// socket options set after each dial, zero values for the flags
+	tcpOptions tcpOptions
+
+	// weight scaled by slowStartWeightScale and reduced while slow starting,
+	// used for selection, guarded by backendPool.mutex
+	effectiveWeight int
+
+	// smooth weighted round robin state, guarded by backendPool.mutex
+	currentWeight int
+
+	// excluded from the current selection, guarded by backendPool.mutex
+	skipped bool
+
+	*backendState
+}
+
+// backendState is the state of a backend shared with the backend replacing it
+// when the backends are reloaded, so connections still using the old backend
+// count against the new one's maxConnections.
+type backendState struct {
+	// unix nanoseconds when slow start began, 0 if not slow starting
+	slowStartTime          atomic.Int64
+	slowStartLoggedQuarter atomic.Int32
+
+	// set while dials of the backend are failing, to slow start it on recovery
+	dialFailing atomic.Bool
+
+	// dials failed in a row, and unix nanoseconds the backend is unhealthy
+	// until once they reach unhealthyThreshold, 0 if not marked unhealthy
+	consecutiveDialFailures atomic.Int64
+	unhealthyUntil          atomic.Int64
+
+	selections        atomic.Uint64
+	activeConnections atomic.Int64
+}
+
+// saturated returns true if backend is at its maxConnections.
+func (b *backend) saturated() bool {
+	return b.maxConnections > 0 && b.activeConnections.Load() >= int64(b.maxConnections)
+}
+
+// available returns true if backend may be selected, neither saturated
+// nor skipped for the current selection.
+func (b *backend) available() bool {
+	return !b.skipped && !b.saturated()
+}
+
+// effectiveDialTimeout returns the timeout for one dial of backend.
+func (b *backend) effectiveDialTimeout() time.Duration {
+	if b.dialTimeout > 0 {
+		return b.dialTimeout
+	}
+	return *backendDialTimeout
+}
+
+// effectiveSourceAddr returns the local address backend is dialed from,
+// nil for the os choice.
+func (b *backend) effectiveSourceAddr() *net.TCPAddr {
+	if b.sourceAddr != nil {
+		return b.sourceAddr
+	}
+	return backendSourceAddr
+}
+
+// effectiveTCPNetwork returns the network backend is dialed with,
+// selecting the ip family of its addresses.
+func (b *backend) effectiveTCPNetwork() string {
+	if b.tcpNetwork != "" {
+		return b.tcpNetwork
+	}
+	return backendTCPNetwork
+}
+
+// effectiveTCPOptions returns the socket options of backend connections,
+// with those the backend does not set taken from the flags.
+func (b *backend) effectiveTCPOptions() tcpOptions {
+	options := tcpOptions{
+		noDelay:           b.tcpOptions.noDelay,
+		keepAliveInterval: cmp.Or(b.tcpOptions.keepAliveInterval, *backendKeepAliveInterval),
+		keepAliveCount:    cmp.Or(b.tcpOptions.keepAliveCount, *backendKeepAliveCount),
+		sendBuffer:        cmp.Or(b.tcpOptions.sendBuffer, *backendSendBuffer),
+		recvBuffer:        cmp.Or(b.tcpOptions.recvBuffer, *backendRecvBuffer),
+	}
+	if options.noDelay == nil {
+		options.noDelay = backendNoDelay
+	}
+	return options
+}
+
+// acquire counts a connection using backend, release must be called when it ends.
+func (b *backend) acquire() {
+	b.activeConnections.Add(1)
+}
+
+func (b *backend) release() {
+	b.activeConnections.Add(-1)
+}
+
+type backendPool struct {
+	mutex    sync.Mutex
+	backends []*backend
+}
+
+// parseBackend parses a backend as host:port, or a unix socket as
+// unix:path where the path has no colons, with optional :weight,
+// :maxConnections, and :dialTimeout suffixes.
+func parseBackend(s string) (*backend, error) {
+	s = strings.TrimSpace(s)
+
+	if path, ok := strings.CutPrefix(s, unixAddressPrefix); ok {
+		return parseUnixBackend(s, path)
+	}
+
+	hostAndPort := s
+	var options []string
+
+	for len(options) < 3 {
+		if _, _, err := net.SplitHostPort(hostAndPort); err == nil {
+			break
+		}
+		i := strings.LastIndex(hostAndPort, ":")
+		if i < 0 {
+			break
+		}
+		options = append([]string{hostAndPort[i+1:]}, options...)
+		hostAndPort = hostAndPort[:i]
+	}
+
+	_, port, err := net.SplitHostPort(hostAndPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend %q: %w", s, err)
+	}
+
+	// an unbracketed ipv6 address such as ::1:31415 splits to an empty port
+	if port == "" {
+		return nil, fmt.Errorf("invalid backend %q: missing port, ipv6 addresses must be bracketed", s)
+	}
+
+	return newBackend(s, hostAndPort, options)
+}
+
+// parseUnixBackend parses the path and options of unix backend s.
+func parseUnixBackend(s string, path string) (*backend, error) {
+	path, optionList, hasOptions := strings.Cut(path, ":")
+	if path == "" {
+		return nil, fmt.Errorf("invalid backend %q: missing socket path", s)
+	}
+
+	var options []string
+	if hasOptions {
+		options = strings.Split(optionList, ":")
+		if len(options) > 3 {
+			return nil, fmt.Errorf("invalid backend %q: too many options", s)
+		}
+	}
+
+	return newBackend(s, unixAddressPrefix+path, options)
+}
+
+// newBackend returns backend s at hostAndPort with the weight,
+// maxConnections, and dialTimeout options given.
+func newBackend(s string, hostAndPort string, options []string) (*backend, error) {
+	b := &backend{
+		hostAndPort:  hostAndPort,
+		weight:       1,
+		backendState: &backendState{},
+	}
+
+	if len(options) > 0 {
+		weight, err := strconv.Atoi(options[0])
+		if err != nil || weight < 1 {
+			return nil, fmt.Errorf("invalid weight in backend %q", s)
+		}
+		b.weight = weight
+	}
+
+	if len(options) > 1 {
+		maxConnections, err := strconv.Atoi(options[1])
+		if err != nil || maxConnections < 0 {
+			return nil, fmt.Errorf("invalid maxConnections in backend %q", s)
+		}
+		b.maxConnections = maxConnections
+	}
+
+	if len(options) > 2 {
+		dialTimeout, err := time.ParseDuration(options[2])
+		if err != nil || dialTimeout <= 0 {
+			return nil, fmt.Errorf("invalid dialTimeout in backend %q", s)
+		}
+		b.dialTimeout = dialTimeout
+	}
+
+	return b, nil
+}
+
+// newBackendPool builds a backendPool from a comma-separated list of backends.
+func newBackendPool(spec string) (*backendPool, error) {
+	var backends []*backend
+
+	for s := range strings.SplitSeq(spec, ",") {
+		backend, err := parseBackend(s)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+
+	return &backendPool{
+		backends: backends,
+	}, nil
+}
+
+// next selects a backend for a client using backendLoadBalanceStrategy,
+// never one of exclude. When the preferred backend is saturated or unhealthy
+// the next best available backend is selected instead. The selected backend
+// is acquired, and is nil if no backend is available.
+func (bp *backendPool) next(clientIP string, exclude ...*backend) (selected *backend, preferred *backend) {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+
+	now := time.Now()
+	for _, backend := range bp.backends {
+		backend.updateEffectiveWeight(now)
+	}
+	bp.updateSkipped(now, exclude)
+
+	switch backendLoadBalanceStrategy {
+	case loadBalanceRandom:
+		selected, preferred = bp.nextRandom()
+	case loadBalanceLeastConnections:
+		selected, preferred = bp.nextLeastConnections()
+	case loadBalanceIPHash:
+		selected, preferred = bp.nextIPHash(clientIP)
+	default:
+		selected, preferred = bp.nextRoundRobin()
+	}
+
+	if selected != nil {
+		selected.selections.Add(1)
+		selected.acquire()
+	}
+
+	return selected, preferred
+}
+
+// nextRoundRobin uses smooth weighted round robin, spreading
+// selections in proportion to backend effective weights.
+func (bp *backendPool) nextRoundRobin() (selected *backend, preferred *backend) {
+	totalWeight := 0
+
+	for _, backend := range bp.backends {
+		backend.currentWeight += backend.effectiveWeight
+		totalWeight += backend.effectiveWeight
+
+		if preferred == nil || backend.currentWeight > preferred.currentWeight {
+			preferred = backend
+		}
+
+		if backend.available() &&
+			(selected == nil || backend.currentWeight > selected.currentWeight) {
+			selected = backend
+		}
+	}
+
+	if selected != nil {
+		selected.currentWeight -= totalWeight
+	}
+
+	return selected, preferred
+}
+
+// hostAndPorts returns the address of each backend.
+func (bp *backendPool) hostAndPorts() []string {
+	hostAndPorts := make([]string, 0, len(bp.backends))
+
+	for _, backend := range bp.backends {
+		hostAndPorts = append(hostAndPorts, backend.hostAndPort)
+	}
+
+	return hostAndPorts
+}
+
+var backendActiveConnectionsGauge = newFuncVec(
+	"wsproxy_backend_active_connections",
+	"Active connections to each backend.",
+	"gauge",
+	"backend",
+	func() map[string]float64 {
+		values := make(map[string]float64)
+		for hostAndPort, count := range backends.Load().activeConnectionCounts() {
+			values[hostAndPort] = float64(count)
+		}
+		return values
+	},
+)
+
+// activeConnectionCounts returns the number of active connections of each backend.
+func (bp *backendPool) activeConnectionCounts() map[string]int64 {
+	activeConnectionCounts := make(map[string]int64, len(bp.backends))
+
+	for _, backend := range bp.backends {
+		activeConnectionCounts[backend.hostAndPort] += backend.activeConnections.Load()
+	}
+
+	return activeConnectionCounts
+}
+
+// selectionCounts returns the number of selections of each backend.
+func (bp *backendPool) selectionCounts() map[string]uint64 {
+	selectionCounts := make(map[string]uint64, len(bp.backends))
+
+	for _, backend := range bp.backends {
+		selectionCounts[backend.hostAndPort] += backend.selections.Load()
+	}
+
+	return selectionCounts
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBackend(t *testing.T) {
+	tests := []struct {
+		spec           string
+		hostAndPort    string
+		weight         int
+		maxConnections int
+		dialTimeout    time.Duration
+		wantErr        bool
+	}{
+		{spec: "localhost:31415", hostAndPort: "localhost:31415", weight: 1},
+		{spec: "backend1:31415:3:100:250ms", hostAndPort: "backend1:31415", weight: 3, maxConnections: 100, dialTimeout: 250 * time.Millisecond},
+		{spec: "[::1]:31415", hostAndPort: "[::1]:31415", weight: 1},
+		{spec: "[::1]:31415:3", hostAndPort: "[::1]:31415", weight: 3},
+		{spec: "[2001:db8::10]:31415:2:50", hostAndPort: "[2001:db8::10]:31415", weight: 2, maxConnections: 50},
+		{spec: "[2001:db8::10]:31415:1:0:1s", hostAndPort: "[2001:db8::10]:31415", weight: 1, dialTimeout: time.Second},
+		{spec: " [fe80::1%eth0]:80 ", hostAndPort: "[fe80::1%eth0]:80", weight: 1},
+		{spec: "::1:31415", wantErr: true},
+		{spec: "[::1]", wantErr: true},
+		{spec: "[::1]:31415:0", wantErr: true},
+		{spec: "[::1]:31415:1:1:1s:extra", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			backend, err := parseBackend(test.spec)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseBackend = %q, want error", backend.hostAndPort)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBackend error: %v", err)
+			}
+
+			if backend.hostAndPort != test.hostAndPort ||
+				backend.weight != test.weight ||
+				backend.maxConnections != test.maxConnections ||
+				backend.dialTimeout != test.dialTimeout {
+				t.Errorf("parseBackend = %q weight %v maxConnections %v dialTimeout %v, want %q weight %v maxConnections %v dialTimeout %v",
+					backend.hostAndPort, backend.weight, backend.maxConnections, backend.dialTimeout,
+					test.hostAndPort, test.weight, test.maxConnections, test.dialTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// parseBackendFile parses backend file contents, one or more backends
+// separated by newlines or commas.
+func parseBackendFile(contents []byte) (*backendPool, error) {
+	var specs []string
+
+	for line := range strings.Lines(string(contents)) {
+		if line = strings.TrimSpace(line); line != "" {
+			specs = append(specs, line)
+		}
+	}
+
+	return newBackendPool(strings.Join(specs, ","))
+}
+
+// loadBackendFile reads and parses the backend file at path.
+func loadBackendFile(path string) (*backendPool, []byte, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("os.ReadFile error: %w", err)
+	}
+
+	pool, err := parseBackendFile(contents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parseBackendFile error: %w", err)
+	}
+
+	return pool, contents, nil
+}
+
+// watchBackendFile polls the backend file at path and swaps in a new
+// backendPool whenever its contents change. New connections use the new
+// backends while existing connections are unaffected.
+// If the changed file fails to parse the current backends are kept.
+func watchBackendFile(
+	ctx context.Context,
+	path string,
+	interval time.Duration,
+	lastContents []byte,
+) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				slog.Warn("watchBackendFile os.ReadFile error",
+					"path", path,
+					"error", err,
+				)
+				continue
+			}
+
+			if bytes.Equal(contents, lastContents) {
+				continue
+			}
+			lastContents = contents
+
+			pool, err := parseBackendFile(contents)
+			if err != nil {
+				slog.Warn("watchBackendFile parseBackendFile error, keeping current backends",
+					"path", path,
+					"error", err,
+				)
+				continue
+			}
+
+			pool.inheritState(backends.Load())
+			backends.Store(pool)
+
+			slog.Info("watchBackendFile backends changed",
+				"path", path,
+				"backends", pool.hostAndPorts(),
+			)
+		}
+	}
+}
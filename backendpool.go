@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// interval for refilling pools whose dials failed
+	backendConnPoolRefillInterval = 1 * time.Second
+
+	// how long a keepalive check waits for an idle connection to fail
+	backendConnPoolCheckWait = 10 * time.Millisecond
+)
+
+// backendConnPool keeps up to size idle pre-dialed connections to a backend,
+// handed to new clients instead of dialing, so they skip the dial latency.
+type backendConnPool struct {
+	backend *backend
+	size    int
+
+	// signaled when a connection is taken
+	refill chan struct{}
+
+	// set while fill dials are failing, used only by run
+	dialFailing bool
+
+	mutex sync.Mutex
+	idle  []net.Conn
+}
+
+// pools for the backends configured at startup, by hostAndPort, nil if
+// backendPoolSize is 0. Backends added by a backendFile reload are not pooled.
+var backendConnPools map[string]*backendConnPool
+
+var backendConnPoolIdleGauge = newFuncVec(
+	"wsproxy_backend_pool_idle_connections",
+	"Idle pre-dialed connections pooled for each backend.",
+	"gauge",
+	"backend",
+	func() map[string]float64 {
+		values := make(map[string]float64, len(backendConnPools))
+		for hostAndPort, pool := range backendConnPools {
+			values[hostAndPort] = float64(pool.idleCount())
+		}
+		return values
+	},
+)
+
+// startBackendConnPools starts a pool of size connections for each backend
+// in pool, closing the idle connections on shutdown.
+func startBackendConnPools(
+	pool *backendPool,
+	size int,
+	keepAliveInterval time.Duration,
+) {
+
+	backendConnPools = make(map[string]*backendConnPool, len(pool.backends))
+
+	for _, backend := range pool.backends {
+		connPool := &backendConnPool{
+			backend: backend,
+			size:    size,
+			refill:  make(chan struct{}, 1),
+		}
+		backendConnPools[backend.hostAndPort] = connPool
+
+		go connPool.run(context.Background(), keepAliveInterval)
+	}
+
+	onShutdown(func() {
+		for _, connPool := range backendConnPools {
+			connPool.closeIdle()
+		}
+	})
+}
+
+// takePooledConn returns an idle pooled connection to backend, nil if none.
+func takePooledConn(backend *backend) net.Conn {
+	connPool, ok := backendConnPools[backend.hostAndPort]
+	if !ok {
+		return nil
+	}
+	return connPool.take()
+}
+
+func (cp *backendConnPool) idleCount() int {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	return len(cp.idle)
+}
+
+// take returns the most recently dialed idle connection, nil if none.
+func (cp *backendConnPool) take() net.Conn {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	if len(cp.idle) == 0 {
+		return nil
+	}
+
+	conn := cp.idle[len(cp.idle)-1]
+	cp.idle = cp.idle[:len(cp.idle)-1]
+
+	select {
+	case cp.refill <- struct{}{}:
+	default:
+	}
+
+	return conn
+}
+
+func (cp *backendConnPool) closeIdle() {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+
+	for _, conn := range cp.idle {
+		conn.Close()
+	}
+	cp.idle = nil
+}
+
+// run keeps the pool filled, and checks its idle connections every
+// keepAliveInterval if set, until ctx is done.
+func (cp *backendConnPool) run(
+	ctx context.Context,
+	keepAliveInterval time.Duration,
+) {
+
+	refillTicker := time.NewTicker(backendConnPoolRefillInterval)
+	defer refillTicker.Stop()
+
+	var keepAliveC <-chan time.Time
+	if keepAliveInterval > 0 {
+		keepAliveTicker := time.NewTicker(keepAliveInterval)
+		defer keepAliveTicker.Stop()
+		keepAliveC = keepAliveTicker.C
+	}
+
+	cp.fill(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cp.refill:
+			cp.fill(ctx)
+		case <-refillTicker.C:
+			cp.fill(ctx)
+		case <-keepAliveC:
+			cp.checkIdle()
+			cp.fill(ctx)
+		}
+	}
+}
+
+// fill dials until the pool has size idle connections, stopping at the
+// first dial error until the next refill. Only the first of consecutive
+// dial errors is logged.
+func (cp *backendConnPool) fill(ctx context.Context) {
+	logger := slog.Default().With(
+		"backend", cp.backend.hostAndPort,
+	)
+
+	for cp.idleCount() < cp.size {
+		conn, err := dialBackend(ctx, cp.backend, false, nil, nil, logger)
+		if err != nil {
+			if !cp.dialFailing {
+				logger.Warn("backend pool dial error",
+					"error", err,
+				)
+				cp.dialFailing = true
+			}
+			return
+		}
+
+		if cp.dialFailing {
+			logger.Info("backend pool dial recovered")
+			cp.dialFailing = false
+		}
+
+		cp.mutex.Lock()
+		cp.idle = append(cp.idle, conn)
+		poolSize := len(cp.idle)
+		cp.mutex.Unlock()
+
+		logger.Debug("backend pool size changed",
+			"poolSize", poolSize,
+		)
+	}
+}
+
+// checkIdle sends poolKeepAliveProbe on each idle connection, if set, and
+// evicts those the backend closed, or that sent data when no probe was sent.
+// Connections are out of the pool while checked, so none is handed out
+// mid-check.
+func (cp *backendConnPool) checkIdle() {
+	cp.mutex.Lock()
+	checking := cp.idle
+	cp.idle = nil
+	cp.mutex.Unlock()
+
+	var alive []net.Conn
+	for _, conn := range checking {
+		if err := checkIdleConn(conn); err != nil {
+			slog.Info("pooled backend connection evicted",
+				"backend", cp.backend.hostAndPort,
+				"error", err,
+			)
+			conn.Close()
+			continue
+		}
+		alive = append(alive, conn)
+	}
+
+	cp.mutex.Lock()
+	cp.idle = append(cp.idle, alive...)
+	poolSize := len(cp.idle)
+	cp.mutex.Unlock()
+
+	if evicted := len(checking) - len(alive); evicted > 0 {
+		slog.Info("backend pool size changed",
+			"backend", cp.backend.hostAndPort,
+			"evicted", evicted,
+			"poolSize", poolSize,
+		)
+	}
+}
+
+var (
+	errPooledConnClosed         = errors.New("backend closed idle connection")
+	errPooledConnUnexpectedData = errors.New("idle connection received unexpected data")
+)
+
+// checkIdleConn returns an error if conn fails within backendConnPoolCheckWait
+// of sending the probe. Replies to the probe are discarded.
+func checkIdleConn(conn net.Conn) error {
+	probe := []byte(*poolKeepAliveProbe)
+
+	if len(probe) > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(backendConnPoolCheckWait)); err != nil {
+			return err
+		}
+		if _, err := conn.Write(probe); err != nil {
+			return err
+		}
+		if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(backendConnPoolCheckWait)); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	_, err := buf.ReadFrom(conn)
+	switch {
+	case err == nil:
+		return errPooledConnClosed
+	case !errors.Is(err, os.ErrDeadlineExceeded):
+		return err
+	}
+	if buf.Len() > 0 && len(probe) == 0 {
+		return errPooledConnUnexpectedData
+	}
+
+	return conn.SetReadDeadline(time.Time{})
+}
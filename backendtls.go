@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// base tls config for backend connections, with backendCAFile roots and the
+// backendClientCertFile certificate when set
+var backendTLSConfig = &tls.Config{
+	MinVersion: tls.VersionTLS12,
+}
+
+// newBackendTLSConfig returns the backend tls config verifying backends
+// against the certificates in caFile, or the system roots when empty, and
+// presenting the client certificate in certFile and keyFile when set, for
+// backends requiring mutual tls.
+func newBackendTLSConfig(
+	caFile string,
+	certFile string,
+	keyFile string,
+) (*tls.Config, error) {
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile error: %w", err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %q", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("backendClientCertFile and backendClientKeyFile must be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls.LoadX509KeyPair error: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// backendTLSHandshake runs a tls client handshake over a freshly dialed backend
+// connection, verifying the backend certificate against the backend host name
+// using backendTLSConfig, within the backend's dial timeout.
+// conn is closed if the handshake fails.
+func backendTLSHandshake(
+	ctx context.Context,
+	conn net.Conn,
+	backend *backend,
+) (net.Conn, error) {
+
+	host, _, err := net.SplitHostPort(backend.hostAndPort)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("net.SplitHostPort error: %w", err)
+	}
+
+	config := backendTLSConfig.Clone()
+	config.ServerName = host
+
+	tlsConn := tls.Client(conn, config)
+
+	ctx, cancel := context.WithTimeout(ctx, backend.effectiveDialTimeout())
+	defer cancel()
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tlsConn.HandshakeContext error: %w", err)
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+// token buckets of maxBytesPerSecond for each direction, shared by all
+// connections, nil if unset
+var (
+	globalWsToTcpBandwidth *tokenBucket
+	globalTcpToWsBandwidth *tokenBucket
+)
+
+// setupGlobalBandwidthLimits creates the shared buckets of maxBytesPerSecond.
+func setupGlobalBandwidthLimits() {
+	if *maxBytesPerSecond > 0 {
+		globalWsToTcpBandwidth = newBandwidthBucket(*maxBytesPerSecond)
+		globalTcpToWsBandwidth = newBandwidthBucket(*maxBytesPerSecond)
+	}
+}
+
+// newBandwidthBucket returns a bucket of rate bytes per second,
+// allowing a burst of one second.
+func newBandwidthBucket(rate int64) *tokenBucket {
+	return newTokenBucket(float64(rate), float64(rate))
+}
+
+// bandwidthLimiter delays one direction of a connection to stay within
+// every one of its buckets.
+type bandwidthLimiter struct {
+	buckets []*tokenBucket
+
+	// largest read or write, the smallest burst, so each delay
+	// stays around a second
+	maxChunk int
+}
+
+// newBandwidthLimiter returns a limiter of perConnectionRate bytes per second
+// and the global bucket, nil if neither is set.
+func newBandwidthLimiter(
+	perConnectionRate int64,
+	global *tokenBucket,
+) *bandwidthLimiter {
+
+	bl := &bandwidthLimiter{
+		maxChunk: math.MaxInt,
+	}
+
+	if perConnectionRate > 0 {
+		bl.buckets = append(bl.buckets, newBandwidthBucket(perConnectionRate))
+	}
+	if global != nil {
+		bl.buckets = append(bl.buckets, global)
+	}
+
+	if len(bl.buckets) == 0 {
+		return nil
+	}
+
+	for _, bucket := range bl.buckets {
+		bl.maxChunk = min(bl.maxChunk, max(1, int(bucket.burst)))
+	}
+
+	return bl
+}
+
+// wait takes n bytes from every bucket, sleeping until the slowest allows them.
+func (bl *bandwidthLimiter) wait(n int) {
+	var delay time.Duration
+	for _, bucket := range bl.buckets {
+		bucketDelay, _ := bucket.reserve(float64(n), math.MaxInt64)
+		delay = max(delay, bucketDelay)
+	}
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// bandwidthLimitedReader limits the rate bytes are read from reader.
+type bandwidthLimitedReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (blr *bandwidthLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > blr.limiter.maxChunk {
+		p = p[:blr.limiter.maxChunk]
+	}
+
+	n, err := blr.reader.Read(p)
+	blr.limiter.wait(n)
+
+	return n, err
+}
+
+// bandwidthLimitedWriter limits the rate bytes are written to writer.
+type bandwidthLimitedWriter struct {
+	writer  io.Writer
+	limiter *bandwidthLimiter
+}
+
+func (blw *bandwidthLimitedWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p[:min(len(p), blw.limiter.maxChunk)]
+		blw.limiter.wait(len(chunk))
+
+		n, err := blw.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+)
+
+const maxBannerLength = 256
+
+// peekBackendBanner waits for the first data from the backend and logs it up to
+// the first newline. The bytes are only peeked so br still yields them to the
+// tcp to websocket copy.
+func peekBackendBanner(
+	br *bufio.Reader,
+	txLogger *slog.Logger,
+) {
+
+	if _, err := br.Peek(1); err != nil {
+		txLogger.Info("peekBackendBanner no banner received",
+			"error", err,
+		)
+		return
+	}
+
+	banner, _ := br.Peek(br.Buffered())
+
+	if i := bytes.IndexByte(banner, '\n'); i >= 0 {
+		banner = banner[:i]
+	}
+
+	banner = bytes.TrimSuffix(banner, []byte("\r"))
+
+	truncated := len(banner) > maxBannerLength
+	if truncated {
+		banner = banner[:maxBannerLength]
+	}
+
+	txLogger.Info("backend banner",
+		"banner", string(banner),
+		"truncated", truncated,
+	)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// bufferPool is a pool of fixed size copy buffers shared by all connections,
+// avoiding per connection buffer allocations.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() any {
+				buf := make([]byte, size)
+				return &buf
+			},
+		},
+	}
+}
+
+func (bp *bufferPool) get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+func (bp *bufferPool) put(buf *[]byte) {
+	bp.pool.Put(buf)
+}
+
+// copy buffer pools, sized by wsReadBufferSize and wsWriteBufferSize
+var (
+	wsReadBufferPool  *bufferPool
+	wsWriteBufferPool *bufferPool
+)
+
+// pool of copyBufferSize buffers for client mode and mux stream copies
+var copyBufferPool *bufferPool
+
+// pooledCopy copies src to dst with a buffer from copyBufferPool.
+// dst and src are wrapped so io.CopyBuffer uses the pooled buffer, rather than
+// a ReadFrom or WriteTo that would allocate its own.
+func pooledCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufferPool.get()
+	defer copyBufferPool.put(buf)
+
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
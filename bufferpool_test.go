@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+const benchmarkCopyBufferSize = 32 * 1024
+
+// each op copies a short connection's worth of data, so the per connection
+// buffer dominates the allocations
+var benchmarkCopyPayload = bytes.Repeat([]byte("x"), 4*1024)
+
+func BenchmarkCopyUnpooled(b *testing.B) {
+	b.ReportAllocs()
+
+	for b.Loop() {
+		buf := make([]byte, benchmarkCopyBufferSize)
+		io.CopyBuffer(struct{ io.Writer }{io.Discard}, bytes.NewReader(benchmarkCopyPayload), buf)
+	}
+}
+
+func BenchmarkCopyPooled(b *testing.B) {
+	copyBufferPool = newBufferPool(benchmarkCopyBufferSize)
+
+	b.ReportAllocs()
+
+	for b.Loop() {
+		pooledCopy(io.Discard, bytes.NewReader(benchmarkCopyPayload))
+	}
+}
+
+// benchmarkWebsocketCopy copies as the websocket handler's copy goroutines do,
+// with a buffer from pool, or from a bare io.Copy when pool is nil.
+func benchmarkWebsocketCopy(b *testing.B, pool *bufferPool) {
+	b.ReportAllocs()
+
+	for b.Loop() {
+		// wrapped so io.Copy cannot hand the copy to a ReadFrom or WriteTo needing no buffer
+		dst := struct{ io.Writer }{io.Discard}
+		src := struct{ io.Reader }{bytes.NewReader(benchmarkCopyPayload)}
+
+		if pool == nil {
+			io.Copy(dst, src)
+			continue
+		}
+
+		buf := pool.get()
+		io.CopyBuffer(dst, src, *buf)
+		pool.put(buf)
+	}
+}
+
+func BenchmarkWebsocketCopyUnpooled(b *testing.B) {
+	benchmarkWebsocketCopy(b, nil)
+}
+
+func BenchmarkWebsocketCopyReadBufferPool(b *testing.B) {
+	wsReadBufferPool = newBufferPool(benchmarkCopyBufferSize)
+
+	benchmarkWebsocketCopy(b, wsReadBufferPool)
+}
+
+func BenchmarkWebsocketCopyWriteBufferPool(b *testing.B) {
+	wsWriteBufferPool = newBufferPool(benchmarkCopyBufferSize)
+
+	benchmarkWebsocketCopy(b, wsWriteBufferPool)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+var clientCloseCodes = newCounterVec(
+	"wsproxy_client_close_codes_total",
+	"Websocket close codes received from clients, 1006 when a client went away without a close frame.",
+	"code",
+)
+
+// clientMessageReader reads messages from the client and keeps the close frame
+// that ends them, which websocket.NetConn reports only as io.EOF.
+type clientMessageReader struct {
+	websocketConn *websocket.Conn
+	reader        io.Reader
+
+	// type Read expects of messages, unless acceptAnyMessageType is set
+	messageType websocket.MessageType
+
+	closeError *websocket.CloseError
+
+	// first message buffered by bufferFirstMessage, returned by the next
+	// nextMessage, nil once returned
+	bufferedType   websocket.MessageType
+	bufferedReader io.Reader
+
+	// messages returned by nextMessage
+	messages int64
+
+	// stopped when the first message arrives, nil if not running
+	firstMessageTimer *time.Timer
+}
+
+func newClientMessageReader(
+	websocketConn *websocket.Conn,
+	messageType websocket.MessageType,
+) *clientMessageReader {
+	return &clientMessageReader{
+		websocketConn: websocketConn,
+		messageType:   messageType,
+	}
+}
+
+// nextMessage returns the next message from the client.
+// A normal or going away close is returned as io.EOF.
+func (cr *clientMessageReader) nextMessage(ctx context.Context) (websocket.MessageType, io.Reader, error) {
+	if cr.bufferedReader != nil {
+		reader := cr.bufferedReader
+		cr.bufferedReader = nil
+		return cr.bufferedType, reader, nil
+	}
+
+	if cr.closeError != nil {
+		return 0, nil, io.EOF
+	}
+
+	messageType, reader, err := cr.websocketConn.Reader(ctx)
+
+	cr.stopFirstMessageTimeout()
+
+	if err != nil {
+		var closeError websocket.CloseError
+		if errors.As(err, &closeError) {
+			cr.closeError = &closeError
+
+			switch closeError.Code {
+			case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+				return 0, nil, io.EOF
+			}
+		}
+		return 0, nil, err
+	}
+
+	cr.messages++
+
+	return messageType, reader, nil
+}
+
+// startFirstMessageTimeout calls onTimeout if no message arrives from the
+// client within timeout. It must be called before reading starts.
+func (cr *clientMessageReader) startFirstMessageTimeout(
+	timeout time.Duration,
+	onTimeout func(),
+) {
+	cr.firstMessageTimer = time.AfterFunc(timeout, onTimeout)
+}
+
+func (cr *clientMessageReader) stopFirstMessageTimeout() {
+	if cr.firstMessageTimer != nil {
+		cr.firstMessageTimer.Stop()
+		cr.firstMessageTimer = nil
+	}
+}
+
+// Read reads the client's messages as one stream, as websocket.NetConn does.
+// A message of the other type closes the websocket with 1003 unless
+// acceptAnyMessageType is set.
+func (cr *clientMessageReader) Read(p []byte) (int, error) {
+	if cr.reader == nil {
+		messageType, reader, err := cr.nextMessage(context.Background())
+		if err != nil {
+			return 0, err
+		}
+
+		if messageType != cr.messageType && !*acceptAnyMessageType {
+			err := fmt.Errorf("unexpected frame type read (expected %v): %v", cr.messageType, messageType)
+			cr.websocketConn.Close(websocket.StatusUnsupportedData, err.Error())
+			return 0, err
+		}
+
+		cr.reader = reader
+	}
+
+	n, err := cr.reader.Read(p)
+	if err == io.EOF {
+		cr.reader = nil
+		err = nil
+	}
+	return n, err
+}
+
+// logClientClose logs and counts how the client ended the connection once
+// reading from it stopped with readErr. When the proxy closed the connection
+// first the client only answered, so nothing is recorded.
+func (cr *clientMessageReader) logClientClose(
+	readErr error,
+	proxyClosed bool,
+	txLogger *slog.Logger,
+) {
+
+	if proxyClosed {
+		return
+	}
+
+	switch {
+	case cr.closeError != nil:
+		txLogger.Info("client closed websocket",
+			"closeCode", int(cr.closeError.Code),
+			"closeCodeName", cr.closeError.Code.String(),
+			"closeReason", cr.closeError.Reason,
+		)
+		clientCloseCodes.inc(strconv.Itoa(int(cr.closeError.Code)))
+
+	case readErr != nil:
+		txLogger.Info("client closed websocket without close frame",
+			"closeCode", int(websocket.StatusAbnormalClosure),
+			"closeCodeName", websocket.StatusAbnormalClosure.String(),
+			"error", readErr,
+		)
+		clientCloseCodes.inc(strconv.Itoa(int(websocket.StatusAbnormalClosure)))
+	}
+}
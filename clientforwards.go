@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// clientForwardsConfig is the config file in client mode, whose forwards
+// each tunnel a local listener to a remote proxy like an ssh -L entry.
+type clientForwardsConfig struct {
+	Forwards []clientForwardConfig `json:"forwards"`
+}
+
+type clientForwardConfig struct {
+	ListenHostAndPort string `json:"listenHostAndPort"`
+	ConnectURL        string `json:"connectURL"`
+
+	// backend chosen with the target query parameter, for allowDynamicTarget
+	Target string `json:"target"`
+
+	// sent with each websocket dial, such as Authorization
+	Headers map[string]string `json:"headers"`
+
+	// verify wss connectURLs against caFile, presenting certFile and keyFile
+	CAFile   string `json:"caFile"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// nil for clientMux
+	Mux *bool `json:"mux"`
+}
+
+// clientForward tunnels the tcp connections accepted on listenHostAndPort
+// to connectURL, each over its own websocket or as a stream of mux.
+type clientForward struct {
+	listenHostAndPort string
+	connectURL        string
+	header            http.Header
+
+	// nil for http.DefaultClient
+	httpClient *http.Client
+
+	// nil unless the forward is muxed
+	mux *clientMuxSession
+
+	activeConnections atomic.Int64
+	connections       atomic.Uint64
+	dialFailures      atomic.Uint64
+	lastDialError     atomic.Pointer[string]
+}
+
+// forwards of client mode, set before the management server starts
+var clientForwards []*clientForward
+
+// forwardStatus describes a clientForward for /admin/forwards.
+type forwardStatus struct {
+	ListenHostAndPort string `json:"listenHostAndPort"`
+	ConnectURL        string `json:"connectURL"`
+	Mux               bool   `json:"mux"`
+	MuxConnected      bool   `json:"muxConnected,omitempty"`
+	ActiveConnections int64  `json:"activeConnections"`
+	Connections       uint64 `json:"connections"`
+	DialFailures      uint64 `json:"dialFailures"`
+	LastDialError     string `json:"lastDialError,omitempty"`
+}
+
+// newClientForward checks config and returns its forward.
+func newClientForward(config clientForwardConfig) (*clientForward, error) {
+	if config.ListenHostAndPort == "" {
+		return nil, errors.New("listenHostAndPort is required")
+	}
+
+	if !strings.HasPrefix(config.ConnectURL, "ws://") && !strings.HasPrefix(config.ConnectURL, "wss://") {
+		return nil, fmt.Errorf("connectURL must be a ws:// or wss:// url: %q", config.ConnectURL)
+	}
+
+	forward := &clientForward{
+		listenHostAndPort: config.ListenHostAndPort,
+		connectURL:        config.ConnectURL,
+		header:            http.Header{},
+	}
+
+	if config.Target != "" {
+		parsedURL, err := url.Parse(config.ConnectURL)
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse error: %w", err)
+		}
+		query := parsedURL.Query()
+		query.Set("target", config.Target)
+		parsedURL.RawQuery = query.Encode()
+		forward.connectURL = parsedURL.String()
+	}
+
+	for name, value := range config.Headers {
+		forward.header.Set(name, value)
+	}
+
+	if config.CAFile != "" || config.CertFile != "" || config.KeyFile != "" {
+		if (config.CertFile == "") != (config.KeyFile == "") {
+			return nil, errors.New("certFile and keyFile must be set together")
+		}
+
+		tlsConfig, err := newBackendTLSConfig(config.CAFile, config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		forward.httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+
+	if mux := config.Mux; (mux == nil && *clientMux) || (mux != nil && *mux) {
+		forward.mux = &clientMuxSession{
+			forward: forward,
+		}
+	}
+
+	return forward, nil
+}
+
+// loadClientForwards returns the forward of clientListenHostAndPort when set,
+// and those of the config file, rejecting a listen address used twice.
+func loadClientForwards(
+	listenHostAndPort string,
+	configFile string,
+) ([]*clientForward, error) {
+
+	var configs []clientForwardConfig
+
+	if listenHostAndPort != "" {
+		configs = append(configs, clientForwardConfig{
+			ListenHostAndPort: listenHostAndPort,
+			ConnectURL:        *connectURL,
+		})
+	}
+
+	if configFile != "" {
+		contents, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("os.ReadFile error: %w", err)
+		}
+
+		var config clientForwardsConfig
+		if err := json.Unmarshal(contents, &config); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal error: %w", err)
+		}
+		if len(config.Forwards) == 0 {
+			return nil, errors.New("no forwards configured")
+		}
+
+		configs = append(configs, config.Forwards...)
+	}
+
+	forwards := make([]*clientForward, 0, len(configs))
+	listenAddresses := make(map[string]bool)
+
+	for i, config := range configs {
+		if listenAddresses[config.ListenHostAndPort] {
+			return nil, fmt.Errorf("forward %v: listenHostAndPort %q is already forwarded", i, config.ListenHostAndPort)
+		}
+		listenAddresses[config.ListenHostAndPort] = true
+
+		forward, err := newClientForward(config)
+		if err != nil {
+			return nil, fmt.Errorf("forward %v: %w", i, err)
+		}
+		forwards = append(forwards, forward)
+	}
+
+	return forwards, nil
+}
+
+// dialOptions returns the options each websocket of f is dialed with,
+// sending the txID in txIDHeader when set so both proxies log the same txID.
+func (f *clientForward) dialOptions(txID string) *websocket.DialOptions {
+	dialOptions := clientDialOptions()
+	dialOptions.HTTPClient = f.httpClient
+	dialOptions.HTTPHeader = f.header.Clone()
+	if *txIDHeader != "" {
+		dialOptions.HTTPHeader.Set(*txIDHeader, txID)
+	}
+	return dialOptions
+}
+
+// recordDialError counts a failed dial of connectURL for /admin/forwards.
+func (f *clientForward) recordDialError(err error) {
+	message := err.Error()
+	f.dialFailures.Add(1)
+	f.lastDialError.Store(&message)
+}
+
+// serve tunnels each connection accepted on listener, returning only if
+// accepting fails.
+func (f *clientForward) serve(listener net.Listener) error {
+	for {
+		tcpConn, err := listener.Accept()
+		if err != nil {
+			return fmt.Errorf("listener.Accept error: %w", err)
+		}
+
+		if f.mux != nil {
+			go f.mux.tunnel(tcpConn)
+			continue
+		}
+
+		go tunnelClientConn(tcpConn, f)
+	}
+}
+
+// startConnection lists tcpConn in /admin/connections until the returned
+// func is called, returning it wrapped to count the bytes it tunnels.
+func (f *clientForward) startConnection(
+	tcpConn net.Conn,
+	txID string,
+) (net.Conn, func()) {
+
+	f.connections.Add(1)
+	f.activeConnections.Add(1)
+
+	clientIP, _, err := net.SplitHostPort(tcpConn.RemoteAddr().String())
+	if err != nil {
+		clientIP = tcpConn.RemoteAddr().String()
+	}
+
+	byteCounts := newConnectionByteCounts(0, nil)
+
+	forwardSession := &session{
+		txID:       txID,
+		clientIP:   clientIP,
+		forward:    f.listenHostAndPort,
+		startTime:  time.Now(),
+		byteCounts: byteCounts,
+		terminate: func() {
+			tcpConn.Close()
+		},
+	}
+	forwardSession.setBackend(f.connectURL)
+	unregister := registerSession(forwardSession)
+
+	countedConn := &countedConn{
+		Conn:   tcpConn,
+		reader: byteCounts.tcpToWsReader(tcpConn),
+		writer: byteCounts.wsToTcpWriter(tcpConn),
+	}
+
+	return countedConn, func() {
+		unregister()
+		f.activeConnections.Add(-1)
+	}
+}
+
+func (f *clientForward) status() forwardStatus {
+	status := forwardStatus{
+		ListenHostAndPort: f.listenHostAndPort,
+		ConnectURL:        f.connectURL,
+		Mux:               f.mux != nil,
+		ActiveConnections: f.activeConnections.Load(),
+		Connections:       f.connections.Load(),
+		DialFailures:      f.dialFailures.Load(),
+	}
+	if f.mux != nil {
+		status.MuxConnected = f.mux.connected()
+	}
+	if lastDialError := f.lastDialError.Load(); lastDialError != nil {
+		status.LastDialError = *lastDialError
+	}
+	return status
+}
+
+// adminForwardsHandler lists the forwards of client mode.
+func adminForwardsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	forwardStatuses := make([]forwardStatus, 0, len(clientForwards))
+	for _, forward := range clientForwards {
+		forwardStatuses = append(forwardStatuses, forward.status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(forwardStatuses)
+}
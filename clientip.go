@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// CIDRs of trustedProxyCIDRs
+var trustedProxyPrefixes []netip.Prefix
+
+// clientIP returns the real client IP for r. When trustForwardedFor is set the
+// client from the Forwarded (RFC 7239) header is preferred, then
+// X-Forwarded-For, before falling back to r.RemoteAddr.
+func clientIP(r *http.Request) string {
+	if *trustForwardedFor {
+		if ip, ok := forwardedHeaderClientIP(strings.Join(r.Header.Values("Forwarded"), ",")); ok {
+			return ip.String()
+		}
+
+		if ip, ok := xForwardedForClientIP(strings.Join(r.Header.Values("X-Forwarded-For"), ",")); ok {
+			return ip.String()
+		}
+	}
+
+	return remoteAddrIP(r.RemoteAddr)
+}
+
+// remoteAddrIP returns the host portion of remoteAddr.
+func remoteAddrIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// forwardedHeaderClientIP returns the client among the for= addresses of a
+// Forwarded header, such as for=192.0.2.60 or for="[2001:db8:cafe::17]:4711",
+// as chosen by rightmostUntrustedIP.
+func forwardedHeaderClientIP(header string) (netip.Addr, bool) {
+	var nodes []string
+
+	for element := range strings.SplitSeq(header, ",") {
+		node := ""
+		for pair := range strings.SplitSeq(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				node = strings.Trim(value, `"`)
+				break
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	return rightmostUntrustedIP(nodes)
+}
+
+// xForwardedForClientIP returns the client among the addresses of an
+// X-Forwarded-For header, as chosen by rightmostUntrustedIP.
+func xForwardedForClientIP(header string) (netip.Addr, bool) {
+	var nodes []string
+
+	for node := range strings.SplitSeq(header, ",") {
+		nodes = append(nodes, strings.TrimSpace(node))
+	}
+
+	return rightmostUntrustedIP(nodes)
+}
+
+// rightmostUntrustedIP returns the address that the proxies of
+// trustedProxyCIDRs received the request from. Each hop appends its peer,
+// so nodes are walked from the right, skipping trusted proxies, and any
+// nodes left of the first untrusted hop are ignored, since the client can
+// send them. Obfuscated identifiers and "unknown" are not IPs, so there is
+// no client ip if the walk reaches one.
+func rightmostUntrustedIP(nodes []string) (netip.Addr, bool) {
+	var leftmostTrusted netip.Addr
+
+	for _, node := range slices.Backward(nodes) {
+		addr, ok := parseNodeIP(node)
+		if !ok {
+			return netip.Addr{}, false
+		}
+
+		if !slices.ContainsFunc(trustedProxyPrefixes, func(prefix netip.Prefix) bool {
+			return prefix.Contains(addr.WithZone(""))
+		}) {
+			return addr, true
+		}
+		leftmostTrusted = addr
+	}
+
+	// every hop is a trusted proxy, so the first is the client
+	return leftmostTrusted, leftmostTrusted.IsValid()
+}
+
+// parseNodeIP parses an IP with an optional port,
+// with IPv6 addresses optionally bracketed.
+func parseNodeIP(node string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	addr, err := netip.ParseAddr(trimIPv6Brackets(node))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// trimIPv6Brackets returns host without the brackets of a bracketed
+// IPv6 address such as [::1], for APIs that take a bare address.
+func trimIPv6Brackets(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(trusted bool) { *trustForwardedFor = trusted }(*trustForwardedFor)
+	defer func() { trustedProxyPrefixes = nil }()
+
+	tests := []struct {
+		name              string
+		remoteAddr        string
+		trustForwardedFor bool
+		trustedProxyCIDRs []string
+		header            http.Header
+		want              string
+	}{
+		{
+			name:       "ipv4 remote addr",
+			remoteAddr: "192.0.2.1:4711",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "bracketed ipv6 remote addr",
+			remoteAddr: "[::1]:4711",
+			want:       "::1",
+		},
+		{
+			name:       "ipv6 remote addr with zone",
+			remoteAddr: "[fe80::1%eth0]:4711",
+			want:       "fe80::1%eth0",
+		},
+		{
+			name:       "forwarded headers ignored unless trusted",
+			remoteAddr: "[2001:db8::1]:4711",
+			header:     http.Header{"X-Forwarded-For": {"2001:db8::2"}},
+			want:       "2001:db8::1",
+		},
+		{
+			name:              "bare ipv6 x-forwarded-for",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			header:            http.Header{"X-Forwarded-For": {"2001:db8::2, 2001:db8::3"}},
+			want:              "2001:db8::3",
+		},
+		{
+			name:              "spoofed x-forwarded-for prefix",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			header:            http.Header{"X-Forwarded-For": {"198.51.100.66, 203.0.113.5"}},
+			want:              "203.0.113.5",
+		},
+		{
+			name:              "spoofed x-forwarded-for header line",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			header:            http.Header{"X-Forwarded-For": {"198.51.100.66", "203.0.113.5"}},
+			want:              "203.0.113.5",
+		},
+		{
+			name:              "x-forwarded-for through trusted proxies",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			trustedProxyCIDRs: []string{"10.0.0.0/8", "2001:db8:ffff::1"},
+			header:            http.Header{"X-Forwarded-For": {"198.51.100.66, 203.0.113.5, 10.0.0.2, 2001:db8:ffff::1"}},
+			want:              "203.0.113.5",
+		},
+		{
+			name:              "x-forwarded-for of only trusted proxies",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			trustedProxyCIDRs: []string{"10.0.0.0/8"},
+			header:            http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}},
+			want:              "10.0.0.3",
+		},
+		{
+			name:              "bracketed ipv6 x-forwarded-for with port",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			header:            http.Header{"X-Forwarded-For": {"[2001:db8::2]:8443"}},
+			want:              "2001:db8::2",
+		},
+		{
+			name:              "ipv4-mapped x-forwarded-for",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			header:            http.Header{"X-Forwarded-For": {"::ffff:192.0.2.7"}},
+			want:              "192.0.2.7",
+		},
+		{
+			name:              "quoted ipv6 forwarded",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			trustedProxyCIDRs: []string{"192.0.2.9"},
+			header: http.Header{
+				"Forwarded":       {`for="[2001:db8:cafe::17]:4711";proto=https, for=192.0.2.9`},
+				"X-Forwarded-For": {"192.0.2.8"},
+			},
+			want: "2001:db8:cafe::17",
+		},
+		{
+			name:              "spoofed forwarded prefix",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			header: http.Header{
+				"Forwarded": {`for=198.51.100.66;proto=https`, `for="203.0.113.5:4711"`},
+			},
+			want: "203.0.113.5",
+		},
+		{
+			name:              "obfuscated forwarded falls back to x-forwarded-for",
+			remoteAddr:        "[::1]:4711",
+			trustForwardedFor: true,
+			header: http.Header{
+				"Forwarded":       {"for=_hidden"},
+				"X-Forwarded-For": {"2001:db8::4"},
+			},
+			want: "2001:db8::4",
+		},
+		{
+			name:              "invalid x-forwarded-for falls back to remote addr",
+			remoteAddr:        "[2001:db8::1]:4711",
+			trustForwardedFor: true,
+			header:            http.Header{"X-Forwarded-For": {"2001:db8::zz"}},
+			want:              "2001:db8::1",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*trustForwardedFor = test.trustForwardedFor
+
+			trusted, err := parseCIDRs("trustedProxyCIDRs", test.trustedProxyCIDRs)
+			if err != nil {
+				t.Fatalf("parseCIDRs error: %v", err)
+			}
+			trustedProxyPrefixes = trusted
+
+			r := &http.Request{
+				RemoteAddr: test.remoteAddr,
+				Header:     test.header,
+			}
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+
+			if got := clientIP(r); got != test.want {
+				t.Errorf("clientIP = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
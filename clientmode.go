@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/google/uuid"
+)
+
+// clientDialOptions returns the options client mode dials websockets with,
+// offering compression when set.
+func clientDialOptions() *websocket.DialOptions {
+	return &websocket.DialOptions{
+		CompressionMode:      compressionMode,
+		CompressionThreshold: *compressionThreshold,
+	}
+}
+
+// runClientMode dials the websocket at connectURL and proxies stdin to it and
+// its binary messages to stdout, like netcat over a websocket. It returns when
+// the server closes the connection, or once stdin has ended, clientModeCloseDelay
+// has passed for replies to arrive, and the close handshake completes.
+// Logs go to stderr.
+func runClientMode(connectURL string) {
+	if !strings.HasPrefix(connectURL, "ws://") && !strings.HasPrefix(connectURL, "wss://") {
+		fatal(exitCodeConfig, "connectURL must be a ws:// or wss:// url: %q", connectURL)
+	}
+
+	websocketConn, err := dialClientWebsocket(connectURL, clientDialOptions(), slog.Default())
+	if err != nil {
+		fatal(exitCodeBackend, "dialClientWebsocket error: %w", err)
+	}
+	defer websocketConn.CloseNow()
+
+	slog.Info("client mode connected",
+		"connectURL", connectURL,
+	)
+
+	wsNetConn := websocket.NetConn(context.Background(), websocketConn, proxyMessageType)
+
+	var bytesSent atomic.Int64
+
+	go func() {
+		sent, err := pooledCopy(wsNetConn, os.Stdin)
+		bytesSent.Store(sent)
+
+		slog.Info("client mode stdin done",
+			"bytesSent", sent,
+			"error", err,
+		)
+
+		time.Sleep(*clientModeCloseDelay)
+
+		websocketConn.Close(websocket.StatusNormalClosure, "")
+	}()
+
+	received, err := pooledCopy(os.Stdout, wsNetConn)
+
+	slog.Info("client mode connection closed",
+		"bytesSent", bytesSent.Load(),
+		"bytesReceived", received,
+		"error", err,
+	)
+}
+
+// runClientForwards listens on the listenHostAndPort of each forward and
+// tunnels each accepted tcp connection over its own websocket to the
+// forward's connectURL, the inverse of serving, so that two proxies form a
+// tcp tunnel over websockets. After a local connection ends its writes,
+// replies are still received for clientModeCloseDelay. A muxed forward
+// instead carries every connection as a stream of one shared websocket.
+// It returns only if accepting fails.
+func runClientForwards(forwards []*clientForward) {
+	listeners := make([]net.Listener, 0, len(forwards))
+
+	for _, forward := range forwards {
+		listener, err := net.Listen("tcp", forward.listenHostAndPort)
+		if err != nil {
+			fatal(exitCodeListen, "net.Listen error: %w", err)
+		}
+		listeners = append(listeners, listener)
+
+		slog.Info("client mode listening",
+			"clientListenHostAndPort", listener.Addr().String(),
+			"connectURL", forward.connectURL,
+			"mux", forward.mux != nil,
+		)
+	}
+
+	acceptErrors := make(chan error)
+
+	for i, forward := range forwards {
+		go func() {
+			acceptErrors <- forward.serve(listeners[i])
+		}()
+	}
+
+	panic(<-acceptErrors)
+}
+
+// tunnelClientConn proxies tcpConn over a websocket dialed to the
+// connectURL of forward.
+func tunnelClientConn(
+	tcpConn net.Conn,
+	forward *clientForward,
+) {
+
+	defer tcpConn.Close()
+
+	txID := uuid.New().String()
+
+	txLogger := slog.Default().With(
+		"txID", txID,
+		"clientListenHostAndPort", forward.listenHostAndPort,
+		"remoteAddr", tcpConn.RemoteAddr().String(),
+	)
+
+	defer recoverConnectionPanic(txLogger)
+
+	tcpConn, endConnection := forward.startConnection(tcpConn, txID)
+	defer endConnection()
+
+	websocketConn, err := dialClientWebsocket(forward.connectURL, forward.dialOptions(txID), txLogger)
+	if err != nil {
+		forward.recordDialError(err)
+		txLogger.Warn("dialClientWebsocket error",
+			"error", err,
+		)
+		return
+	}
+	defer websocketConn.CloseNow()
+
+	txLogger.Info("client mode tunnel connected")
+
+	wsNetConn := websocket.NetConn(context.Background(), websocketConn, proxyMessageType)
+
+	var bytesSent atomic.Int64
+	receiveDone := make(chan struct{})
+	sendDone := make(chan struct{})
+
+	go func() {
+		defer close(sendDone)
+
+		sent, _ := pooledCopy(wsNetConn, tcpConn)
+		bytesSent.Store(sent)
+
+		select {
+		case <-receiveDone:
+		case <-time.After(*clientModeCloseDelay):
+		}
+
+		websocketConn.Close(websocket.StatusNormalClosure, "")
+	}()
+
+	received, err := pooledCopy(tcpConn, wsNetConn)
+	close(receiveDone)
+	tcpConn.Close()
+	<-sendDone
+
+	txLogger.Info("client mode tunnel closed",
+		"bytesSent", bytesSent.Load(),
+		"bytesReceived", received,
+		"error", err,
+	)
+}
+
+// clientMuxSession is the websocket to the connectURL of a muxed forward
+// that its streams are tunneled over, dialed when the first connection
+// arrives and redialed when it ends.
+type clientMuxSession struct {
+	forward *clientForward
+
+	mutex   sync.Mutex
+	session *muxSession
+}
+
+// openStream opens a stream on the current session, dialing a new session
+// if there is none.
+func (cms *clientMuxSession) openStream() (*muxStream, error) {
+	cms.mutex.Lock()
+	defer cms.mutex.Unlock()
+
+	if cms.session == nil || cms.session.isClosed() {
+		session, err := cms.dial()
+		if err != nil {
+			return nil, err
+		}
+		cms.session = session
+	}
+
+	return cms.session.openStream()
+}
+
+// connected returns true if a session is open for new streams.
+func (cms *clientMuxSession) connected() bool {
+	cms.mutex.Lock()
+	defer cms.mutex.Unlock()
+
+	return cms.session != nil && !cms.session.isClosed()
+}
+
+// dial connects a new mux session and starts reading its frames.
+func (cms *clientMuxSession) dial() (*muxSession, error) {
+	txID := uuid.New().String()
+
+	dialOptions := cms.forward.dialOptions(txID)
+	dialOptions.Subprotocols = []string{muxSubprotocol}
+
+	txLogger := slog.Default().With(
+		"txID", txID,
+		"clientListenHostAndPort", cms.forward.listenHostAndPort,
+	)
+
+	websocketConn, err := dialClientWebsocket(cms.forward.connectURL, dialOptions, txLogger)
+	if err != nil {
+		cms.forward.recordDialError(err)
+		return nil, err
+	}
+
+	if websocketConn.Subprotocol() != muxSubprotocol {
+		websocketConn.Close(websocket.StatusPolicyViolation, "mux not accepted")
+		return nil, fmt.Errorf("server did not accept subprotocol %q, it must run with mux", muxSubprotocol)
+	}
+
+	txLogger.Info("client mux session connected")
+
+	session := newMuxSession(websocketConn, 0, nil)
+
+	go func() {
+		defer websocketConn.CloseNow()
+
+		err := session.run()
+
+		txLogger.Info("client mux session ended",
+			"error", err,
+		)
+
+		cms.redial(session)
+	}()
+
+	return session, nil
+}
+
+// redial replaces ended with a new session right away, so connections
+// arriving after the remote proxy restarts find one ready. If the dial
+// fails the next connection dials again.
+func (cms *clientMuxSession) redial(ended *muxSession) {
+	cms.mutex.Lock()
+	defer cms.mutex.Unlock()
+
+	if cms.session != ended {
+		return
+	}
+	cms.session = nil
+
+	session, err := cms.dial()
+	if err != nil {
+		slog.Warn("client mux session redial error",
+			"error", err,
+		)
+		return
+	}
+	cms.session = session
+}
+
+// tunnel proxies tcpConn over a new stream.
+func (cms *clientMuxSession) tunnel(tcpConn net.Conn) {
+	defer tcpConn.Close()
+
+	txID := uuid.New().String()
+
+	txLogger := slog.Default().With(
+		"txID", txID,
+		"clientListenHostAndPort", cms.forward.listenHostAndPort,
+		"remoteAddr", tcpConn.RemoteAddr().String(),
+	)
+
+	defer recoverConnectionPanic(txLogger)
+
+	tcpConn, endConnection := cms.forward.startConnection(tcpConn, txID)
+	defer endConnection()
+
+	stream, err := cms.openStream()
+	if err != nil {
+		txLogger.Warn("client mux openStream error",
+			"error", err,
+		)
+		return
+	}
+
+	txLogger = txLogger.With(
+		"streamID", stream.id,
+	)
+
+	txLogger.Info("client mux stream opened")
+
+	received, sent := bridgeMuxStream(stream, tcpConn)
+
+	txLogger.Info("client mux stream closed",
+		"bytesSent", sent,
+		"bytesReceived", received,
+	)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+var clientDialAttempts = newCounterVec(
+	"wsproxy_client_dial_attempts_total",
+	"Client mode websocket dials to connectURL by result, counting each retry.",
+	"result",
+)
+
+// dialClientWebsocket dials connectURL, retrying failed dials with exponential
+// backoff and jitter, up to reconnectMaxBackoff apart, until reconnectTimeout
+// has passed, so tunnels ride out a restart of the remote proxy.
+func dialClientWebsocket(
+	connectURL string,
+	dialOptions *websocket.DialOptions,
+	txLogger *slog.Logger,
+) (*websocket.Conn, error) {
+
+	deadline := time.Now().Add(*reconnectTimeout)
+	backoff := initialDialBackoff
+
+	for attempt := 1; ; attempt++ {
+		dialCtx, cancelDial := context.WithTimeout(context.Background(), *backendDialTimeout)
+		websocketConn, _, err := websocket.Dial(dialCtx, connectURL, dialOptions)
+		cancelDial()
+
+		if err == nil {
+			clientDialAttempts.inc("success")
+			if attempt > 1 {
+				txLogger.Info("client mode websocket reconnected",
+					"attempts", attempt,
+				)
+			}
+			return websocketConn, nil
+		}
+		clientDialAttempts.inc("failure")
+
+		delay := jitteredBackoff(backoff)
+		remaining := time.Until(deadline)
+		if remaining < delay {
+			return nil, fmt.Errorf("websocket.Dial error after %v attempts: %w", attempt, err)
+		}
+
+		txLogger.Warn("client mode websocket dial failed, retrying",
+			"attempt", attempt,
+			"backoff", delay,
+			"remaining", remaining,
+			"error", err,
+		)
+
+		time.Sleep(delay)
+
+		backoff = min(backoff*2, *reconnectMaxBackoff)
+	}
+}
+
+// jitteredBackoff returns a random delay between half of backoff and backoff,
+// so many tunnels retrying after a restart spread out instead of retrying
+// together.
+func jitteredBackoff(backoff time.Duration) time.Duration {
+	return backoff/2 + rand.N(backoff/2+1)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"time"
+)
+
+// hijackRecorder records the client connection when websocket.Accept
+// hijacks it, so deadlines can be applied to the raw connection.
+// With countWireBytes the connection is wrapped to count its wire bytes.
+type hijackRecorder struct {
+	http.ResponseWriter
+	conn net.Conn
+
+	countWireBytes bool
+	wireConn       *wireCountingConn
+}
+
+func (hr *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(hr.ResponseWriter).Hijack()
+	hr.conn = conn
+	if err != nil || !hr.countWireBytes {
+		return conn, brw, err
+	}
+
+	// websocket.Accept reads the buffered bytes then conn, and writes
+	// through brw.Writer, so only the writer needs replacing
+	hr.wireConn = &wireCountingConn{
+		Conn: conn,
+	}
+	brw.Writer = bufio.NewWriterSize(hr.wireConn, brw.Writer.Size())
+
+	return hr.wireConn, brw, nil
+}
+
+func (hr *hijackRecorder) Unwrap() http.ResponseWriter {
+	return hr.ResponseWriter
+}
+
+// setCloseHandshakeDeadline bounds the websocket close handshake that follows
+// by closeHandshakeTimeout, so teardown is fast even when the client has vanished.
+func (hr *hijackRecorder) setCloseHandshakeDeadline() {
+	if hr.conn == nil || *closeHandshakeTimeout <= 0 {
+		return
+	}
+
+	hr.conn.SetDeadline(time.Now().Add(*closeHandshakeTimeout))
+}
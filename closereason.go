@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// closeClass is the kind of termination that ended a connection, a fixed set
+// of values for alerting on and counting, where the close reason is free text.
+type closeClass string
+
+const (
+	closeClassBackendDialFailed closeClass = "backend_dial_failed"
+	closeClassBackendEOF        closeClass = "backend_eof"
+	closeClassBackendError      closeClass = "backend_error"
+	closeClassClientEOF         closeClass = "client_eof"
+	closeClassIdleTimeout       closeClass = "idle_timeout"
+	closeClassPingTimeout       closeClass = "ping_timeout"
+	closeClassWriteTimeout      closeClass = "write_timeout"
+	closeClassLifetime          closeClass = "lifetime"
+	closeClassPolicy            closeClass = "policy"
+	closeClassAdminKill         closeClass = "admin_kill"
+	closeClassShutdown          closeClass = "shutdown"
+)
+
+var connectionCloses = newCounterVec(
+	"wsproxy_connection_closes_total",
+	"Websocket connections closed by close class.",
+	"class",
+)
+
+type closeCause struct {
+	class  closeClass
+	reason string
+}
+
+// closeReason records why a connection ended, for its connectionRecord and
+// session span. The first reason set wins when several close paths race.
+type closeReason struct {
+	cause atomic.Pointer[closeCause]
+}
+
+func (cr *closeReason) set(class closeClass, reason string) {
+	cr.cause.CompareAndSwap(nil, &closeCause{
+		class:  class,
+		reason: reason,
+	})
+}
+
+// get returns the reason, empty if none was set.
+func (cr *closeReason) get() string {
+	if cause := cr.cause.Load(); cause != nil {
+		return cause.reason
+	}
+	return ""
+}
+
+// class returns the close class, empty if no reason was set.
+func (cr *closeReason) class() closeClass {
+	if cause := cr.cause.Load(); cause != nil {
+		return cause.class
+	}
+	return ""
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// coalescingReader accumulates data arriving within delay of the first byte
+// of each read, so many tiny backend writes become a single websocket message.
+// Reads are bounded by the caller's buffer size, and by delay using read
+// deadlines on conn. If conn does not support deadlines reads are not coalesced.
+type coalescingReader struct {
+	reader io.Reader
+	conn   net.Conn
+	delay  time.Duration
+}
+
+func (cr *coalescingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	if err != nil || n == len(p) {
+		return n, err
+	}
+
+	if err := cr.conn.SetReadDeadline(time.Now().Add(cr.delay)); err != nil {
+		return n, nil
+	}
+	defer cr.conn.SetReadDeadline(time.Time{})
+
+	for n < len(p) {
+		m, err := cr.reader.Read(p[n:])
+		n += m
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
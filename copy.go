@@ -0,0 +1,35 @@
+package main
+
+import (
+	"io"
+)
+
+// copyUnbuffered copies from src to dst writing each chunk as soon as it is
+// read, never waiting to accumulate more data and bypassing any
+// io.ReaderFrom or io.WriterTo implementations.
+func copyUnbuffered(
+	dst io.Writer,
+	src io.Reader,
+	buf []byte,
+) (written int64, err error) {
+
+	for {
+		nr, readErr := src.Read(buf)
+		if nr > 0 {
+			nw, writeErr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if writeErr != nil {
+				return written, writeErr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
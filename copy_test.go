@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// tcpConnPair returns both ends of a loopback tcp connection.
+func tcpConnPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer listener.Close()
+
+	proxySide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial error: %v", err)
+	}
+	t.Cleanup(func() { proxySide.Close() })
+
+	backendSide, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("listener.Accept error: %v", err)
+	}
+	t.Cleanup(func() { backendSide.Close() })
+
+	return proxySide, backendSide
+}
+
+// startCopyServer accepts one websocket and calls serve with it, returning
+// the client's end.
+func startCopyServer(
+	t *testing.T,
+	ctx context.Context,
+	serve func(wsConn *websocket.Conn),
+) *websocket.Conn {
+
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer wsConn.CloseNow()
+
+		serve(wsConn)
+	}))
+	t.Cleanup(server.Close)
+
+	clientConn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("websocket.Dial error: %v", err)
+	}
+	t.Cleanup(func() { clientConn.CloseNow() })
+
+	return clientConn
+}
+
+func TestCopyUnbufferedSingleByteReachesBackend(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxySide, backendSide := tcpConnPair(t)
+
+	clientConn := startCopyServer(t, ctx, func(wsConn *websocket.Conn) {
+		copyUnbuffered(proxySide, newClientMessageReader(wsConn, websocket.MessageBinary), make([]byte, 32*1024))
+	})
+
+	if err := clientConn.Write(ctx, websocket.MessageBinary, []byte("x")); err != nil {
+		t.Fatalf("clientConn.Write error: %v", err)
+	}
+
+	// the client sends nothing more, so the byte must not wait for a full buffer
+	backendSide.SetReadDeadline(time.Now().Add(time.Second))
+	received := make([]byte, 16)
+	n, err := backendSide.Read(received)
+	if err != nil {
+		t.Fatalf("backendSide.Read error: %v", err)
+	}
+	if got := string(received[:n]); got != "x" {
+		t.Fatalf("backend received %q, want %q", got, "x")
+	}
+}
+
+func TestCopyUnbufferedEachBackendReadIsAMessage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	proxySide, backendSide := tcpConnPair(t)
+
+	clientConn := startCopyServer(t, ctx, func(wsConn *websocket.Conn) {
+		wsNetConn := websocket.NetConn(context.Background(), wsConn, websocket.MessageBinary)
+		copyUnbuffered(wsNetConn, proxySide, make([]byte, 32*1024))
+	})
+
+	for _, keystroke := range []string{"a", "b"} {
+		if _, err := backendSide.Write([]byte(keystroke)); err != nil {
+			t.Fatalf("backendSide.Write error: %v", err)
+		}
+
+		_, message, err := clientConn.Read(ctx)
+		if err != nil {
+			t.Fatalf("clientConn.Read error: %v", err)
+		}
+		if got := string(message); got != keystroke {
+			t.Fatalf("client received %q, want %q", got, keystroke)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errByteLimitExceeded = errors.New("byte limit exceeded")
+
+// bytes proxied in each direction across all connections
+var (
+	totalBytesWsToTcp atomic.Int64
+	totalBytesTcpToWs atomic.Int64
+)
+
+var proxiedBytesCounter = newFuncVec(
+	"wsproxy_bytes_total",
+	"Bytes proxied across all connections by direction.",
+	"counter",
+	"direction",
+	proxiedBytes,
+)
+
+// proxiedBytes returns the bytes proxied in each direction across all connections.
+func proxiedBytes() map[string]float64 {
+	return map[string]float64{
+		"wsToTcp": float64(totalBytesWsToTcp.Load()),
+		"tcpToWs": float64(totalBytesTcpToWs.Load()),
+	}
+}
+
+// connectionByteCounts counts the bytes proxied in each direction of a connection
+// as they flow, enforcing an optional limit on the total.
+type connectionByteCounts struct {
+	wsToTcp atomic.Int64
+	tcpToWs atomic.Int64
+
+	// unix nanos of the first bytes in each direction, 0 until then
+	firstWsToTcp atomic.Int64
+	firstTcpToWs atomic.Int64
+
+	// unix nanos of the last bytes in each direction, or of creation
+	lastWsToTcp atomic.Int64
+	lastTcpToWs atomic.Int64
+
+	limit           int64
+	onLimitExceeded func()
+	limitOnce       sync.Once
+}
+
+func newConnectionByteCounts(
+	limit int64,
+	onLimitExceeded func(),
+) *connectionByteCounts {
+	cbc := &connectionByteCounts{
+		limit:           limit,
+		onLimitExceeded: onLimitExceeded,
+	}
+
+	now := time.Now().UnixNano()
+	cbc.lastWsToTcp.Store(now)
+	cbc.lastTcpToWs.Store(now)
+
+	return cbc
+}
+
+func (cbc *connectionByteCounts) total() int64 {
+	return cbc.wsToTcp.Load() + cbc.tcpToWs.Load()
+}
+
+func (cbc *connectionByteCounts) add(
+	counter *atomic.Int64,
+	firstActivity *atomic.Int64,
+	lastActivity *atomic.Int64,
+	totalCounter *atomic.Int64,
+	n int,
+) error {
+
+	if n > 0 {
+		now := time.Now().UnixNano()
+		counter.Add(int64(n))
+		if firstActivity.Load() == 0 {
+			firstActivity.CompareAndSwap(0, now)
+		}
+		lastActivity.Store(now)
+		totalCounter.Add(int64(n))
+	}
+
+	if cbc.limit > 0 && cbc.total() > cbc.limit {
+		cbc.limitOnce.Do(cbc.onLimitExceeded)
+		return errByteLimitExceeded
+	}
+
+	return nil
+}
+
+type countingReader struct {
+	reader        io.Reader
+	counts        *connectionByteCounts
+	counter       *atomic.Int64
+	firstActivity *atomic.Int64
+	lastActivity  *atomic.Int64
+	totalCounter  *atomic.Int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.reader.Read(p)
+	if limitErr := cr.counts.add(cr.counter, cr.firstActivity, cr.lastActivity, cr.totalCounter, n); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+type countingWriter struct {
+	writer        io.Writer
+	counts        *connectionByteCounts
+	counter       *atomic.Int64
+	firstActivity *atomic.Int64
+	lastActivity  *atomic.Int64
+	totalCounter  *atomic.Int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.writer.Write(p)
+	if limitErr := cw.counts.add(cw.counter, cw.firstActivity, cw.lastActivity, cw.totalCounter, n); limitErr != nil && err == nil {
+		return n, limitErr
+	}
+	return n, err
+}
+
+// tcpToWsReader wraps the reader of backend data, counting tcp to websocket bytes.
+func (cbc *connectionByteCounts) tcpToWsReader(reader io.Reader) io.Reader {
+	return &countingReader{
+		reader:        reader,
+		counts:        cbc,
+		counter:       &cbc.tcpToWs,
+		firstActivity: &cbc.firstTcpToWs,
+		lastActivity:  &cbc.lastTcpToWs,
+		totalCounter:  &totalBytesTcpToWs,
+	}
+}
+
+// wsToTcpWriter wraps the writer of backend data, counting websocket to tcp bytes.
+func (cbc *connectionByteCounts) wsToTcpWriter(writer io.Writer) io.Writer {
+	return &countingWriter{
+		writer:        writer,
+		counts:        cbc,
+		counter:       &cbc.wsToTcp,
+		firstActivity: &cbc.firstWsToTcp,
+		lastActivity:  &cbc.lastWsToTcp,
+		totalCounter:  &totalBytesWsToTcp,
+	}
+}
+
+// tcpToWsWriter wraps the writer of client data, counting tcp to websocket bytes,
+// for backends whose data is written rather than read by the proxy.
+func (cbc *connectionByteCounts) tcpToWsWriter(writer io.Writer) io.Writer {
+	return &countingWriter{
+		writer:        writer,
+		counts:        cbc,
+		counter:       &cbc.tcpToWs,
+		firstActivity: &cbc.firstTcpToWs,
+		lastActivity:  &cbc.lastTcpToWs,
+		totalCounter:  &totalBytesTcpToWs,
+	}
+}
+
+// lastActivity returns the time bytes last moved in either direction.
+func (cbc *connectionByteCounts) lastActivity() time.Time {
+	return time.Unix(0, max(cbc.lastWsToTcp.Load(), cbc.lastTcpToWs.Load()))
+}
+
+// messageCountingWriter counts writes to a writer that sends each write as
+// one websocket message, such as websocket.NetConn.
+type messageCountingWriter struct {
+	writer   io.Writer
+	messages int64
+}
+
+func (mw *messageCountingWriter) Write(p []byte) (int, error) {
+	n, err := mw.writer.Write(p)
+	if err == nil {
+		mw.messages++
+	}
+	return n, err
+}
+
+// countedConn is a connection whose reads and writes go through reader and
+// writer, such as those of connectionByteCounts, keeping CloseWrite for half
+// closes.
+type countedConn struct {
+	net.Conn
+	reader io.Reader
+	writer io.Writer
+}
+
+func (cc *countedConn) Read(p []byte) (int, error) {
+	return cc.reader.Read(p)
+}
+
+func (cc *countedConn) Write(p []byte) (int, error) {
+	return cc.writer.Write(p)
+}
+
+func (cc *countedConn) CloseWrite() error {
+	if closeWriter, ok := cc.Conn.(interface{ CloseWrite() error }); ok {
+		return closeWriter.CloseWrite()
+	}
+	return cc.Conn.Close()
+}
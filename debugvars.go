@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+var processStartTime = time.Now()
+
+// debugVars describes the process runtime for /debug/vars.
+type debugVars struct {
+	ReleaseTag        string  `json:"releaseTag"`
+	UptimeSeconds     float64 `json:"uptimeSeconds"`
+	Goroutines        int     `json:"goroutines"`
+	GOMAXPROCS        int     `json:"gomaxprocs"`
+	ActiveConnections int64   `json:"activeConnections"`
+	ActiveSessions    int     `json:"activeSessions"`
+	HeapAllocBytes    uint64  `json:"heapAllocBytes"`
+	HeapInuseBytes    uint64  `json:"heapInuseBytes"`
+	HeapObjects       uint64  `json:"heapObjects"`
+	SysBytes          uint64  `json:"sysBytes"`
+	NumGC             uint32  `json:"numGC"`
+	GCPauseTotalNanos uint64  `json:"gcPauseTotalNanos"`
+}
+
+// debugVarsHandler returns runtime and connection stats as json.
+// Reading the memory stats briefly stops the world, so it is served only
+// with managementPprof.
+func debugVarsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	activeSessionsMutex.Lock()
+	sessions := len(activeSessions)
+	activeSessionsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(debugVars{
+		ReleaseTag:        releaseTag,
+		UptimeSeconds:     time.Since(processStartTime).Seconds(),
+		Goroutines:        runtime.NumGoroutine(),
+		GOMAXPROCS:        runtime.GOMAXPROCS(0),
+		ActiveConnections: activeConnections.Load(),
+		ActiveSessions:    sessions,
+		HeapAllocBytes:    memStats.HeapAlloc,
+		HeapInuseBytes:    memStats.HeapInuse,
+		HeapObjects:       memStats.HeapObjects,
+		SysBytes:          memStats.Sys,
+		NumGC:             memStats.NumGC,
+		GCPauseTotalNanos: memStats.PauseTotalNs,
+	})
+}
+
+// debugBuildInfoHandler returns the build info logged at startup as json.
+func debugBuildInfoHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ReleaseTag string            `json:"releaseTag"`
+		BuildInfo  map[string]string `json:"buildInfo"`
+	}{
+		ReleaseTag: releaseTag,
+		BuildInfo:  buildInfoMap(),
+	})
+}
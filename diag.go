@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// runDiagTicker periodically logs goroutine and open file descriptor counts
+// alongside the active connection count to help spot leaks,
+// the backend selection distribution, and write backpressure.
+func runDiagTicker(
+	ctx context.Context,
+	interval time.Duration,
+) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logAttrs := []any{
+				"activeConnections", activeConnections.Load(),
+				"peakActiveConnections", peakActiveConnections.Load(),
+				"numGoroutine", runtime.NumGoroutine(),
+				"backendSelections", backends.Load().selectionCounts(),
+				"backendActiveConnections", backends.Load().activeConnectionCounts(),
+				"blockedWrites", blockedWriteCounts(),
+				"writeBlockedSeconds", writeBlockedSeconds(),
+			}
+
+			if openFDs, ok := openFDCount(); ok {
+				logAttrs = append(logAttrs, "openFDs", openFDs)
+			}
+
+			slog.Info("diag", logAttrs...)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+const diagMirrorWriteTimeout = 5 * time.Second
+
+// diagMirrorCapture keeps the first limit bytes the client sends and sends a
+// copy of them to the diagnostic target in the background, once limit bytes
+// have arrived or the connection ends. Only the wsToTcp copy goroutine may
+// write to it, and finish may be called only once that copy is done.
+type diagMirrorCapture struct {
+	limit    int
+	target   string
+	txLogger *slog.Logger
+
+	buf  []byte
+	sent bool
+}
+
+func newDiagMirrorCapture(
+	limit int,
+	target string,
+	txLogger *slog.Logger,
+) *diagMirrorCapture {
+	return &diagMirrorCapture{
+		limit:    limit,
+		target:   target,
+		txLogger: txLogger,
+	}
+}
+
+// Write captures p up to the limit. It never fails.
+func (dmc *diagMirrorCapture) Write(p []byte) (int, error) {
+	if !dmc.sent {
+		take := min(len(p), dmc.limit-len(dmc.buf))
+		dmc.buf = append(dmc.buf, p[:take]...)
+
+		if len(dmc.buf) >= dmc.limit {
+			dmc.send()
+		}
+	}
+	return len(p), nil
+}
+
+// finish sends the captured bytes if the connection ended before the limit.
+func (dmc *diagMirrorCapture) finish() {
+	if !dmc.sent && len(dmc.buf) > 0 {
+		dmc.send()
+	}
+}
+
+func (dmc *diagMirrorCapture) send() {
+	dmc.sent = true
+
+	go sendDiagMirror(dmc.target, dmc.buf, dmc.txLogger)
+}
+
+// sendDiagMirror writes captured to a new connection to target, best effort.
+func sendDiagMirror(
+	target string,
+	captured []byte,
+	txLogger *slog.Logger,
+) {
+
+	conn, err := net.DialTimeout("tcp", target, *backendDialTimeout)
+	if err != nil {
+		txLogger.Warn("diag mirror net.DialTimeout error",
+			"diagMirrorTarget", target,
+			"error", err,
+		)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(diagMirrorWriteTimeout))
+
+	if _, err := conn.Write(captured); err != nil {
+		txLogger.Warn("diag mirror write error",
+			"diagMirrorTarget", target,
+			"error", err,
+		)
+		return
+	}
+
+	txLogger.Info("diag mirror sent",
+		"diagMirrorTarget", target,
+		"diagMirrorLocalAddr", conn.LocalAddr().String(),
+		"bytes", len(captured),
+	)
+}
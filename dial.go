@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	initialDialBackoff = 100 * time.Millisecond
+	maxDialBackoff     = 2 * time.Second
+)
+
+// local address backend connections are dialed from, nil for the os choice
+var backendSourceAddr *net.TCPAddr
+
+// network tcp backends are dialed with for backendIPFamily
+var backendTCPNetwork = "tcp"
+
+// parseIPFamily returns the network dialing only the addresses of family,
+// any, ipv4, or ipv6.
+func parseIPFamily(family string) (string, error) {
+	switch family {
+	case "any":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	}
+	return "", fmt.Errorf("invalid ip family %q, must be any, ipv4, or ipv6", family)
+}
+
+// parseBackendSourceIP parses backendSourceIP and checks that it is an
+// address of this host, so a typo fails at startup instead of on every dial.
+func parseBackendSourceIP(sourceIP string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(trimIPv6Brackets(sourceIP))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %q", sourceIP)
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return nil, fmt.Errorf("address is not usable on this host: %w", err)
+	}
+	listener.Close()
+
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+var backendDialFailures = newCounterVec(
+	"wsproxy_backend_dial_failures_total",
+	"Backends that could not be connected to, counted once per dialBackend call.",
+	"backend",
+)
+
+// dialBackend dials backend, writes proxyHeader when not nil, continues over
+// tls when useTLS is set, writes metadata when not nil, and runs the optional
+// backend probe, retrying with exponential backoff until all succeed or the
+// backendDialGrace window expires. With a zero grace a single dial is attempted.
+func dialBackend(
+	ctx context.Context,
+	backend *backend,
+	useTLS bool,
+	proxyHeader []byte,
+	metadata []byte,
+	txLogger *slog.Logger,
+) (net.Conn, error) {
+
+	deadline := time.Now().Add(*backendDialGrace)
+	backoff := initialDialBackoff
+
+	for attempt := 1; ; attempt++ {
+		tcpConn, err := dialBackendConn(ctx, backend)
+		if errors.Is(err, errBackendNotAllowed) {
+			txLogger.Warn("backend not allowed")
+			return nil, err
+		}
+		if err == nil {
+			configureBackendConn(tcpConn, backend, txLogger)
+
+			if proxyHeader != nil {
+				err = writeProxyProtocolHeader(tcpConn, proxyHeader)
+			}
+
+			if err == nil && useTLS {
+				tcpConn, err = backendTLSHandshake(ctx, tcpConn, backend)
+			}
+
+			if err == nil && metadata != nil {
+				err = writeBackendMetadata(tcpConn, metadata)
+			}
+		}
+
+		if err == nil {
+			if !backendProbeEnabled() {
+				return tcpConn, nil
+			}
+
+			if err = probeBackend(tcpConn); err == nil {
+				return tcpConn, nil
+			}
+
+			tcpConn.Close()
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("backend dial error after %v attempts: %w", attempt, err)
+		}
+
+		backoff = min(backoff, remaining)
+
+		txLogger.Info("backend dial failed, retrying",
+			"attempt", attempt,
+			"backoff", backoff,
+			"remaining", remaining,
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("backend dial canceled after %v attempts: %w", attempt, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		if err := waitForDialRetryToken(ctx, deadline, txLogger); err != nil {
+			return nil, fmt.Errorf("backend dial retry not attempted after %v attempts: %w", attempt, err)
+		}
+
+		backoff = min(backoff*2, maxDialBackoff)
+	}
+}
+
+var errDialRetryThrottled = errors.New("global dial retry limit reached")
+
+// limits dial retries across all connections, nil if maxDialRetriesPerSec is unset
+var dialRetryLimiter *tokenBucket
+
+// waitForDialRetryToken waits for the global dial retry limiter before a retry,
+// so many connections retrying together stay within maxDialRetriesPerSec.
+// Fails with errDialRetryThrottled if no token is available before deadline.
+func waitForDialRetryToken(
+	ctx context.Context,
+	deadline time.Time,
+	txLogger *slog.Logger,
+) error {
+
+	if dialRetryLimiter == nil {
+		return nil
+	}
+
+	delay, ok := dialRetryLimiter.reserve(1, time.Until(deadline))
+	if !ok {
+		txLogger.Warn("global dial retry limiter throttled, giving up",
+			"delay", delay,
+		)
+		return errDialRetryThrottled
+	}
+
+	if delay <= 0 {
+		return nil
+	}
+
+	txLogger.Info("global dial retry limiter throttled",
+		"delay", delay,
+	)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+	}
+
+	return nil
+}
+
+// dialBackendConn makes a single backend connection attempt within the
+// backend's dial timeout, through the ssh jump host when one is configured,
+// which then also resolves the backend name. Backends not in the
+// backendAllowlist are never dialed.
+// With echoBackend the in-process echo is returned instead.
+func dialBackendConn(
+	ctx context.Context,
+	backend *backend,
+) (net.Conn, error) {
+
+	if err := checkBackendAllowed(backend.hostAndPort); err != nil {
+		return nil, err
+	}
+
+	if *echoBackend {
+		return dialEchoBackend(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backend.effectiveDialTimeout())
+	defer cancel()
+
+	network, address := splitNetworkAddress(backend.hostAndPort)
+
+	if backendSSHDialer != nil {
+		return backendSSHDialer.dialContext(ctx, network, address)
+	}
+
+	// the resolver is asked on every dial, so a backend whose name moves to
+	// another address is followed without a restart
+	dialer := net.Dialer{
+		Resolver:      backendResolver,
+		FallbackDelay: *backendFallbackDelay,
+	}
+	if network == "tcp" {
+		network = backend.effectiveTCPNetwork()
+		if sourceAddr := backend.effectiveSourceAddr(); sourceAddr != nil {
+			dialer.LocalAddr = sourceAddr
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// waitForBackends dials the configured backends with exponential backoff
+// until one of them accepts a connection or timeout expires.
+func waitForBackends(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	backoff := initialDialBackoff
+
+	for attempt := 1; ; attempt++ {
+		for _, backend := range backends.Load().backends {
+			conn, err := dialBackendConn(ctx, backend)
+			if err == nil {
+				conn.Close()
+
+				slog.Info("waitForBackends backend reachable",
+					"attempt", attempt,
+					"backend", backend.hostAndPort,
+				)
+				return nil
+			}
+
+			slog.Info("waitForBackends backend unreachable",
+				"attempt", attempt,
+				"backend", backend.hostAndPort,
+				"error", err,
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no backend reachable after %v attempts: %w", attempt, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxDialBackoff)
+	}
+}
+
+// dialWithFallback dials backend with failover to the other backends of
+// pool, and if that fails the fallback backend when it is not nil.
+// Returns the backend that was dialed last,
+// which holds the acquired connection slot.
+func dialWithFallback(
+	ctx context.Context,
+	pool *backendPool,
+	clientIP string,
+	backend *backend,
+	fallbackBackend *backend,
+	useTLS bool,
+	proxyHeader []byte,
+	metadata []byte,
+	txLogger *slog.Logger,
+) (net.Conn, *backend, error) {
+
+	if !useTLS {
+		if tcpConn := takePooledConn(backend); tcpConn != nil {
+			txLogger.Debug("using pooled backend connection",
+				"backend", backend.hostAndPort,
+			)
+			return tcpConn, backend, nil
+		}
+	}
+
+	tcpConn, backend, err := dialWithFailover(ctx, pool, clientIP, backend, useTLS, proxyHeader, metadata, txLogger)
+	if err == nil || fallbackBackend == nil {
+		return tcpConn, backend, err
+	}
+
+	txLogger.Warn("dialBackend error, trying fallback backend",
+		"backend", backend.hostAndPort,
+		"fallbackBackend", fallbackBackend.hostAndPort,
+		"error", err,
+	)
+
+	backend.release()
+	fallbackBackend.acquire()
+
+	tcpConn, err = dialBackend(ctx, fallbackBackend, useTLS, proxyHeader, metadata, txLogger.With("backend", fallbackBackend.hostAndPort))
+	recordDialResult(fallbackBackend, err)
+
+	return tcpConn, fallbackBackend, err
+}
+
+// dialWithFailover dials primary, and while that fails up to
+// backendFailoverAttempts other backends of pool selected for clientIP,
+// backing off exponentially between them. The failed backends are released
+// and the one returned holds the acquired connection slot.
+func dialWithFailover(
+	ctx context.Context,
+	pool *backendPool,
+	clientIP string,
+	primary *backend,
+	useTLS bool,
+	proxyHeader []byte,
+	metadata []byte,
+	txLogger *slog.Logger,
+) (net.Conn, *backend, error) {
+
+	current := primary
+	tried := []*backend{primary}
+	backoff := initialDialBackoff
+
+	tcpConn, err := dialBackend(ctx, current, useTLS, proxyHeader, metadata, txLogger.With("backend", current.hostAndPort))
+	recordDialResult(current, err)
+
+	for attempt := 1; err != nil && attempt <= *backendFailoverAttempts && !errors.Is(err, errBackendNotAllowed); attempt++ {
+		next, _ := pool.next(clientIP, tried...)
+		if next == nil {
+			break
+		}
+
+		txLogger.Warn("dialBackend error, failing over to next backend",
+			"backend", current.hostAndPort,
+			"nextBackend", next.hostAndPort,
+			"attempt", attempt,
+			"backoff", backoff,
+			"error", err,
+		)
+
+		current.release()
+		current = next
+		tried = append(tried, current)
+
+		select {
+		case <-ctx.Done():
+			return nil, current, fmt.Errorf("backend failover canceled after %v attempts: %w", attempt, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, maxDialBackoff)
+
+		tcpConn, err = dialBackend(ctx, current, useTLS, proxyHeader, metadata, txLogger.With("backend", current.hostAndPort))
+		recordDialResult(current, err)
+	}
+
+	return tcpConn, current, err
+}
+
+// recordDialResult counts a failed dial of backend toward marking it
+// unhealthy, and slow starts backend when a dial succeeds after failing.
+func recordDialResult(
+	backend *backend,
+	err error,
+) {
+
+	if err != nil {
+		backendDialFailures.inc(backend.hostAndPort)
+		backend.dialFailing.Store(true)
+		backend.recordDialFailure()
+		return
+	}
+
+	backend.recordDialSuccess()
+
+	if backend.dialFailing.Swap(false) {
+		backend.startSlowStart("dial recovered")
+	}
+}
+
+// configureBackendConn applies socket options to a freshly dialed backend connection.
+// Failures are logged and otherwise ignored.
+func configureBackendConn(
+	conn net.Conn,
+	backend *backend,
+	txLogger *slog.Logger,
+) {
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	options := backend.effectiveTCPOptions()
+
+	setSocketBuffers(tcpConn, options.sendBuffer, options.recvBuffer, txLogger)
+
+	if err := tcpConn.SetNoDelay(*options.noDelay || *noBuffer); err != nil {
+		txLogger.Warn("tcpConn.SetNoDelay error",
+			"error", err,
+		)
+	}
+
+	switch {
+	case options.keepAliveInterval < 0:
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			txLogger.Warn("tcpConn.SetKeepAlive error",
+				"error", err,
+			)
+		}
+
+	case options.keepAliveInterval > 0 || options.keepAliveCount > 0:
+		// zero values are the go defaults of 15s and 9 probes
+		if err := tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     options.keepAliveInterval,
+			Interval: options.keepAliveInterval,
+			Count:    options.keepAliveCount,
+		}); err != nil {
+			txLogger.Warn("tcpConn.SetKeepAliveConfig error",
+				"error", err,
+			)
+		}
+	}
+
+	// With a linger of 0 close discards unsent data and sends RST,
+	// avoiding TIME_WAIT. A positive linger blocks close for up to
+	// that many seconds while unsent data is delivered.
+	if *backendLinger >= 0 {
+		if err := tcpConn.SetLinger(*backendLinger); err != nil {
+			txLogger.Warn("tcpConn.SetLinger error",
+				"error", err,
+			)
+		}
+	}
+
+	if *backendTCPUserTimeout > 0 && tcpUserTimeoutSupported {
+		if err := setTCPUserTimeout(tcpConn, *backendTCPUserTimeout); err != nil {
+			txLogger.Warn("setTCPUserTimeout error",
+				"error", err,
+			)
+		}
+	}
+}
+
+// pingWhileDialing sends periodic pings on websocketConn until ctx is done,
+// keeping the client connection healthy while dialBackend retries.
+// Nothing reads from websocketConn yet so pongs cannot be seen. Each ping is
+// sent from its own goroutine that gives up on its pong after an interval,
+// so the pings keep to the interval, and the ping frames alone are enough to
+// keep intermediaries from idling it out. The pings are not canceled with
+// ctx, as websocket.Conn closes the connection when a write is canceled.
+func pingWhileDialing(
+	ctx context.Context,
+	websocketConn *websocket.Conn,
+	txLogger *slog.Logger,
+) {
+
+	ticker := time.NewTicker(*backendDialGracePingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			go func() {
+				pingCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), *backendDialGracePingInterval)
+				defer cancel()
+
+				// the pong wait always times out, as no pong is read
+				if err := websocketConn.Ping(pingCtx); err != nil && !errors.Is(err, context.DeadlineExceeded) {
+					txLogger.Debug("pingWhileDialing ping error",
+						"error", err,
+					)
+				}
+			}()
+
+			txLogger.Debug("pingWhileDialing sending ping")
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// dialRawWebsocket completes a websocket handshake with serverURL by hand, so
+// the test sees the control frames the client library would answer itself.
+func dialRawWebsocket(t *testing.T, serverURL string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	if err != nil {
+		t.Fatalf("net.Dial error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	request := "GET / HTTP/1.1\r\n" +
+		"Host: " + conn.RemoteAddr().String() + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("conn.Write error: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("http.ReadResponse error: %v", err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("response status = %v, want 101", response.StatusCode)
+	}
+
+	return conn, reader
+}
+
+func TestPingWhileDialingLongerThanPingInterval(t *testing.T) {
+	defer func(interval time.Duration) { *backendDialGracePingInterval = interval }(*backendDialGracePingInterval)
+	*backendDialGracePingInterval = 50 * time.Millisecond
+
+	const dialDuration = 400 * time.Millisecond
+
+	var logBuffer bytes.Buffer
+	logs := &lockedWriter{writer: &logBuffer}
+	txLogger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	pingerReturned := make(chan time.Duration, 1)
+	serverRead := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		websocketConn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer websocketConn.CloseNow()
+
+		// a backend dial outlasting several ping intervals
+		dialCtx, cancelDial := context.WithTimeout(context.Background(), dialDuration)
+		defer cancelDial()
+
+		pingWhileDialing(dialCtx, websocketConn, txLogger)
+		dialEnd, _ := dialCtx.Deadline()
+		pingerReturned <- time.Since(dialEnd)
+
+		_, message, err := websocketConn.Read(context.Background())
+		if err != nil {
+			serverRead <- "error: " + err.Error()
+			return
+		}
+		serverRead <- string(message)
+	}))
+	defer server.Close()
+
+	conn, reader := dialRawWebsocket(t, server.URL)
+
+	var pings atomic.Int64
+	go func() {
+		header := make([]byte, 2)
+		for {
+			if _, err := io.ReadFull(reader, header); err != nil {
+				return
+			}
+			payload := make([]byte, header[1]&0x7f)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			if header[0]&0x0f == 0x9 {
+				pings.Add(1)
+			}
+		}
+	}()
+
+	select {
+	case lateBy := <-pingerReturned:
+		if lateBy > 100*time.Millisecond {
+			t.Errorf("pingWhileDialing returned %v after the dial ended", lateBy)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pingWhileDialing did not return after the dial ended")
+	}
+
+	// pongs cannot arrive until the websocket is read, so none are awaited
+	logs.mutex.Lock()
+	logged := logBuffer.String()
+	logs.mutex.Unlock()
+	if strings.Contains(logged, "failed to wait for pong") {
+		t.Errorf("pingWhileDialing logged pong timeouts:\n%s", logged)
+	}
+
+	// one ping per interval of the dial, allowing for a slow scheduler
+	if got := pings.Load(); got < 4 {
+		t.Errorf("client received %v pings during a %v dial, want at least 4", got, dialDuration)
+	}
+
+	// a masked binary frame "hi", with an all zero mask key
+	if _, err := conn.Write([]byte{0x82, 0x82, 0, 0, 0, 0, 'h', 'i'}); err != nil {
+		t.Fatalf("conn.Write error: %v", err)
+	}
+
+	select {
+	case message := <-serverRead:
+		if message != "hi" {
+			t.Errorf("server read %q, want %q", message, "hi")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not read the message sent after the dial")
+	}
+}
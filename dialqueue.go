@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// dialLimiter limits concurrent backend dials to maxConcurrentDials, with
+// connections waiting for a dial slot counted in a queue bounded by
+// maxDialQueue so a backlog cannot grow without limit while backends are slow.
+type dialLimiter struct {
+	slots    semaphore
+	maxQueue int
+
+	// connections admitted to the queue and not yet holding a slot
+	queued atomic.Int64
+}
+
+// limits maxConcurrentDials, nil if unlimited
+var backendDialLimiter *dialLimiter
+
+func newDialLimiter(
+	maxConcurrentDials int,
+	maxQueue int,
+) *dialLimiter {
+
+	return &dialLimiter{
+		slots:    newSemaphore(maxConcurrentDials),
+		maxQueue: maxQueue,
+	}
+}
+
+// enterQueue admits a connection to the queue, returning false when the
+// queue is full. leaveQueue must be called once the connection stops waiting.
+func (dl *dialLimiter) enterQueue() bool {
+	for {
+		queued := dl.queued.Load()
+		if dl.maxQueue > 0 && queued >= int64(dl.maxQueue) {
+			return false
+		}
+		if dl.queued.CompareAndSwap(queued, queued+1) {
+			return true
+		}
+	}
+}
+
+func (dl *dialLimiter) leaveQueue() {
+	dl.queued.Add(-1)
+}
+
+// logDialQueue logs the queue depth every interval while connections are
+// waiting for a dial slot.
+func (dl *dialLimiter) logDialQueue(
+	ctx context.Context,
+	interval time.Duration,
+) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			queued := dl.queued.Load()
+			if queued == 0 {
+				continue
+			}
+
+			slog.Info("dial queue depth",
+				"dialQueueDepth", queued,
+				"maxDialQueue", dl.maxQueue,
+				"activeDials", len(dl.slots),
+			)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// unix nanoseconds when draining began, 0 when not draining.
+// While draining new connections are rejected and active ones continue.
+var drainStartTime atomic.Int64
+
+// startDraining begins draining, returning false if already draining.
+func startDraining() bool {
+	if !drainStartTime.CompareAndSwap(0, time.Now().UnixNano()) {
+		return false
+	}
+
+	slog.Info("draining started",
+		"activeConnections", activeConnections.Load(),
+	)
+
+	return true
+}
+
+// cancelDraining ends draining, returning false if not draining.
+func cancelDraining() bool {
+	startTime := drainStartTime.Swap(0)
+	if startTime == 0 {
+		return false
+	}
+
+	slog.Info("draining canceled",
+		"activeConnections", activeConnections.Load(),
+		"drainingFor", time.Since(time.Unix(0, startTime)).String(),
+	)
+
+	return true
+}
+
+// drainingSince returns when draining began, and false if not draining.
+func drainingSince() (time.Time, bool) {
+	startTime := drainStartTime.Load()
+	if startTime == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, startTime), true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// query parameter a client selects its backend with under allowDynamicTarget
+const dynamicTargetParam = "target"
+
+var errDynamicTargetNotAllowed = errors.New("target not allowed")
+
+// host:port patterns from allowDynamicTarget, nil if unset
+var dynamicTargetPatterns []string
+
+// parseDynamicTargetPatterns parses the comma-separated allowDynamicTarget
+// patterns, lowercased to match lowercased targets.
+func parseDynamicTargetPatterns(patterns string) ([]string, error) {
+	var parsed []string
+
+	for _, pattern := range splitCommaList(patterns) {
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid allowDynamicTarget pattern %q: %w", pattern, err)
+		}
+		parsed = append(parsed, pattern)
+	}
+
+	if len(parsed) == 0 {
+		return nil, errors.New("allowDynamicTarget has no patterns")
+	}
+
+	return parsed, nil
+}
+
+// dynamicTargetPool returns a pool of the single backend a client requested
+// with target, which must be host:port matching an allowDynamicTarget pattern.
+func dynamicTargetPool(target string) (*backendPool, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || host == "" || port == "" {
+		return nil, fmt.Errorf("%w: %q is not host:port", errDynamicTargetNotAllowed, target)
+	}
+
+	hostAndPort := net.JoinHostPort(strings.ToLower(host), port)
+
+	for _, pattern := range dynamicTargetPatterns {
+		if matched, _ := path.Match(pattern, hostAndPort); matched {
+			return &backendPool{
+				backends: []*backend{{
+					hostAndPort: hostAndPort,
+					weight:      1,
+				}},
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", errDynamicTargetNotAllowed, target)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"io"
+	"net"
+)
+
+// dialEchoBackend returns one end of an in-process pipe whose other end
+// writes back everything written to it, standing in for a tcp backend so the
+// rest of the proxy path runs unchanged.
+func dialEchoBackend() net.Conn {
+	proxyConn, echoConn := net.Pipe()
+
+	go func() {
+		defer echoConn.Close()
+
+		io.Copy(echoConn, echoConn)
+	}()
+
+	return proxyConn
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// prefix of the environment variables that set flags
+const flagEnvPrefix = "WSPROXY_"
+
+// names of the flags set from the environment and from flagFile,
+// logged once logging is set up
+var (
+	flagsFromEnvironment []string
+	flagsFromFlagFile    []string
+)
+
+// the value of each flag in the environment and in flagFile, including
+// those overridden by a source of higher precedence, for checkDuplicateFlags
+var (
+	environmentFlagValues = make(map[string]string)
+	flagFileFlagValues    map[string]string
+)
+
+// flagEnvName returns the environment variable for the flag name, such as
+// WSPROXY_LISTEN_HOST_AND_PORT for listenHostAndPort.
+func flagEnvName(name string) string {
+	var envName strings.Builder
+	envName.WriteString(flagEnvPrefix)
+
+	runes := []rune(name)
+	for i, r := range runes {
+		// a word starts at an upper case letter after a lower case one,
+		// or at the last letter of an acronym followed by lower case, as in
+		// the IP of backendIPFamily
+		if i > 0 && unicode.IsUpper(r) &&
+			(unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			envName.WriteByte('_')
+		}
+		envName.WriteRune(unicode.ToUpper(r))
+	}
+
+	return envName.String()
+}
+
+// parseFlagFile parses flagFile contents of one name=value per line,
+// with blank lines and lines starting with # ignored.
+func parseFlagFile(contents []byte) (map[string]string, error) {
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %v: expected name=value", lineNumber)
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("line %v: unknown flag %q", lineNumber, name)
+		}
+
+		values[name] = strings.TrimSpace(value)
+	}
+
+	return values, scanner.Err()
+}
+
+// applyFlagDefaults sets each flag not given on the command line from its
+// WSPROXY_ environment variable, or else from flagFile, so the precedence is
+// command line, then environment, then flagFile, then the flag's default.
+func applyFlagDefaults() error {
+	commandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = true
+	})
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(flagEnvName(f.Name)); ok {
+			environmentFlagValues[f.Name] = value
+		}
+	})
+
+	if !commandLine["flagFile"] {
+		if path, ok := environmentFlagValues["flagFile"]; ok {
+			flag.Set("flagFile", path)
+		}
+	}
+
+	var fileValues map[string]string
+	if *flagFile != "" {
+		contents, err := os.ReadFile(*flagFile)
+		if err != nil {
+			return fmt.Errorf("os.ReadFile error: %w", err)
+		}
+		if fileValues, err = parseFlagFile(contents); err != nil {
+			return fmt.Errorf("flagFile %q: %w", *flagFile, err)
+		}
+		if _, ok := fileValues["flagFile"]; ok {
+			return fmt.Errorf("flagFile %q: flagFile cannot be set from a flagFile", *flagFile)
+		}
+	}
+	flagFileFlagValues = fileValues
+
+	var err error
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || commandLine[f.Name] || f.Name == "flagFile" {
+			return
+		}
+
+		if value, ok := environmentFlagValues[f.Name]; ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %v: %w", value, flagEnvName(f.Name), setErr)
+			}
+			flagsFromEnvironment = append(flagsFromEnvironment, f.Name)
+			return
+		}
+
+		if value, ok := fileValues[f.Name]; ok {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %v in flagFile: %w", value, f.Name, setErr)
+			}
+			flagsFromFlagFile = append(flagsFromFlagFile, f.Name)
+		}
+	})
+
+	slices.Sort(flagsFromEnvironment)
+	slices.Sort(flagsFromFlagFile)
+
+	return err
+}
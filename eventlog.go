@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// eventLog appends connectionRecords to a file as NDJSON, optionally gzip
+// compressed. Records are buffered and flushed every flush interval.
+// Appending to an existing compressed file adds a gzip member, and
+// concatenated members are read back as one gzip stream.
+type eventLog struct {
+	mutex      sync.Mutex
+	file       *os.File
+	buffer     *bufio.Writer
+	gzipWriter *gzip.Writer
+	encoder    *json.Encoder
+	closed     bool
+}
+
+// connection record event log, nil if eventLogFile is unset
+var connectionEventLog *eventLog
+
+func openEventLog(
+	path string,
+	compress bool,
+) (*eventLog, error) {
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("os.OpenFile error: %w", err)
+	}
+
+	el := &eventLog{
+		file:   file,
+		buffer: bufio.NewWriter(file),
+	}
+
+	var writer io.Writer = el.buffer
+	if compress {
+		el.gzipWriter = gzip.NewWriter(el.buffer)
+		writer = el.gzipWriter
+	}
+	el.encoder = json.NewEncoder(writer)
+
+	return el, nil
+}
+
+func (el *eventLog) record(record connectionRecord) {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	if el.closed {
+		return
+	}
+
+	if err := el.encoder.Encode(record); err != nil {
+		slog.Warn("eventLog encoder.Encode error",
+			"error", err,
+		)
+	}
+}
+
+// flushLocked writes buffered records through to the file.
+func (el *eventLog) flushLocked() error {
+	if el.gzipWriter != nil {
+		if err := el.gzipWriter.Flush(); err != nil {
+			return fmt.Errorf("gzipWriter.Flush error: %w", err)
+		}
+	}
+
+	if err := el.buffer.Flush(); err != nil {
+		return fmt.Errorf("buffer.Flush error: %w", err)
+	}
+
+	return nil
+}
+
+// close flushes buffered records and, when compressed, writes the gzip
+// trailer so the file is a complete gzip stream, then closes the file.
+func (el *eventLog) close() {
+	el.mutex.Lock()
+	defer el.mutex.Unlock()
+
+	if el.closed {
+		return
+	}
+	el.closed = true
+
+	if el.gzipWriter != nil {
+		if err := el.gzipWriter.Close(); err != nil {
+			slog.Warn("eventLog gzipWriter.Close error",
+				"error", err,
+			)
+		}
+	}
+
+	if err := el.buffer.Flush(); err != nil {
+		slog.Warn("eventLog buffer.Flush error",
+			"error", err,
+		)
+	}
+
+	if err := el.file.Close(); err != nil {
+		slog.Warn("eventLog file.Close error",
+			"error", err,
+		)
+	}
+}
+
+// run flushes buffered records every flushInterval until ctx is done.
+func (el *eventLog) run(
+	ctx context.Context,
+	flushInterval time.Duration,
+) {
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			el.mutex.Lock()
+			var err error
+			if !el.closed {
+				err = el.flushLocked()
+			}
+			el.mutex.Unlock()
+
+			if err != nil {
+				slog.Warn("eventLog flush error",
+					"error", err,
+				)
+			}
+		}
+	}
+}
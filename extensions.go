@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/coder/websocket"
+)
+
+// withWebsocketExtensions returns txLogger with the websocket extensions the
+// client offered and those negotiated in responseHeader by websocket.Accept,
+// such as permessage-deflate and its parameters, when logExtensions is set.
+// With compression enabled the negotiated compression is always added.
+func withWebsocketExtensions(
+	txLogger *slog.Logger,
+	r *http.Request,
+	responseHeader http.Header,
+) *slog.Logger {
+
+	if compressionMode != websocket.CompressionDisabled {
+		txLogger = txLogger.With(
+			"compression", negotiatedCompression(responseHeader.Get("Sec-WebSocket-Extensions")),
+		)
+	}
+
+	if !*logExtensions {
+		return txLogger
+	}
+
+	return txLogger.With(
+		"offeredExtensions", r.Header.Values("Sec-WebSocket-Extensions"),
+		"negotiatedExtensions", responseHeader.Get("Sec-WebSocket-Extensions"),
+	)
+}
+
+// negotiatedCompression returns the compression mode of negotiated
+// extensions, as named by the compression flag, disabled if the client
+// did not offer permessage-deflate.
+func negotiatedCompression(extensions string) string {
+	for extension := range strings.SplitSeq(extensions, ",") {
+		params := strings.Split(extension, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if strings.TrimSpace(param) == "server_no_context_takeover" {
+				return "no-context-takeover"
+			}
+		}
+		return "context-takeover"
+	}
+	return "disabled"
+}
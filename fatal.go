@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+)
+
+// Process exit codes for fatal errors, documented in README.md.
+const (
+	exitCodePanic    = 1
+	exitCodeConfig   = 2 // matches the flag package's exit code for parse errors
+	exitCodeTLS      = 3
+	exitCodeListen   = 4
+	exitCodeBackend  = 5
+	exitCodeSelfTest = 6
+)
+
+// fatalError is an error that terminates the process with exitCode.
+type fatalError struct {
+	exitCode int
+	err      error
+}
+
+func (fe fatalError) Error() string {
+	return fe.err.Error()
+}
+
+func (fe fatalError) Unwrap() error {
+	return fe.err
+}
+
+// fatal panics with a fatalError, which main recovers and maps to an exit code.
+func fatal(
+	exitCode int,
+	format string,
+	args ...any,
+) {
+	panic(fatalError{
+		exitCode: exitCode,
+		err:      fmt.Errorf(format, args...),
+	})
+}
+
+// recoverConnectionPanic recovers a panic while handling one connection and,
+// unless panicExit is set, drops only that connection instead of the process.
+// It is deferred first in the handler and in each goroutine serving a
+// connection, so the connection's other deferred cleanup runs before it.
+func recoverConnectionPanic(txLogger *slog.Logger) {
+	err := recover()
+	if err == nil {
+		return
+	}
+
+	// net/http uses this panic to abort a response on purpose
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+
+	txLogger.Error("panic handling connection",
+		"error", err,
+		"stack", string(debug.Stack()),
+		"panicExit", *panicExit,
+	)
+
+	if *panicExit {
+		os.Exit(exitCodePanic)
+	}
+}
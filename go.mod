@@ -5,4 +5,11 @@ go 1.26.5
 require (
 	github.com/coder/websocket v1.8.15
 	github.com/google/uuid v1.6.0
+	golang.org/x/crypto v0.57.0
+	golang.org/x/sys v0.48.0
+)
+
+require (
+	golang.org/x/net v0.58.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
 )
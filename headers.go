@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const redactedHeaderValue = "[REDACTED]"
+
+// canonical names of headers whose values are redacted in logs
+var redactedHeaderNames = make(map[string]bool)
+
+// parseRedactHeaders parses the comma-separated redactHeaders flag.
+func parseRedactHeaders() {
+	for name := range strings.SplitSeq(*redactHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			redactedHeaderNames[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+}
+
+// loggableHeaders returns a copy of header safe for logging,
+// with redacted header values replaced.
+func loggableHeaders(header http.Header) http.Header {
+	loggable := header.Clone()
+
+	for name, values := range loggable {
+		if redactedHeaderNames[name] {
+			for i := range values {
+				values[i] = redactedHeaderValue
+			}
+		}
+	}
+
+	return loggable
+}
+
+// requiredHeader is a header every request must present,
+// with exactly value when matchValue is set.
+type requiredHeader struct {
+	name       string
+	value      string
+	matchValue bool
+}
+
+// headers from requiredHeaders, in flag order
+var requiredHeaderList []requiredHeader
+
+// parseRequiredHeaders parses the comma-separated requiredHeaders flag
+// of header names, each optionally as name=value.
+func parseRequiredHeaders() {
+	for entry := range strings.SplitSeq(*requiredHeaders, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		name, value, matchValue := strings.Cut(entry, "=")
+
+		requiredHeaderList = append(requiredHeaderList, requiredHeader{
+			name:       http.CanonicalHeaderKey(strings.TrimSpace(name)),
+			value:      strings.TrimSpace(value),
+			matchValue: matchValue,
+		})
+	}
+}
+
+// checkRequiredHeaders returns the first required header that header is
+// missing or has the wrong value for, and the reason, or ok if there is none.
+func checkRequiredHeaders(header http.Header) (name string, reason string, ok bool) {
+	for _, required := range requiredHeaderList {
+		values := header.Values(required.name)
+
+		switch {
+		case len(values) == 0:
+			return required.name, "missing required header", false
+		case required.matchValue && values[0] != required.value:
+			return required.name, "required header value mismatch", false
+		}
+	}
+
+	return "", "", true
+}
+
+// rejectRequiredHeader responds 400 with a json body naming the header and reason.
+func rejectRequiredHeader(
+	w http.ResponseWriter,
+	name string,
+	reason string,
+) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error  string `json:"error"`
+		Header string `json:"header"`
+	}{
+		Error:  reason,
+		Header: name,
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// unhealthy reports whether backend is within the cool-down that follows
+// unhealthyThreshold dial failures in a row.
+func (b *backend) unhealthy(now time.Time) bool {
+	return now.UnixNano() < b.unhealthyUntil.Load()
+}
+
+// recordDialFailure counts a failed dial of backend, marking it unhealthy
+// for unhealthyCooldown once unhealthyThreshold dials in a row have failed.
+// A backend failing again after its cool-down is marked unhealthy again.
+func (b *backend) recordDialFailure() {
+	failures := b.consecutiveDialFailures.Add(1)
+	if *unhealthyThreshold <= 0 || failures < int64(*unhealthyThreshold) {
+		return
+	}
+
+	now := time.Now()
+	if b.unhealthy(now) {
+		return
+	}
+
+	b.unhealthyUntil.Store(now.Add(*unhealthyCooldown).UnixNano())
+
+	slog.Warn("backend marked unhealthy",
+		"backend", b.hostAndPort,
+		"consecutiveDialFailures", failures,
+		"unhealthyCooldown", unhealthyCooldown.String(),
+	)
+}
+
+// recordDialSuccess resets the consecutive dial failures of backend,
+// marking it healthy again if it had been marked unhealthy.
+func (b *backend) recordDialSuccess() {
+	failures := b.consecutiveDialFailures.Swap(0)
+
+	if b.unhealthyUntil.Swap(0) != 0 {
+		slog.Info("backend marked healthy",
+			"backend", b.hostAndPort,
+			"consecutiveDialFailures", failures,
+		)
+	}
+}
+
+// updateSkipped sets skipped for each backend, skipping those in exclude,
+// and unhealthy backends unless every backend not excluded is unhealthy,
+// in which case they are all tried rather than rejecting the client.
+// It must be called with backendPool.mutex held.
+func (bp *backendPool) updateSkipped(
+	now time.Time,
+	exclude []*backend,
+) {
+
+	anyHealthy := slices.ContainsFunc(bp.backends, func(b *backend) bool {
+		return !slices.Contains(exclude, b) && !b.unhealthy(now)
+	})
+
+	for _, backend := range bp.backends {
+		backend.skipped = slices.Contains(exclude, backend) || (anyHealthy && backend.unhealthy(now))
+	}
+}
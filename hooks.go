@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// PreAcceptHook is called with each request just before its websocket is
+// accepted, after the proxy's own checks. Code built with this package may
+// replace it to add validation such as custom auth. A non-nil error rejects the
+// request, with the status and message of a *HookError, or 403 otherwise.
+var PreAcceptHook = func(*http.Request) error {
+	return nil
+}
+
+// HookError rejects a request from PreAcceptHook with Status and Message.
+type HookError struct {
+	Status  int
+	Message string
+}
+
+func (he *HookError) Error() string {
+	return he.Message
+}
+
+// rejectHookError responds to a request rejected by a hook with err.
+// Returns the status sent.
+func rejectHookError(
+	w http.ResponseWriter,
+	err error,
+) int {
+
+	status, message := http.StatusForbidden, http.StatusText(http.StatusForbidden)
+
+	var hookError *HookError
+	if errors.As(err, &hookError) {
+		status, message = hookError.Status, hookError.Message
+	}
+
+	http.Error(w, message, status)
+
+	return status
+}
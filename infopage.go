@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const infoPageHTML = `<!DOCTYPE html>
+<html>
+<head><title>go-ws-proxy</title></head>
+<body>
+<h1>go-ws-proxy</h1>
+<p>This is a WebSocket endpoint. Connect with a WebSocket client using ws:// or wss://.</p>
+</body>
+</html>
+`
+
+// isWebsocketUpgrade returns true if r asks to upgrade to a websocket.
+func isWebsocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// serveInfo responds to a request without the websocket upgrade headers,
+// such as a browser visiting the proxy url, with a page describing the endpoint,
+// as HTML when the client accepts it and otherwise JSON.
+func serveInfo(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(infoPageHTML))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"service": "go-ws-proxy",
+		"message": "This is a WebSocket endpoint. Connect with a WebSocket client using ws:// or wss://.",
+	})
+}
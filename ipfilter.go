@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// clientIPFilter admits clients by their ip, as returned by clientIP.
+type clientIPFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// clientIPFilter of allowCIDRs and denyCIDRs
+var flagClientIPFilter clientIPFilter
+
+// flagClientIPFilter combined with the allowCIDRs and denyCIDRs of the
+// config file, swapped on each reload. nil if no CIDRs are configured.
+var activeClientIPFilter atomic.Pointer[clientIPFilter]
+
+// parseCIDRs parses CIDRs such as 10.0.0.0/8 or 2001:db8::/32, with a bare
+// ip taken as the single address.
+func parseCIDRs(
+	name string,
+	cidrs []string,
+) ([]netip.Prefix, error) {
+
+	var prefixes []netip.Prefix
+
+	for _, cidr := range cidrs {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %v entry %q: %w", name, cidr, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v entry %q: %w", name, cidr, err)
+		}
+
+		// client ips are unmapped, so match ipv4-mapped CIDRs as ipv4
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// storeClientIPFilter makes flagClientIPFilter together with the CIDRs of
+// configFilter the active filter.
+func storeClientIPFilter(configFilter clientIPFilter) {
+	filter := &clientIPFilter{
+		allow: slices.Concat(flagClientIPFilter.allow, configFilter.allow),
+		deny:  slices.Concat(flagClientIPFilter.deny, configFilter.deny),
+	}
+
+	if len(filter.allow) == 0 && len(filter.deny) == 0 {
+		filter = nil
+	}
+
+	activeClientIPFilter.Store(filter)
+}
+
+// checkClientIP returns an error if the active filter rejects clientIPAddress,
+// either matching a deny CIDR or, when allow CIDRs are configured, matching
+// none of them. A client whose ip is not known is rejected only when allow
+// CIDRs are configured.
+func checkClientIP(clientIPAddress string) error {
+	filter := activeClientIPFilter.Load()
+	if filter == nil {
+		return nil
+	}
+
+	addr, err := netip.ParseAddr(clientIPAddress)
+	if err != nil {
+		if len(filter.allow) > 0 {
+			return fmt.Errorf("client ip %q is not an ip address", clientIPAddress)
+		}
+		return nil
+	}
+	addr = addr.Unmap().WithZone("")
+
+	for _, prefix := range filter.deny {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("client ip %v matches denied %v", addr, prefix)
+		}
+	}
+
+	if len(filter.allow) > 0 && !slices.ContainsFunc(filter.allow, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	}) {
+		return fmt.Errorf("client ip %v matches no allowed CIDR", addr)
+	}
+
+	return nil
+}
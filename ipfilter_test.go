@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckClientIP(t *testing.T) {
+	defer storeClientIPFilter(clientIPFilter{})
+
+	allow, err := parseCIDRs("allowCIDRs", []string{"10.0.0.0/8", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatalf("parseCIDRs error: %v", err)
+	}
+	deny, err := parseCIDRs("denyCIDRs", []string{"10.1.0.0/16", "2001:db8:bad::/48"})
+	if err != nil {
+		t.Fatalf("parseCIDRs error: %v", err)
+	}
+
+	storeClientIPFilter(clientIPFilter{
+		allow: allow,
+		deny:  deny,
+	})
+
+	tests := []struct {
+		clientIP string
+		want     bool
+	}{
+		{clientIP: "10.2.3.4", want: true},
+		{clientIP: "10.1.2.3", want: false},
+		{clientIP: "192.0.2.1", want: false},
+		{clientIP: "::ffff:10.2.3.4", want: true},
+		{clientIP: "::ffff:10.1.2.3", want: false},
+		{clientIP: "2001:db8::1", want: true},
+		{clientIP: "2001:db8:bad::1", want: false},
+		{clientIP: "2001:db9::1", want: false},
+		{clientIP: "::1", want: true},
+		{clientIP: "::2", want: false},
+		{clientIP: "2001:db8::1%eth0", want: true},
+		{clientIP: "not-an-ip", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.clientIP, func(t *testing.T) {
+			err := checkClientIP(test.clientIP)
+			if got := err == nil; got != test.want {
+				t.Errorf("checkClientIP allowed = %v, want %v, error %v", got, test.want, err)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		cidr    string
+		want    string
+		wantErr bool
+	}{
+		{cidr: "10.0.0.0/8", want: "10.0.0.0/8"},
+		{cidr: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{cidr: "192.0.2.1", want: "192.0.2.1/32"},
+		{cidr: "2001:db8::/32", want: "2001:db8::/32"},
+		{cidr: "2001:db8::1/32", want: "2001:db8::/32"},
+		{cidr: "::1", want: "::1/128"},
+		{cidr: "::ffff:192.0.2.1", want: "192.0.2.1/32"},
+		{cidr: "::ffff:10.0.0.0/104", want: "10.0.0.0/8"},
+		{cidr: "[::1]", wantErr: true},
+		{cidr: "2001:db8::/129", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.cidr, func(t *testing.T) {
+			prefixes, err := parseCIDRs("allowCIDRs", []string{test.cidr})
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseCIDRs = %v, want error", prefixes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCIDRs error: %v", err)
+			}
+
+			if len(prefixes) != 1 || prefixes[0].String() != test.want {
+				t.Errorf("parseCIDRs = %v, want %v", prefixes, test.want)
+			}
+		})
+	}
+}
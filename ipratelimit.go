@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// offenders kept for /admin/offenders
+const maxRecentOffenders = 100
+
+// clientIPRateLimiter limits websocket upgrade attempts with a token bucket
+// per client ip. Only the maxIPs most recently seen ips are tracked, so a
+// flood from many addresses cannot grow it without bound. An ip forgotten
+// this way starts again with a full bucket.
+type clientIPRateLimiter struct {
+	rate   float64
+	burst  float64
+	maxIPs int
+
+	mutex   sync.Mutex
+	buckets map[string]*list.Element
+	lru     list.List
+
+	// most recently rejected first
+	offenders   map[string]*list.Element
+	offenderLRU list.List
+}
+
+type clientIPBucket struct {
+	ip     string
+	bucket *tokenBucket
+}
+
+// rateLimitOffender is a client ip rejected by the limiter, for /admin/offenders.
+type rateLimitOffender struct {
+	ClientIP      string    `json:"clientIP"`
+	Rejected      uint64    `json:"rejected"`
+	FirstRejected time.Time `json:"firstRejected"`
+	LastRejected  time.Time `json:"lastRejected"`
+}
+
+// upgrade rate limiter of maxUpgradesPerMinutePerIP, nil if unlimited
+var upgradeRateLimiter *clientIPRateLimiter
+
+// upgrade attempts rejected by upgradeRateLimiter
+var upgradesRateLimited atomic.Uint64
+
+var upgradesRateLimitedCounter = newFuncValue(
+	"wsproxy_upgrades_rate_limited_total",
+	"Websocket upgrade attempts rejected by maxUpgradesPerMinutePerIP.",
+	"counter",
+	func() float64 {
+		return float64(upgradesRateLimited.Load())
+	},
+)
+
+// newClientIPRateLimiter allows each client ip perMinute attempts a minute,
+// in bursts of up to a minute's worth.
+func newClientIPRateLimiter(
+	perMinute float64,
+	maxIPs int,
+) *clientIPRateLimiter {
+
+	return &clientIPRateLimiter{
+		rate:      perMinute / 60,
+		burst:     math.Max(1, math.Ceil(perMinute)),
+		maxIPs:    maxIPs,
+		buckets:   make(map[string]*list.Element),
+		offenders: make(map[string]*list.Element),
+	}
+}
+
+// allow takes a token from the bucket of clientIP. If there is none ok is
+// false, delay is how long until there will be, and firstRejection is true if
+// clientIP was not already a recent offender.
+func (l *clientIPRateLimiter) allow(clientIP string) (delay time.Duration, ok bool, firstRejection bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var bucket *tokenBucket
+	if element, found := l.buckets[clientIP]; found {
+		l.lru.MoveToFront(element)
+		bucket = element.Value.(*clientIPBucket).bucket
+	} else {
+		bucket = newTokenBucket(l.rate, l.burst)
+		l.buckets[clientIP] = l.lru.PushFront(&clientIPBucket{
+			ip:     clientIP,
+			bucket: bucket,
+		})
+
+		for l.lru.Len() > l.maxIPs {
+			oldest := l.lru.Remove(l.lru.Back()).(*clientIPBucket)
+			delete(l.buckets, oldest.ip)
+		}
+	}
+
+	if delay, ok = bucket.reserve(1, 0); ok {
+		return delay, true, false
+	}
+
+	upgradesRateLimited.Add(1)
+
+	return delay, false, l.recordOffender(clientIP)
+}
+
+// recordOffender counts a rejection of clientIP, returning true if it was
+// not already a recent offender. It must be called with mutex held.
+func (l *clientIPRateLimiter) recordOffender(clientIP string) bool {
+	now := time.Now()
+
+	if element, found := l.offenders[clientIP]; found {
+		l.offenderLRU.MoveToFront(element)
+		offender := element.Value.(*rateLimitOffender)
+		offender.Rejected++
+		offender.LastRejected = now
+		return false
+	}
+
+	l.offenders[clientIP] = l.offenderLRU.PushFront(&rateLimitOffender{
+		ClientIP:      clientIP,
+		Rejected:      1,
+		FirstRejected: now,
+		LastRejected:  now,
+	})
+
+	for l.offenderLRU.Len() > maxRecentOffenders {
+		oldest := l.offenderLRU.Remove(l.offenderLRU.Back()).(*rateLimitOffender)
+		delete(l.offenders, oldest.ClientIP)
+	}
+
+	return true
+}
+
+// recentOffenders returns the recently rejected client ips, most recent first.
+func (l *clientIPRateLimiter) recentOffenders() []rateLimitOffender {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	offenders := make([]rateLimitOffender, 0, l.offenderLRU.Len())
+	for element := l.offenderLRU.Front(); element != nil; element = element.Next() {
+		offenders = append(offenders, *element.Value.(*rateLimitOffender))
+	}
+
+	return offenders
+}
+
+// adminOffendersHandler lists the client ips recently rejected by
+// maxUpgradesPerMinutePerIP.
+func adminOffendersHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	offenders := []rateLimitOffender{}
+	if upgradeRateLimiter != nil {
+		offenders = upgradeRateLimiter.recentOffenders()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offenders)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// effectivePongTimeout returns how long each ping awaits its pong.
+func effectivePongTimeout() time.Duration {
+	if *pongTimeout > 0 {
+		return *pongTimeout
+	}
+	return *pingInterval
+}
+
+// pingUntilDead pings websocketConn every interval until ctx is done, calling
+// onDead once maxMissedPongs consecutive pings go unanswered within pongTimeout.
+// Pongs are only seen while the connection is being read, so this must run
+// alongside the copy from the websocket.
+func pingUntilDead(
+	ctx context.Context,
+	websocketConn *websocket.Conn,
+	interval time.Duration,
+	pongTimeout time.Duration,
+	maxMissedPongs int,
+	onDead func(),
+	txLogger *slog.Logger,
+) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	missedPongs := 0
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, pongTimeout)
+		err := websocketConn.Ping(pingCtx)
+		cancel()
+
+		if err == nil {
+			missedPongs = 0
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		missedPongs++
+
+		txLogger.Info("missed pong",
+			"missedPongs", missedPongs,
+			"maxMissedPongs", maxMissedPongs,
+			"error", err,
+		)
+
+		if missedPongs >= maxMissedPongs {
+			txLogger.Warn("ping timeout, closing connection",
+				"missedPongs", missedPongs,
+			)
+			onDead()
+			return
+		}
+	}
+}
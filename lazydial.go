@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/coder/websocket"
+)
+
+var errFirstMessageTooLarge = errors.New("first message exceeds lazyDialMaxBuffer")
+
+// bufferFirstMessage reads the client's first message into memory, up to
+// maxBytes, so it can be replayed to a backend dialed only once it arrives.
+// The message is returned by the next call to nextMessage or Read.
+func (cr *clientMessageReader) bufferFirstMessage(
+	ctx context.Context,
+	maxBytes int,
+) error {
+
+	// raise the websocket's own limit, 32KiB by default, to read one byte past
+	// maxBytes, and treat messages it rejects as too large as well
+	cr.websocketConn.SetReadLimit(int64(maxBytes) + 1)
+
+	messageType, reader, err := cr.nextMessage(ctx)
+	if err != nil {
+		return err
+	}
+
+	// read one byte past the limit to detect a larger message
+	buffered, err := io.ReadAll(io.LimitReader(reader, int64(maxBytes)+1))
+	if errors.Is(err, websocket.ErrMessageTooBig) {
+		return errFirstMessageTooLarge
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(buffered) > maxBytes {
+		return errFirstMessageTooLarge
+	}
+
+	cr.bufferedType = messageType
+	cr.bufferedReader = bytes.NewReader(buffered)
+
+	return nil
+}
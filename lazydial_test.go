@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestBufferFirstMessage(t *testing.T) {
+	// 40KiB is over the websocket's 32KiB read limit by default
+	firstMessage := bytes.Repeat([]byte("x"), 40*1024)
+
+	tests := []struct {
+		name     string
+		maxBytes int
+		wantErr  error
+	}{
+		{name: "within lazyDialMaxBuffer", maxBytes: 64 * 1024},
+		{name: "exactly lazyDialMaxBuffer", maxBytes: 40 * 1024},
+		{name: "one byte over lazyDialMaxBuffer", maxBytes: 40*1024 - 1, wantErr: errFirstMessageTooLarge},
+		{name: "far over lazyDialMaxBuffer", maxBytes: 16 * 1024, wantErr: errFirstMessageTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			type result struct {
+				message []byte
+				err     error
+			}
+			results := make(chan result, 1)
+
+			clientConn := startCopyServer(t, ctx, func(wsConn *websocket.Conn) {
+				clientReader := newClientMessageReader(wsConn, websocket.MessageBinary)
+				if err := clientReader.bufferFirstMessage(ctx, test.maxBytes); err != nil {
+					results <- result{err: err}
+					return
+				}
+
+				message, err := io.ReadAll(clientReader)
+				results <- result{message: message, err: err}
+			})
+
+			if err := clientConn.Write(ctx, websocket.MessageBinary, firstMessage); err != nil {
+				t.Fatalf("clientConn.Write error: %v", err)
+			}
+			clientConn.Close(websocket.StatusNormalClosure, "")
+
+			got := <-results
+			if test.wantErr != nil {
+				if !errors.Is(got.err, test.wantErr) {
+					t.Fatalf("bufferFirstMessage error = %v, want %v", got.err, test.wantErr)
+				}
+				return
+			}
+			if got.err != nil {
+				t.Fatalf("read error = %v", got.err)
+			}
+			if !bytes.Equal(got.message, firstMessage) {
+				t.Fatalf("read %v bytes, want the %v sent", len(got.message), len(firstMessage))
+			}
+		})
+	}
+}
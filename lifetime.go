@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// requestedConnectionLifetime returns the connection lifetime requested by
+// the client in the maxDurationHeader, clamped to maxAllowedConnectionLifetime.
+// Returns 0 if no valid lifetime was requested.
+func requestedConnectionLifetime(
+	r *http.Request,
+	txLogger *slog.Logger,
+) time.Duration {
+
+	if *maxAllowedConnectionLifetime <= 0 {
+		return 0
+	}
+
+	headerValue := r.Header.Get(*maxDurationHeader)
+	if headerValue == "" {
+		return 0
+	}
+
+	lifetime, err := time.ParseDuration(headerValue)
+	if err != nil || lifetime <= 0 {
+		txLogger.Warn("ignoring invalid max duration header",
+			"header", *maxDurationHeader,
+			"value", headerValue,
+		)
+		return 0
+	}
+
+	return min(lifetime, *maxAllowedConnectionLifetime)
+}
+
+// connectionLifetime returns how long a connection may last, proxyMaxDuration
+// or the shorter lifetime requested by the client. Returns 0 for no limit.
+func connectionLifetime(
+	r *http.Request,
+	txLogger *slog.Logger,
+) time.Duration {
+
+	lifetime := requestedConnectionLifetime(r, txLogger)
+	if *proxyMaxDuration > 0 && (lifetime == 0 || *proxyMaxDuration < lifetime) {
+		lifetime = *proxyMaxDuration
+	}
+
+	return lifetime
+}
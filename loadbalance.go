@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"slices"
+)
+
+type loadBalanceStrategy string
+
+const (
+	loadBalanceRoundRobin       loadBalanceStrategy = "round-robin"
+	loadBalanceRandom           loadBalanceStrategy = "random"
+	loadBalanceLeastConnections loadBalanceStrategy = "least-connections"
+	loadBalanceIPHash           loadBalanceStrategy = "ip-hash"
+)
+
+var loadBalanceStrategies = []loadBalanceStrategy{
+	loadBalanceRoundRobin,
+	loadBalanceRandom,
+	loadBalanceLeastConnections,
+	loadBalanceIPHash,
+}
+
+// strategy used by backendPool.next, parsed from loadBalanceStrategy
+var backendLoadBalanceStrategy = loadBalanceRoundRobin
+
+func parseLoadBalanceStrategy(s string) (loadBalanceStrategy, error) {
+	strategy := loadBalanceStrategy(s)
+
+	if !slices.Contains(loadBalanceStrategies, strategy) {
+		return "", fmt.Errorf("invalid loadBalanceStrategy %q, expected one of %v", s, loadBalanceStrategies)
+	}
+
+	return strategy, nil
+}
+
+// weightedBackend returns the backend owning slot in [0, total weight)
+// when each backend owns a run of slots as long as its effective weight.
+func weightedBackend(
+	backends []*backend,
+	slot int,
+) *backend {
+
+	for _, backend := range backends {
+		if slot < backend.effectiveWeight {
+			return backend
+		}
+		slot -= backend.effectiveWeight
+	}
+
+	return nil
+}
+
+func totalWeight(backends []*backend) (totalWeight int) {
+	for _, backend := range backends {
+		totalWeight += backend.effectiveWeight
+	}
+	return totalWeight
+}
+
+// availableBackends returns the backends that may be selected.
+func (bp *backendPool) availableBackends() []*backend {
+	available := make([]*backend, 0, len(bp.backends))
+
+	for _, backend := range bp.backends {
+		if backend.available() {
+			available = append(available, backend)
+		}
+	}
+
+	return available
+}
+
+// nextRandom picks a backend at random in proportion to backend effective weights.
+func (bp *backendPool) nextRandom() (selected *backend, preferred *backend) {
+	preferred = weightedBackend(bp.backends, rand.IntN(totalWeight(bp.backends)))
+
+	if preferred.available() {
+		return preferred, preferred
+	}
+
+	available := bp.availableBackends()
+	if len(available) == 0 {
+		return nil, preferred
+	}
+
+	return weightedBackend(available, rand.IntN(totalWeight(available))), preferred
+}
+
+// nextLeastConnections picks the backend with the fewest active connections
+// relative to its effective weight.
+func (bp *backendPool) nextLeastConnections() (selected *backend, preferred *backend) {
+	// a has fewer connections per weight than b
+	fewer := func(a, b *backend) bool {
+		return a.activeConnections.Load()*int64(b.effectiveWeight) < b.activeConnections.Load()*int64(a.effectiveWeight)
+	}
+
+	for _, backend := range bp.backends {
+		if preferred == nil || fewer(backend, preferred) {
+			preferred = backend
+		}
+
+		if backend.available() && (selected == nil || fewer(backend, selected)) {
+			selected = backend
+		}
+	}
+
+	return selected, preferred
+}
+
+// nextIPHash picks a backend by hashing clientIP, in proportion to backend
+// effective weights, so a client consistently reaches the same backend while
+// the backends are unchanged and none is slow starting. A saturated or unhealthy
+// backend overflows to the next available backend in pool order.
+func (bp *backendPool) nextIPHash(clientIP string) (selected *backend, preferred *backend) {
+	hash := fnv.New32a()
+	hash.Write([]byte(clientIP))
+
+	preferred = weightedBackend(bp.backends, int(hash.Sum32()%uint32(totalWeight(bp.backends))))
+
+	start := slices.Index(bp.backends, preferred)
+
+	for i := range bp.backends {
+		backend := bp.backends[(start+i)%len(bp.backends)]
+		if backend.available() {
+			return backend, preferred
+		}
+	}
+
+	return nil, preferred
+}
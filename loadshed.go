@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often shouldShed counts open file descriptors, which on linux
+// lists /proc/self/fd, too costly for every request
+const openFDSampleInterval = 100 * time.Millisecond
+
+// resourceLoadShedder rejects new connections while the goroutine or open file
+// descriptor count is over its threshold, logging when shedding begins and ends.
+type resourceLoadShedder struct {
+	maxGoroutines int
+	maxOpenFDs    int
+
+	// last openFDCount, -1 if not available, and the unix nanos it was taken
+	openFDs          atomic.Int64
+	openFDsSampledAt atomic.Int64
+
+	mutex    sync.Mutex
+	shedding bool
+}
+
+// shedder for maxGoroutines and maxOpenFDs, nil if both are unset
+var connectionLoadShedder *resourceLoadShedder
+
+func newResourceLoadShedder(
+	maxGoroutines int,
+	maxOpenFDs int,
+) *resourceLoadShedder {
+	rls := &resourceLoadShedder{
+		maxGoroutines: maxGoroutines,
+		maxOpenFDs:    maxOpenFDs,
+	}
+	rls.sampleOpenFDs(time.Now().UnixNano())
+
+	return rls
+}
+
+func (rls *resourceLoadShedder) sampleOpenFDs(now int64) {
+	openFDs, ok := openFDCount()
+	if !ok {
+		openFDs = -1
+	}
+	rls.openFDs.Store(int64(openFDs))
+	rls.openFDsSampledAt.Store(now)
+}
+
+// sampledOpenFDCount returns openFDCount, taken again by one caller once the
+// last count is openFDSampleInterval old.
+func (rls *resourceLoadShedder) sampledOpenFDCount() (int, bool) {
+	now := time.Now().UnixNano()
+	sampledAt := rls.openFDsSampledAt.Load()
+	if now-sampledAt >= int64(openFDSampleInterval) && rls.openFDsSampledAt.CompareAndSwap(sampledAt, now) {
+		rls.sampleOpenFDs(now)
+	}
+
+	openFDs := rls.openFDs.Load()
+	return int(openFDs), openFDs >= 0
+}
+
+// shouldShed reports whether a new connection should be rejected.
+func (rls *resourceLoadShedder) shouldShed() bool {
+	numGoroutine := runtime.NumGoroutine()
+	overGoroutines := rls.maxGoroutines > 0 && numGoroutine > rls.maxGoroutines
+
+	openFDs, openFDsOK := 0, false
+	if rls.maxOpenFDs > 0 {
+		openFDs, openFDsOK = rls.sampledOpenFDCount()
+	}
+	overOpenFDs := openFDsOK && openFDs > rls.maxOpenFDs
+
+	shed := overGoroutines || overOpenFDs
+
+	rls.mutex.Lock()
+	defer rls.mutex.Unlock()
+
+	if shed == rls.shedding {
+		return shed
+	}
+	rls.shedding = shed
+
+	logAttrs := []any{
+		"numGoroutine", numGoroutine,
+		"maxGoroutines", rls.maxGoroutines,
+	}
+	if openFDsOK {
+		logAttrs = append(logAttrs,
+			"openFDs", openFDs,
+			"maxOpenFDs", rls.maxOpenFDs,
+		)
+	}
+
+	if shed {
+		slog.Warn("load shedding started", logAttrs...)
+	} else {
+		slog.Info("load shedding ended", logAttrs...)
+	}
+
+	return shed
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestShouldShedSamplesOpenFDs(t *testing.T) {
+	openFDs, ok := openFDCount()
+	if !ok {
+		t.Skip("openFDCount is not supported on this platform")
+	}
+
+	const extraFDs = 20
+
+	shedder := newResourceLoadShedder(0, openFDs+extraFDs/2)
+	if shedder.shouldShed() {
+		t.Fatal("shouldShed = true under maxOpenFDs")
+	}
+
+	for range extraFDs {
+		file, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatalf("os.Open error: %v", err)
+		}
+		defer file.Close()
+	}
+
+	// the count taken when the shedder was created is still in use
+	if shedder.shouldShed() {
+		t.Fatal("shouldShed = true before the open file descriptors were sampled again")
+	}
+
+	time.Sleep(openFDSampleInterval)
+
+	if !shedder.shouldShed() {
+		t.Fatal("shouldShed = false over maxOpenFDs")
+	}
+}
+
+func BenchmarkShouldShed(b *testing.B) {
+	shedder := newResourceLoadShedder(0, 1<<20)
+
+	b.ReportAllocs()
+
+	for b.Loop() {
+		shedder.shouldShed()
+	}
+}
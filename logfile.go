@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// layout of the timestamp suffix of rotated log files, sorting by time
+const rotatedLogFileTimeLayout = "20060102T150405.000000000Z"
+
+// rotatingFile appends to a file, renaming it aside with a timestamp suffix
+// and starting a new one once it reaches maxSize bytes or has been open for
+// maxAge. Only the newest maxBackups rotated files are kept.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openTime time.Time
+}
+
+func openRotatingFile(
+	path string,
+	maxSize int64,
+	maxAge time.Duration,
+	maxBackups int,
+) (*rotatingFile, error) {
+
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile error: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("file.Stat error: %w", err)
+	}
+
+	rf.file = file
+	rf.size = info.Size()
+	rf.openTime = time.Now()
+
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file past maxSize
+// or the file has reached maxAge. A write is never split across files.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if rf.rotationDue(len(p)) {
+		if err := rf.rotate(); err != nil {
+			// keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "logFile rotate error: %v\n", err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+
+	return n, err
+}
+
+func (rf *rotatingFile) rotationDue(writeSize int) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+int64(writeSize) > rf.maxSize {
+		return true
+	}
+	return rf.maxAge > 0 && time.Since(rf.openTime) >= rf.maxAge
+}
+
+// rotate renames the current file aside and opens a new one at path.
+// It must be called with mutex held.
+func (rf *rotatingFile) rotate() error {
+	rotatedPath := rf.path + "." + time.Now().UTC().Format(rotatedLogFileTimeLayout)
+
+	if err := os.Rename(rf.path, rotatedPath); err != nil {
+		return fmt.Errorf("os.Rename error: %w", err)
+	}
+
+	previousFile := rf.file
+	if err := rf.open(); err != nil {
+		// still appending to the renamed file
+		return err
+	}
+	previousFile.Close()
+
+	rf.removeOldBackups()
+
+	return nil
+}
+
+// removeOldBackups removes rotated files beyond the newest maxBackups.
+func (rf *rotatingFile) removeOldBackups() {
+	if rf.maxBackups <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	backups = slices.DeleteFunc(backups, func(backup string) bool {
+		_, err := time.Parse(rotatedLogFileTimeLayout, backup[len(rf.path)+1:])
+		return err != nil
+	})
+
+	slices.Sort(backups)
+
+	for len(backups) > rf.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "logFile remove rotated file error: %v\n", err)
+		}
+		backups = backups[1:]
+	}
+}
+
+func (rf *rotatingFile) close() {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+}
@@ -1,30 +1,378 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime/debug"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coder/websocket"
-	"github.com/google/uuid"
 )
 
 // flags
 var (
-	listenHostAndPort = flag.String("listenHostAndPort", "localhost:8080", "listen host and port")
-	tcpHostAndPort    = flag.String("tcpHostAndPort", "localhost:31415", "tcp host and port")
-	slogLevel         slog.Level
+	listenHostAndPort       = flag.String("listenHostAndPort", "localhost:8080", "comma-separated listen host and ports, or unix:path for a unix domain socket, ignored when systemd passes listen sockets")
+	websocketPath           = flag.String("websocketPath", "", "the only request path accepted for websocket upgrades, others get 404, empty to accept any path")
+	tcpHostAndPort          = flag.String("tcpHostAndPort", "localhost:31415", "comma-separated tcp backends as host:port[:weight[:maxConnections[:dialTimeout]]], or unix:path[:weight[:maxConnections[:dialTimeout]]] for unix domain sockets")
+	loadBalanceStrategyName = flag.String("loadBalanceStrategy", "round-robin", "backend selection strategy: round-robin, random, least-connections, or ip-hash")
+	clientMode              = flag.Bool("clientMode", false, "instead of serving, dial connectURL and proxy stdin and stdout to it, logging to stderr")
+	connectURL              = flag.String("connectURL", "", "with clientMode, ws:// or wss:// url to connect to")
+	clientModeCloseDelay    = flag.Duration("clientModeCloseDelay", 1*time.Second, "with clientMode, how long to keep receiving after stdin or a tunneled connection ends before closing the connection")
+	reconnectTimeout        = flag.Duration("reconnectTimeout", 30*time.Second, "with clientMode, how long to keep retrying a failed dial of connectURL, such as while the remote proxy restarts, 0 to dial once")
+	reconnectMaxBackoff     = flag.Duration("reconnectMaxBackoff", 10*time.Second, "with clientMode, longest delay between retries of a failed dial of connectURL, which doubles from 100ms with jitter")
+	clientListenHostAndPort = flag.String("clientListenHostAndPort", "", "with clientMode, listen host and port for tcp connections that are each tunneled over a websocket to connectURL, instead of proxying stdin and stdout")
+	backendURL              = flag.String("backendURL", "", "ws:// or wss:// url of a websocket backend to relay messages to instead of the tcp backends, forwarding the client's subprotocols")
+	backendURLReadLimit     = flag.Int64("backendURLReadLimit", 16*1024*1024, "with backendURL, largest message in bytes read from the client or the backend, larger messages close both with status 1009")
+	slogLevel               slog.Level
+
+	backendProtocol = flag.String("backendProtocol", backendProtocolTCP, "protocol of the tcpHostAndPort backends, tcp, or udp to relay each client message as one datagram and each datagram received as one message")
+	udpIdleTimeout  = flag.Duration("udpIdleTimeout", 60*time.Second, "with backendProtocol udp, close the session once no datagram moves in either direction for this long")
+
+	messageTypeName      = flag.String("messageType", "binary", "websocket message type of data sent to clients and expected from them, binary, or text for text protocols, overridden per route by config")
+	acceptAnyMessageType = flag.Bool("acceptAnyMessageType", false, "relay client messages of either type to the backend, instead of closing the websocket with 1003 when a client sends the other type")
+
+	compression          = flag.String("compression", "disabled", "permessage-deflate compression negotiated with clients offering it, disabled, context-takeover to compress with a window shared across messages, or no-context-takeover to compress each message alone with less memory")
+	compressionThreshold = flag.Int("compressionThreshold", 0, "with compression, smallest message in bytes that is compressed, 0 for the websocket library default of 128 with context-takeover and 512 with no-context-takeover")
+
+	reusePort = flag.Bool("reusePort", false, "set SO_REUSEPORT on host:port listen sockets so a new process can listen alongside this one, and close the proxy listeners as soon as shutdown begins so new connections go to the new process while existing ones drain")
+
+	unixSocketMode = flag.String("unixSocketMode", "0660", "octal permissions of unix:path listen sockets, whose stale socket files are removed at startup")
+
+	originPatterns           = flag.String("originPatterns", "", "comma-separated host patterns, matched with path.Match, of the cross origin browser pages allowed to connect; other cross origin requests are rejected with 403")
+	insecureSkipOriginVerify = flag.Bool("insecureSkipOriginVerify", false, "accept cross origin browser requests from any origin, exposing the proxy to cross-site websocket hijacking")
+	subprotocols             = flag.String("subprotocols", "", "comma-separated websocket subprotocols negotiated with clients in order of preference, for tcp backends")
+
+	muxMode       = flag.Bool("mux", false, "accept clients offering the wsproxy-mux.v1 subprotocol, such as clientMux, carrying many tcp streams over one websocket, each dialed to a backend as a connection would be")
+	muxMaxStreams = flag.Int("muxMaxStreams", 100, "with mux, most concurrent streams over one websocket, resetting others, 0 for unlimited")
+	clientMux     = flag.Bool("clientMux", false, "with clientListenHostAndPort, tunnel every tcp connection as a stream over one persistent websocket to a mux server, redialed when it ends, the default for forwards of the config file not setting mux")
+
+	backendDialTimeout           = flag.Duration("backendDialTimeout", 2*time.Second, "timeout for each backend dial attempt, for backends without their own dialTimeout")
+	backendDialGrace             = flag.Duration("backendDialGrace", 0, "how long to keep retrying the backend dial while holding the websocket open, 0 to dial once")
+	maxDialRetriesPerSec         = flag.Float64("maxDialRetriesPerSec", 0, "maximum backend dial retries per second across all connections during backendDialGrace, delaying retries beyond this, 0 for unlimited")
+	backendDialGracePingInterval = flag.Duration("backendDialGracePingInterval", 0, "interval between websocket pings sent during the backend dial grace period, 0 to disable")
+	backendSendBuffer            = flag.Int("backendSendBuffer", 0, "SO_SNDBUF bytes for backend connections, 0 for the os default")
+	backendRecvBuffer            = flag.Int("backendRecvBuffer", 0, "SO_RCVBUF bytes for backend connections, 0 for the os default")
+	clientSendBuffer             = flag.Int("clientSendBuffer", 0, "SO_SNDBUF bytes for accepted client connections, 0 for the os default")
+	clientRecvBuffer             = flag.Int("clientRecvBuffer", 0, "SO_RCVBUF bytes for accepted client connections, 0 for the os default")
+	backendTCPUserTimeout        = flag.Duration("backendTCPUserTimeout", 0, "TCP_USER_TIMEOUT for backend connections (linux only), 0 for the os default")
+	backendNoDelay               = flag.Bool("backendNoDelay", true, "TCP_NODELAY for backend connections, false to let the os coalesce small writes, always set with noBuffer")
+	backendKeepAliveInterval     = flag.Duration("backendKeepAliveInterval", 0, "idle time before the first TCP keepalive probe of backend connections and between probes, 0 for 15s, negative to disable keepalives")
+	backendKeepAliveCount        = flag.Int("backendKeepAliveCount", 0, "unanswered TCP keepalive probes before a backend connection is dropped, 0 for 9")
+	logBackendBanner             = flag.Bool("logBackendBanner", false, "log the first line sent by the backend on each connection")
+	logBackendAddrs              = flag.Bool("logBackendAddrs", false, "log the local and remote addresses of each backend connection, such as the source port and resolved backend ip")
+	backendFile                  = flag.String("backendFile", "", "file to read backends from instead of tcpHostAndPort, reloaded when it changes")
+	routeConfigFile              = flag.String("config", "", "json file of routes mapping request paths to backends, instead of tcpHostAndPort, with other paths rejected with 404, reloaded on SIGHUP or POST /admin/reload, or with clientMode of local forwards to remote proxies")
+	backendFilePollInterval      = flag.Duration("backendFilePollInterval", 2*time.Second, "interval for polling backendFile for changes")
+	backendPoolSize              = flag.Int("backendPoolSize", 0, "idle pre-dialed connections kept for each backend configured at startup and handed to new clients, 0 to dial for each client")
+	poolKeepAliveInterval        = flag.Duration("poolKeepAliveInterval", 0, "with backendPoolSize, interval for checking idle pooled connections, evicting those the backend closed, 0 to disable")
+	poolKeepAliveProbe           = flag.String("poolKeepAliveProbe", "", "with poolKeepAliveInterval, bytes sent on each idle pooled connection when checked, whose replies are discarded, empty to only check for closes")
+	backendSlowStart             = flag.Duration("backendSlowStart", 0, "ramp the share of new connections given to a backend added by a backendFile reload, or whose dials succeed again after failing, up to its full weight over this long, 0 to disable")
+	backendLinger                = flag.Int("backendLinger", -1, "SO_LINGER seconds for backend connections: 0 resets the connection on close, -1 for the os default")
+	waitForBackend               = flag.Bool("waitForBackend", false, "wait until a backend is reachable before listening")
+	waitForBackendTimeout        = flag.Duration("waitForBackendTimeout", 30*time.Second, "how long waitForBackend waits before exiting")
+	backendTLSFromClient         = flag.Bool("backendTLSFromClient", false, "dial backends with tls when the client connected with wss, and plaintext when it connected with ws")
+	backendTLS                   = flag.Bool("backendTLS", false, "dial backends with tls, verifying their certificates")
+	backendCAFile                = flag.String("backendCAFile", "", "pem file of the certificate authorities that backend tls certificates are verified against, empty for the system roots")
+	backendClientCertFile        = flag.String("backendClientCertFile", "", "tls client certificate file presented to backends requiring mutual tls, set with backendClientKeyFile")
+	backendClientKeyFile         = flag.String("backendClientKeyFile", "", "tls client key file for backendClientCertFile")
+	backendSourceIP              = flag.String("backendSourceIP", "", "local ip address backend connections are dialed from, empty for the os choice, overridden per route by config")
+	backendIPFamily              = flag.String("backendIPFamily", "any", "ip family of the addresses tcp backend names are dialed at, any, ipv4, or ipv6, overridden per route by config")
+	backendFallbackDelay         = flag.Duration("backendFallbackDelay", 0, "with backendIPFamily any, how long a dial to the preferred ip family of a backend's addresses, usually ipv6, runs before one to the other family races it as in happy eyeballs, 0 for 300ms, negative to disable")
+	echoBackend                  = flag.Bool("echoBackend", false, "proxy to an in-process backend that echoes all bytes back instead of dialing tcp backends, for smoke testing")
+	selfTest                     = flag.Bool("selfTest", false, "instead of serving, proxy one loopback websocket connection to echoBackend with the other flags in effect, exiting 0 if a payload echoes back unchanged")
+	backendAllowlist             = flag.String("backendAllowlist", "", "comma-separated host:port values that are the only backends ever dialed, empty to allow any configured backend")
+	fallbackTcpHostAndPort       = flag.String("fallbackTcpHostAndPort", "", "backup tcp host and port dialed only when the selected backend fails")
+	noBuffer                     = flag.Bool("noBuffer", false, "write each chunk read from either side to the other at once, each backend read as its own websocket message, for interactive protocols")
+
+	backendFailoverAttempts = flag.Int("backendFailoverAttempts", 0, "when a backend dial fails, other backends of the pool tried in turn before fallbackTcpHostAndPort, with exponential backoff between them, 0 to not fail over")
+	unhealthyThreshold      = flag.Int("unhealthyThreshold", 0, "dial failures in a row after which a backend is marked unhealthy and skipped by selection for unhealthyCooldown, 0 to never mark backends unhealthy")
+	unhealthyCooldown       = flag.Duration("unhealthyCooldown", 30*time.Second, "with unhealthyThreshold, how long an unhealthy backend is skipped before it is tried again")
+
+	allowDynamicTarget = flag.String("allowDynamicTarget", "", "comma-separated host:port patterns, matched with path.Match, of backends a client may select with the target query parameter, such as /proxy?target=db1.internal:5432, instead of the configured backends, empty to disable")
+
+	backendProbe         = flag.String("backendProbe", "", "probe bytes written to the backend after dialing, before proxying")
+	backendProbeExpect   = flag.String("backendProbeExpect", "", "response prefix the backend must send after backendProbe")
+	backendProbeEncoding = flag.String("backendProbeEncoding", "hex", "encoding of backendProbe and backendProbeExpect: hex or base64")
+	backendProbeTimeout  = flag.Duration("backendProbeTimeout", 2*time.Second, "timeout for the backend probe exchange")
+
+	tlsCertFile         = flag.String("tlsCertFile", "", "tls certificate file, enables wss when set with tlsKeyFile")
+	tlsKeyFile          = flag.String("tlsKeyFile", "", "tls key file")
+	tlsCertPollInterval = flag.Duration("tlsCertPollInterval", 0, "interval for polling the tls cert and key files for changes, 0 to reload only on SIGHUP")
+
+	acmeDomains               = flag.String("acmeDomains", "", "comma-separated domains to obtain and renew tls certificates for automatically with acme, such as from Let's Encrypt, instead of tlsCertFile and tlsKeyFile, accepting the CA's terms of service")
+	acmeCacheDir              = flag.String("acmeCacheDir", "acme-cache", "directory acme account keys and certificates are cached in across restarts")
+	acmeEmail                 = flag.String("acmeEmail", "", "contact email registered with the acme CA for expiry and problem notices, empty for none")
+	acmeDirectoryURL          = flag.String("acmeDirectoryURL", "", "acme directory url, such as a CA's staging directory for testing, empty for Let's Encrypt production")
+	acmeHTTPListenHostAndPort = flag.String("acmeHTTPListenHostAndPort", ":80", "listen host and port answering acme http-01 challenges and redirecting other requests to https, empty to rely on tls-alpn-01 challenges to the tls listeners on port 443")
+
+	tlsListenHostAndPort = flag.String("tlsListenHostAndPort", "", "comma-separated listen host and ports, or unix:path, served with tls while listenHostAndPort is served plaintext, empty to serve listenHostAndPort with tls when tlsCertFile is set")
+
+	tenantFile = flag.String("tenantFile", "", "file mapping bearer tokens to tenants and their backends, requiring a known token on every connection, empty to disable")
+
+	authToken         = flag.String("authToken", "", "bearer token every connection must present, unless it presents another authTokenFile token or a valid jwt, empty to disable")
+	authTokenFile     = flag.String("authTokenFile", "", "file of bearer tokens accepted from connections, one per line, empty to disable")
+	jwtSigningKeyFile = flag.String("jwtSigningKeyFile", "", "file of the hmac key that HS256 jwt bearer tokens are verified with, empty to disable jwt validation")
+	jwtIssuer         = flag.String("jwtIssuer", "", "iss claim required in jwt bearer tokens, empty to accept any issuer")
+
+	dnsServer = flag.String("dnsServer", "", "dns server host[:port] used to resolve backend names, empty for the system resolver")
+
+	sshJumpHost              = flag.String("sshJumpHost", "", "ssh host:port to dial backends through, empty to dial backends directly")
+	sshUser                  = flag.String("sshUser", "", "ssh user for sshJumpHost")
+	sshKeyFile               = flag.String("sshKeyFile", "", "ssh private key file for sshJumpHost")
+	sshKnownHostsFile        = flag.String("sshKnownHostsFile", "", "known_hosts file used to verify the sshJumpHost host key")
+	sshInsecureIgnoreHostKey = flag.Bool("sshInsecureIgnoreHostKey", false, "skip verifying the sshJumpHost host key")
+
+	maxBytesPerConnection = flag.Int64("maxBytesPerConnection", 0, "maximum total bytes proxied in both directions per connection, 0 for unlimited")
+
+	maxBytesPerSecondPerConn = flag.Int64("maxBytesPerSecondPerConn", 0, "bandwidth limit of each connection in each direction, in bytes per second, 0 for unlimited")
+	maxBytesPerSecond        = flag.Int64("maxBytesPerSecond", 0, "bandwidth limit across all connections in each direction, in bytes per second, 0 for unlimited")
+
+	tee       = flag.String("tee", "", "mirror proxied bytes in direction wsToTcp, tcpToWs, or both to teeTarget")
+	teeTarget = flag.String("teeTarget", "", "tee destination, file:path or tcp:host:port, written as frames of a \"txID direction length\" line and length bytes")
+
+	teeDropOnBlock     = flag.Bool("teeDropOnBlock", false, "write tee data asynchronously through a bounded queue, dropping it when the queue is full instead of slowing the proxied connection")
+	teeDropQueueSize   = flag.Int("teeDropQueueSize", 1024, "with teeDropOnBlock, chunks queued per connection before tee data is dropped")
+	teeDropLogInterval = flag.Duration("teeDropLogInterval", 10*time.Second, "with teeDropOnBlock, interval for logging dropped tee data")
+
+	diagMirrorBytes  = flag.Int("diagMirrorBytes", 4096, "number of opening bytes from each client copied to diagMirrorTarget")
+	diagMirrorTarget = flag.String("diagMirrorTarget", "", "tcp host:port that the opening bytes of each client are sent to, best effort, empty to disable")
+
+	wsReadBufferSize  = flag.Int("wsReadBufferSize", 32*1024, "size of pooled buffers for copying data read from websockets")
+	wsWriteBufferSize = flag.Int("wsWriteBufferSize", 32*1024, "size of pooled buffers for copying data written to websockets, the maximum message size sent to clients")
+	copyBufferSize    = flag.Int("copyBufferSize", 32*1024, "size of pooled buffers for copying data in client mode and over mux streams")
+
+	txIDHeader         = flag.String("txIDHeader", "", "request header, such as X-Request-Id, whose value is used as the transaction id when present and valid, empty to always generate one")
+	txIDResponseHeader = flag.String("txIDResponseHeader", "", "response header set to the transaction id, such as X-Proxy-Tx-Id, empty to disable")
+
+	auditSinkURL           = flag.String("auditSink", "", "url that connection close records are POSTed to as NDJSON, empty to disable")
+	auditSinkFlushInterval = flag.Duration("auditSinkFlushInterval", 5*time.Second, "interval between auditSink batch posts")
+	auditSinkMaxBuffered   = flag.Int("auditSinkMaxBuffered", 10000, "maximum records buffered for auditSink, the oldest are dropped beyond this")
+
+	otlpTracesEndpoint      = flag.String("otlpTracesEndpoint", "", "otlp/http url, such as http://localhost:4318/v1/traces, that session spans are POSTed to as json, empty to use OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT, disabled if none is set")
+	otlpTracesFlushInterval = flag.Duration("otlpTracesFlushInterval", 5*time.Second, "interval between otlp span batch posts")
+	otlpTracesMaxBuffered   = flag.Int("otlpTracesMaxBuffered", 10000, "maximum spans buffered for otlp export, the oldest are dropped beyond this")
+
+	eventLogFile          = flag.String("eventLogFile", "", "file that connection close records are appended to as NDJSON, empty to disable")
+	eventLogCompress      = flag.Bool("eventLogCompress", false, "gzip compress eventLogFile")
+	eventLogFlushInterval = flag.Duration("eventLogFlushInterval", 5*time.Second, "interval between eventLogFile flushes")
+
+	accessLogFile   = flag.String("accessLogFile", "", "file that an access log line is appended to for each connection, separate from the operational log, empty to disable")
+	accessLogFormat = flag.String("accessLogFormat", "combined", "accessLogFile line format, clf, combined, or a text/template given the connection record fields along with RemoteAddr, Request, Status, Referer, and UserAgent")
+
+	messageWriteTimeout = flag.Duration("messageWriteTimeout", 0, "deadline for each write of proxied data to the websocket or backend, closing the connection when one is exceeded, 0 to disable")
+
+	writeCoalesceDelay = flag.Duration("writeCoalesceDelay", 0, "how long to accumulate backend data, up to wsWriteBufferSize bytes, into one websocket message, 0 to disable")
+
+	clientFirstMessageTimeout = flag.Duration("clientFirstMessageTimeout", 0, "close connections whose client sends no message within this time of the backend connecting, or of the websocket being accepted with lazyBackendDial, 0 to disable")
+
+	lazyBackendDial   = flag.Bool("lazyBackendDial", false, "dial the tcp backend only once the client's first message arrives, writing that message to the backend first")
+	lazyDialMaxBuffer = flag.Int("lazyDialMaxBuffer", 64*1024, "with lazyBackendDial, maximum size of the first message buffered before dialing, closing connections that send a larger one with status 1009")
+
+	pingInterval   = flag.Duration("pingInterval", 0, "interval between websocket pings sent to clients while proxying, keeping idle connections open through NATs and load balancers, 0 to disable")
+	pongTimeout    = flag.Duration("pongTimeout", 0, "with pingInterval, how long each ping awaits its pong before counting as missed, 0 for pingInterval")
+	maxMissedPongs = flag.Int("maxMissedPongs", 3, "consecutive unanswered pings after which a client connection is closed as dead")
+
+	backendReconnectOnReset = flag.Bool("backendReconnectOnReset", false, "redial the tcp backend when it resets the connection, keeping the client connected, losing data in flight during the reset")
+	maxBackendReconnects    = flag.Int("maxBackendReconnects", 3, "with backendReconnectOnReset, maximum redials per client connection within backendReconnectWindow, after which the client is closed with status 1013")
+	backendReconnectWindow  = flag.Duration("backendReconnectWindow", 0, "window maxBackendReconnects is counted over, 0 to count over the whole client connection")
+
+	appDataIdleTimeout = flag.Duration("appDataIdleTimeout", 0, "close tcp backend connections with no application data proxied in either direction for this long, ignoring pings and other control frames, 0 to disable")
+
+	globalStallTimeout = flag.Duration("globalStallTimeout", 0, "forcibly tear down connections with no bytes moving in either direction for this long, 0 to disable")
+
+	progressLogInterval = flag.Duration("progressLogInterval", 0, "interval for logging the bytes each connection has proxied so far, as \"connection progress\" lines, 0 to log byte counts only when connections end")
+
+	teardownGrace = flag.Duration("teardownGrace", 0, "how long the still active copy direction may drain after the other finishes before both connections close, 0 to close immediately")
+
+	closeHandshakeTimeout = flag.Duration("closeHandshakeTimeout", 0, "deadline for the websocket close handshake on teardown, 0 for the websocket library default")
+
+	trustForwardedFor = flag.Bool("trustForwardedFor", false, "trust the Forwarded and X-Forwarded-For headers for the client ip, the rightmost address that is not a trustedProxyCIDRs proxy")
+	trustedProxyCIDRs = flag.String("trustedProxyCIDRs", "", "with trustForwardedFor, comma-separated CIDRs or ips of the proxies in front of this one, whose own hops in the Forwarded and X-Forwarded-For headers are skipped, empty to take the client ip from the rightmost hop")
+
+	allowCIDRs = flag.String("allowCIDRs", "", "comma-separated CIDRs or ips that client ips must match one of, rejecting others with 403, empty to allow any client")
+	denyCIDRs  = flag.String("denyCIDRs", "", "comma-separated CIDRs or ips whose clients are rejected with 403, checked before allowCIDRs")
+
+	acceptProxyProtocol        = flag.Bool("acceptProxyProtocol", false, "require a PROXY protocol v1 or v2 header on each client connection, such as from an L4 load balancer, using its client address as the remote address in logs, auth decisions, and sendProxyProtocol")
+	proxyProtocolHeaderTimeout = flag.Duration("proxyProtocolHeaderTimeout", 5*time.Second, "with acceptProxyProtocol, time for a client connection to send its PROXY protocol header before it is closed")
+	sendProxyProtocol          = flag.String("sendProxyProtocol", "", "send a PROXY protocol v1 or v2 header with the client ip, as in trustForwardedFor, on each backend connection right after dialing, empty to send none")
+
+	sendMetadata        = flag.String("sendMetadata", "", "send a json line describing the client, with its txID, client ip, path, jwt sub claim as user, tenant, and sendMetadataHeaders, on each backend connection before any client bytes, inside backendTLS, json or empty to send none")
+	sendMetadataHeaders = flag.String("sendMetadataHeaders", "", "comma-separated request headers, such as X-Forwarded-User or Cookie, included in the sendMetadata line")
+
+	logSyslog  = flag.Bool("logSyslog", false, "log to syslog instead of stdout")
+	syslogAddr = flag.String("syslogAddr", "", "syslog server as udp://host:port or tcp://host:port, empty for the local syslog daemon")
+	syslogTag  = flag.String("syslogTag", "go-ws-proxy", "syslog tag")
+
+	logFormat         = flag.String("logFormat", "json", "log line format, json or text")
+	logFile           = flag.String("logFile", "", "file that the log is appended to instead of stdout, empty for stdout")
+	logFileMaxSize    = flag.Int64("logFileMaxSize", 100*1024*1024, "size in bytes at which logFile is rotated, 0 to disable")
+	logFileMaxAge     = flag.Duration("logFileMaxAge", 0, "age at which logFile is rotated, 0 to disable")
+	logFileMaxBackups = flag.Int("logFileMaxBackups", 5, "number of rotated logFile files kept, 0 to keep all")
+
+	acceptLogSampleRate = flag.Uint64("acceptLogSampleRate", 1, "log 1 in N \"begin websocket handler\" lines at info level and the rest at debug, 1 to log every accept at info")
+
+	logRequestHeaders = flag.Bool("logRequestHeaders", false, "log request headers, with redactHeaders redacted, in the \"begin websocket handler\" line, false to log only the method, url, and protocol")
+	logExtensions     = flag.Bool("logExtensions", false, "log the websocket extensions each client offered and those negotiated, such as permessage-deflate parameters, on every line of its connection")
+	requiredHeaders   = flag.String("requiredHeaders", "", "comma-separated request headers that must be present, each as name or name=value to require a value, rejecting other requests with 400")
+	redactHeaders     = flag.String("redactHeaders", "Authorization,Cookie,Proxy-Authorization", "comma-separated request headers whose values are redacted in logs")
+
+	logMessages            = flag.Bool("logMessages", false, "proxy discrete websocket messages, logging the direction, size, and type of each at debug level")
+	logCompressionRatio    = flag.Bool("logCompressionRatio", false, "count the client connection's wire bytes, logging them with the ratio of proxied to wire bytes in each direction when a connection ends")
+	countMessages          = flag.Bool("countMessages", false, "count websocket messages in each direction, logging messagesWsToTcp and messagesTcpToWs when a connection ends")
+	logMessagePreviewBytes = flag.Int("logMessagePreviewBytes", 0, "with logMessages, number of bytes of each message to log as a hex preview, 0 to log no contents")
+
+	maxDurationHeader            = flag.String("maxDurationHeader", "X-Proxy-Max-Duration", "request header clients may use to set a connection's max lifetime, as a duration")
+	maxAllowedConnectionLifetime = flag.Duration("maxAllowedConnectionLifetime", 0, "upper bound for lifetimes requested via maxDurationHeader, 0 to ignore the header")
+	proxyMaxDuration             = flag.Duration("proxyMaxDuration", 0, "close every connection with status 1001 once it has lasted this long, or a shorter lifetime requested via maxDurationHeader, 0 for no limit")
+	proxyIdleTimeout             = flag.Duration("proxyIdleTimeout", 0, "close every connection, of tcp, udp, and websocket backends and mux streams alike, with status 1001 once no data has moved in either direction for this long, 0 to disable")
+
+	maxConcurrentDials   = flag.Int("maxConcurrentDials", 0, "maximum concurrent backend dials, other connections waiting for a slot, 0 for unlimited")
+	maxDialQueue         = flag.Int("maxDialQueue", 0, "with maxConcurrentDials, maximum connections waiting for a dial slot, rejecting others with 503, 0 for unbounded")
+	dialQueueLogInterval = flag.Duration("dialQueueLogInterval", 10*time.Second, "with maxConcurrentDials, interval for logging the dial queue depth while connections are waiting")
+
+	maxConcurrentHandshakes = flag.Int("maxConcurrentHandshakes", 0, "maximum connections concurrently between request arrival and proxying, 0 for unlimited")
+	handshakeQueueTimeout   = flag.Duration("handshakeQueueTimeout", 0, "how long a connection may wait for a maxConcurrentHandshakes slot before being rejected with 503, 0 to wait indefinitely")
+
+	maxNewConnectionsPerSec    = flag.Float64("maxNewConnectionsPerSec", 0, "maximum new websocket connections accepted per second, 0 for unlimited")
+	newConnectionRateLimitWait = flag.Duration("newConnectionRateLimitWait", 0, "how long a new connection may wait for the rate limiter before being rejected with 429")
+
+	maxUpgradesPerMinutePerIP = flag.Float64("maxUpgradesPerMinutePerIP", 0, "maximum websocket upgrade attempts per minute from one client ip, in bursts of up to a minute's worth, rejecting others with 429, 0 for unlimited")
+	upgradeRateLimitMaxIPs    = flag.Int("upgradeRateLimitMaxIPs", 10000, "with maxUpgradesPerMinutePerIP, most client ips tracked, forgetting the least recently seen beyond this")
+
+	maxConnections                  = flag.Int("maxConnections", 0, "maximum concurrent connections, rejecting others with 503, 0 for unlimited")
+	maxConnectionsWait              = flag.Duration("maxConnectionsWait", 0, "how long a new connection may wait for one of maxConnections before being rejected with 503, 0 to reject at once")
+	highPriorityReservedConnections = flag.Int("highPriorityReservedConnections", 0, "connections of maxConnections reserved for high priority clients, low priority clients being rejected once only these remain")
+	highPriorityHeader              = flag.String("highPriorityHeader", "", "request header, as name or name=value, marking a client high priority, which only a trusted upstream should set, empty to disable")
+	highPriorityTenants             = flag.String("highPriorityTenants", "", "comma-separated tenantFile tenant names whose connections are high priority")
+
+	maxGoroutines = flag.Int("maxGoroutines", 0, "reject new connections with 503 while the goroutine count exceeds this, 0 for unlimited")
+	maxOpenFDs    = flag.Int("maxOpenFDs", 0, "reject new connections with 503 while the open file descriptor count exceeds this (linux only), 0 for unlimited")
+
+	retryAfterSeconds = flag.Int("retryAfterSeconds", 0, "minimum Retry-After seconds advertised on 429 and 503 capacity rejections, raised to the rate limiter's refill time when longer, 0 to omit the header")
+
+	managementListenHostAndPort = flag.String("managementListenHostAndPort", "", "listen host and port, or unix:path, for the management endpoints, separate from listenHostAndPort, empty to disable")
+	managementMetrics           = flag.Bool("managementMetrics", true, "serve prometheus metrics at /metrics on the management listener")
+	managementHealthz           = flag.Bool("managementHealthz", true, "serve /healthz on the management listener")
+	managementReadyz            = flag.Bool("managementReadyz", true, "serve /readyz on the management listener, answering 503 while draining")
+	readyzCheckBackends         = flag.Bool("readyzCheckBackends", false, "also answer /readyz with 503 while no tcp backend accepts a connection")
+	readyzCacheTTL              = flag.Duration("readyzCacheTTL", 5*time.Second, "how long a readyzCheckBackends result is reused before the backends are dialed again")
+	readyzDialTimeout           = flag.Duration("readyzDialTimeout", 1*time.Second, "timeout for all readyzCheckBackends dials")
+	managementAdmin             = flag.Bool("managementAdmin", false, "serve /admin/ endpoints on the management listener")
+	managementPprof             = flag.Bool("managementPprof", false, "serve /debug/pprof/, /debug/vars runtime stats, and /debug/buildinfo on the management listener")
+
+	metricLabels = flag.String("metricLabels", "", "comma-separated connection labels that the wsproxy_labeled_ metrics are partitioned by, from backend, path, subprotocol, and tenant, empty to disable")
+
+	statsdAddr          = flag.String("statsdAddr", "", "udp host:port of a statsd endpoint that metrics are sent to, independent of the management listener, empty to disable")
+	statsdFlushInterval = flag.Duration("statsdFlushInterval", 10*time.Second, "interval between sends to statsdAddr")
+
+	maintenanceMode        = flag.Bool("maintenanceMode", false, "start in maintenance mode, answering each websocket with maintenanceMessage and closing it with status 1013 instead of proxying")
+	maintenanceMessage     = flag.String("maintenanceMessage", "service under maintenance, please retry later", "message sent to clients in maintenance mode")
+	maintenanceMessageType = flag.String("maintenanceMessageType", "text", "websocket message type of maintenanceMessage, text or binary")
+
+	serveInfoPage = flag.Bool("serveInfoPage", false, "respond to requests without websocket upgrade headers, such as from a browser, with a page describing the endpoint")
+
+	shutdownTimeout = flag.Duration("shutdownTimeout", 0, "how long shutdown on SIGINT, SIGTERM, or maxUptime waits for active connections to end before force closing them, 0 to force close at once")
+	maxUptime       = flag.Duration("maxUptime", 0, "shut down after running this long, as on SIGTERM, for a supervisor to restart the process, 0 to run indefinitely")
+
+	flagFile = flag.String("flagFile", "", "file of name=value lines setting flags not given on the command line or in WSPROXY_ environment variables, such as WSPROXY_LISTEN_HOST_AND_PORT for listenHostAndPort")
+
+	strictConfig = flag.String("strictConfig", strictConfigOff, "handling of flags given more than once, on the command line or across the command line, environment, and flagFile, where the value of highest precedence wins: off, warn to log each, or fail to exit")
+
+	panicExit = flag.Bool("panicExit", true, "exit the process when a panic handling a connection is recovered, false to drop only that connection")
+
+	diagInterval = flag.Duration("diagInterval", 0, "interval for logging goroutine, fd, and active connection counts, 0 to disable")
+)
+
+// active websocket connections
+var activeConnections atomic.Int64
+
+// websocket connections accepted since startup
+var acceptedConnections atomic.Uint64
+
+// most activeConnections since startup
+var peakActiveConnections atomic.Int64
+
+var activeConnectionsGauge = newFuncValue(
+	"wsproxy_active_connections",
+	"Active websocket connections.",
+	"gauge",
+	func() float64 {
+		return float64(activeConnections.Load())
+	},
+)
+
+var peakActiveConnectionsGauge = newFuncValue(
+	"wsproxy_peak_active_connections",
+	"Most active websocket connections since startup.",
+	"gauge",
+	func() float64 {
+		return float64(peakActiveConnections.Load())
+	},
+)
+
+// connectionOpened counts an accepted connection as active, returning the
+// func to call when it closes.
+func connectionOpened() (closed func()) {
+	acceptedConnections.Add(1)
+
+	active := activeConnections.Add(1)
+	for {
+		peak := peakActiveConnections.Load()
+		if active <= peak || peakActiveConnections.CompareAndSwap(peak, active) {
+			break
+		}
+	}
+
+	return func() {
+		activeConnections.Add(-1)
+	}
+}
+
+var acceptedConnectionsCounter = newFuncValue(
+	"wsproxy_accepted_connections_total",
+	"Websocket connections accepted.",
+	"counter",
+	func() float64 {
+		return float64(acceptedConnections.Load())
+	},
 )
 
+// accepts counted for acceptLogSampleRate
+var acceptLogCount atomic.Uint64
+
+// backends parsed from tcpHostAndPort or backendFile
+var backends atomic.Pointer[backendPool]
+
+// backend parsed from fallbackTcpHostAndPort, nil if unset
+var fallbackBackend *backend
+
+// resolver for backend names, nil for the system resolver
+var backendResolver *net.Resolver
+
+// dialer for backends reached through sshJumpHost, nil if unset
+var backendSSHDialer *sshDialer
+
+// new connection rate limiter, nil if unlimited
+var newConnectionLimiter *tokenBucket
+
+// limits maxConcurrentHandshakes, nil if unlimited
+var handshakeSemaphore semaphore
+
 // Release tag - embedded during build with ldflags
 var releaseTag = "dev"
 
@@ -32,22 +380,67 @@ func parseFlags() {
 	flag.TextVar(&slogLevel, "slogLevel", slog.LevelInfo, "slog level")
 
 	flag.Parse()
+
+	if flag.NArg() > 0 {
+		fatal(exitCodeConfig, "unexpected arguments: %q", flag.Args())
+	}
+
+	if err := applyFlagDefaults(); err != nil {
+		fatal(exitCodeConfig, "applyFlagDefaults error: %w", err)
+	}
 }
 
 func setupSlog() {
+	// clientMode proxies data over stdout
+	var logOutput io.Writer = os.Stdout
+	if *clientMode {
+		logOutput = os.Stderr
+	}
+
+	if *logFile != "" {
+		if *logSyslog {
+			fatal(exitCodeConfig, "logFile is not supported with logSyslog")
+		}
+
+		rotatingLogFile, err := openRotatingFile(*logFile, *logFileMaxSize, *logFileMaxAge, *logFileMaxBackups)
+		if err != nil {
+			fatal(exitCodeConfig, "openRotatingFile error: %w", err)
+		}
+		onShutdown(rotatingLogFile.close)
+		logOutput = rotatingLogFile
+	}
+
+	handlerOptions := &slog.HandlerOptions{
+		Level: slogLevel,
+	}
+
+	var handler slog.Handler
+	switch *logFormat {
+	case "json":
+		handler = slog.NewJSONHandler(logOutput, handlerOptions)
+	case "text":
+		handler = slog.NewTextHandler(logOutput, handlerOptions)
+	default:
+		fatal(exitCodeConfig, "invalid logFormat %q, expected json or text", *logFormat)
+	}
+
+	if *logSyslog {
+		var err error
+		handler, err = newSyslogHandler(*syslogAddr, *syslogTag, slogLevel)
+		if err != nil {
+			fatal(exitCodeConfig, "newSyslogHandler error: %w", err)
+		}
+	}
+
 	slog.SetDefault(
-		slog.New(
-			slog.NewJSONHandler(
-				os.Stdout,
-				&slog.HandlerOptions{
-					Level: slogLevel,
-				},
-			),
-		),
+		slog.New(handler),
 	)
 
 	slog.Info("setupSlog",
 		"sloglevel", slogLevel,
+		"logSyslog", *logSyslog,
+		"logFormat", *logFormat,
+		"logFile", *logFile,
 	)
 }
 
@@ -73,106 +466,1673 @@ func websocketServerHandlerFunc() http.HandlerFunc {
 		r *http.Request,
 	) {
 
-		txID := uuid.New().String()
+		setupTiming := connectionSetupTiming{
+			requestTime: time.Now(),
+		}
+
+		txID, txIDRejected := requestTxID(r)
 
 		txLogger := slog.Default().With(
 			"txID", txID,
 		)
+		txLogger = withClientTLS(txLogger, r.TLS)
 
-		txLogger.Info("begin websocket handler",
-			"host", r.Host,
-			"method", r.Method,
-			"headers", r.Header,
-			"protocol", r.Proto,
-			"url", r.URL.String(),
-		)
+		if txIDRejected {
+			txLogger.Warn("invalid txIDHeader value, generated txID",
+				"txIDHeader", *txIDHeader,
+				"length", len(r.Header.Get(*txIDHeader)),
+			)
+		}
 
-		websocketConn, err := websocket.Accept(w, r, nil)
-		if err != nil {
-			txLogger.Warn("websocket.Accept error",
-				"error", err,
+		defer recoverConnectionPanic(txLogger)
+
+		sessionSpan := startSessionSpan(r, txID, setupTiming.requestTime)
+		defer sessionSpan.end()
+
+		if *txIDResponseHeader != "" {
+			w.Header().Set(*txIDResponseHeader, txID)
+		}
+
+		if shuttingDown.Load() {
+			txLogger.Info("shutting down, connection rejected",
+				"remoteAddr", r.RemoteAddr,
 			)
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
 			return
 		}
 
-		defer websocketConn.CloseNow()
+		if _, draining := drainingSince(); draining {
+			txLogger.Info("draining, connection rejected",
+				"remoteAddr", r.RemoteAddr,
+			)
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
 
-		tcpConn, err := net.DialTimeout("tcp", *tcpHostAndPort, 2*time.Second)
-		if err != nil {
-			txLogger.Warn("net.DialTimeout error",
-				"error", err,
+		if connectionLoadShedder != nil && connectionLoadShedder.shouldShed() {
+			retryAfter := setRetryAfter(w, 0)
+			txLogger.Warn("shedding load, connection rejected",
+				"remoteAddr", r.RemoteAddr,
+				"retryAfterSeconds", retryAfter,
 			)
+			http.Error(w, "server overloaded", http.StatusServiceUnavailable)
 			return
 		}
 
-		defer tcpConn.Close()
+		if *websocketPath != "" && r.URL.Path != *websocketPath {
+			txLogger.Info("request path not allowed",
+				"remoteAddr", r.RemoteAddr,
+				"method", r.Method,
+				"path", r.URL.Path,
+			)
+			http.NotFound(w, r)
+			return
+		}
 
-		wsNetConn := websocket.NetConn(context.Background(), websocketConn, websocket.MessageBinary)
+		if r.Method != http.MethodGet {
+			txLogger.Info("request method not allowed",
+				"remoteAddr", r.RemoteAddr,
+				"method", r.Method,
+				"path", r.URL.Path,
+			)
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-		var proxyWaitGroup sync.WaitGroup
+		if *serveInfoPage && !isWebsocketUpgrade(r) {
+			txLogger.Info("serving info page",
+				"remoteAddr", r.RemoteAddr,
+				"method", r.Method,
+				"url", r.URL.String(),
+			)
+			serveInfo(w, r)
+			return
+		}
 
-		proxyWaitGroup.Go(func() {
-			defer wsNetConn.Close()
-			defer tcpConn.Close()
+		if name, reason, ok := checkRequiredHeaders(r.Header); !ok {
+			txLogger.Warn("required header check failed",
+				"remoteAddr", r.RemoteAddr,
+				"header", name,
+				"reason", reason,
+			)
+			rejectRequiredHeader(w, name, reason)
+			return
+		}
 
-			written, err := io.Copy(wsNetConn, tcpConn)
+		if maintenanceActive.Load() {
+			serveMaintenance(w, r, txLogger)
+			return
+		}
 
-			txLogger.Info("after io.Copy(wsNetConn, tcpConn)",
-				"written", written,
+		clientIPAddress := clientIP(r)
+		sessionSpan.setString("client.address", clientIPAddress)
+
+		// before the rate limiters and handshake slots, so rejected clients use none
+		if err := checkClientIP(clientIPAddress); err != nil {
+			txLogger.Warn("client ip rejected",
+				"remoteAddr", r.RemoteAddr,
+				"clientIP", clientIPAddress,
 				"error", err,
 			)
-		})
+			sessionSpan.setError(err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
 
-		proxyWaitGroup.Go(func() {
-			defer wsNetConn.Close()
-			defer tcpConn.Close()
+		// before the global limiter, so one client's flood does not take its tokens
+		if upgradeRateLimiter != nil {
+			delay, ok, firstRejection := upgradeRateLimiter.allow(clientIPAddress)
+			if !ok {
+				retryAfter := setRetryAfter(w, delay)
+				logLevel := slog.LevelDebug
+				if firstRejection {
+					logLevel = slog.LevelWarn
+				}
+				txLogger.Log(r.Context(), logLevel, "client ip upgrade rate limit exceeded",
+					"remoteAddr", r.RemoteAddr,
+					"clientIP", clientIPAddress,
+					"retryAfterSeconds", retryAfter,
+				)
+				http.Error(w, "too many upgrade attempts", http.StatusTooManyRequests)
+				return
+			}
+		}
 
-			written, err := io.Copy(tcpConn, wsNetConn)
+		if newConnectionLimiter != nil {
+			delay, ok := newConnectionLimiter.reserve(1, *newConnectionRateLimitWait)
+			if !ok {
+				retryAfter := setRetryAfter(w, delay)
+				txLogger.Warn("new connection rate limit exceeded",
+					"remoteAddr", r.RemoteAddr,
+					"retryAfterSeconds", retryAfter,
+				)
+				http.Error(w, "too many new connections", http.StatusTooManyRequests)
+				return
+			}
 
-			txLogger.Info("after io.Copy(tcpConn, wsNetConn)",
-				"written", written,
-				"error", err,
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					newConnectionLimiter.refund(1)
+					txLogger.Info("client went away waiting for new connection rate limit",
+						"remoteAddr", r.RemoteAddr,
+						"delay", delay.String(),
+					)
+					return
+				}
+			}
+		}
+
+		releaseHandshakeSlot := func() {}
+		if handshakeSemaphore != nil {
+			acquireCtx := r.Context()
+			if *handshakeQueueTimeout > 0 {
+				var cancelAcquire context.CancelFunc
+				acquireCtx, cancelAcquire = context.WithTimeout(acquireCtx, *handshakeQueueTimeout)
+				defer cancelAcquire()
+			}
+
+			if err := handshakeSemaphore.acquire(acquireCtx); err != nil {
+				if r.Context().Err() == nil {
+					retryAfter := setRetryAfter(w, 0)
+					txLogger.Warn("handshake queue timeout",
+						"handshakeQueueTimeout", handshakeQueueTimeout.String(),
+						"maxConcurrentHandshakes", *maxConcurrentHandshakes,
+						"retryAfterSeconds", retryAfter,
+					)
+					http.Error(w, "too many concurrent handshakes", http.StatusServiceUnavailable)
+					return
+				}
+
+				txLogger.Warn("handshakeSemaphore.acquire error",
+					"error", err,
+				)
+				return
+			}
+			releaseHandshakeSlot = sync.OnceFunc(handshakeSemaphore.release)
+		}
+		defer releaseHandshakeSlot()
+
+		beginLogLevel := slog.LevelInfo
+		if *acceptLogSampleRate > 1 && acceptLogCount.Add(1)%*acceptLogSampleRate != 1 {
+			beginLogLevel = slog.LevelDebug
+		}
+
+		// skip building the attrs, including the headers, when the line is not logged
+		if txLogger.Enabled(r.Context(), beginLogLevel) {
+			beginLogAttrs := []any{
+				"clientIP", clientIPAddress,
+				"host", r.Host,
+				"method", r.Method,
+				"protocol", r.Proto,
+				"url", r.URL.String(),
+			}
+
+			if *logRequestHeaders {
+				beginLogAttrs = append(beginLogAttrs, "headers", loggableHeaders(r.Header))
+			}
+
+			txLogger.Log(r.Context(), beginLogLevel, "begin websocket handler", beginLogAttrs...)
+		}
+
+		// sub claim of the client's jwt, empty without one
+		var authUser string
+
+		if authEnabled() {
+			user, err := authenticateRequest(r)
+			if err != nil {
+				txLogger.Warn("unauthorized request",
+					"remoteAddr", r.RemoteAddr,
+					"error", err,
+				)
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			authUser = user
+		}
+
+		pool := backends.Load()
+		fallback := fallbackBackend
+		messageType := proxyMessageType
+
+		if *routeConfigFile != "" {
+			route := matchRoute(r.URL.Path)
+			if route == nil {
+				txLogger.Info("no route for request path",
+					"remoteAddr", r.RemoteAddr,
+					"path", r.URL.Path,
+				)
+				http.NotFound(w, r)
+				return
+			}
+
+			txLogger = txLogger.With(
+				"route", route.path,
 			)
-		})
+			pool = route.backends
+			messageType = route.messageType
+		}
 
-		proxyWaitGroup.Wait()
+		if target := r.URL.Query().Get(dynamicTargetParam); target != "" && dynamicTargetPatterns != nil {
+			targetPool, err := dynamicTargetPool(target)
+			if err != nil {
+				txLogger.Warn("dynamic target rejected",
+					"remoteAddr", r.RemoteAddr,
+					"target", target,
+					"error", err,
+				)
+				http.Error(w, "target not allowed", http.StatusForbidden)
+				return
+			}
 
-		txLogger.Info("end websocket handler")
+			txLogger = txLogger.With(
+				"target", targetPool.backends[0].hostAndPort,
+			)
+			pool = targetPool
+			fallback = nil
+		}
 
-	})
-}
+		// authenticated tenant, nil without tenantFile
+		var clientTenant *tenant
 
-func main() {
-	defer func() {
-		if err := recover(); err != nil {
-			slog.Error("panic in main",
+		if tenantsByTokenHash != nil {
+			tenant, err := authenticateTenant(r)
+			switch {
+			case errors.Is(err, errTenantNoBackend):
+				txLogger.Warn("tenant rejected",
+					"tenant", tenant.name,
+					"error", err,
+				)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+
+			case err != nil:
+				txLogger.Warn("tenant rejected",
+					"error", err,
+				)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			txLogger = txLogger.With(
+				"tenant", tenant.name,
+			)
+
+			txLogger.Info("tenant authenticated",
+				"tenantBackends", tenant.backends.hostAndPorts(),
+			)
+
+			// tenant connections reach only the tenant's backends, never the fallback
+			pool = tenant.backends
+			fallback = nil
+			clientTenant = tenant
+		}
+
+		isMuxSession := *muxMode && slices.Contains(offeredSubprotocols(r), muxSubprotocol)
+
+		// each stream of a mux session counts against the budget instead
+		if connectionsBudget != nil && !isMuxSession {
+			priority := clientPriority(r, clientTenant)
+
+			releaseBudget, ok := connectionsBudget.tryAcquire(priority)
+			if !ok && *maxConnectionsWait > 0 {
+				waitCtx, cancelWait := context.WithTimeout(r.Context(), *maxConnectionsWait)
+				var err error
+				releaseBudget, err = connectionsBudget.acquire(waitCtx, priority)
+				cancelWait()
+				ok = err == nil
+			}
+			if !ok {
+				retryAfter := setRetryAfter(w, 0)
+				txLogger.Warn("connection budget exhausted, connection rejected",
+					"priority", priority,
+					"maxConnections", *maxConnections,
+					"maxConnectionsWait", maxConnectionsWait.String(),
+					"highPriorityReservedConnections", *highPriorityReservedConnections,
+					"activeConnections", activeConnections.Load(),
+					"peakActiveConnections", peakActiveConnections.Load(),
+					"retryAfterSeconds", retryAfter,
+				)
+				http.Error(w, "too many connections", http.StatusServiceUnavailable)
+				return
+			}
+			defer releaseBudget()
+		}
+
+		labels := newConnectionLabels(r.URL.Path, clientTenant)
+
+		if *backendURL != "" {
+			proxyToWebsocketBackend(w, r, txID, clientIPAddress, labels, releaseHandshakeSlot, txLogger)
+			return
+		}
+
+		metadata := backendMetadataLine(r, txID, clientIPAddress, clientTenant, authUser)
+
+		if isMuxSession {
+			proxyMuxSession(w, r, muxSessionConfig{
+				txID:     txID,
+				pool:     pool,
+				fallback: fallback,
+				clientIP: clientIPAddress,
+				priority: clientPriority(r, clientTenant),
+				metadata: metadata,
+				labels:   labels,
+			}, releaseHandshakeSlot, txLogger)
+			return
+		}
+
+		backend, preferredBackend := pool.next(clientIPAddress)
+		if backend == nil {
+			retryAfter := setRetryAfter(w, 0)
+			txLogger.Warn("all backends at capacity",
+				"retryAfterSeconds", retryAfter,
+			)
+			http.Error(w, "all backends at capacity", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { backend.release() }()
+
+		if backend != preferredBackend {
+			txLogger.Info("preferred backend at capacity, overflow routing",
+				"preferredBackend", preferredBackend.hostAndPort,
+				"preferredBackendUnhealthy", preferredBackend.unhealthy(time.Now()),
+				"overflowBackend", backend.hostAndPort,
+			)
+		}
+
+		if *backendProtocol == backendProtocolUDP {
+			proxyToUDPBackend(w, r, txID, clientIPAddress, backend, messageType, labels, releaseHandshakeSlot, txLogger)
+			return
+		}
+
+		leaveDialQueue := func() {}
+		if backendDialLimiter != nil {
+			if !backendDialLimiter.enterQueue() {
+				retryAfter := setRetryAfter(w, 0)
+				txLogger.Warn("dial queue full, connection rejected",
+					"maxDialQueue", *maxDialQueue,
+					"retryAfterSeconds", retryAfter,
+				)
+				http.Error(w, "too many connections awaiting a backend", http.StatusServiceUnavailable)
+				return
+			}
+			leaveDialQueue = sync.OnceFunc(backendDialLimiter.leaveQueue)
+		}
+		defer leaveDialQueue()
+
+		if err := PreAcceptHook(r); err != nil {
+			status := rejectHookError(w, err)
+			txLogger.Warn("PreAcceptHook rejected request",
+				"status", status,
 				"error", err,
 			)
-			os.Exit(1)
+			return
 		}
-	}()
 
-	parseFlags()
+		hijackRecorder := &hijackRecorder{
+			ResponseWriter: w,
+			countWireBytes: *logCompressionRatio,
+		}
 
-	setupSlog()
+		upgradeSpan := sessionSpan.startChild("websocket upgrade", spanKindInternal)
+		websocketConn, err := websocket.Accept(hijackRecorder, r, websocketAcceptOptions)
+		upgradeSpan.setError(err)
+		upgradeSpan.end()
+		if err != nil {
+			txLogger.Warn("websocket.Accept error",
+				"error", err,
+			)
+			sessionSpan.setError(err)
+			return
+		}
 
-	slog.Info("begin main",
-		"releaseTag", releaseTag,
-		"buildInfoMap", buildInfoMap(),
-		"listenHostAndPort", *listenHostAndPort,
-		"tcpHostAndPort", *tcpHostAndPort,
-	)
+		defer websocketConn.CloseNow()
 
-	httpServer := &http.Server{
-		Addr:         *listenHostAndPort,
-		Handler:      websocketServerHandlerFunc(),
-		IdleTimeout:  5 * time.Minute,
-		ReadTimeout:  1 * time.Minute,
-		WriteTimeout: 1 * time.Minute,
-	}
+		setupTiming.acceptTime = time.Now()
 
-	slog.Info("starting http server")
+		txLogger = withWebsocketExtensions(txLogger, r, w.Header())
 
-	err := httpServer.ListenAndServe()
-	panic(fmt.Errorf("httpServer.ListenAndServe error: %w", err))
+		// set once the proxy begins closing the websocket
+		var proxyClosed atomic.Bool
+
+		var connectionCloseReason closeReason
+
+		closeWebsocket := func(class closeClass, code websocket.StatusCode, reason string) {
+			connectionCloseReason.set(class, reason)
+			proxyClosed.Store(true)
+			hijackRecorder.setCloseHandshakeDeadline()
+			websocketConn.Close(code, reason)
+		}
+
+		stopForceCloseWebsocket := context.AfterFunc(forceCloseContext, func() {
+			closeWebsocket(closeClassShutdown, websocket.StatusGoingAway, "server shutting down")
+		})
+		defer stopForceCloseWebsocket()
+
+		defer connectionOpened()()
+
+		connectionStartTime := time.Now()
+
+		byteCounts := newConnectionByteCounts(*maxBytesPerConnection, func() {
+			txLogger.Warn("byte limit exceeded",
+				"maxBytesPerConnection", *maxBytesPerConnection,
+			)
+			go closeWebsocket(closeClassPolicy, websocket.StatusPolicyViolation, "byte limit exceeded")
+		})
+
+		adminSession := &session{
+			txID:       txID,
+			clientIP:   clientIPAddress,
+			startTime:  connectionStartTime,
+			byteCounts: byteCounts,
+			terminate: func() {
+				go closeWebsocket(closeClassAdminKill, websocket.StatusPolicyViolation, "terminated by admin")
+			},
+		}
+		adminSession.setBackend(backend.hostAndPort)
+		defer registerSession(adminSession)()
+
+		defer func() {
+			record := connectionRecord{
+				Time:            time.Now(),
+				TxID:            txID,
+				ClientIP:        clientIPAddress,
+				Backend:         backend.hostAndPort,
+				DurationSeconds: time.Since(connectionStartTime).Seconds(),
+				BytesWsToTcp:    byteCounts.wsToTcp.Load(),
+				BytesTcpToWs:    byteCounts.tcpToWs.Load(),
+				CloseReason:     connectionCloseReason.get(),
+				CloseClass:      string(connectionCloseReason.class()),
+			}
+			recordConnectionEnd(r, record)
+
+			sessionSpan.setString("wsproxy.backend", record.Backend)
+			sessionSpan.setInt("wsproxy.bytes_ws_to_tcp", record.BytesWsToTcp)
+			sessionSpan.setInt("wsproxy.bytes_tcp_to_ws", record.BytesTcpToWs)
+			if record.CloseReason != "" {
+				sessionSpan.setString("wsproxy.close_reason", record.CloseReason)
+				sessionSpan.setString("wsproxy.close_class", record.CloseClass)
+			}
+		}()
+
+		if lifetime := connectionLifetime(r, txLogger); lifetime > 0 {
+			txLogger.Info("applying connection lifetime",
+				"lifetime", lifetime.String(),
+			)
+
+			lifetimeLogger := txLogger
+			lifetimeTimer := time.AfterFunc(lifetime, func() {
+				lifetimeLogger.Info("connection lifetime reached")
+				closeWebsocket(closeClassLifetime, websocket.StatusGoingAway, "connection lifetime reached")
+			})
+			defer lifetimeTimer.Stop()
+		}
+
+		clientReader := newClientMessageReader(websocketConn, messageType)
+
+		startFirstMessageTimeout := func() {
+			if *clientFirstMessageTimeout <= 0 {
+				return
+			}
+			clientReader.startFirstMessageTimeout(*clientFirstMessageTimeout, func() {
+				txLogger.Info("client first-message timeout",
+					"clientFirstMessageTimeout", clientFirstMessageTimeout.String(),
+				)
+				closeWebsocket(closeClassIdleTimeout, websocket.StatusPolicyViolation, "first message timeout")
+			})
+		}
+
+		if *lazyBackendDial {
+			startFirstMessageTimeout()
+
+			if err := clientReader.bufferFirstMessage(context.Background(), *lazyDialMaxBuffer); err != nil {
+				if errors.Is(err, errFirstMessageTooLarge) {
+					txLogger.Warn("first message too large for lazy dial",
+						"lazyDialMaxBuffer", *lazyDialMaxBuffer,
+					)
+					closeWebsocket(closeClassPolicy, websocket.StatusMessageTooBig, "first message too large")
+					return
+				}
+
+				clientReader.logClientClose(err, proxyClosed.Load(), txLogger)
+				connectionCloseReason.set(closeClassClientEOF, "client closed")
+
+				txLogger.Info("no first message for lazy dial",
+					"error", err,
+				)
+				return
+			}
+		}
+
+		dialCtx, cancelDial := context.WithCancel(r.Context())
+
+		if *backendDialGrace > 0 && *backendDialGracePingInterval > 0 {
+			go pingWhileDialing(dialCtx, websocketConn, txLogger)
+		}
+
+		backendDialPause.wait(dialCtx, txLogger)
+
+		useBackendTLS := *backendTLS || (*backendTLSFromClient && r.TLS != nil)
+		if *backendTLSFromClient {
+			txLogger.Info("backendTLSFromClient",
+				"clientTLS", r.TLS != nil,
+				"backendTLS", useBackendTLS,
+			)
+		}
+
+		releaseDialSlot := func() {}
+		if backendDialLimiter != nil {
+			err := backendDialLimiter.slots.acquire(dialCtx)
+			leaveDialQueue()
+			if err != nil {
+				cancelDial()
+				txLogger.Warn("dial slot acquire error",
+					"error", err,
+				)
+				closeWebsocket(closeClassBackendDialFailed, websocket.StatusTryAgainLater, "backend unavailable")
+				return
+			}
+			releaseDialSlot = backendDialLimiter.slots.release
+		}
+
+		var proxyHeader []byte
+		if *sendProxyProtocol != "" {
+			source, destination, ok := proxyProtocolAddrs(r, clientIPAddress)
+			proxyHeader = proxyProtocolHeader(*sendProxyProtocol, source, destination, ok)
+		}
+
+		dialStartTime := time.Now()
+		dialSpan := sessionSpan.startChild("backend dial", spanKindClient)
+		tcpConn, backend, err := dialWithFallback(dialCtx, pool, clientIPAddress, backend, fallback, useBackendTLS, proxyHeader, metadata, txLogger)
+		dialSpan.setString("wsproxy.backend", backend.hostAndPort)
+		dialSpan.setError(err)
+		dialSpan.end()
+		releaseDialSlot()
+		cancelDial()
+		recordTiming("wsproxy_backend_dial_duration", time.Since(dialStartTime))
+
+		txLogger = txLogger.With(
+			"backend", backend.hostAndPort,
+		)
+		adminSession.setBackend(backend.hostAndPort)
+
+		if err != nil {
+			txLogger.Warn("dialBackend error",
+				"error", err,
+			)
+			sessionSpan.setError(err)
+			reason := "backend unavailable"
+			switch {
+			case errors.Is(err, errBackendProbeFailed):
+				reason = "backend probe failed"
+			case errors.Is(err, errBackendNotAllowed):
+				reason = "backend not allowed"
+			}
+			closeWebsocket(closeClassBackendDialFailed, websocket.StatusTryAgainLater, reason)
+			return
+		}
+
+		var reconnectingConn *reconnectingBackendConn
+		if *backendReconnectOnReset {
+			reconnectBackend := backend
+			reconnectingConn = newReconnectingBackendConn(tcpConn, func(ctx context.Context) (net.Conn, error) {
+				conn, err := dialBackend(ctx, reconnectBackend, useBackendTLS, proxyHeader, metadata, txLogger)
+				recordDialResult(reconnectBackend, err)
+				return conn, err
+			}, *maxBackendReconnects, *backendReconnectWindow, func(reason string) {
+				closeWebsocket(closeClassBackendError, websocket.StatusTryAgainLater, reason)
+			}, txLogger)
+			tcpConn = reconnectingConn
+		}
+
+		defer tcpConn.Close()
+
+		setupTiming.dialTime = time.Now()
+
+		// once dialed, force close the websocket before the backend, so the client
+		// sees going away rather than the normal close that follows the backend closing
+		if stopForceCloseWebsocket() {
+			stopForceClose := context.AfterFunc(forceCloseContext, func() {
+				closeWebsocket(closeClassShutdown, websocket.StatusGoingAway, "server shutting down")
+				tcpConn.Close()
+			})
+			defer stopForceClose()
+		}
+
+		if *logBackendAddrs {
+			txLogger = txLogger.With(
+				"backendLocalAddr", tcpConn.LocalAddr().String(),
+				"backendRemoteAddr", tcpConn.RemoteAddr().String(),
+			)
+		}
+
+		txLogger.Info("connected to backend")
+
+		labels.backend = backend.hostAndPort
+		labels.subprotocol = websocketConn.Subprotocol()
+		defer recordLabeledConnectionStart(labels)()
+		defer recordLabeledBytes(labels, byteCounts)
+
+		releaseHandshakeSlot()
+
+		wsNetConn := websocket.NetConn(context.Background(), websocketConn, messageType)
+
+		closeWsNetConn := func() {
+			proxyClosed.Store(true)
+			hijackRecorder.setCloseHandshakeDeadline()
+			wsNetConn.Close()
+		}
+
+		if !*lazyBackendDial {
+			startFirstMessageTimeout()
+		}
+
+		var tcpReader io.Reader = tcpConn
+
+		var bannerReader *bufio.Reader
+		if *logBackendBanner {
+			bannerReader = bufio.NewReader(tcpConn)
+			tcpReader = bannerReader
+		}
+
+		tcpReader = byteCounts.tcpToWsReader(tcpReader)
+		if limiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalTcpToWsBandwidth); limiter != nil {
+			tcpReader = &bandwidthLimitedReader{
+				reader:  tcpReader,
+				limiter: limiter,
+			}
+		}
+
+		var tcpConnWriter io.Writer = tcpConn
+		if *messageWriteTimeout > 0 {
+			tcpConnWriter = &timedConnWriter{
+				conn:    tcpConn,
+				timeout: *messageWriteTimeout,
+			}
+		}
+		tcpWriter := byteCounts.wsToTcpWriter(tcpConnWriter)
+
+		if *diagMirrorTarget != "" {
+			diagMirror := newDiagMirrorCapture(*diagMirrorBytes, *diagMirrorTarget, txLogger)
+			// runs after the copy goroutines are done writing to diagMirror
+			defer diagMirror.finish()
+
+			tcpWriter = io.MultiWriter(tcpWriter, diagMirror)
+		}
+
+		if teeWriter, closeTee := openTee(txLogger); teeWriter != nil {
+			defer closeTee()
+
+			if teeEnabled(teeWsToTcp) {
+				tcpWriter = io.MultiWriter(tcpWriter, newBestEffortWriter(newTeeFrameWriter(teeWriter, txID, teeWsToTcp), teeWsToTcp, txLogger))
+			}
+			if teeEnabled(teeTcpToWs) {
+				tcpReader = io.TeeReader(tcpReader, newBestEffortWriter(newTeeFrameWriter(teeWriter, txID, teeTcpToWs), teeTcpToWs, txLogger))
+			}
+		}
+
+		if *writeCoalesceDelay > 0 {
+			tcpReader = &coalescingReader{
+				reader: tcpReader,
+				conn:   tcpConn,
+				delay:  *writeCoalesceDelay,
+			}
+		}
+
+		teardown := newConnectionTeardown(*teardownGrace, tcpConn, byteCounts, txLogger)
+
+		if *globalStallTimeout > 0 {
+			watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+			defer stopWatchdog()
+
+			go runStallWatchdog(watchdogCtx, *globalStallTimeout, byteCounts, func() {
+				// both directions are blocked, so no close frame could be sent
+				connectionCloseReason.set(closeClassIdleTimeout, "global stall")
+				proxyClosed.Store(true)
+				websocketConn.CloseNow()
+				tcpConn.Close()
+			}, txLogger)
+		}
+
+		stopProgressLog := func() {}
+		if *progressLogInterval > 0 {
+			var progressCtx context.Context
+			progressCtx, stopProgressLog = context.WithCancel(context.Background())
+			defer stopProgressLog()
+
+			go logConnectionProgress(progressCtx, *progressLogInterval, connectionStartTime, byteCounts, txLogger)
+		}
+
+		if *appDataIdleTimeout > 0 {
+			idleCtx, stopIdleTimeout := context.WithCancel(context.Background())
+			defer stopIdleTimeout()
+
+			go runIdleTimeout(idleCtx, *appDataIdleTimeout, byteCounts, func(idle time.Duration) {
+				txLogger.Info("app-data idle timeout",
+					"appDataIdleTimeout", appDataIdleTimeout.String(),
+					"idle", idle.String(),
+				)
+				closeWebsocket(closeClassIdleTimeout, websocket.StatusGoingAway, "app-data idle timeout")
+			})
+		}
+
+		if *proxyIdleTimeout > 0 {
+			idleCtx, stopIdleTimeout := context.WithCancel(context.Background())
+			defer stopIdleTimeout()
+
+			go runIdleTimeout(idleCtx, *proxyIdleTimeout, byteCounts, func(idle time.Duration) {
+				logProxyIdleTimeout(idle, txLogger)
+				closeWebsocket(closeClassIdleTimeout, websocket.StatusGoingAway, "proxy idle timeout")
+			})
+		}
+
+		if *pingInterval > 0 {
+			pingCtx, stopPings := context.WithCancel(context.Background())
+			defer stopPings()
+
+			go pingUntilDead(pingCtx, websocketConn, *pingInterval, effectivePongTimeout(), *maxMissedPongs, func() {
+				closeWebsocket(closeClassPingTimeout, websocket.StatusGoingAway, "ping timeout")
+			}, txLogger)
+		}
+
+		// each write to wsConnWriter is sent as one message
+		var wsConnWriter io.Writer = wsNetConn
+		if *messageWriteTimeout > 0 {
+			wsConnWriter = &timedWebsocketWriter{
+				websocketConn: websocketConn,
+				messageType:   messageType,
+				timeout:       *messageWriteTimeout,
+			}
+		}
+		if messageType == websocket.MessageText {
+			wsConnWriter = &utf8BoundaryWriter{
+				writer: wsConnWriter,
+			}
+		}
+
+		wsMessageCounter := &messageCountingWriter{
+			writer: wsConnWriter,
+		}
+
+		closeOnWriteTimeout := func(direction string, err error) {
+			if !errors.Is(err, errMessageWriteTimeout) {
+				return
+			}
+
+			txLogger.Warn("message write timeout",
+				"direction", direction,
+				"messageWriteTimeout", messageWriteTimeout.String(),
+			)
+			closeWebsocket(closeClassWriteTimeout, websocket.StatusGoingAway, "message write timeout")
+		}
+
+		var proxyWaitGroup sync.WaitGroup
+
+		proxyWaitGroup.Go(func() {
+			defer recoverConnectionPanic(txLogger)
+			defer closeWsNetConn()
+			defer tcpConn.Close()
+			defer teardown.finish("tcpToWs")
+
+			if bannerReader != nil {
+				peekBackendBanner(bannerReader, txLogger)
+			}
+
+			buf := wsWriteBufferPool.get()
+			defer wsWriteBufferPool.put(buf)
+
+			wsWriter := wsConnWriter
+			if *countMessages {
+				wsWriter = wsMessageCounter
+			}
+			wsBlockTimingWriter := newBlockTimingWriter(wsWriter, &tcpToWsWriteBlocks)
+
+			var written int64
+			var err error
+
+			switch {
+			case *logMessages:
+				written, err = proxyMessagesTcpToWs(tcpReader, wsBlockTimingWriter, messageType, *buf, txLogger)
+			case *noBuffer:
+				written, err = copyUnbuffered(wsBlockTimingWriter, tcpReader, *buf)
+			default:
+				written, err = io.CopyBuffer(wsBlockTimingWriter, tcpReader, *buf)
+			}
+
+			closeOnWriteTimeout("tcpToWs", err)
+
+			// tell the client the backend closed, rather than the empty normal
+			// closure sent by closeWsNetConn
+			if !proxyClosed.Load() {
+				closeWebsocket(closeClassBackendEOF, websocket.StatusNormalClosure, "backend closed")
+			}
+
+			txLogger.Info("after io.Copy(wsNetConn, tcpConn)",
+				"written", written,
+				"writeBlocked", wsBlockTimingWriter.blocked.String(),
+				"error", err,
+			)
+		})
+
+		proxyWaitGroup.Go(func() {
+			defer recoverConnectionPanic(txLogger)
+			defer closeWsNetConn()
+			defer tcpConn.Close()
+			defer teardown.finish("wsToTcp")
+
+			buf := wsReadBufferPool.get()
+			defer wsReadBufferPool.put(buf)
+
+			tcpBlockTimingWriter := newBlockTimingWriter(tcpWriter, &wsToTcpWriteBlocks)
+
+			// limited outside the block timing so delays are not counted as a slow backend
+			var limitedTcpWriter io.Writer = tcpBlockTimingWriter
+			if limiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalWsToTcpBandwidth); limiter != nil {
+				limitedTcpWriter = &bandwidthLimitedWriter{
+					writer:  tcpBlockTimingWriter,
+					limiter: limiter,
+				}
+			}
+
+			var written int64
+			var err error
+
+			switch {
+			case *logMessages:
+				written, err = proxyMessagesWsToTcp(context.Background(), clientReader, limitedTcpWriter, *buf, txLogger)
+			case *noBuffer:
+				written, err = copyUnbuffered(limitedTcpWriter, clientReader, *buf)
+			default:
+				written, err = io.CopyBuffer(limitedTcpWriter, clientReader, *buf)
+			}
+
+			closeOnWriteTimeout("wsToTcp", err)
+
+			clientReader.logClientClose(err, proxyClosed.Load(), txLogger)
+
+			if !proxyClosed.Load() {
+				connectionCloseReason.set(closeClassClientEOF, "client closed")
+				if clientReader.closeError != nil {
+					sessionSpan.setInt("websocket.close_code", int64(clientReader.closeError.Code))
+				}
+			}
+
+			txLogger.Info("after io.Copy(tcpConn, wsNetConn)",
+				"written", written,
+				"writeBlocked", tcpBlockTimingWriter.blocked.String(),
+				"error", err,
+			)
+		})
+
+		proxyWaitGroup.Wait()
+		stopProgressLog()
+
+		setupTiming.log(byteCounts, txLogger)
+
+		endAttrs := []any{
+			"duration", time.Since(connectionStartTime).String(),
+			"bytesWsToTcp", byteCounts.wsToTcp.Load(),
+			"bytesTcpToWs", byteCounts.tcpToWs.Load(),
+			"closeReason", connectionCloseReason.get(),
+			"closeClass", connectionCloseReason.class(),
+		}
+		if wireConn := hijackRecorder.wireConn; wireConn != nil {
+			endAttrs = append(endAttrs,
+				"wireBytesWsToTcp", wireConn.read.Load(),
+				"wireBytesTcpToWs", wireConn.written.Load(),
+				"compressionRatioWsToTcp", compressionRatio(byteCounts.wsToTcp.Load(), wireConn.read.Load()),
+				"compressionRatioTcpToWs", compressionRatio(byteCounts.tcpToWs.Load(), wireConn.written.Load()),
+			)
+		}
+		if reconnectingConn != nil {
+			endAttrs = append(endAttrs,
+				"backendReconnects", reconnectingConn.backendReconnects(),
+			)
+		}
+		if *countMessages {
+			endAttrs = append(endAttrs,
+				"messagesWsToTcp", clientReader.messages,
+				"messagesTcpToWs", wsMessageCounter.messages,
+			)
+		}
+
+		txLogger.Info("end websocket handler", endAttrs...)
+
+	})
+}
+
+func main() {
+	defer func() {
+		if err := recover(); err != nil {
+			exitCode := exitCodePanic
+			if fatalError, ok := err.(fatalError); ok {
+				exitCode = fatalError.exitCode
+			}
+
+			slog.Error("panic in main",
+				"error", err,
+				"exitCode", exitCode,
+			)
+			runShutdownHooks()
+			os.Exit(exitCode)
+		}
+	}()
+
+	parseFlags()
+
+	setupSlog()
+
+	if len(flagsFromEnvironment) > 0 || len(flagsFromFlagFile) > 0 {
+		slog.Info("flags set from environment and flagFile",
+			"environment", flagsFromEnvironment,
+			"flagFile", flagsFromFlagFile,
+		)
+	}
+
+	checkDuplicateFlags()
+
+	if *copyBufferSize <= 0 {
+		fatal(exitCodeConfig, "copyBufferSize must be positive")
+	}
+
+	if *noBuffer && *writeCoalesceDelay > 0 {
+		fatal(exitCodeConfig, "noBuffer and writeCoalesceDelay cannot both be set")
+	}
+	copyBufferPool = newBufferPool(*copyBufferSize)
+
+	if messageType, err := parseMessageType("messageType", *messageTypeName); err != nil {
+		fatal(exitCodeConfig, "parseMessageType error: %w", err)
+	} else {
+		proxyMessageType = messageType
+	}
+
+	if mode, err := parseCompressionMode(*compression); err != nil {
+		fatal(exitCodeConfig, "parseCompressionMode error: %w", err)
+	} else {
+		compressionMode = mode
+	}
+	if *compressionThreshold < 0 {
+		fatal(exitCodeConfig, "compressionThreshold must not be negative: %v", *compressionThreshold)
+	}
+
+	if *clientMode {
+		if *reconnectMaxBackoff <= 0 {
+			fatal(exitCodeConfig, "reconnectMaxBackoff must be positive")
+		}
+		if *clientListenHostAndPort != "" || *routeConfigFile != "" {
+			if forwards, err := loadClientForwards(*clientListenHostAndPort, *routeConfigFile); err != nil {
+				fatal(exitCodeConfig, "loadClientForwards error: %w", err)
+			} else {
+				clientForwards = forwards
+			}
+
+			if *managementListenHostAndPort != "" {
+				// for the client mode metrics, such as wsproxy_client_dial_attempts_total
+				backends.Store(&backendPool{})
+
+				managementListener, err := listenNetwork(*managementListenHostAndPort)
+				if err != nil {
+					fatal(exitCodeListen, "management listenNetwork error: %w", err)
+				}
+				startManagementServer(managementListener)
+			}
+			runClientForwards(clientForwards)
+			return
+		}
+		if *clientMux {
+			fatal(exitCodeConfig, "clientMux requires clientListenHostAndPort or config")
+		}
+		runClientMode(*connectURL)
+		return
+	}
+
+	if *selfTest {
+		if *backendURL != "" {
+			fatal(exitCodeConfig, "selfTest is not supported with backendURL")
+		}
+		*echoBackend = true
+	}
+
+	slog.Info("begin main",
+		"releaseTag", releaseTag,
+		"buildInfoMap", buildInfoMap(),
+		"listenHostAndPort", *listenHostAndPort,
+		"tcpHostAndPort", *tcpHostAndPort,
+		"backendDialGrace", *backendDialGrace,
+	)
+
+	if *routeConfigFile != "" &&
+		(*backendFile != "" || *websocketPath != "" || *backendURL != "" || *tenantFile != "" || *backendPoolSize > 0) {
+		fatal(exitCodeConfig, "config is not supported with backendFile, websocketPath, backendURL, tenantFile, or backendPoolSize")
+	}
+
+	if *allowDynamicTarget != "" {
+		if *routeConfigFile != "" || *backendURL != "" || *tenantFile != "" {
+			fatal(exitCodeConfig, "allowDynamicTarget is not supported with config, backendURL, or tenantFile")
+		}
+
+		patterns, err := parseDynamicTargetPatterns(*allowDynamicTarget)
+		if err != nil {
+			fatal(exitCodeConfig, "parseDynamicTargetPatterns error: %w", err)
+		}
+		dynamicTargetPatterns = patterns
+	}
+
+	if trusted, err := parseCIDRs("trustedProxyCIDRs", splitCommaList(*trustedProxyCIDRs)); err != nil {
+		fatal(exitCodeConfig, "parseCIDRs error: %w", err)
+	} else {
+		trustedProxyPrefixes = trusted
+	}
+
+	if allowed, err := parseCIDRs("allowCIDRs", splitCommaList(*allowCIDRs)); err != nil {
+		fatal(exitCodeConfig, "parseCIDRs error: %w", err)
+	} else {
+		flagClientIPFilter.allow = allowed
+	}
+	if denied, err := parseCIDRs("denyCIDRs", splitCommaList(*denyCIDRs)); err != nil {
+		fatal(exitCodeConfig, "parseCIDRs error: %w", err)
+	} else {
+		flagClientIPFilter.deny = denied
+	}
+	storeClientIPFilter(clientIPFilter{})
+
+	if *backendFile != "" {
+		pool, contents, err := loadBackendFile(*backendFile)
+		if err != nil {
+			fatal(exitCodeBackend, "loadBackendFile error: %w", err)
+		}
+		backends.Store(pool)
+
+		go watchBackendFile(context.Background(), *backendFile, *backendFilePollInterval, contents)
+	} else if *routeConfigFile != "" {
+		routes, filter, err := loadRouteConfig(*routeConfigFile)
+		if err != nil {
+			fatal(exitCodeBackend, "loadRouteConfig error: %w", err)
+		}
+		storeRoutes(routes, filter)
+
+		go reloadRouteConfigOnSIGHUP(context.Background(), *routeConfigFile)
+	} else {
+		pool, err := newBackendPool(*tcpHostAndPort)
+		if err != nil {
+			fatal(exitCodeBackend, "newBackendPool error: %w", err)
+		}
+		backends.Store(pool)
+	}
+
+	if *backendAllowlist != "" {
+		var err error
+		backendAllowlistSet, err = parseBackendAllowlist(*backendAllowlist)
+		if err != nil {
+			fatal(exitCodeConfig, "parseBackendAllowlist error: %w", err)
+		}
+
+		for _, backend := range backends.Load().backends {
+			if err := checkBackendAllowed(backend.hostAndPort); err != nil {
+				slog.Warn("configured backend is not in backendAllowlist and will not be dialed",
+					"backend", backend.hostAndPort,
+				)
+			}
+		}
+	}
+
+	if *backendDialTimeout <= 0 {
+		fatal(exitCodeConfig, "backendDialTimeout must be positive")
+	}
+
+	if *fallbackTcpHostAndPort != "" {
+		var err error
+		fallbackBackend, err = parseBackend(*fallbackTcpHostAndPort)
+		if err != nil {
+			fatal(exitCodeBackend, "invalid fallbackTcpHostAndPort: %w", err)
+		}
+	}
+
+	if *sshJumpHost != "" {
+		var err error
+		backendSSHDialer, err = newSSHDialerFromFlags()
+		if err != nil {
+			fatal(exitCodeConfig, "newSSHDialerFromFlags error: %w", err)
+		}
+	}
+
+	if *backendURL != "" {
+		if !strings.HasPrefix(*backendURL, "ws://") && !strings.HasPrefix(*backendURL, "wss://") {
+			fatal(exitCodeConfig, "backendURL must be a ws:// or wss:// url: %q", *backendURL)
+		}
+
+		u, err := url.Parse(*backendURL)
+		if err != nil {
+			fatal(exitCodeConfig, "backendURL parse error: %w", err)
+		}
+		websocketBackendLabel = u.Host
+
+		if *backendURLReadLimit <= 0 {
+			fatal(exitCodeConfig, "backendURLReadLimit must be positive")
+		}
+	}
+
+	strategy, err := parseLoadBalanceStrategy(*loadBalanceStrategyName)
+	if err != nil {
+		fatal(exitCodeConfig, "parseLoadBalanceStrategy error: %w", err)
+	}
+	backendLoadBalanceStrategy = strategy
+
+	if *tenantFile != "" {
+		if *backendURL != "" {
+			fatal(exitCodeConfig, "tenantFile is not supported with backendURL")
+		}
+
+		var err error
+		tenantsByTokenHash, err = loadTenantFile(*tenantFile)
+		if err != nil {
+			fatal(exitCodeConfig, "loadTenantFile error: %w", err)
+		}
+
+		slog.Info("loaded tenantFile",
+			"tenants", len(tenantsByTokenHash),
+		)
+	}
+
+	if *authToken != "" || *authTokenFile != "" || *jwtSigningKeyFile != "" {
+		if *tenantFile != "" {
+			fatal(exitCodeConfig, "authToken, authTokenFile, and jwtSigningKeyFile are not supported with tenantFile")
+		}
+
+		if err := loadAuthTokens(*authToken, *authTokenFile); err != nil {
+			fatal(exitCodeConfig, "loadAuthTokens error: %w", err)
+		}
+
+		if *jwtSigningKeyFile != "" {
+			var err error
+			jwtSigningKey, err = loadJWTSigningKey(*jwtSigningKeyFile)
+			if err != nil {
+				fatal(exitCodeConfig, "loadJWTSigningKey error: %w", err)
+			}
+		}
+
+		slog.Info("bearer token authentication enabled",
+			"staticTokens", len(authTokenHashes),
+			"jwt", jwtSigningKey != nil,
+			"jwtIssuer", *jwtIssuer,
+		)
+	}
+
+	if *readyzCheckBackends && *backendURL != "" {
+		fatal(exitCodeConfig, "readyzCheckBackends is not supported with backendURL")
+	}
+
+	if *jwtIssuer != "" && *jwtSigningKeyFile == "" {
+		fatal(exitCodeConfig, "jwtIssuer requires jwtSigningKeyFile")
+	}
+
+	if *dnsServer != "" {
+		var err error
+		backendResolver, err = newDNSServerResolver(*dnsServer)
+		if err != nil {
+			fatal(exitCodeConfig, "newDNSServerResolver error: %w", err)
+		}
+	}
+
+	if *backendCAFile != "" || *backendClientCertFile != "" || *backendClientKeyFile != "" {
+		if !*backendTLS && !*backendTLSFromClient && !strings.HasPrefix(*backendURL, "wss://") {
+			fatal(exitCodeConfig, "backendCAFile, backendClientCertFile, and backendClientKeyFile require backendTLS, backendTLSFromClient, or a wss:// backendURL")
+		}
+
+		var err error
+		backendTLSConfig, err = newBackendTLSConfig(*backendCAFile, *backendClientCertFile, *backendClientKeyFile)
+		if err != nil {
+			fatal(exitCodeTLS, "newBackendTLSConfig error: %w", err)
+		}
+	}
+
+	if *backendSourceIP != "" {
+		if *sshJumpHost != "" {
+			fatal(exitCodeConfig, "backendSourceIP is not supported with sshJumpHost")
+		}
+
+		var err error
+		backendSourceAddr, err = parseBackendSourceIP(*backendSourceIP)
+		if err != nil {
+			fatal(exitCodeConfig, "parseBackendSourceIP error: %w", err)
+		}
+	}
+
+	if network, err := parseIPFamily(*backendIPFamily); err != nil {
+		fatal(exitCodeConfig, "parseIPFamily error: %w", err)
+	} else {
+		backendTCPNetwork = network
+	}
+	if *backendKeepAliveCount < 0 {
+		fatal(exitCodeConfig, "backendKeepAliveCount must not be negative: %v", *backendKeepAliveCount)
+	}
+
+	if *backendURL != "" {
+		websocketBackendHTTPClient = newWebsocketBackendHTTPClient()
+	}
+
+	slog.Info("backends",
+		"backends", backends.Load().hostAndPorts(),
+		"loadBalanceStrategy", backendLoadBalanceStrategy,
+		"backendURL", *backendURL,
+		"dnsServer", *dnsServer,
+		"fallbackTcpHostAndPort", *fallbackTcpHostAndPort,
+		"sshJumpHost", *sshJumpHost,
+		"echoBackend", *echoBackend,
+		"backendSourceIP", *backendSourceIP,
+		"backendIPFamily", *backendIPFamily,
+	)
+
+	if *echoBackend {
+		slog.Warn("echoBackend enabled, proxying to an in-process echo instead of the backends")
+	}
+
+	parseRedactHeaders()
+	parseRequiredHeaders()
+
+	websocketAcceptOptions, err = newWebsocketAcceptOptions()
+	if err != nil {
+		fatal(exitCodeConfig, "newWebsocketAcceptOptions error: %w", err)
+	}
+
+	setupGlobalBandwidthLimits()
+
+	switch *backendProtocol {
+	case backendProtocolTCP:
+	case backendProtocolUDP:
+		if *backendURL != "" || *muxMode || *sshJumpHost != "" || *backendTLS || *sendProxyProtocol != "" || *sendMetadata != "" || *backendPoolSize > 0 || *lazyBackendDial || *echoBackend || *waitForBackend || *readyzCheckBackends {
+			fatal(exitCodeConfig, "backendProtocol udp is not supported with backendURL, mux, sshJumpHost, backendTLS, sendProxyProtocol, sendMetadata, backendPoolSize, lazyBackendDial, echoBackend, waitForBackend, or readyzCheckBackends")
+		}
+		if *udpIdleTimeout <= 0 {
+			fatal(exitCodeConfig, "udpIdleTimeout must be positive")
+		}
+	default:
+		fatal(exitCodeConfig, "invalid backendProtocol %q, expected tcp or udp", *backendProtocol)
+	}
+
+	if *muxMode && *backendURL != "" {
+		fatal(exitCodeConfig, "mux is not supported with backendURL")
+	}
+
+	if labelNames, err := parseMetricLabels(*metricLabels); err != nil {
+		fatal(exitCodeConfig, "parseMetricLabels error: %w", err)
+	} else if len(labelNames) > 0 {
+		setupMetricLabels(labelNames)
+	}
+
+	if *wsReadBufferSize <= 0 || *wsWriteBufferSize <= 0 {
+		fatal(exitCodeConfig, "wsReadBufferSize and wsWriteBufferSize must be positive")
+	}
+	wsReadBufferPool = newBufferPool(*wsReadBufferSize)
+	wsWriteBufferPool = newBufferPool(*wsWriteBufferSize)
+
+	if err := validateTeeFlags(); err != nil {
+		fatal(exitCodeConfig, "validateTeeFlags error: %w", err)
+	}
+
+	if *tee != teeNone && *teeDropOnBlock {
+		go logTeeDrops(context.Background(), *teeDropLogInterval)
+	}
+
+	if *diagMirrorTarget != "" && *diagMirrorBytes <= 0 {
+		fatal(exitCodeConfig, "diagMirrorBytes must be positive")
+	}
+
+	if err := parseProbeFlags(); err != nil {
+		fatal(exitCodeConfig, "parseProbeFlags error: %w", err)
+	}
+
+	if *lazyBackendDial && *lazyDialMaxBuffer <= 0 {
+		fatal(exitCodeConfig, "lazyDialMaxBuffer must be positive")
+	}
+
+	if *backendReconnectOnReset && *maxBackendReconnects <= 0 {
+		fatal(exitCodeConfig, "maxBackendReconnects must be positive")
+	}
+
+	if *pingInterval > 0 && *maxMissedPongs <= 0 {
+		fatal(exitCodeConfig, "maxMissedPongs must be positive")
+	}
+
+	if *pongTimeout < 0 || *pongTimeout > *pingInterval {
+		fatal(exitCodeConfig, "pongTimeout must be between 0 and pingInterval")
+	}
+
+	parsePriorityFlags()
+
+	messageType, err := parseMessageType("maintenanceMessageType", *maintenanceMessageType)
+	if err != nil {
+		fatal(exitCodeConfig, "parseMessageType error: %w", err)
+	}
+	maintenanceWebsocketMessageType = messageType
+	maintenanceActive.Store(*maintenanceMode)
+
+	if *maxConnections > 0 {
+		budget, err := newConnectionBudget(*maxConnections, *highPriorityReservedConnections)
+		if err != nil {
+			fatal(exitCodeConfig, "newConnectionBudget error: %w", err)
+		}
+		connectionsBudget = budget
+	} else if *highPriorityReservedConnections > 0 {
+		fatal(exitCodeConfig, "highPriorityReservedConnections requires maxConnections")
+	}
+
+	if *maxGoroutines > 0 || *maxOpenFDs > 0 {
+		if _, ok := openFDCount(); *maxOpenFDs > 0 && !ok {
+			slog.Warn("maxOpenFDs is not supported on this platform, ignoring")
+		}
+		connectionLoadShedder = newResourceLoadShedder(*maxGoroutines, *maxOpenFDs)
+	}
+
+	if *maxConcurrentHandshakes > 0 {
+		handshakeSemaphore = newSemaphore(*maxConcurrentHandshakes)
+	}
+
+	if *maxConcurrentDials > 0 {
+		if *dialQueueLogInterval <= 0 {
+			fatal(exitCodeConfig, "dialQueueLogInterval must be positive")
+		}
+		backendDialLimiter = newDialLimiter(*maxConcurrentDials, *maxDialQueue)
+		go backendDialLimiter.logDialQueue(context.Background(), *dialQueueLogInterval)
+	}
+
+	if err := parseProxyProtocolVersion(*sendProxyProtocol); err != nil {
+		fatal(exitCodeConfig, "parseProxyProtocolVersion error: %w", err)
+	}
+	if *sendProxyProtocol != "" && (*backendURL != "" || *backendPoolSize > 0) {
+		fatal(exitCodeConfig, "sendProxyProtocol is not supported with backendURL or backendPoolSize, whose backend connections are not dialed per client")
+	}
+
+	if err := parseSendMetadata(); err != nil {
+		fatal(exitCodeConfig, "parseSendMetadata error: %w", err)
+	}
+	if *sendMetadata != "" && (*backendURL != "" || *backendPoolSize > 0) {
+		fatal(exitCodeConfig, "sendMetadata is not supported with backendURL or backendPoolSize, whose backend connections are not dialed per client")
+	}
+
+	if *backendPoolSize > 0 {
+		if *backendURL != "" || tenantsByTokenHash != nil {
+			fatal(exitCodeConfig, "backendPoolSize is not supported with backendURL or tenantFile")
+		}
+		startBackendConnPools(backends.Load(), *backendPoolSize, *poolKeepAliveInterval)
+	}
+
+	if *maxNewConnectionsPerSec > 0 {
+		newConnectionLimiter = newTokenBucket(
+			*maxNewConnectionsPerSec,
+			math.Max(1, math.Ceil(*maxNewConnectionsPerSec)),
+		)
+	}
+
+	if *maxUpgradesPerMinutePerIP > 0 {
+		if *upgradeRateLimitMaxIPs <= 0 {
+			fatal(exitCodeConfig, "upgradeRateLimitMaxIPs must be positive")
+		}
+		upgradeRateLimiter = newClientIPRateLimiter(*maxUpgradesPerMinutePerIP, *upgradeRateLimitMaxIPs)
+	}
+
+	if *maxDialRetriesPerSec > 0 {
+		dialRetryLimiter = newTokenBucket(
+			*maxDialRetriesPerSec,
+			math.Max(1, math.Ceil(*maxDialRetriesPerSec)),
+		)
+	}
+
+	if *backendTCPUserTimeout > 0 && !tcpUserTimeoutSupported {
+		slog.Warn("backendTCPUserTimeout is not supported on this platform, ignoring")
+	}
+
+	if *diagInterval > 0 {
+		go runDiagTicker(context.Background(), *diagInterval)
+	}
+
+	httpServer := &http.Server{
+		Handler:      websocketServerHandlerFunc(),
+		IdleTimeout:  5 * time.Minute,
+		ReadTimeout:  1 * time.Minute,
+		WriteTimeout: 1 * time.Minute,
+	}
+
+	if *clientSendBuffer > 0 || *clientRecvBuffer > 0 {
+		httpServer.ConnContext = func(ctx context.Context, conn net.Conn) context.Context {
+			setSocketBuffers(conn, *clientSendBuffer, *clientRecvBuffer, slog.Default())
+			return ctx
+		}
+	}
+
+	if *backendSendBuffer > 0 || *backendRecvBuffer > 0 || *clientSendBuffer > 0 || *clientRecvBuffer > 0 {
+		slog.Info("socket buffer sizes",
+			"backendSendBuffer", *backendSendBuffer,
+			"backendRecvBuffer", *backendRecvBuffer,
+			"clientSendBuffer", *clientSendBuffer,
+			"clientRecvBuffer", *clientRecvBuffer,
+		)
+	}
+
+	if *auditSinkURL != "" {
+		connectionAuditSink = newAuditSink(*auditSinkURL, *auditSinkMaxBuffered)
+		go connectionAuditSink.run(context.Background(), *auditSinkFlushInterval)
+	}
+
+	if tracesURL := otlpTracesURL(); tracesURL != "" {
+		spanExporter = newTraceExporter(tracesURL, *otlpTracesMaxBuffered)
+		onShutdown(func() {
+			spanExporter.flush(context.Background())
+		})
+		go spanExporter.run(context.Background(), *otlpTracesFlushInterval)
+
+		slog.Info("otlp tracing enabled",
+			"otlpTracesEndpoint", tracesURL,
+			"serviceName", spanExporter.serviceName,
+		)
+	}
+
+	if *eventLogFile != "" {
+		var err error
+		connectionEventLog, err = openEventLog(*eventLogFile, *eventLogCompress)
+		if err != nil {
+			fatal(exitCodeConfig, "openEventLog error: %w", err)
+		}
+		onShutdown(connectionEventLog.close)
+		go connectionEventLog.run(context.Background(), *eventLogFlushInterval)
+	}
+
+	if *accessLogFile != "" {
+		var err error
+		connectionAccessLog, err = openAccessLog(*accessLogFile, *accessLogFormat)
+		if err != nil {
+			fatal(exitCodeConfig, "openAccessLog error: %w", err)
+		}
+		onShutdown(connectionAccessLog.close)
+	}
+
+	closeOnShutdown(httpServer)
+	exitOnShutdownSignal()
+
+	if *maxUptime > 0 {
+		shutdownAfterMaxUptime(*maxUptime)
+	}
+
+	if *statsdAddr != "" {
+		if *statsdFlushInterval <= 0 {
+			fatal(exitCodeConfig, "statsdFlushInterval must be positive")
+		}
+
+		var err error
+		metricsStatsdSender, err = newStatsdSender(*statsdAddr)
+		if err != nil {
+			fatal(exitCodeConfig, "newStatsdSender error: %w", err)
+		}
+		go metricsStatsdSender.run(context.Background(), *statsdFlushInterval)
+	}
+
+	if *waitForBackend {
+		if err := waitForBackends(*waitForBackendTimeout); err != nil {
+			fatal(exitCodeBackend, "waitForBackends error: %w", err)
+		}
+	}
+
+	if *selfTest {
+		runSelfTest(httpServer.Handler)
+		return
+	}
+
+	inheritedListeners, err := systemdListeners()
+	if err != nil {
+		fatal(exitCodeListen, "systemdListeners error: %w", err)
+	}
+
+	var plaintextListeners, tlsListeners []net.Listener
+	var managementListener net.Listener
+
+	if len(inheritedListeners) > 0 {
+		for _, inherited := range inheritedListeners {
+			slog.Info("inherited systemd listen socket",
+				"name", inherited.name,
+				"addr", inherited.listener.Addr().String(),
+			)
+
+			switch inherited.name {
+			case systemdSocketNameTLS:
+				tlsListeners = append(tlsListeners, inherited.listener)
+			case systemdSocketNameManagement:
+				if managementListener != nil {
+					fatal(exitCodeConfig, "more than one systemd listen socket named %q", systemdSocketNameManagement)
+				}
+				managementListener = inherited.listener
+			default:
+				plaintextListeners = append(plaintextListeners, inherited.listener)
+			}
+		}
+	} else {
+		for _, address := range splitCommaList(*listenHostAndPort) {
+			listener, err := listenNetwork(address)
+			if err != nil {
+				fatal(exitCodeListen, "listenNetwork error: %w", err)
+			}
+			plaintextListeners = append(plaintextListeners, listener)
+		}
+
+		for _, address := range splitCommaList(*tlsListenHostAndPort) {
+			listener, err := listenNetwork(address)
+			if err != nil {
+				fatal(exitCodeListen, "listenNetwork error: %w", err)
+			}
+			tlsListeners = append(tlsListeners, listener)
+		}
+	}
+
+	if managementListener == nil && *managementListenHostAndPort != "" {
+		managementListener, err = listenNetwork(*managementListenHostAndPort)
+		if err != nil {
+			fatal(exitCodeListen, "management listenNetwork error: %w", err)
+		}
+	}
+
+	if managementListener != nil {
+		startManagementServer(managementListener)
+	}
+
+	tlsEnabled := *tlsCertFile != "" || *tlsKeyFile != "" || *acmeDomains != ""
+
+	// without listeners marked for tls, tls applies to every listener as before
+	if tlsEnabled && len(tlsListeners) == 0 {
+		tlsListeners, plaintextListeners = plaintextListeners, nil
+	}
+
+	if len(tlsListeners) > 0 && !tlsEnabled {
+		fatal(exitCodeConfig, "tls listeners require tlsCertFile and tlsKeyFile, or acmeDomains")
+	}
+
+	if len(plaintextListeners) == 0 && len(tlsListeners) == 0 {
+		fatal(exitCodeConfig, "no listeners, listenHostAndPort is empty")
+	}
+
+	if *reusePort {
+		if !reusePortSupported {
+			fatal(exitCodeConfig, "reusePort is not supported on this platform")
+		}
+		closeOnShutdownStart(plaintextListeners...)
+		closeOnShutdownStart(tlsListeners...)
+	}
+
+	if *acceptProxyProtocol {
+		for _, listeners := range [][]net.Listener{plaintextListeners, tlsListeners} {
+			for i, listener := range listeners {
+				listeners[i] = &proxyProtocolListener{
+					Listener:      listener,
+					headerTimeout: *proxyProtocolHeaderTimeout,
+				}
+			}
+		}
+	}
+
+	if *acmeDomains != "" {
+		if *tlsCertFile != "" || *tlsKeyFile != "" {
+			fatal(exitCodeConfig, "acmeDomains is not supported with tlsCertFile and tlsKeyFile")
+		}
+
+		manager, err := newACMEManager()
+		if err != nil {
+			fatal(exitCodeConfig, "newACMEManager error: %w", err)
+		}
+
+		if *acmeHTTPListenHostAndPort != "" {
+			challengeListener, err := listenNetwork(*acmeHTTPListenHostAndPort)
+			if err != nil {
+				fatal(exitCodeListen, "acme listenNetwork error: %w", err)
+			}
+			startACMEChallengeServer(challengeListener, manager)
+		}
+
+		httpServer.TLSConfig = acmeTLSConfig(manager)
+	} else if tlsEnabled {
+		if *tlsCertFile == "" || *tlsKeyFile == "" {
+			fatal(exitCodeConfig, "tlsCertFile and tlsKeyFile must be set together")
+		}
+
+		certReloader, err := newCertReloader(*tlsCertFile, *tlsKeyFile)
+		if err != nil {
+			fatal(exitCodeTLS, "newCertReloader error: %w", err)
+		}
+
+		go certReloader.run(context.Background(), *tlsCertPollInterval)
+
+		httpServer.TLSConfig = &tls.Config{
+			GetCertificate: certReloader.getCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	serveErrors := make(chan error, len(plaintextListeners)+len(tlsListeners))
+
+	for _, listener := range plaintextListeners {
+		slog.Info("starting http server",
+			"listenAddr", listener.Addr().String(),
+		)
+
+		go func() {
+			serveErrors <- fmt.Errorf("httpServer.Serve error: %w", httpServer.Serve(listener))
+		}()
+	}
+
+	for _, listener := range tlsListeners {
+		slog.Info("starting https server",
+			"listenAddr", listener.Addr().String(),
+		)
+
+		go func() {
+			serveErrors <- fmt.Errorf("httpServer.ServeTLS error: %w", httpServer.ServeTLS(listener, "", ""))
+		}()
+	}
+
+	// every listener is served until shutdown, so the first error ends the process
+	err = <-serveErrors
+	if errors.Is(err, http.ErrServerClosed) || shuttingDown.Load() {
+		waitForShutdownExit()
+	}
+	panic(err)
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// how long a maintenance message may take to send
+const maintenanceWriteTimeout = 5 * time.Second
+
+// set while in maintenance mode, from maintenanceMode and the admin endpoints
+var maintenanceActive atomic.Bool
+
+// message type of maintenanceMessage, parsed from maintenanceMessageType
+var maintenanceWebsocketMessageType = websocket.MessageText
+
+// setMaintenance enters or leaves maintenance mode, returning false if it
+// was already in that state.
+func setMaintenance(active bool) bool {
+	if !maintenanceActive.CompareAndSwap(!active, active) {
+		return false
+	}
+
+	slog.Info("maintenance mode changed",
+		"maintenance", active,
+	)
+
+	return true
+}
+
+// serveMaintenance accepts the websocket, sends maintenanceMessage as one
+// message, and closes with status 1013, without dialing a backend.
+func serveMaintenance(
+	w http.ResponseWriter,
+	r *http.Request,
+	txLogger *slog.Logger,
+) {
+
+	websocketConn, err := websocket.Accept(w, r, websocketAcceptOptions)
+	if err != nil {
+		txLogger.Warn("websocket.Accept error",
+			"error", err,
+		)
+		return
+	}
+	defer websocketConn.CloseNow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceWriteTimeout)
+	defer cancel()
+
+	if err := websocketConn.Write(ctx, maintenanceWebsocketMessageType, []byte(*maintenanceMessage)); err != nil {
+		txLogger.Warn("maintenance message write error",
+			"error", err,
+		)
+		return
+	}
+
+	websocketConn.Close(websocket.StatusTryAgainLater, "maintenance")
+
+	txLogger.Info("maintenance response sent")
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// backendStatus describes a backend for /admin/backends.
+type backendStatus struct {
+	HostAndPort       string `json:"hostAndPort"`
+	Weight            int    `json:"weight"`
+	MaxConnections    int    `json:"maxConnections"`
+	ActiveConnections int64  `json:"activeConnections"`
+	Selections        uint64 `json:"selections"`
+	Unhealthy         bool   `json:"unhealthy"`
+}
+
+// drainStatus describes draining for /admin/drain/status.
+type drainStatus struct {
+	Draining          bool    `json:"draining"`
+	ShuttingDown      bool    `json:"shuttingDown"`
+	ActiveConnections int64   `json:"activeConnections"`
+	DrainingSeconds   float64 `json:"drainingSeconds"`
+}
+
+// configFlag describes a flag for /admin/config.
+type configFlag struct {
+	Value    string `json:"value"`
+	Default  string `json:"default"`
+	Set      bool   `json:"set"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// flags whose values /admin/config redacts: credentials, private key
+// locations, urls that may carry credentials, and header values that may
+// be shared secrets
+var sensitiveConfigFlags = map[string]bool{
+	"auditSink":            true,
+	"authToken":            true,
+	"backendClientKeyFile": true,
+	"backendURL":           true,
+	"connectURL":           true,
+	"highPriorityHeader":   true,
+	"jwtSigningKeyFile":    true,
+	"otlpTracesEndpoint":   true,
+	"requiredHeaders":      true,
+	"sshKeyFile":           true,
+	"tlsKeyFile":           true,
+}
+
+func healthzHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func adminBackendsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	backendStatuses := []backendStatus{}
+
+	for _, backend := range backends.Load().backends {
+		backendStatuses = append(backendStatuses, backendStatus{
+			HostAndPort:       backend.hostAndPort,
+			Weight:            backend.weight,
+			MaxConnections:    backend.maxConnections,
+			ActiveConnections: backend.activeConnections.Load(),
+			Selections:        backend.selections.Load(),
+			Unhealthy:         backend.unhealthy(time.Now()),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(backendStatuses)
+}
+
+// adminPauseHandler holds new connections before they dial a backend
+// for the duration query parameter.
+func adminPauseHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || duration <= 0 {
+		http.Error(w, "duration must be a positive duration such as 10s", http.StatusBadRequest)
+		return
+	}
+
+	backendDialPause.pause(duration)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "paused for %v\n", duration)
+}
+
+// adminResumeHandler ends a pause early.
+func adminResumeHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !backendDialPause.resume() {
+		w.Write([]byte("not paused\n"))
+		return
+	}
+
+	w.Write([]byte("resumed\n"))
+}
+
+// adminReloadHandler reloads the config file's routes, answering 500 with
+// the error and keeping the current routes if it fails to load.
+func adminReloadHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if *routeConfigFile == "" {
+		http.Error(w, "config is not set", http.StatusNotFound)
+		return
+	}
+
+	if err := reloadRouteConfig(*routeConfigFile, "admin"); err != nil {
+		http.Error(w, fmt.Sprintf("reload failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte("reloaded\n"))
+}
+
+// adminDrainHandler starts rejecting new connections while active ones finish.
+func adminDrainHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !startDraining() {
+		w.Write([]byte("already draining\n"))
+		return
+	}
+
+	w.Write([]byte("draining\n"))
+}
+
+// adminDrainCancelHandler accepts new connections again, unless shutting down.
+func adminDrainCancelHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	if shuttingDown.Load() {
+		http.Error(w, "shutting down", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !cancelDraining() {
+		w.Write([]byte("not draining\n"))
+		return
+	}
+
+	w.Write([]byte("drain canceled\n"))
+}
+
+// adminMaintenanceHandler answers new connections with maintenanceMessage.
+func adminMaintenanceHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !setMaintenance(true) {
+		w.Write([]byte("already in maintenance\n"))
+		return
+	}
+
+	w.Write([]byte("maintenance started\n"))
+}
+
+// adminMaintenanceEndHandler proxies new connections again.
+func adminMaintenanceEndHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !setMaintenance(false) {
+		w.Write([]byte("not in maintenance\n"))
+		return
+	}
+
+	w.Write([]byte("maintenance ended\n"))
+}
+
+// adminDrainStatusHandler reports the progress of draining, so deployment
+// automation can poll for when the process is safe to stop.
+func adminDrainStatusHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	status := drainStatus{
+		ShuttingDown:      shuttingDown.Load(),
+		ActiveConnections: activeConnections.Load(),
+	}
+
+	if startTime, ok := drainingSince(); ok {
+		status.Draining = true
+		status.DrainingSeconds = time.Since(startTime).Seconds()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// adminConfigHandler returns the value in effect of every flag, with
+// sensitiveConfigFlags redacted, and whether it was set on the command line.
+func adminConfigHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+
+	configFlags := make(map[string]configFlag)
+	flag.VisitAll(func(f *flag.Flag) {
+		cf := configFlag{
+			Value:   f.Value.String(),
+			Default: f.DefValue,
+			Set:     setFlags[f.Name],
+		}
+
+		if sensitiveConfigFlags[f.Name] && cf.Value != "" {
+			cf.Value = redactedHeaderValue
+			cf.Redacted = true
+		}
+
+		configFlags[f.Name] = cf
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		ReleaseTag string                `json:"releaseTag"`
+		Flags      map[string]configFlag `json:"flags"`
+	}{
+		ReleaseTag: releaseTag,
+		Flags:      configFlags,
+	})
+}
+
+// newManagementServeMux routes the enabled management endpoints.
+func newManagementServeMux() *http.ServeMux {
+	serveMux := http.NewServeMux()
+
+	if *managementMetrics {
+		serveMux.HandleFunc("GET /metrics", metricsHandler)
+	}
+
+	if *managementHealthz {
+		serveMux.HandleFunc("GET /healthz", healthzHandler)
+	}
+
+	if *managementReadyz {
+		serveMux.HandleFunc("GET /readyz", readyzHandler)
+	}
+
+	if *managementAdmin {
+		serveMux.HandleFunc("GET /admin/backends", adminBackendsHandler)
+		serveMux.HandleFunc("GET /admin/config", adminConfigHandler)
+		serveMux.HandleFunc("GET /admin/connections", adminConnectionsHandler)
+		serveMux.HandleFunc("DELETE /admin/connections/{txID}", adminTerminateConnectionHandler)
+		serveMux.HandleFunc("GET /admin/forwards", adminForwardsHandler)
+		serveMux.HandleFunc("GET /admin/offenders", adminOffendersHandler)
+		serveMux.HandleFunc("POST /admin/pause", adminPauseHandler)
+		serveMux.HandleFunc("POST /admin/resume", adminResumeHandler)
+		serveMux.HandleFunc("POST /admin/drain", adminDrainHandler)
+		serveMux.HandleFunc("POST /admin/drain/cancel", adminDrainCancelHandler)
+		serveMux.HandleFunc("GET /admin/drain/status", adminDrainStatusHandler)
+		serveMux.HandleFunc("POST /admin/maintenance", adminMaintenanceHandler)
+		serveMux.HandleFunc("POST /admin/maintenance/end", adminMaintenanceEndHandler)
+		serveMux.HandleFunc("POST /admin/reload", adminReloadHandler)
+	}
+
+	if *managementPprof {
+		serveMux.HandleFunc("/debug/pprof/", pprof.Index)
+		serveMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		serveMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		serveMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		serveMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		serveMux.HandleFunc("GET /debug/vars", debugVarsHandler)
+		serveMux.HandleFunc("GET /debug/buildinfo", debugBuildInfoHandler)
+	}
+
+	return serveMux
+}
+
+// startManagementServer serves the management endpoints on listener in the
+// background, isolated from the proxy listeners.
+func startManagementServer(listener net.Listener) {
+	managementServer := &http.Server{
+		Handler:     newManagementServeMux(),
+		IdleTimeout: 5 * time.Minute,
+		ReadTimeout: 1 * time.Minute,
+	}
+
+	slog.Info("starting management server",
+		"managementListenAddr", listener.Addr().String(),
+		"metrics", *managementMetrics,
+		"healthz", *managementHealthz,
+		"readyz", *managementReadyz,
+		"admin", *managementAdmin,
+		"pprof", *managementPprof,
+	)
+
+	closeOnShutdown(managementServer)
+
+	go func() {
+		err := managementServer.Serve(listener)
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		slog.Error("managementServer.Serve error",
+			"error", err,
+		)
+	}()
+}
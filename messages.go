@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+
+	"github.com/coder/websocket"
+)
+
+// previewCapture keeps the first len(buf) bytes written to it.
+type previewCapture struct {
+	buf []byte
+	n   int
+}
+
+func newPreviewCapture(size int) *previewCapture {
+	return &previewCapture{
+		buf: make([]byte, size),
+	}
+}
+
+func (pc *previewCapture) Write(p []byte) (int, error) {
+	pc.n += copy(pc.buf[pc.n:], p)
+	return len(p), nil
+}
+
+func (pc *previewCapture) reset() {
+	pc.n = 0
+}
+
+func (pc *previewCapture) hex() string {
+	return hex.EncodeToString(pc.buf[:pc.n])
+}
+
+func logMessage(
+	txLogger *slog.Logger,
+	direction string,
+	messageType websocket.MessageType,
+	size int64,
+	preview *previewCapture,
+) {
+
+	logAttrs := []any{
+		"direction", direction,
+		"size", size,
+		"type", messageType.String(),
+	}
+
+	if preview != nil {
+		logAttrs = append(logAttrs, "preview", preview.hex())
+	}
+
+	txLogger.Debug("websocket message", logAttrs...)
+}
+
+// proxyMessagesWsToTcp reads discrete websocket messages and copies each to tcpConn
+// through buf, logging every message.
+func proxyMessagesWsToTcp(
+	ctx context.Context,
+	clientReader *clientMessageReader,
+	tcpConn io.Writer,
+	buf []byte,
+	txLogger *slog.Logger,
+) (written int64, err error) {
+
+	var preview *previewCapture
+	if *logMessagePreviewBytes > 0 {
+		preview = newPreviewCapture(*logMessagePreviewBytes)
+	}
+
+	for {
+		messageType, reader, err := clientReader.nextMessage(ctx)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+
+		if preview != nil {
+			preview.reset()
+			reader = io.TeeReader(reader, preview)
+		}
+
+		n, err := io.CopyBuffer(tcpConn, reader, buf)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		logMessage(txLogger, "wsToTcp", messageType, n, preview)
+	}
+}
+
+// proxyMessagesTcpToWs sends each read from tcpReader into buf as one
+// websocket message of messageType through wsWriter, which must send each
+// Write as one message, logging every message.
+func proxyMessagesTcpToWs(
+	tcpReader io.Reader,
+	wsWriter io.Writer,
+	messageType websocket.MessageType,
+	buf []byte,
+	txLogger *slog.Logger,
+) (written int64, err error) {
+
+	var preview *previewCapture
+	if *logMessagePreviewBytes > 0 {
+		preview = newPreviewCapture(*logMessagePreviewBytes)
+	}
+
+	for {
+		n, readErr := tcpReader.Read(buf)
+		if n > 0 {
+			if _, err := wsWriter.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+
+			if preview != nil {
+				preview.reset()
+				preview.Write(buf[:n])
+			}
+
+			logMessage(txLogger, "tcpToWs", messageType, int64(n), preview)
+		}
+		if errors.Is(readErr, io.EOF) {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
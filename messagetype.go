@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+)
+
+// message type of data sent to clients and expected from them, parsed from
+// messageType, overridden per route by the config file
+var proxyMessageType = websocket.MessageBinary
+
+// parseMessageType parses the text or binary value of the flag or config
+// field name.
+func parseMessageType(
+	name string,
+	s string,
+) (websocket.MessageType, error) {
+
+	switch s {
+	case "text":
+		return websocket.MessageText, nil
+	case "binary":
+		return websocket.MessageBinary, nil
+	}
+	return 0, fmt.Errorf("invalid %v %q, expected text or binary", name, s)
+}
+
+// utf8BoundaryWriter holds back a utf-8 sequence split across the end of a
+// Write until the next Write completes it, so a writer sending each Write as
+// one text message never splits a character across messages. Bytes that are
+// not utf-8 are passed through.
+type utf8BoundaryWriter struct {
+	writer io.Writer
+
+	pending    [utf8.UTFMax]byte
+	pendingLen int
+}
+
+func (ubw *utf8BoundaryWriter) Write(p []byte) (int, error) {
+	data := p
+	if ubw.pendingLen > 0 {
+		data = make([]byte, 0, ubw.pendingLen+len(p))
+		data = append(data, ubw.pending[:ubw.pendingLen]...)
+		data = append(data, p...)
+		ubw.pendingLen = 0
+	}
+
+	complete := len(data) - incompleteUTF8SuffixLen(data)
+	ubw.pendingLen = copy(ubw.pending[:], data[complete:])
+
+	if complete > 0 {
+		if _, err := ubw.writer.Write(data[:complete]); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// incompleteUTF8SuffixLen returns the length of the start of a utf-8 sequence
+// at the end of data that needs more bytes, 0 if there is none.
+func incompleteUTF8SuffixLen(data []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if utf8.FullRune(data[len(data)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const backendMetadataJSON = "json"
+
+// canonical names of the sendMetadataHeaders request headers
+var metadataHeaderNames []string
+
+// parseSendMetadata validates sendMetadata and parses sendMetadataHeaders.
+func parseSendMetadata() error {
+	switch *sendMetadata {
+	case "", backendMetadataJSON:
+	default:
+		return fmt.Errorf("unknown sendMetadata %q, expected json", *sendMetadata)
+	}
+
+	for _, name := range splitCommaList(*sendMetadataHeaders) {
+		metadataHeaderNames = append(metadataHeaderNames, http.CanonicalHeaderKey(name))
+	}
+
+	if len(metadataHeaderNames) > 0 && *sendMetadata == "" {
+		return errors.New("sendMetadataHeaders requires sendMetadata")
+	}
+
+	return nil
+}
+
+// backendMetadata describes the client of a backend connection,
+// sent as a json line before any client bytes.
+type backendMetadata struct {
+	TxID     string            `json:"txID"`
+	ClientIP string            `json:"clientIP"`
+	Path     string            `json:"path"`
+	TLS      bool              `json:"tls"`
+	User     string            `json:"user,omitempty"`
+	Tenant   string            `json:"tenant,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+}
+
+// backendMetadataLine returns the sendMetadata line for a connection of r,
+// nil if sendMetadata is unset. user is the sub claim of a jwt the client
+// authenticated with. Headers of sendMetadataHeaders that r does not have
+// are left out, and repeated ones joined with commas.
+func backendMetadataLine(
+	r *http.Request,
+	txID string,
+	clientIPAddress string,
+	clientTenant *tenant,
+	user string,
+) []byte {
+
+	if *sendMetadata == "" {
+		return nil
+	}
+
+	metadata := backendMetadata{
+		TxID:     txID,
+		ClientIP: clientIPAddress,
+		Path:     r.URL.Path,
+		TLS:      r.TLS != nil,
+		User:     user,
+	}
+	if clientTenant != nil {
+		metadata.Tenant = clientTenant.name
+	}
+
+	for _, name := range metadataHeaderNames {
+		if values := r.Header.Values(name); len(values) > 0 {
+			if metadata.Headers == nil {
+				metadata.Headers = make(map[string]string)
+			}
+			metadata.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	// json.Marshal escapes newlines within strings, so the line cannot end early
+	line, _ := json.Marshal(metadata)
+
+	return append(line, '\n')
+}
+
+// writeBackendMetadata writes metadata on a dialed backend conn, after any
+// PROXY protocol header and tls handshake, within backendDialTimeout,
+// closing conn on error.
+func writeBackendMetadata(
+	conn net.Conn,
+	metadata []byte,
+) error {
+
+	conn.SetWriteDeadline(time.Now().Add(*backendDialTimeout))
+
+	if _, err := conn.Write(metadata); err != nil {
+		conn.Close()
+		return fmt.Errorf("backend metadata write error: %w", err)
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// maximum label value combinations kept by each labeledVec, beyond which new
+// combinations are counted under otherLabelValue so a label whose values come
+// from clients cannot grow the metrics without bound
+const maxMetricLabelSets = 100
+
+const otherLabelValue = "other"
+
+// metricLabels sources, with values bounded by configuration except
+// path, whose values come from clients unless websocketPath is set
+var metricLabelSources = []string{"backend", "path", "subprotocol", "tenant"}
+
+// request fields rejected as metricLabels, each value a new series
+var unboundedMetricLabelSources = []string{"clientIP", "host", "url", "userAgent"}
+
+// labeledVec is a set of gauges or counters partitioned by the values of
+// several labels.
+type labeledVec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+
+	mutex      sync.Mutex
+	values     map[string]float64
+	overflowed bool
+}
+
+func newLabeledVec(
+	name string,
+	help string,
+	metricType string,
+	labelNames []string,
+) *labeledVec {
+
+	lv := &labeledVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+
+	registerMetric(lv)
+
+	return lv
+}
+
+// add adds delta to the value for labelValues, given in labelNames order.
+func (lv *labeledVec) add(
+	labelValues []string,
+	delta float64,
+) {
+
+	key := strings.Join(labelValues, "\x00")
+
+	lv.mutex.Lock()
+	defer lv.mutex.Unlock()
+
+	if _, ok := lv.values[key]; !ok && len(lv.values) >= maxMetricLabelSets {
+		if !lv.overflowed {
+			lv.overflowed = true
+			slog.Warn("metric label combinations over limit, counting new ones as other",
+				"metric", lv.name,
+				"maxMetricLabelSets", maxMetricLabelSets,
+			)
+		}
+
+		otherValues := make([]string, len(labelValues))
+		for i := range otherValues {
+			otherValues[i] = otherLabelValue
+		}
+		key = strings.Join(otherValues, "\x00")
+	}
+
+	lv.values[key] += delta
+}
+
+func (lv *labeledVec) writeMetric(w io.Writer) {
+	lv.mutex.Lock()
+	defer lv.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", lv.name, lv.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", lv.name, lv.metricType)
+
+	keys := make([]string, 0, len(lv.values))
+	for key := range lv.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		labels := make([]string, len(lv.labelNames))
+		for i, labelValue := range strings.Split(key, "\x00") {
+			labels[i] = fmt.Sprintf("%s=%q", lv.labelNames[i], labelValue)
+		}
+		fmt.Fprintf(w, "%s{%s} %v\n", lv.name, strings.Join(labels, ","), lv.values[key])
+	}
+}
+
+// sample joins the label values of each value with "_" for statsd.
+func (lv *labeledVec) sample() metricSample {
+	lv.mutex.Lock()
+	defer lv.mutex.Unlock()
+
+	values := make(map[string]float64, len(lv.values))
+	for key, value := range lv.values {
+		values[strings.ReplaceAll(key, "\x00", "_")] = value
+	}
+
+	return metricSample{
+		name:       lv.name,
+		metricType: lv.metricType,
+		values:     values,
+	}
+}
+
+// parseMetricLabels parses the comma-separated metricLabels flag, rejecting
+// unknown sources and sources with unbounded values.
+func parseMetricLabels(value string) ([]string, error) {
+	var labelNames []string
+
+	for name := range strings.SplitSeq(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		switch {
+		case slices.Contains(unboundedMetricLabelSources, name):
+			return nil, fmt.Errorf("metric label %q has unbounded values, choose from %v", name, metricLabelSources)
+		case !slices.Contains(metricLabelSources, name):
+			return nil, fmt.Errorf("unknown metric label %q, choose from %v", name, metricLabelSources)
+		case slices.Contains(labelNames, name):
+			return nil, fmt.Errorf("duplicate metric label %q", name)
+		}
+
+		labelNames = append(labelNames, name)
+	}
+
+	return labelNames, nil
+}
+
+// connectionLabels are the metricLabels values of one connection.
+type connectionLabels struct {
+	backend     string
+	path        string
+	subprotocol string
+	tenant      string
+}
+
+func newConnectionLabels(
+	path string,
+	clientTenant *tenant,
+) *connectionLabels {
+
+	cl := &connectionLabels{
+		path: path,
+	}
+	if clientTenant != nil {
+		cl.tenant = clientTenant.name
+	}
+
+	return cl
+}
+
+func (cl *connectionLabels) values() []string {
+	values := make([]string, len(metricLabelNames))
+	for i, name := range metricLabelNames {
+		switch name {
+		case "backend":
+			values[i] = cl.backend
+		case "path":
+			values[i] = cl.path
+		case "subprotocol":
+			values[i] = cl.subprotocol
+		case "tenant":
+			values[i] = cl.tenant
+		}
+	}
+	return values
+}
+
+// labels selected by metricLabels, empty if unset
+var metricLabelNames []string
+
+// per connection metrics with metricLabels, nil if unset
+var (
+	labeledConnectionsCounter     *labeledVec
+	labeledActiveConnectionsGauge *labeledVec
+	labeledProxiedBytesCounter    *labeledVec
+)
+
+// setupMetricLabels registers the labeled connection metrics for labelNames.
+func setupMetricLabels(labelNames []string) {
+	metricLabelNames = labelNames
+
+	if slices.Contains(labelNames, "path") && *websocketPath == "" {
+		slog.Warn("metric label path has client chosen values without websocketPath",
+			"maxMetricLabelSets", maxMetricLabelSets,
+		)
+	}
+
+	labeledConnectionsCounter = newLabeledVec(
+		"wsproxy_labeled_connections_total",
+		"Websocket connections proxied, by metricLabels.",
+		"counter",
+		labelNames,
+	)
+
+	labeledActiveConnectionsGauge = newLabeledVec(
+		"wsproxy_labeled_active_connections",
+		"Active websocket connections, by metricLabels.",
+		"gauge",
+		labelNames,
+	)
+
+	labeledProxiedBytesCounter = newLabeledVec(
+		"wsproxy_labeled_bytes_total",
+		"Bytes proxied to tcp backends, by metricLabels and direction, added as each connection closes.",
+		"counter",
+		append(slices.Clone(labelNames), "direction"),
+	)
+}
+
+// recordLabeledConnectionStart counts a proxied connection with its labels,
+// returning the function to call when it ends. Does nothing without metricLabels.
+func recordLabeledConnectionStart(cl *connectionLabels) (end func()) {
+	if labeledConnectionsCounter == nil {
+		return func() {}
+	}
+
+	values := cl.values()
+
+	labeledConnectionsCounter.add(values, 1)
+	labeledActiveConnectionsGauge.add(values, 1)
+
+	return func() {
+		labeledActiveConnectionsGauge.add(values, -1)
+	}
+}
+
+// recordLabeledBytes adds a closed connection's proxied bytes with its labels.
+func recordLabeledBytes(
+	cl *connectionLabels,
+	byteCounts *connectionByteCounts,
+) {
+
+	if labeledProxiedBytesCounter == nil {
+		return
+	}
+
+	values := cl.values()
+
+	labeledProxiedBytesCounter.add(slices.Concat(values, []string{"wsToTcp"}), float64(byteCounts.wsToTcp.Load()))
+	labeledProxiedBytesCounter.add(slices.Concat(values, []string{"tcpToWs"}), float64(byteCounts.tcpToWs.Load()))
+}
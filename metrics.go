@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// metric is written in the prometheus text exposition format,
+// and sampled for statsd.
+type metric interface {
+	writeMetric(w io.Writer)
+	sample() metricSample
+}
+
+// metricSample is the current value of a metric for each label value,
+// with the empty label value for a metric without labels.
+type metricSample struct {
+	name       string
+	metricType string
+	values     map[string]float64
+}
+
+// metrics served by metricsHandler, in registration order
+var registeredMetrics []metric
+
+func registerMetric(m metric) {
+	registeredMetrics = append(registeredMetrics, m)
+}
+
+// counterVec is a set of counters partitioned by the value of one label.
+type counterVec struct {
+	name      string
+	help      string
+	labelName string
+
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(
+	name string,
+	help string,
+	labelName string,
+) *counterVec {
+
+	cv := &counterVec{
+		name:      name,
+		help:      help,
+		labelName: labelName,
+		values:    make(map[string]uint64),
+	}
+
+	registerMetric(cv)
+
+	return cv
+}
+
+func (cv *counterVec) inc(labelValue string) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+
+	cv.values[labelValue]++
+}
+
+func (cv *counterVec) writeMetric(w io.Writer) {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", cv.name, cv.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", cv.name)
+
+	labelValues := make([]string, 0, len(cv.values))
+	for labelValue := range cv.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	slices.Sort(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", cv.name, cv.labelName, labelValue, cv.values[labelValue])
+	}
+}
+
+func (cv *counterVec) sample() metricSample {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+
+	values := make(map[string]float64, len(cv.values))
+	for labelValue, value := range cv.values {
+		values[labelValue] = float64(value)
+	}
+
+	return metricSample{
+		name:       cv.name,
+		metricType: "counter",
+		values:     values,
+	}
+}
+
+// funcVec is a set of gauges or counters partitioned by the value of one label,
+// sampled from values each time it is written.
+type funcVec struct {
+	name       string
+	help       string
+	metricType string
+	labelName  string
+	values     func() map[string]float64
+}
+
+func newFuncVec(
+	name string,
+	help string,
+	metricType string,
+	labelName string,
+	values func() map[string]float64,
+) *funcVec {
+
+	fv := &funcVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelName:  labelName,
+		values:     values,
+	}
+
+	registerMetric(fv)
+
+	return fv
+}
+
+func (fv *funcVec) writeMetric(w io.Writer) {
+	values := fv.values()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", fv.name, fv.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", fv.name, fv.metricType)
+
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	slices.Sort(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %v\n", fv.name, fv.labelName, labelValue, values[labelValue])
+	}
+}
+
+func (fv *funcVec) sample() metricSample {
+	return metricSample{
+		name:       fv.name,
+		metricType: fv.metricType,
+		values:     fv.values(),
+	}
+}
+
+// funcValue is a single gauge or counter without labels, sampled from value
+// each time it is written.
+type funcValue struct {
+	name       string
+	help       string
+	metricType string
+	value      func() float64
+}
+
+func newFuncValue(
+	name string,
+	help string,
+	metricType string,
+	value func() float64,
+) *funcValue {
+
+	fv := &funcValue{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		value:      value,
+	}
+
+	registerMetric(fv)
+
+	return fv
+}
+
+func (fv *funcValue) writeMetric(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", fv.name, fv.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", fv.name, fv.metricType)
+	fmt.Fprintf(w, "%s %v\n", fv.name, fv.value())
+}
+
+// sample returns the value under the empty label value.
+func (fv *funcValue) sample() metricSample {
+	return metricSample{
+		name:       fv.name,
+		metricType: fv.metricType,
+		values: map[string]float64{
+			"": fv.value(),
+		},
+	}
+}
+
+// histogram counts observations into cumulative buckets by upper bound.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mutex  sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(
+	name string,
+	help string,
+	buckets []float64,
+) *histogram {
+
+	h := &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+
+	registerMetric(h)
+
+	return h
+}
+
+func (h *histogram) observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *histogram) writeMetric(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	for i, upperBound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, upperBound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// sample returns the count and sum of the observations as counters.
+func (h *histogram) sample() metricSample {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return metricSample{
+		name:       h.name,
+		metricType: "counter",
+		values: map[string]float64{
+			"count": float64(h.count),
+			"sum":   h.sum,
+		},
+	}
+}
+
+func metricsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	for _, m := range registeredMetrics {
+		m.writeMetric(w)
+	}
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// subprotocol of websockets carrying many tcp streams, offered by clientMux
+// clients and accepted by servers with mux
+const muxSubprotocol = "wsproxy-mux.v1"
+
+// Each binary message of a mux websocket is one frame: a frame type byte,
+// a big endian uint32 stream id, and the payload.
+const (
+	// client opens a stream, with no payload
+	muxFrameOpen byte = iota
+
+	// stream data
+	muxFrameData
+
+	// sender will write no more to the stream, as a tcp half close
+	muxFrameClose
+
+	// stream aborted in both directions
+	muxFrameReset
+
+	// payload is a big endian uint32 of stream bytes the receiver consumed,
+	// that the sender may send again
+	muxFrameWindow
+)
+
+const (
+	muxFrameHeaderLength = 5
+
+	// largest data frame payload, keeping frames within the default read limit
+	muxMaxDataPayload = 16 * 1024
+
+	// bytes each side may send on a stream before the receiver consumes them,
+	// so a slow stream does not stall the others sharing the websocket
+	muxStreamWindow = 256 * 1024
+)
+
+var (
+	errMuxProtocol      = errors.New("mux protocol error")
+	errMuxStreamReset   = errors.New("mux stream reset")
+	errMuxSessionClosed = errors.New("mux session closed")
+)
+
+// muxSession carries the streams of one mux websocket.
+type muxSession struct {
+	conn   *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// called in a new goroutine for each stream the peer opens,
+	// nil if the peer may not open streams
+	onOpen func(*muxStream)
+
+	// most concurrent streams the peer may open, 0 for unlimited
+	maxStreams int
+
+	// tracks the onOpen goroutines, see waitOpened
+	opened sync.WaitGroup
+
+	mutex        sync.Mutex
+	streams      map[uint32]*muxStream
+	nextStreamID uint32
+	closed       bool
+}
+
+func newMuxSession(
+	conn *websocket.Conn,
+	maxStreams int,
+	onOpen func(*muxStream),
+) *muxSession {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &muxSession{
+		conn:       conn,
+		ctx:        ctx,
+		cancel:     cancel,
+		onOpen:     onOpen,
+		maxStreams: maxStreams,
+		streams:    make(map[uint32]*muxStream),
+	}
+}
+
+// writeFrame sends one frame. Writes are serialized by the websocket.
+func (ms *muxSession) writeFrame(
+	frameType byte,
+	streamID uint32,
+	payload []byte,
+) error {
+
+	frame := make([]byte, muxFrameHeaderLength+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], streamID)
+	copy(frame[muxFrameHeaderLength:], payload)
+
+	return ms.conn.Write(ms.ctx, websocket.MessageBinary, frame)
+}
+
+// run reads and dispatches frames until the websocket ends or the peer
+// breaks the protocol, then fails every remaining stream.
+func (ms *muxSession) run() error {
+	defer ms.close()
+
+	for {
+		messageType, frame, err := ms.conn.Read(ms.ctx)
+		if err != nil {
+			return err
+		}
+
+		if messageType != websocket.MessageBinary || len(frame) < muxFrameHeaderLength {
+			return errMuxProtocol
+		}
+
+		frameType := frame[0]
+		streamID := binary.BigEndian.Uint32(frame[1:])
+		payload := frame[muxFrameHeaderLength:]
+
+		if frameType == muxFrameOpen {
+			if err := ms.acceptStream(streamID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// frames for streams already closed locally are dropped
+		stream := ms.stream(streamID)
+		if stream == nil {
+			continue
+		}
+
+		switch frameType {
+		case muxFrameData:
+			if err := stream.receiveData(payload); err != nil {
+				return err
+			}
+		case muxFrameClose:
+			stream.receiveClose()
+		case muxFrameReset:
+			stream.fail(errMuxStreamReset)
+		case muxFrameWindow:
+			if len(payload) != 4 {
+				return errMuxProtocol
+			}
+			stream.addSendCredit(int(binary.BigEndian.Uint32(payload)))
+		default:
+			return errMuxProtocol
+		}
+	}
+}
+
+// close ends the session, failing every stream.
+func (ms *muxSession) close() {
+	ms.cancel()
+
+	ms.mutex.Lock()
+	streams := ms.streams
+	ms.streams = nil
+	ms.closed = true
+	ms.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.fail(errMuxSessionClosed)
+	}
+}
+
+// isClosed reports whether the session has ended.
+func (ms *muxSession) isClosed() bool {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.closed
+}
+
+// stream returns the open stream streamID, nil if there is none.
+func (ms *muxSession) stream(streamID uint32) *muxStream {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.streams[streamID]
+}
+
+func (ms *muxSession) removeStream(stream *muxStream) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.streams[stream.id] == stream {
+		delete(ms.streams, stream.id)
+	}
+}
+
+// acceptStream starts a stream the peer opened, resetting it when
+// maxStreams are already open.
+func (ms *muxSession) acceptStream(streamID uint32) error {
+	if ms.onOpen == nil {
+		return errMuxProtocol
+	}
+
+	ms.mutex.Lock()
+	if _, exists := ms.streams[streamID]; exists {
+		ms.mutex.Unlock()
+		return errMuxProtocol
+	}
+	if ms.maxStreams > 0 && len(ms.streams) >= ms.maxStreams {
+		ms.mutex.Unlock()
+		return ms.writeFrame(muxFrameReset, streamID, nil)
+	}
+	stream := newMuxStream(ms, streamID)
+	ms.streams[streamID] = stream
+	ms.mutex.Unlock()
+
+	ms.opened.Go(func() {
+		ms.onOpen(stream)
+	})
+
+	return nil
+}
+
+// waitOpened waits for the onOpen calls of the streams the peer opened to
+// return, once run has returned and failed the streams.
+func (ms *muxSession) waitOpened() {
+	ms.opened.Wait()
+}
+
+// openStream opens a new stream to the peer.
+func (ms *muxSession) openStream() (*muxStream, error) {
+	ms.mutex.Lock()
+	if ms.closed {
+		ms.mutex.Unlock()
+		return nil, errMuxSessionClosed
+	}
+	ms.nextStreamID++
+	stream := newMuxStream(ms, ms.nextStreamID)
+	ms.streams[stream.id] = stream
+	ms.mutex.Unlock()
+
+	if err := ms.writeFrame(muxFrameOpen, stream.id, nil); err != nil {
+		stream.fail(err)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// muxStream is one tcp stream of a muxSession, read and written like a
+// connection, with credit based flow control in each direction.
+type muxStream struct {
+	id      uint32
+	session *muxSession
+
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	// received and not yet read
+	readBuffer []byte
+	// read and not yet returned to the sender as window credit
+	unacknowledged int
+	// bytes that may be sent before the peer returns credit
+	sendCredit int
+
+	// peer will send no more data
+	remoteClosed bool
+	// no more data will be sent
+	localClosed bool
+	// set once the stream is reset, closed, or its session ends
+	err error
+}
+
+func newMuxStream(
+	session *muxSession,
+	id uint32,
+) *muxStream {
+
+	stream := &muxStream{
+		id:         id,
+		session:    session,
+		sendCredit: muxStreamWindow,
+	}
+	stream.cond = sync.NewCond(&stream.mutex)
+
+	return stream
+}
+
+// Read blocks until data arrives, returning io.EOF once the peer closes the
+// stream and its data has been read.
+func (s *muxStream) Read(b []byte) (int, error) {
+	s.mutex.Lock()
+
+	for len(s.readBuffer) == 0 && !s.remoteClosed && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if len(s.readBuffer) == 0 {
+		err := s.err
+		s.mutex.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+
+	n := copy(b, s.readBuffer)
+	s.readBuffer = s.readBuffer[n:]
+	s.unacknowledged += n
+
+	// return credit in batches rather than per read
+	var credit int
+	if s.unacknowledged >= muxStreamWindow/2 || len(s.readBuffer) == 0 {
+		credit, s.unacknowledged = s.unacknowledged, 0
+	}
+	s.mutex.Unlock()
+
+	if credit > 0 {
+		s.session.writeFrame(muxFrameWindow, s.id, binary.BigEndian.AppendUint32(nil, uint32(credit)))
+	}
+
+	return n, nil
+}
+
+// Write sends b as data frames, blocking while the peer has not returned
+// enough credit.
+func (s *muxStream) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		s.mutex.Lock()
+		for s.sendCredit == 0 && s.err == nil && !s.localClosed {
+			s.cond.Wait()
+		}
+		if s.err != nil || s.localClosed {
+			err := s.err
+			s.mutex.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return written, err
+		}
+		n := min(len(b), s.sendCredit, muxMaxDataPayload)
+		s.sendCredit -= n
+		s.mutex.Unlock()
+
+		if err := s.session.writeFrame(muxFrameData, s.id, b[:n]); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// CloseWrite tells the peer no more data will be sent, as a tcp half close.
+func (s *muxStream) CloseWrite() error {
+	s.mutex.Lock()
+	if s.localClosed || s.err != nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.localClosed = true
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+
+	return s.session.writeFrame(muxFrameClose, s.id, nil)
+}
+
+// Close ends the stream, resetting it unless both sides had closed it.
+func (s *muxStream) Close() error {
+	s.mutex.Lock()
+	reset := s.err == nil && !(s.localClosed && s.remoteClosed)
+	if s.err == nil {
+		s.err = net.ErrClosed
+	}
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+
+	s.session.removeStream(s)
+
+	if reset {
+		return s.session.writeFrame(muxFrameReset, s.id, nil)
+	}
+	return nil
+}
+
+// receiveData buffers a data frame, failing the session if the peer
+// sent more than its credit or sent after closing.
+func (s *muxStream) receiveData(payload []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.remoteClosed || len(s.readBuffer)+s.unacknowledged+len(payload) > muxStreamWindow {
+		return errMuxProtocol
+	}
+
+	if s.err == nil {
+		s.readBuffer = append(s.readBuffer, payload...)
+		s.cond.Broadcast()
+	}
+
+	return nil
+}
+
+func (s *muxStream) receiveClose() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remoteClosed = true
+	s.cond.Broadcast()
+}
+
+func (s *muxStream) addSendCredit(credit int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sendCredit += credit
+	s.cond.Broadcast()
+}
+
+// fail ends the stream with err, waking blocked reads and writes.
+func (s *muxStream) fail(err error) {
+	s.mutex.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+
+	s.session.removeStream(s)
+}
+
+// bridgeMuxStream copies between stream and conn until both directions end,
+// half closing each as the other side finishes writing. Returns the bytes
+// copied to conn and to stream.
+func bridgeMuxStream(
+	stream *muxStream,
+	conn net.Conn,
+) (toConn int64, toStream int64) {
+
+	var copyWaitGroup sync.WaitGroup
+
+	copyWaitGroup.Go(func() {
+		var err error
+		toStream, err = pooledCopy(stream, conn)
+		if err != nil {
+			stream.Close()
+			return
+		}
+		stream.CloseWrite()
+	})
+
+	toConn, err := pooledCopy(conn, stream)
+	if closeWriter, ok := conn.(interface{ CloseWrite() error }); ok && err == nil {
+		closeWriter.CloseWrite()
+	} else {
+		conn.Close()
+	}
+
+	copyWaitGroup.Wait()
+
+	stream.Close()
+	conn.Close()
+
+	return toConn, toStream
+}
+
+// muxSessionConfig is the per-connection state of a mux session that each of
+// its streams is proxied with.
+type muxSessionConfig struct {
+	r             *http.Request
+	txID          string
+	pool          *backendPool
+	fallback      *backend
+	clientIP      string
+	priority      string
+	useBackendTLS bool
+	proxyHeader   []byte
+	metadata      []byte
+	labels        *connectionLabels
+}
+
+// proxyMuxSession serves a websocket whose client offered muxSubprotocol,
+// proxying each stream it opens to a backend of pool selected as for a
+// connection, until the websocket closes. Each stream is a connection to the
+// per-connection limits, admin connection list, and connection records.
+// releaseHandshakeSlot is called once the client is accepted.
+func proxyMuxSession(
+	w http.ResponseWriter,
+	r *http.Request,
+	config muxSessionConfig,
+	releaseHandshakeSlot func(),
+	txLogger *slog.Logger,
+) {
+
+	if err := PreAcceptHook(r); err != nil {
+		status := rejectHookError(w, err)
+		txLogger.Warn("PreAcceptHook rejected request",
+			"status", status,
+			"error", err,
+		)
+		return
+	}
+
+	acceptOptions := *websocketAcceptOptions
+	acceptOptions.Subprotocols = []string{muxSubprotocol}
+
+	websocketConn, err := websocket.Accept(w, r, &acceptOptions)
+	if err != nil {
+		txLogger.Warn("websocket.Accept error",
+			"error", err,
+		)
+		return
+	}
+	defer websocketConn.CloseNow()
+
+	releaseHandshakeSlot()
+
+	stopForceClose := context.AfterFunc(forceCloseContext, func() {
+		websocketConn.Close(websocket.StatusGoingAway, "server shutting down")
+	})
+	defer stopForceClose()
+
+	defer connectionOpened()()
+
+	config.r = r
+	config.useBackendTLS = *backendTLS || (*backendTLSFromClient && r.TLS != nil)
+
+	if *sendProxyProtocol != "" {
+		source, destination, ok := proxyProtocolAddrs(r, config.clientIP)
+		config.proxyHeader = proxyProtocolHeader(*sendProxyProtocol, source, destination, ok)
+	}
+
+	txLogger.Info("mux session started")
+
+	var streams atomic.Int64
+
+	session := newMuxSession(websocketConn, *muxMaxStreams, func(stream *muxStream) {
+		streams.Add(1)
+		serveMuxStream(stream, config, txLogger)
+	})
+
+	err = session.run()
+
+	// the streams' records and releases run before the session's deferred ones
+	session.waitOpened()
+
+	txLogger.Info("mux session ended",
+		"streams", streams.Load(),
+		"error", err,
+	)
+}
+
+// serveMuxStream dials a backend for stream and proxies between them, as
+// the websocket handler does for a connection. The stream is reset when a
+// limit rejects it.
+func serveMuxStream(
+	stream *muxStream,
+	config muxSessionConfig,
+	txLogger *slog.Logger,
+) {
+
+	defer stream.Close()
+
+	streamTxID := fmt.Sprintf("%v-%v", config.txID, stream.id)
+
+	txLogger = txLogger.With(
+		"streamID", stream.id,
+	)
+
+	defer recoverConnectionPanic(txLogger)
+
+	if connectionsBudget != nil {
+		releaseBudget, ok := connectionsBudget.tryAcquire(config.priority)
+		if !ok {
+			txLogger.Warn("connection budget exhausted, mux stream rejected",
+				"priority", config.priority,
+				"maxConnections", *maxConnections,
+			)
+			return
+		}
+		defer releaseBudget()
+	}
+
+	backend, _ := config.pool.next(config.clientIP)
+	if backend == nil {
+		txLogger.Warn("all backends at capacity")
+		return
+	}
+	defer func() { backend.release() }()
+
+	dialCtx := stream.session.ctx
+
+	if backendDialLimiter != nil {
+		if !backendDialLimiter.enterQueue() {
+			txLogger.Warn("dial queue full, mux stream rejected",
+				"maxDialQueue", *maxDialQueue,
+			)
+			return
+		}
+	}
+
+	backendDialPause.wait(dialCtx, txLogger)
+
+	releaseDialSlot := func() {}
+	if backendDialLimiter != nil {
+		err := backendDialLimiter.slots.acquire(dialCtx)
+		backendDialLimiter.leaveQueue()
+		if err != nil {
+			txLogger.Warn("dial slot acquire error",
+				"error", err,
+			)
+			return
+		}
+		releaseDialSlot = backendDialLimiter.slots.release
+	}
+
+	dialStartTime := time.Now()
+	tcpConn, backend, err := dialWithFallback(dialCtx, config.pool, config.clientIP, backend, config.fallback, config.useBackendTLS, config.proxyHeader, config.metadata, txLogger)
+	releaseDialSlot()
+	recordTiming("wsproxy_backend_dial_duration", time.Since(dialStartTime))
+
+	var streamCloseReason closeReason
+
+	connectionStartTime := time.Now()
+
+	byteCounts := newConnectionByteCounts(*maxBytesPerConnection, func() {
+		txLogger.Warn("byte limit exceeded",
+			"maxBytesPerConnection", *maxBytesPerConnection,
+		)
+		streamCloseReason.set(closeClassPolicy, "byte limit exceeded")
+		stream.Close()
+	})
+
+	defer func() {
+		recordConnectionEnd(config.r, connectionRecord{
+			Time:            time.Now(),
+			TxID:            streamTxID,
+			ClientIP:        config.clientIP,
+			Backend:         backend.hostAndPort,
+			DurationSeconds: time.Since(connectionStartTime).Seconds(),
+			BytesWsToTcp:    byteCounts.wsToTcp.Load(),
+			BytesTcpToWs:    byteCounts.tcpToWs.Load(),
+			CloseReason:     streamCloseReason.get(),
+			CloseClass:      string(streamCloseReason.class()),
+		})
+	}()
+
+	if err != nil {
+		txLogger.Warn("dialBackend error",
+			"error", err,
+		)
+		streamCloseReason.set(closeClassBackendDialFailed, "backend unavailable")
+		return
+	}
+	defer tcpConn.Close()
+
+	txLogger = txLogger.With(
+		"backend", backend.hostAndPort,
+	)
+
+	adminSession := &session{
+		txID:       streamTxID,
+		clientIP:   config.clientIP,
+		startTime:  connectionStartTime,
+		byteCounts: byteCounts,
+		terminate: func() {
+			streamCloseReason.set(closeClassAdminKill, "terminated by admin")
+			stream.Close()
+			tcpConn.Close()
+		},
+	}
+	adminSession.setBackend(backend.hostAndPort)
+	defer registerSession(adminSession)()
+
+	streamLabels := *config.labels
+	streamLabels.backend = backend.hostAndPort
+	defer recordLabeledConnectionStart(&streamLabels)()
+	defer recordLabeledBytes(&streamLabels, byteCounts)
+
+	tcpReader := byteCounts.tcpToWsReader(tcpConn)
+	if limiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalTcpToWsBandwidth); limiter != nil {
+		tcpReader = &bandwidthLimitedReader{
+			reader:  tcpReader,
+			limiter: limiter,
+		}
+	}
+
+	tcpWriter := byteCounts.wsToTcpWriter(tcpConn)
+	if limiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalWsToTcpBandwidth); limiter != nil {
+		tcpWriter = &bandwidthLimitedWriter{
+			writer:  tcpWriter,
+			limiter: limiter,
+		}
+	}
+
+	if *proxyIdleTimeout > 0 {
+		idleCtx, stopIdleTimeout := context.WithCancel(context.Background())
+		defer stopIdleTimeout()
+
+		go runIdleTimeout(idleCtx, *proxyIdleTimeout, byteCounts, func(idle time.Duration) {
+			logProxyIdleTimeout(idle, txLogger)
+			streamCloseReason.set(closeClassIdleTimeout, "proxy idle timeout")
+			stream.Close()
+			tcpConn.Close()
+		})
+	}
+
+	txLogger.Info("mux stream connected to backend")
+
+	wsToTcp, tcpToWs := bridgeMuxStream(stream, &countedConn{
+		Conn:   tcpConn,
+		reader: tcpReader,
+		writer: tcpWriter,
+	})
+
+	txLogger.Info("mux stream closed",
+		"bytesWsToTcp", wsToTcp,
+		"bytesTcpToWs", tcpToWs,
+	)
+}
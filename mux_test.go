@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// startEchoBackend returns the address of a tcp server echoing each connection.
+func startEchoBackend(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// startProxyServer serves the websocket handler in front of an echo backend.
+func startProxyServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	pool, err := newBackendPool(startEchoBackend(t))
+	if err != nil {
+		t.Fatalf("newBackendPool error: %v", err)
+	}
+	previousPool := backends.Load()
+	backends.Store(pool)
+	t.Cleanup(func() { backends.Store(previousPool) })
+
+	wsReadBufferPool = newBufferPool(32 * 1024)
+	wsWriteBufferPool = newBufferPool(32 * 1024)
+	copyBufferPool = newBufferPool(32 * 1024)
+
+	server := httptest.NewServer(websocketServerHandlerFunc())
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestMuxSessionStreamsUseTheWholeConnectionBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	budget, err := newConnectionBudget(1, 0)
+	if err != nil {
+		t.Fatalf("newConnectionBudget error: %v", err)
+	}
+	connectionsBudget = budget
+	defer func() { connectionsBudget = nil }()
+
+	defer func(mux bool) { *muxMode = mux }(*muxMode)
+	*muxMode = true
+
+	server := startProxyServer(t)
+
+	clientConn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), &websocket.DialOptions{
+		Subprotocols: []string{muxSubprotocol},
+	})
+	if err != nil {
+		t.Fatalf("websocket.Dial error: %v", err)
+	}
+	defer clientConn.CloseNow()
+
+	session := newMuxSession(clientConn, 0, nil)
+	go session.run()
+
+	// the only connection of the budget goes to the stream, not the session
+	stream, err := session.openStream()
+	if err != nil {
+		t.Fatalf("session.openStream error: %v", err)
+	}
+	if _, err := stream.Write([]byte("hi")); err != nil {
+		t.Fatalf("stream.Write error: %v", err)
+	}
+
+	echoed := make([]byte, 2)
+	if _, err := io.ReadFull(stream, echoed); err != nil {
+		t.Fatalf("stream read error: %v", err)
+	}
+	if string(echoed) != "hi" {
+		t.Fatalf("stream echoed %q, want %q", echoed, "hi")
+	}
+
+	clientConn.Close(websocket.StatusNormalClosure, "")
+
+	// the stream releases its connection once the session ends
+	for {
+		if release, ok := budget.tryAcquire(priorityLow); ok {
+			release()
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("connection budget not released after the mux session ended")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
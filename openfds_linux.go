@@ -0,0 +1,13 @@
+package main
+
+import "os"
+
+// openFDCount returns the number of open file descriptors of this process.
+func openFDCount() (int, bool) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+	// excluding the descriptor ReadDir opened to list the directory
+	return len(entries) - 1, true
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// openFDCount is not cheaply available on this platform.
+func openFDCount() (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// dialPause holds new connections before they dial a backend, such as while
+// a backend restarts. Connections already proxying are unaffected.
+type dialPause struct {
+	mutex sync.Mutex
+
+	// non-nil while paused, closed when the pause ends
+	resumeChannel chan struct{}
+	timer         *time.Timer
+	startTime     time.Time
+	held          int
+}
+
+var backendDialPause dialPause
+
+// pause holds new backend dials for up to duration, extending or shortening
+// a pause already in effect.
+func (dp *dialPause) pause(duration time.Duration) {
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+
+	if dp.resumeChannel != nil {
+		dp.timer.Reset(duration)
+
+		slog.Info("dial pause extended",
+			"duration", duration.String(),
+		)
+		return
+	}
+
+	resumeChannel := make(chan struct{})
+	dp.resumeChannel = resumeChannel
+	dp.timer = time.AfterFunc(duration, func() { dp.end(resumeChannel, "duration expired") })
+	dp.startTime = time.Now()
+	dp.held = 0
+
+	slog.Info("dial pause started",
+		"duration", duration.String(),
+	)
+}
+
+// resume ends the pause, releasing the held connections to dial.
+// Returns false if no pause was in effect.
+func (dp *dialPause) resume() bool {
+	return dp.end(nil, "resume")
+}
+
+// end ends the pause identified by resumeChannel, or any pause when nil,
+// so a timer from an earlier pause cannot end a later one.
+func (dp *dialPause) end(
+	resumeChannel chan struct{},
+	trigger string,
+) bool {
+
+	dp.mutex.Lock()
+	defer dp.mutex.Unlock()
+
+	if dp.resumeChannel == nil ||
+		(resumeChannel != nil && resumeChannel != dp.resumeChannel) {
+		return false
+	}
+
+	dp.timer.Stop()
+	close(dp.resumeChannel)
+	dp.resumeChannel = nil
+
+	slog.Info("dial pause ended",
+		"trigger", trigger,
+		"pausedFor", time.Since(dp.startTime).String(),
+		"heldConnections", dp.held,
+	)
+
+	return true
+}
+
+// wait blocks while a pause is in effect or until ctx is done.
+func (dp *dialPause) wait(
+	ctx context.Context,
+	txLogger *slog.Logger,
+) {
+
+	dp.mutex.Lock()
+	resumeChannel := dp.resumeChannel
+	if resumeChannel != nil {
+		dp.held++
+	}
+	dp.mutex.Unlock()
+
+	if resumeChannel == nil {
+		return
+	}
+
+	txLogger.Info("holding connection for dial pause")
+
+	waitStartTime := time.Now()
+
+	select {
+	case <-ctx.Done():
+	case <-resumeChannel:
+	}
+
+	txLogger.Info("released connection from dial pause",
+		"held", time.Since(waitStartTime).String(),
+	)
+}
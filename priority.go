@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	priorityLow  = "low"
+	priorityHigh = "high"
+)
+
+// connectionBudget limits concurrent connections to maxConnections as a two
+// tier semaphore. Every connection holds a slot of all, and low priority
+// connections also hold a slot of shared, which is smaller by the slots
+// reserved for high priority connections.
+type connectionBudget struct {
+	all    semaphore
+	shared semaphore
+}
+
+// budget for maxConnections, nil if unlimited
+var connectionsBudget *connectionBudget
+
+func newConnectionBudget(
+	maxConnections int,
+	reservedHighPriority int,
+) (*connectionBudget, error) {
+
+	if reservedHighPriority < 0 || reservedHighPriority >= maxConnections {
+		return nil, fmt.Errorf("highPriorityReservedConnections must be at least 0 and less than maxConnections %v", maxConnections)
+	}
+
+	return &connectionBudget{
+		all:    newSemaphore(maxConnections),
+		shared: newSemaphore(maxConnections - reservedHighPriority),
+	}, nil
+}
+
+// tryAcquire takes a slot for a connection of priority without blocking,
+// returning the func releasing it, or false if none is available.
+func (cb *connectionBudget) tryAcquire(priority string) (func(), bool) {
+	if priority == priorityHigh {
+		if !cb.all.tryAcquire() {
+			return nil, false
+		}
+		return cb.all.release, true
+	}
+
+	if !cb.shared.tryAcquire() {
+		return nil, false
+	}
+	if !cb.all.tryAcquire() {
+		cb.shared.release()
+		return nil, false
+	}
+
+	return func() {
+		cb.all.release()
+		cb.shared.release()
+	}, true
+}
+
+// acquire takes a slot for a connection of priority, waiting until one is
+// available or ctx is done, returning the func releasing it.
+func (cb *connectionBudget) acquire(
+	ctx context.Context,
+	priority string,
+) (func(), error) {
+
+	if priority == priorityHigh {
+		if err := cb.all.acquire(ctx); err != nil {
+			return nil, err
+		}
+		return cb.all.release, nil
+	}
+
+	if err := cb.shared.acquire(ctx); err != nil {
+		return nil, err
+	}
+	if err := cb.all.acquire(ctx); err != nil {
+		cb.shared.release()
+		return nil, err
+	}
+
+	return func() {
+		cb.all.release()
+		cb.shared.release()
+	}, nil
+}
+
+var (
+	// header from highPriorityHeader, nil if unset
+	highPriorityHeaderMatch *requiredHeader
+
+	// tenant names from highPriorityTenants
+	highPriorityTenantNames = make(map[string]bool)
+)
+
+// parsePriorityFlags parses highPriorityHeader, as name or name=value,
+// and the comma-separated highPriorityTenants.
+func parsePriorityFlags() {
+	if entry := strings.TrimSpace(*highPriorityHeader); entry != "" {
+		name, value, matchValue := strings.Cut(entry, "=")
+
+		highPriorityHeaderMatch = &requiredHeader{
+			name:       http.CanonicalHeaderKey(strings.TrimSpace(name)),
+			value:      strings.TrimSpace(value),
+			matchValue: matchValue,
+		}
+	}
+
+	for name := range strings.SplitSeq(*highPriorityTenants, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			highPriorityTenantNames[name] = true
+		}
+	}
+}
+
+// clientPriority returns priorityHigh for requests matching
+// highPriorityHeader or from a highPriorityTenants tenant, and priorityLow
+// otherwise.
+func clientPriority(
+	r *http.Request,
+	t *tenant,
+) string {
+
+	if t != nil && highPriorityTenantNames[t.name] {
+		return priorityHigh
+	}
+
+	if match := highPriorityHeaderMatch; match != nil {
+		values := r.Header.Values(match.name)
+		if len(values) > 0 && (!match.matchValue || values[0] == match.value) {
+			return priorityHigh
+		}
+	}
+
+	return priorityLow
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var errBackendProbeFailed = errors.New("backend probe failed")
+
+// decoded backendProbe and backendProbeExpect flags
+var (
+	backendProbeBytes       []byte
+	backendProbeExpectBytes []byte
+)
+
+func decodeProbeFlag(value string) ([]byte, error) {
+	switch *backendProbeEncoding {
+	case "hex":
+		return hex.DecodeString(value)
+	case "base64":
+		return base64.StdEncoding.DecodeString(value)
+	default:
+		return nil, fmt.Errorf("unknown backendProbeEncoding %q", *backendProbeEncoding)
+	}
+}
+
+// parseProbeFlags decodes the backendProbe and backendProbeExpect flags.
+func parseProbeFlags() error {
+	var err error
+
+	if backendProbeBytes, err = decodeProbeFlag(*backendProbe); err != nil {
+		return fmt.Errorf("invalid backendProbe: %w", err)
+	}
+
+	if backendProbeExpectBytes, err = decodeProbeFlag(*backendProbeExpect); err != nil {
+		return fmt.Errorf("invalid backendProbeExpect: %w", err)
+	}
+
+	return nil
+}
+
+func backendProbeEnabled() bool {
+	return len(backendProbeBytes) > 0 || len(backendProbeExpectBytes) > 0
+}
+
+// probeBackend writes the probe bytes to tcpConn and reads exactly
+// len(backendProbeExpectBytes) bytes of response, which must match.
+// Only the probe response is consumed so nothing leaks into the proxied stream.
+func probeBackend(tcpConn net.Conn) error {
+	if err := tcpConn.SetDeadline(time.Now().Add(*backendProbeTimeout)); err != nil {
+		return fmt.Errorf("tcpConn.SetDeadline error: %w", err)
+	}
+
+	if _, err := tcpConn.Write(backendProbeBytes); err != nil {
+		return fmt.Errorf("%w: write error: %w", errBackendProbeFailed, err)
+	}
+
+	response := make([]byte, len(backendProbeExpectBytes))
+	if _, err := io.ReadFull(tcpConn, response); err != nil {
+		return fmt.Errorf("%w: read error: %w", errBackendProbeFailed, err)
+	}
+
+	if !bytes.Equal(response, backendProbeExpectBytes) {
+		return fmt.Errorf("%w: unexpected response %x", errBackendProbeFailed, response)
+	}
+
+	if err := tcpConn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("tcpConn.SetDeadline error: %w", err)
+	}
+
+	return nil
+}
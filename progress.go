@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// logConnectionProgress logs the bytes proxied by a connection every interval
+// until ctx is done, so long-lived tunnels are visible before they end.
+// Each line has the totals since start and the bytes since the previous line.
+func logConnectionProgress(
+	ctx context.Context,
+	interval time.Duration,
+	start time.Time,
+	byteCounts *connectionByteCounts,
+	txLogger *slog.Logger,
+) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var previousWsToTcp, previousTcpToWs int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			wsToTcp, tcpToWs := byteCounts.wsToTcp.Load(), byteCounts.tcpToWs.Load()
+
+			txLogger.Info("connection progress",
+				"duration", time.Since(start).String(),
+				"bytesWsToTcp", wsToTcp,
+				"bytesTcpToWs", tcpToWs,
+				"intervalBytesWsToTcp", wsToTcp-previousWsToTcp,
+				"intervalBytesTcpToWs", tcpToWs-previousTcpToWs,
+				"idle", time.Since(byteCounts.lastActivity()).Round(time.Millisecond).String(),
+			)
+
+			previousWsToTcp, previousTcpToWs = wsToTcp, tcpToWs
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+// signature starting every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// longest v1 header line, including the trailing CRLF
+const proxyProtocolV1MaxLength = 107
+
+var (
+	errProxyProtocolMissing   = errors.New("missing proxy protocol header")
+	errProxyProtocolMalformed = errors.New("malformed proxy protocol header")
+)
+
+// parseProxyProtocolVersion validates the sendProxyProtocol flag.
+func parseProxyProtocolVersion(version string) error {
+	switch version {
+	case "", proxyProtocolV1, proxyProtocolV2:
+		return nil
+	}
+	return fmt.Errorf("unknown sendProxyProtocol %q, expected v1 or v2", version)
+}
+
+// proxyProtocolAddrs returns the client and proxy addresses of r for a
+// PROXY protocol header. The client is clientIP, which honors
+// trustForwardedFor, with the port of RemoteAddr only when clientIP is the
+// RemoteAddr host, as a forwarded client's port is unknown.
+func proxyProtocolAddrs(
+	r *http.Request,
+	clientIPAddress string,
+) (source netip.AddrPort, destination netip.AddrPort, ok bool) {
+
+	clientAddr, err := netip.ParseAddr(clientIPAddress)
+	if err != nil {
+		return source, destination, false
+	}
+
+	var clientPort uint16
+	if remoteAddrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && remoteAddrPort.Addr() == clientAddr {
+		clientPort = remoteAddrPort.Port()
+	}
+
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return source, destination, false
+	}
+
+	return netip.AddrPortFrom(clientAddr.Unmap(), clientPort), localAddr.AddrPort(), true
+}
+
+// proxyProtocolHeader builds a PROXY protocol header of version for a tcp
+// connection from source to destination. Without the addresses, v1 sends
+// UNKNOWN and v2 sends a LOCAL command, so the backend uses the proxy's
+// own address.
+func proxyProtocolHeader(
+	version string,
+	source netip.AddrPort,
+	destination netip.AddrPort,
+	ok bool,
+) []byte {
+
+	// the header has no room for a zone
+	source = netip.AddrPortFrom(source.Addr().Unmap().WithZone(""), source.Port())
+	destination = netip.AddrPortFrom(destination.Addr().Unmap().WithZone(""), destination.Port())
+
+	if version == proxyProtocolV1 {
+		if !ok || source.Addr().Is4() != destination.Addr().Is4() {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+
+		family := "TCP4"
+		if source.Addr().Is6() {
+			family = "TCP6"
+		}
+
+		return []byte("PROXY " + family + " " +
+			source.Addr().String() + " " + destination.Addr().String() + " " +
+			strconv.Itoa(int(source.Port())) + " " + strconv.Itoa(int(destination.Port())) + "\r\n")
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+
+	if !ok {
+		// version 2, LOCAL command, unspecified family, no addresses
+		header.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+
+	var addresses []byte
+	familyAndProtocol := byte(0x11) // inet, stream
+	if source.Addr().Is4() && destination.Addr().Is4() {
+		sourceIP, destinationIP := source.Addr().As4(), destination.Addr().As4()
+		addresses = append(addresses, sourceIP[:]...)
+		addresses = append(addresses, destinationIP[:]...)
+	} else {
+		familyAndProtocol = 0x21 // inet6, stream
+		sourceIP, destinationIP := source.Addr().As16(), destination.Addr().As16()
+		addresses = append(addresses, sourceIP[:]...)
+		addresses = append(addresses, destinationIP[:]...)
+	}
+	addresses = binary.BigEndian.AppendUint16(addresses, source.Port())
+	addresses = binary.BigEndian.AppendUint16(addresses, destination.Port())
+
+	// version 2, PROXY command
+	header.Write([]byte{0x21, familyAndProtocol})
+	header.Write(binary.BigEndian.AppendUint16(nil, uint16(len(addresses))))
+	header.Write(addresses)
+
+	return header.Bytes()
+}
+
+// writeProxyProtocolHeader writes header as the first bytes on a freshly
+// dialed backend conn, within backendDialTimeout, closing conn on error.
+func writeProxyProtocolHeader(
+	conn net.Conn,
+	header []byte,
+) error {
+
+	conn.SetWriteDeadline(time.Now().Add(*backendDialTimeout))
+
+	if _, err := conn.Write(header); err != nil {
+		conn.Close()
+		return fmt.Errorf("proxy protocol header write error: %w", err)
+	}
+
+	conn.SetWriteDeadline(time.Time{})
+
+	return nil
+}
+
+// proxyProtocolListener wraps a listener whose connections each start with a
+// PROXY protocol v1 or v2 header, such as from an L4 load balancer, so their
+// RemoteAddr and LocalAddr are the addresses in the header.
+type proxyProtocolListener struct {
+	net.Listener
+	headerTimeout time.Duration
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtocolConn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+// proxyProtocolConn reads its PROXY protocol header on the first Read,
+// RemoteAddr, or LocalAddr call, so a slow client does not hold up Accept.
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+
+	headerOnce sync.Once
+	headerErr  error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.headerOnce.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.headerOnce.Do(c.readHeader)
+	return c.remoteAddr
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.headerOnce.Do(c.readHeader)
+	return c.localAddr
+}
+
+// readHeader reads the header within headerTimeout. Connections whose header
+// is missing or malformed are logged and closed, and LOCAL or
+// UNKNOWN headers, such as load balancer health checks, keep the conn's own
+// addresses.
+func (c *proxyProtocolConn) readHeader() {
+	c.remoteAddr = c.Conn.RemoteAddr()
+	c.localAddr = c.Conn.LocalAddr()
+
+	c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	source, destination, ok, err := readProxyProtocolHeader(c.reader)
+	if err != nil {
+		slog.Warn("proxy protocol header error",
+			"remoteAddr", c.remoteAddr.String(),
+			"error", err,
+		)
+		c.headerErr = err
+		c.Conn.Close()
+		return
+	}
+
+	if ok {
+		c.remoteAddr = net.TCPAddrFromAddrPort(source)
+		c.localAddr = net.TCPAddrFromAddrPort(destination)
+	}
+}
+
+// readProxyProtocolHeader reads a v1 or v2 header from reader, returning ok
+// false for headers without addresses and for address families other than
+// tcp over ipv4 or ipv6.
+func readProxyProtocolHeader(reader *bufio.Reader) (source netip.AddrPort, destination netip.AddrPort, ok bool, err error) {
+	prefix, err := reader.Peek(5)
+	if err != nil {
+		return source, destination, false, fmt.Errorf("%w: %w", errProxyProtocolMissing, err)
+	}
+
+	if string(prefix) == "PROXY" {
+		return readProxyProtocolV1Header(reader)
+	}
+
+	fixedHeader, err := reader.Peek(16)
+	if err != nil || !bytes.Equal(fixedHeader[:12], proxyProtocolV2Signature) {
+		return source, destination, false, errProxyProtocolMissing
+	}
+
+	return readProxyProtocolV2Header(reader)
+}
+
+// readProxyProtocolV1Header reads a line such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func readProxyProtocolV1Header(reader *bufio.Reader) (source netip.AddrPort, destination netip.AddrPort, ok bool, err error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return source, destination, false, fmt.Errorf("%w: %w", errProxyProtocolMalformed, err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+
+	fields, found := strings.CutSuffix(string(line), "\r\n")
+	if !found {
+		return source, destination, false, errProxyProtocolMalformed
+	}
+
+	parts := strings.Split(fields, " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return source, destination, false, nil
+	}
+
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return source, destination, false, errProxyProtocolMalformed
+	}
+
+	source, err = netip.ParseAddrPort(net.JoinHostPort(parts[2], parts[4]))
+	if err != nil {
+		return source, destination, false, fmt.Errorf("%w: %w", errProxyProtocolMalformed, err)
+	}
+
+	destination, err = netip.ParseAddrPort(net.JoinHostPort(parts[3], parts[5]))
+	if err != nil {
+		return source, destination, false, fmt.Errorf("%w: %w", errProxyProtocolMalformed, err)
+	}
+
+	source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+	destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+
+	return source, destination, true, nil
+}
+
+// readProxyProtocolV2Header reads the binary header, ignoring any TLVs
+// after the addresses.
+func readProxyProtocolV2Header(reader *bufio.Reader) (source netip.AddrPort, destination netip.AddrPort, ok bool, err error) {
+	fixedHeader := make([]byte, 16)
+	if _, err := io.ReadFull(reader, fixedHeader); err != nil {
+		return source, destination, false, fmt.Errorf("%w: %w", errProxyProtocolMalformed, err)
+	}
+
+	versionAndCommand := fixedHeader[12]
+	familyAndProtocol := fixedHeader[13]
+
+	if versionAndCommand>>4 != 2 {
+		return source, destination, false, errProxyProtocolMalformed
+	}
+
+	addresses := make([]byte, binary.BigEndian.Uint16(fixedHeader[14:]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return source, destination, false, fmt.Errorf("%w: %w", errProxyProtocolMalformed, err)
+	}
+
+	// LOCAL command
+	if versionAndCommand&0x0f == 0 {
+		return source, destination, false, nil
+	}
+
+	switch {
+	case familyAndProtocol == 0x11 && len(addresses) >= 12:
+		source = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addresses[0:4])), binary.BigEndian.Uint16(addresses[8:]))
+		destination = netip.AddrPortFrom(netip.AddrFrom4([4]byte(addresses[4:8])), binary.BigEndian.Uint16(addresses[10:]))
+	case familyAndProtocol == 0x21 && len(addresses) >= 36:
+		source = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addresses[0:16])).Unmap(), binary.BigEndian.Uint16(addresses[32:]))
+		destination = netip.AddrPortFrom(netip.AddrFrom16([16]byte(addresses[16:32])).Unmap(), binary.BigEndian.Uint16(addresses[34:]))
+	default:
+		return source, destination, false, nil
+	}
+
+	return source, destination, true, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestProxyProtocolHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name            string
+		source          string
+		destination     string
+		wantSource      string
+		wantDestination string
+		wantV1          string
+	}{
+		{
+			name:            "ipv4",
+			source:          "192.0.2.1:56324",
+			destination:     "192.0.2.2:443",
+			wantSource:      "192.0.2.1:56324",
+			wantDestination: "192.0.2.2:443",
+			wantV1:          "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+		},
+		{
+			name:            "ipv6",
+			source:          "[2001:db8::1]:56324",
+			destination:     "[2001:db8::2]:443",
+			wantSource:      "[2001:db8::1]:56324",
+			wantDestination: "[2001:db8::2]:443",
+			wantV1:          "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			name:            "ipv4 client on a dual stack listener",
+			source:          "[::ffff:192.0.2.1]:56324",
+			destination:     "[::ffff:192.0.2.2]:443",
+			wantSource:      "192.0.2.1:56324",
+			wantDestination: "192.0.2.2:443",
+			wantV1:          "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n",
+		},
+		{
+			name:            "ipv6 with zone",
+			source:          "[fe80::1%eth0]:56324",
+			destination:     "[fe80::2%eth0]:443",
+			wantSource:      "[fe80::1]:56324",
+			wantDestination: "[fe80::2]:443",
+			wantV1:          "PROXY TCP6 fe80::1 fe80::2 56324 443\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		for _, version := range []string{proxyProtocolV1, proxyProtocolV2} {
+			t.Run(test.name+" "+version, func(t *testing.T) {
+				header := proxyProtocolHeader(version,
+					netip.MustParseAddrPort(test.source),
+					netip.MustParseAddrPort(test.destination),
+					true,
+				)
+
+				if version == proxyProtocolV1 && string(header) != test.wantV1 {
+					t.Errorf("header = %q, want %q", header, test.wantV1)
+				}
+
+				source, destination, ok, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(header)))
+				if err != nil || !ok {
+					t.Fatalf("readProxyProtocolHeader ok = %v, error %v", ok, err)
+				}
+
+				if source.String() != test.wantSource || destination.String() != test.wantDestination {
+					t.Errorf("read %v %v, want %v %v", source, destination, test.wantSource, test.wantDestination)
+				}
+			})
+		}
+	}
+}
+
+func TestProxyProtocolHeaderMixedFamilies(t *testing.T) {
+	source := netip.MustParseAddrPort("192.0.2.1:56324")
+	destination := netip.MustParseAddrPort("[2001:db8::2]:443")
+
+	if header := proxyProtocolHeader(proxyProtocolV1, source, destination, true); string(header) != "PROXY UNKNOWN\r\n" {
+		t.Errorf("v1 header = %q, want PROXY UNKNOWN", header)
+	}
+
+	header := proxyProtocolHeader(proxyProtocolV2, source, destination, true)
+	readSource, readDestination, ok, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(header)))
+	if err != nil || !ok {
+		t.Fatalf("readProxyProtocolHeader ok = %v, error %v", ok, err)
+	}
+	if readSource != source || readDestination != destination {
+		t.Errorf("read %v %v, want %v %v", readSource, readDestination, source, destination)
+	}
+}
+
+func TestProxyProtocolAddrs(t *testing.T) {
+	localAddr := &net.TCPAddr{
+		IP:   net.ParseIP("2001:db8::2"),
+		Port: 443,
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		clientIP   string
+		wantSource string
+		wantOK     bool
+	}{
+		{
+			name:       "bracketed ipv6 remote addr keeps its port",
+			remoteAddr: "[2001:db8::1]:56324",
+			clientIP:   "2001:db8::1",
+			wantSource: "[2001:db8::1]:56324",
+			wantOK:     true,
+		},
+		{
+			name:       "forwarded ipv6 client has no port",
+			remoteAddr: "[2001:db8::1]:56324",
+			clientIP:   "2001:db8::9",
+			wantSource: "[2001:db8::9]:0",
+			wantOK:     true,
+		},
+		{
+			name:       "ipv4-mapped client is unmapped",
+			remoteAddr: "[2001:db8::1]:56324",
+			clientIP:   "::ffff:192.0.2.9",
+			wantSource: "192.0.2.9:0",
+			wantOK:     true,
+		},
+		{
+			name:       "unknown client ip",
+			remoteAddr: "@",
+			clientIP:   "@",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := (&http.Request{RemoteAddr: test.remoteAddr}).WithContext(
+				context.WithValue(context.Background(), http.LocalAddrContextKey, localAddr),
+			)
+
+			source, destination, ok := proxyProtocolAddrs(r, test.clientIP)
+			if ok != test.wantOK {
+				t.Fatalf("proxyProtocolAddrs ok = %v, want %v", ok, test.wantOK)
+			}
+			if !ok {
+				return
+			}
+
+			if source.String() != test.wantSource {
+				t.Errorf("source = %v, want %v", source, test.wantSource)
+			}
+			if destination.String() != "[2001:db8::2]:443" {
+				t.Errorf("destination = %v, want [2001:db8::2]:443", destination)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolV1HeaderUnmapsIPv4(t *testing.T) {
+	header := "PROXY TCP6 ::ffff:192.0.2.1 ::ffff:192.0.2.2 56324 443\r\n"
+
+	source, destination, ok, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader([]byte(header))))
+	if err != nil || !ok {
+		t.Fatalf("readProxyProtocolHeader ok = %v, error %v", ok, err)
+	}
+
+	if source.String() != "192.0.2.1:56324" || destination.String() != "192.0.2.2:443" {
+		t.Errorf("read %v %v, want 192.0.2.1:56324 192.0.2.2:443", source, destination)
+	}
+}
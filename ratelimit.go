@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a token bucket rate limiter.
+// Tokens refill continuously at rate per second up to burst.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(
+	rate float64,
+	burst float64,
+) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens if they will be available within maxWait,
+// returning how long the caller must wait before proceeding.
+// If the tokens would not be available in time nothing is taken, ok is false,
+// and delay is how long until they would be.
+func (tb *tokenBucket) reserve(
+	n float64,
+	maxWait time.Duration,
+) (delay time.Duration, ok bool) {
+
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	now := time.Now()
+
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+
+	if tb.tokens < n {
+		delay = time.Duration((n - tb.tokens) / tb.rate * float64(time.Second))
+		if delay > maxWait {
+			return delay, false
+		}
+	}
+
+	tb.tokens -= n
+
+	return delay, true
+}
+
+// refund returns n tokens taken by reserve that went unused, such as by a
+// caller that gave up waiting, so later callers need not wait for them.
+func (tb *tokenBucket) refund(n float64) {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	now := time.Now()
+
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate+n)
+	tb.last = now
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefund(t *testing.T) {
+	bucket := newTokenBucket(1, 1)
+
+	if delay, ok := bucket.reserve(1, 0); !ok || delay != 0 {
+		t.Fatalf("first reserve = %v, %v, want 0, true", delay, ok)
+	}
+
+	// a caller reserves the next token, then gives up waiting for it
+	if _, ok := bucket.reserve(1, 10*time.Second); !ok {
+		t.Fatal("second reserve not ok")
+	}
+	bucket.refund(1)
+
+	// the next caller waits for one token, not two
+	delay, ok := bucket.reserve(1, 10*time.Second)
+	if !ok || delay > 1100*time.Millisecond {
+		t.Fatalf("reserve after refund = %v, %v, want at most 1s, true", delay, ok)
+	}
+}
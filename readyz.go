@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errNoBackends = errors.New("no backends configured")
+
+// readinessCache holds the result of the last backend check, so frequent
+// readiness probes do not dial the backends on every request.
+type readinessCache struct {
+	mutex     sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+var backendReadiness readinessCache
+
+// check returns the cached backend check result, dialing the backends again
+// once it is older than readyzCacheTTL.
+func (rc *readinessCache) check(ctx context.Context) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if !rc.checkedAt.IsZero() && time.Since(rc.checkedAt) < *readyzCacheTTL {
+		return rc.err
+	}
+
+	err := anyBackendReachable(ctx, *readyzDialTimeout)
+	if (err == nil) != (rc.err == nil) && !rc.checkedAt.IsZero() {
+		slog.Info("readyz backend check changed",
+			"ready", err == nil,
+			"error", err,
+		)
+	}
+
+	rc.checkedAt = time.Now()
+	rc.err = err
+
+	return err
+}
+
+// anyBackendReachable dials the backends in turn within timeout,
+// returning nil once one accepts a connection.
+func anyBackendReachable(
+	ctx context.Context,
+	timeout time.Duration,
+) error {
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := errNoBackends
+	for _, backend := range backends.Load().backends {
+		conn, dialErr := dialBackendConn(ctx, backend)
+		if dialErr == nil {
+			conn.Close()
+			return nil
+		}
+		err = dialErr
+	}
+
+	return fmt.Errorf("no backend reachable: %w", err)
+}
+
+// readyzHandler answers 503 while draining or shutting down, or with
+// readyzCheckBackends while no backend is reachable, so a load balancer
+// stops sending new connections. Otherwise it answers 200.
+func readyzHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if _, draining := drainingSince(); draining || shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready: draining\n"))
+		return
+	}
+
+	if *readyzCheckBackends {
+		if err := backendReadiness.check(r.Context()); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %v\n", err)
+			return
+		}
+	}
+
+	w.Write([]byte("ready\n"))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reconnectingBackendConn is a backend connection that is redialed when it is
+// reset, so the client connection survives a backend restart. Data in flight
+// when the reset happened is lost. At most maxReconnects redials are made
+// within each window, or within the whole connection if window is 0, after
+// which onExhausted is called with the reason and the reset error is returned.
+type reconnectingBackendConn struct {
+	dial          func(ctx context.Context) (net.Conn, error)
+	maxReconnects int
+	window        time.Duration
+	onExhausted   func(reason string)
+	txLogger      *slog.Logger
+
+	// canceled by Close, ending a redial in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex          sync.Mutex
+	conn           net.Conn
+	reconnectTimes []time.Time
+	reconnects     int
+	closed         bool
+}
+
+func newReconnectingBackendConn(
+	conn net.Conn,
+	dial func(ctx context.Context) (net.Conn, error),
+	maxReconnects int,
+	window time.Duration,
+	onExhausted func(reason string),
+	txLogger *slog.Logger,
+) *reconnectingBackendConn {
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &reconnectingBackendConn{
+		dial:          dial,
+		maxReconnects: maxReconnects,
+		window:        window,
+		onExhausted:   onExhausted,
+		txLogger:      txLogger,
+		ctx:           ctx,
+		cancel:        cancel,
+		conn:          conn,
+	}
+}
+
+// isBackendReset reports whether err means the backend reset the connection.
+func isBackendReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+func (rc *reconnectingBackendConn) current() net.Conn {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	return rc.conn
+}
+
+// reconnect replaces failed with a newly dialed connection, returning false if
+// the reconnect limit is reached, the dial fails, or rc is closed. When the
+// other direction already replaced failed it returns true at once.
+func (rc *reconnectingBackendConn) reconnect(
+	failed net.Conn,
+	resetErr error,
+) bool {
+
+	// called after unlocking, as closing the client may wait for the other direction
+	exhaustedReason := ""
+	defer func() {
+		if exhaustedReason != "" {
+			rc.onExhausted(exhaustedReason)
+		}
+	}()
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.closed {
+		return false
+	}
+	if rc.conn != failed {
+		return true
+	}
+
+	now := time.Now()
+	if rc.window > 0 {
+		recent := rc.reconnectTimes[:0]
+		for _, reconnectTime := range rc.reconnectTimes {
+			if now.Sub(reconnectTime) < rc.window {
+				recent = append(recent, reconnectTime)
+			}
+		}
+		rc.reconnectTimes = recent
+	}
+
+	if len(rc.reconnectTimes) >= rc.maxReconnects {
+		rc.txLogger.Warn("backend reconnect limit reached",
+			"maxBackendReconnects", rc.maxReconnects,
+			"backendReconnectWindow", rc.window.String(),
+			"backendReconnects", rc.reconnects,
+			"error", resetErr,
+		)
+		exhaustedReason = "backend reconnect limit reached"
+		return false
+	}
+
+	failed.Close()
+
+	conn, err := rc.dial(rc.ctx)
+	if err != nil {
+		rc.txLogger.Warn("backend reconnect error",
+			"backendReconnects", rc.reconnects,
+			"error", err,
+		)
+		exhaustedReason = "backend reconnect failed"
+		return false
+	}
+
+	rc.conn = conn
+	rc.reconnects++
+	rc.reconnectTimes = append(rc.reconnectTimes, now)
+
+	rc.txLogger.Info("backend reconnected after reset",
+		"backendReconnects", rc.reconnects,
+		"resetError", resetErr,
+	)
+
+	return true
+}
+
+// backendReconnects returns the number of successful reconnects.
+func (rc *reconnectingBackendConn) backendReconnects() int {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	return rc.reconnects
+}
+
+func (rc *reconnectingBackendConn) Read(p []byte) (int, error) {
+	for {
+		conn := rc.current()
+
+		n, err := conn.Read(p)
+		if n > 0 || !isBackendReset(err) || !rc.reconnect(conn, err) {
+			return n, err
+		}
+	}
+}
+
+func (rc *reconnectingBackendConn) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		conn := rc.current()
+
+		n, err := conn.Write(p[written:])
+		written += n
+		if !isBackendReset(err) || !rc.reconnect(conn, err) {
+			return written, err
+		}
+	}
+}
+
+func (rc *reconnectingBackendConn) Close() error {
+	rc.cancel()
+
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	rc.closed = true
+	return rc.conn.Close()
+}
+
+// CloseWrite half closes the current connection, for connectionTeardown.
+func (rc *reconnectingBackendConn) CloseWrite() error {
+	closeWriter, ok := rc.current().(interface{ CloseWrite() error })
+	if !ok {
+		return nil
+	}
+	return closeWriter.CloseWrite()
+}
+
+func (rc *reconnectingBackendConn) LocalAddr() net.Addr {
+	return rc.current().LocalAddr()
+}
+
+func (rc *reconnectingBackendConn) RemoteAddr() net.Addr {
+	return rc.current().RemoteAddr()
+}
+
+func (rc *reconnectingBackendConn) SetDeadline(t time.Time) error {
+	return rc.current().SetDeadline(t)
+}
+
+func (rc *reconnectingBackendConn) SetReadDeadline(t time.Time) error {
+	return rc.current().SetReadDeadline(t)
+}
+
+func (rc *reconnectingBackendConn) SetWriteDeadline(t time.Time) error {
+	return rc.current().SetWriteDeadline(t)
+}
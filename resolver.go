@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// newDNSServerResolver returns a resolver that sends every query to dnsServer
+// instead of the servers in the system configuration.
+// dnsServer is host or host:port, the port defaults to 53.
+// IPv6 addresses may be bracketed, and must be when a port is given.
+func newDNSServerResolver(dnsServer string) (*net.Resolver, error) {
+	if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+		dnsServer = net.JoinHostPort(trimIPv6Brackets(dnsServer), "53")
+	}
+
+	if _, _, err := net.SplitHostPort(dnsServer); err != nil {
+		return nil, fmt.Errorf("invalid dnsServer %q: %w", dnsServer, err)
+	}
+
+	return &net.Resolver{
+		// the go resolver is required for Dial to be used
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, dnsServer)
+		},
+	}, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// setRetryAfter sets the Retry-After header on a capacity rejection to
+// retryAfterSeconds, or to wait rounded up to whole seconds when that is
+// longer, such as the time until the rate limiter has a token.
+// Returns the seconds advertised, 0 if retryAfterSeconds is unset and no header
+// was set.
+func setRetryAfter(
+	w http.ResponseWriter,
+	wait time.Duration,
+) int {
+
+	if *retryAfterSeconds <= 0 {
+		return 0
+	}
+
+	seconds := max(*retryAfterSeconds, int(math.Ceil(wait.Seconds())))
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	return seconds
+}
@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+const reusePortSupported = false
+
+// reusePortControl is not supported on this platform.
+func reusePortControl(
+	network string,
+	address string,
+	rawConn syscall.RawConn,
+) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on a listen socket before it is bound,
+// so another process can listen on the same address at the same time.
+func reusePortControl(
+	network string,
+	address string,
+	rawConn syscall.RawConn,
+) error {
+
+	var setsockoptErr error
+
+	err := rawConn.Control(func(fd uintptr) {
+		setsockoptErr = unix.SetsockoptInt(
+			int(fd),
+			unix.SOL_SOCKET,
+			unix.SO_REUSEPORT,
+			1,
+		)
+	})
+	if err != nil {
+		return err
+	}
+
+	return setsockoptErr
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// route proxies requests for path to its own backends.
+// A path ending in "/" matches every path below it, as in http.ServeMux.
+type route struct {
+	path        string
+	backends    *backendPool
+	messageType websocket.MessageType
+}
+
+// routeConfig is the json file given by the config flag.
+type routeConfig struct {
+	Routes []struct {
+		Path        string `json:"path"`
+		Backends    string `json:"backends"`
+		MessageType string `json:"messageType"`
+
+		// override backendDialTimeout, backendSourceIP, and backendIPFamily
+		// for the route's backends, with a backend's own dialTimeout kept
+		DialTimeout string `json:"dialTimeout"`
+		SourceIP    string `json:"sourceIP"`
+		IPFamily    string `json:"ipFamily"`
+
+		// override backendNoDelay, backendKeepAliveInterval,
+		// backendKeepAliveCount, backendSendBuffer, and backendRecvBuffer
+		NoDelay           *bool  `json:"noDelay"`
+		KeepAliveInterval string `json:"keepAliveInterval"`
+		KeepAliveCount    int    `json:"keepAliveCount"`
+		SendBuffer        int    `json:"sendBuffer"`
+		RecvBuffer        int    `json:"recvBuffer"`
+	} `json:"routes"`
+
+	// added to the allowCIDRs and denyCIDRs flags
+	AllowCIDRs []string `json:"allowCIDRs"`
+	DenyCIDRs  []string `json:"denyCIDRs"`
+}
+
+// routes from the config file, longest path first so the most specific
+// route matches. Swapped on each reload, and nil if config is unset.
+var configuredRoutes atomic.Pointer[[]*route]
+
+// serializes reloadRouteConfig calls
+var routeConfigReloadMutex sync.Mutex
+
+// parseRouteConfig parses config file contents, with each route's backends
+// as in tcpHostAndPort, returning the routes and client ip CIDRs.
+func parseRouteConfig(contents []byte) ([]*route, clientIPFilter, error) {
+	var config routeConfig
+	if err := json.Unmarshal(contents, &config); err != nil {
+		return nil, clientIPFilter{}, fmt.Errorf("json.Unmarshal error: %w", err)
+	}
+
+	if len(config.Routes) == 0 {
+		return nil, clientIPFilter{}, errors.New("no routes configured")
+	}
+
+	var filter clientIPFilter
+	var err error
+
+	if filter.allow, err = parseCIDRs("allowCIDRs", config.AllowCIDRs); err != nil {
+		return nil, clientIPFilter{}, err
+	}
+	if filter.deny, err = parseCIDRs("denyCIDRs", config.DenyCIDRs); err != nil {
+		return nil, clientIPFilter{}, err
+	}
+
+	var routes []*route
+
+	for i, configRoute := range config.Routes {
+		if !strings.HasPrefix(configRoute.Path, "/") {
+			return nil, clientIPFilter{}, fmt.Errorf("route %v: path %q must start with /", i, configRoute.Path)
+		}
+
+		if slices.ContainsFunc(routes, func(r *route) bool { return r.path == configRoute.Path }) {
+			return nil, clientIPFilter{}, fmt.Errorf("route %v: duplicate path %q", i, configRoute.Path)
+		}
+
+		backends, err := newBackendPool(configRoute.Backends)
+		if err != nil {
+			return nil, clientIPFilter{}, fmt.Errorf("route %v: %w", i, err)
+		}
+
+		if err := applyRouteDialOptions(backends, configRoute.DialTimeout, configRoute.SourceIP, configRoute.IPFamily); err != nil {
+			return nil, clientIPFilter{}, fmt.Errorf("route %v: %w", i, err)
+		}
+
+		if err := applyRouteTCPOptions(backends, configRoute.NoDelay, configRoute.KeepAliveInterval, configRoute.KeepAliveCount, configRoute.SendBuffer, configRoute.RecvBuffer); err != nil {
+			return nil, clientIPFilter{}, fmt.Errorf("route %v: %w", i, err)
+		}
+
+		messageType := proxyMessageType
+		if configRoute.MessageType != "" {
+			if messageType, err = parseMessageType("messageType", configRoute.MessageType); err != nil {
+				return nil, clientIPFilter{}, fmt.Errorf("route %v: %w", i, err)
+			}
+		}
+
+		routes = append(routes, &route{
+			path:        configRoute.Path,
+			backends:    backends,
+			messageType: messageType,
+		})
+	}
+
+	slices.SortStableFunc(routes, func(a, b *route) int {
+		return len(b.path) - len(a.path)
+	})
+
+	return routes, filter, nil
+}
+
+// applyRouteDialOptions sets the dialTimeout, sourceIP, and ipFamily of a
+// route on each of its backends, leaving empty options to the flags.
+func applyRouteDialOptions(
+	backends *backendPool,
+	dialTimeout string,
+	sourceIP string,
+	ipFamily string,
+) error {
+
+	var timeout time.Duration
+	if dialTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(dialTimeout); err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid dialTimeout %q", dialTimeout)
+		}
+	}
+
+	var sourceAddr *net.TCPAddr
+	if sourceIP != "" {
+		var err error
+		if sourceAddr, err = parseBackendSourceIP(sourceIP); err != nil {
+			return fmt.Errorf("invalid sourceIP %q: %w", sourceIP, err)
+		}
+	}
+
+	var tcpNetwork string
+	if ipFamily != "" {
+		var err error
+		if tcpNetwork, err = parseIPFamily(ipFamily); err != nil {
+			return err
+		}
+	}
+
+	for _, backend := range backends.backends {
+		if backend.dialTimeout == 0 {
+			backend.dialTimeout = timeout
+		}
+		backend.sourceAddr = sourceAddr
+		backend.tcpNetwork = tcpNetwork
+	}
+
+	return nil
+}
+
+// applyRouteTCPOptions sets the socket options of a route on each of its
+// backends, leaving unset options to the flags.
+func applyRouteTCPOptions(
+	backends *backendPool,
+	noDelay *bool,
+	keepAliveInterval string,
+	keepAliveCount int,
+	sendBuffer int,
+	recvBuffer int,
+) error {
+
+	options := tcpOptions{
+		noDelay:        noDelay,
+		keepAliveCount: keepAliveCount,
+		sendBuffer:     sendBuffer,
+		recvBuffer:     recvBuffer,
+	}
+
+	if keepAliveInterval != "" {
+		var err error
+		if options.keepAliveInterval, err = time.ParseDuration(keepAliveInterval); err != nil || options.keepAliveInterval == 0 {
+			return fmt.Errorf("invalid keepAliveInterval %q", keepAliveInterval)
+		}
+	}
+
+	if keepAliveCount < 0 || sendBuffer < 0 || recvBuffer < 0 {
+		return errors.New("keepAliveCount, sendBuffer, and recvBuffer must not be negative")
+	}
+
+	for _, backend := range backends.backends {
+		backend.tcpOptions = options
+	}
+
+	return nil
+}
+
+// loadRouteConfig reads and parses the config file at path.
+func loadRouteConfig(path string) ([]*route, clientIPFilter, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, clientIPFilter{}, fmt.Errorf("os.ReadFile error: %w", err)
+	}
+
+	routes, filter, err := parseRouteConfig(contents)
+	if err != nil {
+		return nil, clientIPFilter{}, fmt.Errorf("parseRouteConfig error: %w", err)
+	}
+
+	return routes, filter, nil
+}
+
+// matchRoute returns the configured route for a request path, nil if none matches.
+func matchRoute(path string) *route {
+	for _, r := range *configuredRoutes.Load() {
+		if path == r.path || (strings.HasSuffix(r.path, "/") && strings.HasPrefix(path, r.path)) {
+			return r
+		}
+	}
+	return nil
+}
+
+// routesBackendPool returns a pool of the backends of every route, so the
+// backend metrics, admin endpoint, and startup checks cover them.
+// Connections are never balanced across it.
+func routesBackendPool(routes []*route) *backendPool {
+	pool := &backendPool{}
+	for _, r := range routes {
+		pool.backends = append(pool.backends, r.backends.backends...)
+	}
+	return pool
+}
+
+// storeRoutes makes routes the configured routes, their backends
+// the backends of the metrics and admin endpoint, and filter the config
+// file's client ip CIDRs.
+func storeRoutes(
+	routes []*route,
+	filter clientIPFilter,
+) {
+
+	configuredRoutes.Store(&routes)
+	backends.Store(routesBackendPool(routes))
+	storeClientIPFilter(filter)
+
+	for _, route := range routes {
+		slog.Info("route",
+			"path", route.path,
+			"backends", route.backends.hostAndPorts(),
+		)
+	}
+}
+
+// reloadRouteConfig re-reads the config file at path and swaps in its routes.
+// New connections use the new routes and backends, including their dial
+// timeouts, while existing connections are unaffected. If the file fails to
+// load the current routes are kept and the error is returned.
+func reloadRouteConfig(
+	path string,
+	trigger string,
+) error {
+
+	routeConfigReloadMutex.Lock()
+	defer routeConfigReloadMutex.Unlock()
+
+	routes, filter, err := loadRouteConfig(path)
+	if err != nil {
+		slog.Warn("loadRouteConfig error, keeping current routes",
+			"path", path,
+			"trigger", trigger,
+			"error", err,
+		)
+		return err
+	}
+
+	routesBackendPool(routes).inheritState(backends.Load())
+
+	slog.Info("route config reloaded",
+		"path", path,
+		"trigger", trigger,
+		"routes", len(routes),
+		"allowCIDRs", len(filter.allow),
+		"denyCIDRs", len(filter.deny),
+	)
+
+	storeRoutes(routes, filter)
+
+	return nil
+}
+
+// reloadRouteConfigOnSIGHUP reloads the config file at path on each SIGHUP.
+func reloadRouteConfigOnSIGHUP(
+	ctx context.Context,
+	path string,
+) {
+
+	sighupChannel := make(chan os.Signal, 1)
+	signal.Notify(sighupChannel, syscall.SIGHUP)
+	defer signal.Stop(sighupChannel)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighupChannel:
+			reloadRouteConfig(path, "SIGHUP")
+		}
+	}
+}
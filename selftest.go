@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	// larger than the default buffer sizes, so the payload is proxied
+	// in several reads and writes in each direction
+	selfTestPayloadSize = 256 * 1024
+
+	// size of each message the payload is sent in, within the default
+	// websocket read limit
+	selfTestMessageSize = 16 * 1024
+
+	selfTestTimeout = 10 * time.Second
+)
+
+// runSelfTest serves handler, proxying to the in-process echo backend, on a
+// loopback listener and checks that a payload sent by a websocket client
+// echoes back unchanged and that the connection then ends. Failures are fatal
+// with exitCodeSelfTest.
+func runSelfTest(handler http.Handler) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fatal(exitCodeListen, "net.Listen error: %w", err)
+	}
+
+	httpServer := &http.Server{
+		Handler: handler,
+	}
+	defer httpServer.Close()
+
+	go httpServer.Serve(listener)
+
+	url := "ws://" + listener.Addr().String() + *websocketPath
+	if *websocketPath == "" {
+		url += "/"
+	}
+
+	slog.Info("self test starting",
+		"url", url,
+		"payloadBytes", selfTestPayloadSize,
+	)
+
+	startTime := time.Now()
+
+	if err := selfTestRoundTrip(url); err != nil {
+		fatal(exitCodeSelfTest, "self test failed: %w", err)
+	}
+
+	slog.Info("self test passed",
+		"duration", time.Since(startTime).String(),
+	)
+
+	runShutdownHooks()
+}
+
+// selfTestRoundTrip sends a random payload to the proxy at url, reads it
+// back, and waits for the proxy to end the connection after the client closes.
+func selfTestRoundTrip(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	payload := make([]byte, selfTestPayloadSize)
+	rand.Read(payload)
+
+	websocketConn, _, err := websocket.Dial(ctx, url, nil)
+	if err != nil {
+		return fmt.Errorf("websocket.Dial error: %w", err)
+	}
+	defer websocketConn.CloseNow()
+
+	wsNetConn := websocket.NetConn(ctx, websocketConn, proxyMessageType)
+
+	writeErrors := make(chan error, 1)
+	go func() {
+		for chunk := range slices.Chunk(payload, selfTestMessageSize) {
+			if _, err := wsNetConn.Write(chunk); err != nil {
+				writeErrors <- err
+				return
+			}
+		}
+		writeErrors <- nil
+	}()
+
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(wsNetConn, echoed); err != nil {
+		return fmt.Errorf("read echo error: %w", err)
+	}
+
+	if err := <-writeErrors; err != nil {
+		return fmt.Errorf("write payload error: %w", err)
+	}
+
+	if !bytes.Equal(echoed, payload) {
+		return errors.New("echoed payload does not match the payload sent")
+	}
+
+	if err := websocketConn.Close(websocket.StatusNormalClosure, ""); err != nil {
+		return fmt.Errorf("websocketConn.Close error: %w", err)
+	}
+
+	for activeConnections.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("proxy connection did not end: %w", ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// session is an active tcp backend connection listed by /admin/connections,
+// or in client mode a connection tunneled by a forward.
+type session struct {
+	txID       string
+	clientIP   string
+	startTime  time.Time
+	byteCounts *connectionByteCounts
+
+	// listenHostAndPort of the client mode forward, empty when serving
+	forward string
+
+	// hostAndPort of the backend, changed if the dial fails over
+	backend atomic.Pointer[string]
+
+	// closes the client websocket, ending the connection
+	terminate func()
+}
+
+// sessionStatus describes a session for /admin/connections.
+type sessionStatus struct {
+	TxID            string    `json:"txID"`
+	ClientIP        string    `json:"clientIP"`
+	Backend         string    `json:"backend"`
+	StartTime       time.Time `json:"startTime"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	BytesWsToTcp    int64     `json:"bytesWsToTcp"`
+	BytesTcpToWs    int64     `json:"bytesTcpToWs"`
+	Forward         string    `json:"forward,omitempty"`
+}
+
+// active sessions by txID
+var (
+	activeSessionsMutex sync.Mutex
+	activeSessions      = make(map[string]*session)
+)
+
+// setBackend records the backend s is connected to.
+func (s *session) setBackend(hostAndPort string) {
+	s.backend.Store(&hostAndPort)
+}
+
+// registerSession adds s to the active sessions, returning a func that
+// removes it when the connection ends. A client supplied txID already in use
+// is listed for the newer session.
+func registerSession(s *session) func() {
+	activeSessionsMutex.Lock()
+	defer activeSessionsMutex.Unlock()
+
+	activeSessions[s.txID] = s
+
+	return func() {
+		activeSessionsMutex.Lock()
+		defer activeSessionsMutex.Unlock()
+
+		if activeSessions[s.txID] == s {
+			delete(activeSessions, s.txID)
+		}
+	}
+}
+
+// lookupSession returns the active session with txID, nil if there is none.
+func lookupSession(txID string) *session {
+	activeSessionsMutex.Lock()
+	defer activeSessionsMutex.Unlock()
+
+	return activeSessions[txID]
+}
+
+// adminConnectionsHandler lists the active sessions, oldest first.
+func adminConnectionsHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	activeSessionsMutex.Lock()
+	sessions := make([]*session, 0, len(activeSessions))
+	for _, s := range activeSessions {
+		sessions = append(sessions, s)
+	}
+	activeSessionsMutex.Unlock()
+
+	slices.SortFunc(sessions, func(a, b *session) int {
+		return cmp.Or(a.startTime.Compare(b.startTime), cmp.Compare(a.txID, b.txID))
+	})
+
+	now := time.Now()
+	sessionStatuses := make([]sessionStatus, 0, len(sessions))
+
+	for _, s := range sessions {
+		sessionStatuses = append(sessionStatuses, sessionStatus{
+			TxID:            s.txID,
+			ClientIP:        s.clientIP,
+			Backend:         *s.backend.Load(),
+			StartTime:       s.startTime,
+			DurationSeconds: now.Sub(s.startTime).Seconds(),
+			BytesWsToTcp:    s.byteCounts.wsToTcp.Load(),
+			BytesTcpToWs:    s.byteCounts.tcpToWs.Load(),
+			Forward:         s.forward,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionStatuses)
+}
+
+// adminTerminateConnectionHandler closes the session with the txID path
+// value, answering 404 if there is none.
+func adminTerminateConnectionHandler(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	txID := r.PathValue("txID")
+
+	s := lookupSession(txID)
+	if s == nil {
+		http.Error(w, "no active connection with txID", http.StatusNotFound)
+		return
+	}
+
+	slog.Warn("terminating connection by admin request",
+		"txID", txID,
+		"clientIP", s.clientIP,
+		"backend", *s.backend.Load(),
+	)
+
+	s.terminate()
+
+	w.Write([]byte("terminated\n"))
+}
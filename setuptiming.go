@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// connectionSetupTiming records when each stage of setting up a connection
+// completed, for one debug log line breaking down setup latency.
+type connectionSetupTiming struct {
+	requestTime time.Time
+	acceptTime  time.Time
+	dialTime    time.Time
+}
+
+// log logs the time from the request arriving to the websocket accept, the
+// backend dial, the first byte from the backend, and the first bytes proxied
+// in either direction. Stages that never happened are omitted.
+func (cst *connectionSetupTiming) log(
+	byteCounts *connectionByteCounts,
+	txLogger *slog.Logger,
+) {
+
+	if !txLogger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	since := func(t time.Time) string {
+		return t.Sub(cst.requestTime).String()
+	}
+
+	logAttrs := []any{
+		"timeToAccept", since(cst.acceptTime),
+		"timeToDial", since(cst.dialTime),
+	}
+
+	firstTcpToWs := byteCounts.firstTcpToWs.Load()
+	if firstTcpToWs != 0 {
+		logAttrs = append(logAttrs, "timeToFirstByte", since(time.Unix(0, firstTcpToWs)))
+	}
+
+	firstCopy := firstTcpToWs
+	if firstWsToTcp := byteCounts.firstWsToTcp.Load(); firstWsToTcp != 0 && (firstCopy == 0 || firstWsToTcp < firstCopy) {
+		firstCopy = firstWsToTcp
+	}
+	if firstCopy != 0 {
+		logAttrs = append(logAttrs, "timeToFirstCopy", since(time.Unix(0, firstCopy)))
+	}
+
+	txLogger.Debug("connection setup timing", logAttrs...)
+}
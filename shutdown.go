@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	shutdownHooksMutex sync.Mutex
+	shutdownHooks      []func()
+)
+
+// onShutdown registers hook to run before the process exits on shutdown,
+// or after a panic in main.
+func onShutdown(hook func()) {
+	shutdownHooksMutex.Lock()
+	defer shutdownHooksMutex.Unlock()
+
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// runShutdownHooks runs the registered hooks once, in reverse order of registration.
+func runShutdownHooks() {
+	shutdownHooksMutex.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownHooksMutex.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
+}
+
+const (
+	shutdownDrainPollInterval = 100 * time.Millisecond
+
+	// how long force closed connections have to finish their handlers
+	shutdownForceCloseWait = 1 * time.Second
+)
+
+var (
+	// set once shutdown begins, new connections are then rejected
+	shuttingDown atomic.Bool
+
+	// canceled when shutdown force closes the remaining connections
+	forceCloseContext, forceCloseConnections = context.WithCancel(context.Background())
+
+	shutdownOnce sync.Once
+
+	shutdownServersMutex sync.Mutex
+	shutdownServers      []*http.Server
+
+	// closed when shutdown begins rather than after draining, with reusePort
+	shutdownStartListeners []net.Listener
+)
+
+// closeOnShutdown registers server to be closed by shutdown
+// once connections have drained.
+func closeOnShutdown(server *http.Server) {
+	shutdownServersMutex.Lock()
+	defer shutdownServersMutex.Unlock()
+
+	shutdownServers = append(shutdownServers, server)
+}
+
+// closeOnShutdownStart registers listeners to be closed as soon as shutdown
+// begins, so with reusePort a new process listening on the same addresses
+// receives every new connection while this one drains.
+func closeOnShutdownStart(listeners ...net.Listener) {
+	shutdownServersMutex.Lock()
+	defer shutdownServersMutex.Unlock()
+
+	shutdownStartListeners = append(shutdownStartListeners, listeners...)
+}
+
+// waitForActiveConnections waits up to timeout for activeConnections to reach
+// zero, returning the number still active.
+func waitForActiveConnections(timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		active := activeConnections.Load()
+		if active == 0 || !time.Now().Before(deadline) {
+			return active
+		}
+		time.Sleep(min(shutdownDrainPollInterval, time.Until(deadline)))
+	}
+}
+
+// shutdown stops accepting new connections, waits up to shutdownTimeout for
+// active connections to end, force closes the rest, closes the listeners,
+// then runs the shutdown hooks and exits. Each phase is logged with the
+// elapsed time. Only the first call shuts down, later calls return at once.
+func shutdown() {
+	shutdownOnce.Do(func() {
+		startTime := time.Now()
+
+		shuttingDown.Store(true)
+		startDraining()
+
+		slog.Info("shutdown phase",
+			"phase", "stop accepting",
+			"activeConnections", activeConnections.Load(),
+		)
+
+		shutdownServersMutex.Lock()
+		for _, listener := range shutdownStartListeners {
+			listener.Close()
+		}
+		shutdownServersMutex.Unlock()
+
+		remaining := activeConnections.Load()
+		activeAtStart := remaining
+
+		if remaining > 0 && *shutdownTimeout > 0 {
+			slog.Info("shutdown phase",
+				"phase", "draining",
+				"activeConnections", remaining,
+				"shutdownTimeout", shutdownTimeout.String(),
+			)
+
+			remaining = waitForActiveConnections(*shutdownTimeout)
+		}
+
+		drained := remaining == 0
+		forceClosed := remaining
+
+		if !drained {
+			slog.Warn("shutdown phase",
+				"phase", "force-closing remaining",
+				"activeConnections", remaining,
+				"elapsed", time.Since(startTime).String(),
+			)
+
+			forceCloseConnections()
+			remaining = waitForActiveConnections(shutdownForceCloseWait)
+		}
+
+		shutdownServersMutex.Lock()
+		for _, server := range shutdownServers {
+			server.Close()
+		}
+		shutdownServersMutex.Unlock()
+
+		slog.Info("shutdown phase",
+			"phase", "closed listeners",
+			"elapsed", time.Since(startTime).String(),
+		)
+
+		runShutdownHooks()
+
+		slog.Info("shutdown phase",
+			"phase", "exited",
+			"drained", drained,
+			"drainedConnections", activeAtStart-forceClosed,
+			"forceClosedConnections", forceClosed,
+			"activeConnections", remaining,
+			"elapsed", time.Since(startTime).String(),
+		)
+
+		os.Exit(0)
+	})
+}
+
+// waitForShutdownExit blocks a server whose Serve returned after shutdown
+// closed it, until shutdown exits the process.
+func waitForShutdownExit() {
+	select {}
+}
+
+// exitOnShutdownSignal shuts down on SIGINT or SIGTERM.
+func exitOnShutdownSignal() {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		receivedSignal := <-signalChannel
+
+		slog.Info("received shutdown signal, shutting down",
+			"signal", receivedSignal.String(),
+		)
+
+		shutdown()
+	}()
+}
+
+// shutdownAfterMaxUptime shuts down once the process has run for maxUptime,
+// so a supervisor restarts it fresh.
+func shutdownAfterMaxUptime(maxUptime time.Duration) {
+	time.AfterFunc(maxUptime, func() {
+		slog.Info("max uptime reached, initiating shutdown",
+			"maxUptime", maxUptime.String(),
+		)
+
+		shutdown()
+	})
+}
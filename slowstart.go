@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// weights are scaled so a backend of weight 1 can ramp up from a fraction of
+// its full weight
+const slowStartWeightScale = 100
+
+// startSlowStart ramps backend's effective weight up to its full weight over
+// backendSlowStart, if set, so a cold backend is not given its full share of
+// new connections at once.
+func (b *backend) startSlowStart(reason string) {
+	if *backendSlowStart <= 0 {
+		return
+	}
+
+	b.slowStartLoggedQuarter.Store(0)
+	b.slowStartTime.Store(time.Now().UnixNano())
+
+	slog.Info("backend slow start begun",
+		"backend", b.hostAndPort,
+		"reason", reason,
+		"backendSlowStart", backendSlowStart.String(),
+	)
+}
+
+// updateEffectiveWeight sets effectiveWeight from the weight and the progress
+// of any slow start, logging each quarter of the ramp.
+// It must be called with backendPool.mutex held.
+func (b *backend) updateEffectiveWeight(now time.Time) {
+	fullWeight := b.weight * slowStartWeightScale
+
+	startTime := b.slowStartTime.Load()
+	if startTime == 0 {
+		b.effectiveWeight = fullWeight
+		return
+	}
+
+	elapsed := now.Sub(time.Unix(0, startTime))
+	if elapsed >= *backendSlowStart {
+		b.effectiveWeight = fullWeight
+
+		if b.slowStartTime.CompareAndSwap(startTime, 0) {
+			slog.Info("backend slow start complete",
+				"backend", b.hostAndPort,
+				"effectiveWeight", fullWeight,
+			)
+		}
+		return
+	}
+
+	b.effectiveWeight = max(1, int(int64(fullWeight)*int64(elapsed)/int64(*backendSlowStart)))
+
+	quarter := int32(4 * elapsed / *backendSlowStart)
+	if loggedQuarter := b.slowStartLoggedQuarter.Load(); quarter > loggedQuarter &&
+		b.slowStartLoggedQuarter.CompareAndSwap(loggedQuarter, quarter) {
+
+		slog.Info("backend slow start progress",
+			"backend", b.hostAndPort,
+			"progressPercent", 25*quarter,
+			"effectiveWeight", b.effectiveWeight,
+			"fullWeight", fullWeight,
+		)
+	}
+}
+
+// inheritState shares the state of each backend of previous with the
+// backend of bp replacing it, the one with the same hostAndPort, so reloads
+// keep their active connections, selections, health, and slow start. The
+// backends of bp not in previous are slow started.
+func (bp *backendPool) inheritState(previous *backendPool) {
+	// a hostAndPort may be in several routes, matched in order
+	previousStates := make(map[string][]*backendState, len(previous.backends))
+	for _, backend := range previous.backends {
+		previousStates[backend.hostAndPort] = append(previousStates[backend.hostAndPort], backend.backendState)
+	}
+
+	for _, backend := range bp.backends {
+		states := previousStates[backend.hostAndPort]
+		if len(states) == 0 {
+			backend.startSlowStart("backend added")
+			continue
+		}
+
+		backend.backendState = states[0]
+		previousStates[backend.hostAndPort] = states[1:]
+	}
+}
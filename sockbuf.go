@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+)
+
+// setSocketBuffers sets the SO_SNDBUF and SO_RCVBUF sizes of a tcp conn,
+// or of the tcp conn under a tls conn, leaving sizes that are not positive
+// at the os default. Failures are logged and otherwise ignored.
+func setSocketBuffers(
+	conn net.Conn,
+	sendBuffer int,
+	recvBuffer int,
+	logger *slog.Logger,
+) {
+
+	if tlsConn, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if sendBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(sendBuffer); err != nil {
+			logger.Warn("tcpConn.SetWriteBuffer error",
+				"error", err,
+			)
+		}
+	}
+
+	if recvBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(recvBuffer); err != nil {
+			logger.Warn("tcpConn.SetReadBuffer error",
+				"error", err,
+			)
+		}
+	}
+}
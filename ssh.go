@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialer dials backends through a single ssh client shared by all connections.
+// The client is established on first use and re-established after it disconnects.
+type sshDialer struct {
+	jumpHost string
+	config   *ssh.ClientConfig
+
+	mutex  sync.Mutex
+	client *ssh.Client
+}
+
+// newSSHDialerFromFlags builds an sshDialer from the ssh flags.
+func newSSHDialerFromFlags() (*sshDialer, error) {
+	keyBytes, err := os.ReadFile(*sshKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile error: %w", err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("ssh.ParsePrivateKey error: %w", err)
+	}
+
+	var hostKeyCallback ssh.HostKeyCallback
+	switch {
+	case *sshInsecureIgnoreHostKey:
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	case *sshKnownHostsFile != "":
+		hostKeyCallback, err = knownhosts.New(*sshKnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("knownhosts.New error: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("sshKnownHostsFile or sshInsecureIgnoreHostKey is required")
+	}
+
+	return &sshDialer{
+		jumpHost: *sshJumpHost,
+		config: &ssh.ClientConfig{
+			User:            *sshUser,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         *backendDialTimeout,
+		},
+	}, nil
+}
+
+// getClient returns the shared ssh client, connecting if needed.
+func (sd *sshDialer) getClient() (*ssh.Client, error) {
+	sd.mutex.Lock()
+	defer sd.mutex.Unlock()
+
+	if sd.client != nil {
+		return sd.client, nil
+	}
+
+	client, err := ssh.Dial("tcp", sd.jumpHost, sd.config)
+	if err != nil {
+		slog.Warn("ssh connection failed",
+			"sshJumpHost", sd.jumpHost,
+			"error", err,
+		)
+		return nil, fmt.Errorf("ssh.Dial error: %w", err)
+	}
+
+	slog.Info("ssh connection established",
+		"sshJumpHost", sd.jumpHost,
+		"serverVersion", string(client.ServerVersion()),
+	)
+
+	sd.client = client
+
+	go func() {
+		err := client.Wait()
+
+		sd.mutex.Lock()
+		if sd.client == client {
+			sd.client = nil
+		}
+		sd.mutex.Unlock()
+
+		slog.Warn("ssh connection closed",
+			"sshJumpHost", sd.jumpHost,
+			"error", err,
+		)
+	}()
+
+	return client, nil
+}
+
+// dialContext dials address on network, tcp or unix, from the ssh jump host.
+func (sd *sshDialer) dialContext(
+	ctx context.Context,
+	network string,
+	address string,
+) (net.Conn, error) {
+
+	client, err := sd.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("ssh client.DialContext error: %w", err)
+	}
+
+	return conn, nil
+}
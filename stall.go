@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// runStallWatchdog calls teardown if no bytes move in either direction of a
+// connection for timeout, until ctx is done. It is a safety net for both
+// directions blocking at once, independent of any per-direction deadlines.
+func runStallWatchdog(
+	ctx context.Context,
+	timeout time.Duration,
+	byteCounts *connectionByteCounts,
+	teardown func(),
+	txLogger *slog.Logger,
+) {
+
+	ticker := time.NewTicker(max(timeout/4, 10*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if time.Since(byteCounts.lastActivity()) < timeout {
+				continue
+			}
+
+			txLogger.Warn("global stall detected",
+				"globalStallTimeout", timeout.String(),
+				"lastWsToTcp", time.Unix(0, byteCounts.lastWsToTcp.Load()),
+				"lastTcpToWs", time.Unix(0, byteCounts.lastTcpToWs.Load()),
+			)
+
+			teardown()
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// keeps each statsd datagram within a typical ethernet mtu
+	maxStatsdPacketSize = 1432
+
+	maxStatsdBufferedTimings = 10000
+)
+
+// statsdTiming is a duration recorded for a statsd timer.
+type statsdTiming struct {
+	name     string
+	duration time.Duration
+}
+
+// statsdSender periodically sends the registered metrics and recorded timings
+// to a statsd endpoint over udp. Counters are sent as the change since the
+// previous flush. Timings are buffered in memory up to maxStatsdBufferedTimings,
+// dropping new timings on overflow, so the proxy path never blocks.
+type statsdSender struct {
+	conn net.Conn
+
+	// counter values sent in the previous flush, used only by run
+	lastCounters map[string]float64
+
+	mutex   sync.Mutex
+	timings []statsdTiming
+	dropped uint64
+}
+
+// sender for statsdAddr, nil if statsdAddr is unset
+var metricsStatsdSender *statsdSender
+
+func newStatsdSender(addr string) (*statsdSender, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.Dial error: %w", err)
+	}
+
+	return &statsdSender{
+		conn:         conn,
+		lastCounters: make(map[string]float64),
+	}, nil
+}
+
+func (ss *statsdSender) timing(
+	name string,
+	duration time.Duration,
+) {
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	if len(ss.timings) >= maxStatsdBufferedTimings {
+		ss.dropped++
+		return
+	}
+
+	ss.timings = append(ss.timings, statsdTiming{
+		name:     name,
+		duration: duration,
+	})
+}
+
+// recordTiming records a statsd timing if statsdAddr is configured.
+func recordTiming(
+	name string,
+	duration time.Duration,
+) {
+
+	if metricsStatsdSender != nil {
+		metricsStatsdSender.timing(name, duration)
+	}
+}
+
+func (ss *statsdSender) takeTimings() ([]statsdTiming, uint64) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	timings, dropped := ss.timings, ss.dropped
+	ss.timings = nil
+	ss.dropped = 0
+
+	return timings, dropped
+}
+
+// statsdLabelReplacer replaces characters that are separators in the statsd
+// line format, the "." separating metric name components, and the brackets
+// of IPv6 backends such as [::1]:31415, which graphite treats as globs.
+var statsdLabelReplacer = strings.NewReplacer(
+	":", "_",
+	"|", "_",
+	"@", "_",
+	".", "_",
+	" ", "_",
+	"[", "_",
+	"]", "_",
+)
+
+// formatStatsdValue formats value without an exponent,
+// which statsd servers do not all accept.
+func formatStatsdValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// lines returns the statsd lines for the registered metrics and the
+// recorded timings.
+func (ss *statsdSender) lines() []string {
+	var lines []string
+
+	for _, m := range registeredMetrics {
+		sample := m.sample()
+
+		for labelValue, value := range sample.values {
+			name := sample.name
+			if labelValue != "" {
+				name += "." + statsdLabelReplacer.Replace(labelValue)
+			}
+
+			if sample.metricType == "counter" {
+				delta := value - ss.lastCounters[name]
+				ss.lastCounters[name] = value
+				if delta > 0 {
+					lines = append(lines, name+":"+formatStatsdValue(delta)+"|c")
+				}
+				continue
+			}
+
+			lines = append(lines, name+":"+formatStatsdValue(value)+"|g")
+		}
+	}
+
+	timings, dropped := ss.takeTimings()
+	if dropped > 0 {
+		slog.Warn("statsdSender buffer full, dropped timings",
+			"dropped", dropped,
+		)
+	}
+
+	for _, timing := range timings {
+		lines = append(lines, fmt.Sprintf("%s:%v|ms", timing.name, timing.duration.Milliseconds()))
+	}
+
+	return lines
+}
+
+// flush sends lines packed into as few datagrams as fit maxStatsdPacketSize.
+func (ss *statsdSender) flush(lines []string) error {
+	var packet bytes.Buffer
+
+	send := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := ss.conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxStatsdPacketSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+
+	return send()
+}
+
+// run sends metrics every flushInterval.
+func (ss *statsdSender) run(
+	ctx context.Context,
+	flushInterval time.Duration,
+) {
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			lines := ss.lines()
+
+			if err := ss.flush(lines); err != nil {
+				slog.Warn("statsdSender flush error",
+					"lines", len(lines),
+					"error", err,
+				)
+				continue
+			}
+
+			slog.Debug("statsdSender sent metrics",
+				"lines", len(lines),
+			)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	strictConfigOff  = "off"
+	strictConfigWarn = "warn"
+	strictConfigFail = "fail"
+)
+
+// commandLineFlagValues returns each value given for each flag in the flag
+// arguments that flag.Parse consumed, in order.
+func commandLineFlagValues() map[string][]string {
+	values := make(map[string][]string)
+
+	args := os.Args[1 : len(os.Args)-flag.NArg()]
+
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "" {
+			// "--" ends the flags
+			break
+		}
+
+		name, value, hasValue := strings.Cut(name, "=")
+
+		if !hasValue {
+			value = "true"
+
+			boolFlag, ok := flag.Lookup(name).Value.(interface{ IsBoolFlag() bool })
+			if (!ok || !boolFlag.IsBoolFlag()) && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+		}
+
+		values[name] = append(values[name], value)
+	}
+
+	return values
+}
+
+type flagSetting struct {
+	source string
+	value  string
+}
+
+// flagSettings returns each value given for each flag, from flagFile, then
+// the environment, then the command line, so the last value is the one in
+// effect as applyFlagDefaults gives them precedence.
+func flagSettings() map[string][]flagSetting {
+	settings := make(map[string][]flagSetting)
+
+	for name, value := range flagFileFlagValues {
+		settings[name] = append(settings[name], flagSetting{source: "flagFile", value: value})
+	}
+
+	for name, value := range environmentFlagValues {
+		settings[name] = append(settings[name], flagSetting{source: flagEnvName(name), value: value})
+	}
+
+	for name, values := range commandLineFlagValues() {
+		for _, value := range values {
+			settings[name] = append(settings[name], flagSetting{source: "command line", value: value})
+		}
+	}
+
+	return settings
+}
+
+// checkDuplicateFlags reports flags given more than once, on the command line
+// or across the command line, environment, and flagFile, where the value of
+// highest precedence silently wins, warning or failing per strictConfig.
+func checkDuplicateFlags() {
+	switch *strictConfig {
+	case strictConfigOff:
+		return
+	case strictConfigWarn, strictConfigFail:
+	default:
+		fatal(exitCodeConfig, "invalid strictConfig %q, expected off, warn, or fail", *strictConfig)
+	}
+
+	settings := flagSettings()
+
+	var duplicates []string
+	for name, nameSettings := range settings {
+		if len(nameSettings) > 1 {
+			duplicates = append(duplicates, name)
+		}
+	}
+	slices.Sort(duplicates)
+
+	for _, name := range duplicates {
+		var sources, values []string
+		for _, setting := range settings[name] {
+			sources = append(sources, setting.source)
+			values = append(values, setting.value)
+		}
+		if sensitiveConfigFlags[name] {
+			values = slices.Repeat([]string{redactedHeaderValue}, len(values))
+		}
+
+		slog.Warn("flag set more than once",
+			"flag", name,
+			"sources", sources,
+			"values", values,
+			"winner", values[len(values)-1],
+			"strictConfig", *strictConfig,
+		)
+	}
+
+	if len(duplicates) > 0 && *strictConfig == strictConfigFail {
+		fatal(exitCodeConfig, "flags set more than once: %v", duplicates)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestFlagSettingsAcrossSources(t *testing.T) {
+	defer func(args []string) { os.Args = args }(os.Args)
+	defer func(environment, flagFile map[string]string) {
+		environmentFlagValues = environment
+		flagFileFlagValues = flagFile
+	}(environmentFlagValues, flagFileFlagValues)
+
+	// flag.NArg is 0 in tests, so every argument is read as a flag
+	os.Args = []string{"go-ws-proxy", "-copyBufferSize", "3000", "-logMessages"}
+	environmentFlagValues = map[string]string{"copyBufferSize": "2000", "backendURL": "ws://a/"}
+	flagFileFlagValues = map[string]string{"copyBufferSize": "1000", "backendURL": "ws://b/", "tcpHostAndPort": "c:1"}
+
+	settings := flagSettings()
+
+	tests := []struct {
+		name string
+		want []flagSetting
+	}{
+		{
+			name: "copyBufferSize",
+			want: []flagSetting{
+				{source: "flagFile", value: "1000"},
+				{source: "WSPROXY_COPY_BUFFER_SIZE", value: "2000"},
+				{source: "command line", value: "3000"},
+			},
+		},
+		{
+			name: "backendURL",
+			want: []flagSetting{
+				{source: "flagFile", value: "ws://b/"},
+				{source: "WSPROXY_BACKEND_URL", value: "ws://a/"},
+			},
+		},
+		{
+			name: "tcpHostAndPort",
+			want: []flagSetting{
+				{source: "flagFile", value: "c:1"},
+			},
+		},
+		{
+			name: "logMessages",
+			want: []flagSetting{
+				{source: "command line", value: "true"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if got := settings[test.name]; !slices.Equal(got, test.want) {
+			t.Errorf("flagSettings()[%q] = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
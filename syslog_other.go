@@ -0,0 +1,17 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// newSyslogHandler is not supported on this platform.
+func newSyslogHandler(
+	addr string,
+	tag string,
+	level slog.Leveler,
+) (slog.Handler, error) {
+	return nil, errors.ErrUnsupported
+}
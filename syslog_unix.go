@@ -0,0 +1,104 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"strings"
+	"sync"
+)
+
+// syslogHandler formats records as JSON and sends each to syslog with the
+// severity matching its level.
+type syslogHandler struct {
+	writer *syslog.Writer
+
+	// jsonHandler writes into buffer, both guarded by mutex and shared
+	// by the handlers derived with WithAttrs and WithGroup
+	mutex       *sync.Mutex
+	buffer      *bytes.Buffer
+	jsonHandler slog.Handler
+}
+
+// newSyslogHandler dials addr as network://host:port, or the local syslog
+// daemon when addr is empty.
+func newSyslogHandler(
+	addr string,
+	tag string,
+	level slog.Leveler,
+) (slog.Handler, error) {
+
+	var network, hostAndPort string
+	if addr != "" {
+		var ok bool
+		network, hostAndPort, ok = strings.Cut(addr, "://")
+		if !ok {
+			return nil, fmt.Errorf("syslogAddr must be udp://host:port or tcp://host:port: %q", addr)
+		}
+	}
+
+	writer, err := syslog.Dial(network, hostAndPort, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, fmt.Errorf("syslog.Dial error: %w", err)
+	}
+
+	buffer := new(bytes.Buffer)
+
+	return &syslogHandler{
+		writer: writer,
+		mutex:  new(sync.Mutex),
+		buffer: buffer,
+		jsonHandler: slog.NewJSONHandler(buffer, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				// syslog timestamps each message
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}),
+	}, nil
+}
+
+func (sh *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return sh.jsonHandler.Enabled(ctx, level)
+}
+
+func (sh *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.buffer.Reset()
+	if err := sh.jsonHandler.Handle(ctx, record); err != nil {
+		return err
+	}
+	message := strings.TrimSuffix(sh.buffer.String(), "\n")
+
+	switch {
+	case record.Level >= slog.LevelError:
+		return sh.writer.Err(message)
+	case record.Level >= slog.LevelWarn:
+		return sh.writer.Warning(message)
+	case record.Level >= slog.LevelInfo:
+		return sh.writer.Info(message)
+	default:
+		return sh.writer.Debug(message)
+	}
+}
+
+func (sh *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	derived := *sh
+	derived.jsonHandler = sh.jsonHandler.WithAttrs(attrs)
+	return &derived
+}
+
+func (sh *syslogHandler) WithGroup(name string) slog.Handler {
+	derived := *sh
+	derived.jsonHandler = sh.jsonHandler.WithGroup(name)
+	return &derived
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// first file descriptor passed by systemd socket activation, after stdio
+const systemdListenFDsStart = 3
+
+// FileDescriptorName values of systemd sockets given a role other than
+// a plaintext proxy listener
+const (
+	systemdSocketNameTLS        = "tls"
+	systemdSocketNameManagement = "management"
+)
+
+// inheritedListener is a listen socket passed by systemd, with the
+// FileDescriptorName of its socket unit.
+type inheritedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// systemdListeners returns the listen sockets passed by systemd socket
+// activation in LISTEN_FDS, or none if the process was not socket activated.
+// The activation environment variables are unset so child processes do not
+// inherit them.
+func systemdListeners() ([]inheritedListener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]inheritedListener, 0, count)
+
+	for i := range count {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		file := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("net.FileListener error for fd %v %q: %w", systemdListenFDsStart+i, name, err)
+		}
+
+		listeners = append(listeners, inheritedListener{
+			name:     name,
+			listener: listener,
+		})
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpUserTimeoutSupported = true
+
+// setTCPUserTimeout sets TCP_USER_TIMEOUT on tcpConn,
+// bounding how long transmitted data may remain unacknowledged.
+func setTCPUserTimeout(
+	tcpConn *net.TCPConn,
+	timeout time.Duration,
+) error {
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var setsockoptErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		setsockoptErr = unix.SetsockoptInt(
+			int(fd),
+			unix.IPPROTO_TCP,
+			unix.TCP_USER_TIMEOUT,
+			int(timeout.Milliseconds()),
+		)
+	})
+	if err != nil {
+		return err
+	}
+
+	return setsockoptErr
+}
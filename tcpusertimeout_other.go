@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const tcpUserTimeoutSupported = false
+
+// setTCPUserTimeout is not supported on this platform.
+func setTCPUserTimeout(
+	tcpConn *net.TCPConn,
+	timeout time.Duration,
+) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"time"
+)
+
+// connectionTeardown lets the copy direction that is still active drain for up
+// to teardownGrace after the other direction finishes, before the shared
+// close of both connections fires.
+type connectionTeardown struct {
+	grace      time.Duration
+	tcpConn    net.Conn
+	byteCounts *connectionByteCounts
+	txLogger   *slog.Logger
+
+	wsToTcpDone chan struct{}
+	tcpToWsDone chan struct{}
+}
+
+func newConnectionTeardown(
+	grace time.Duration,
+	tcpConn net.Conn,
+	byteCounts *connectionByteCounts,
+	txLogger *slog.Logger,
+) *connectionTeardown {
+	return &connectionTeardown{
+		grace:       grace,
+		tcpConn:     tcpConn,
+		byteCounts:  byteCounts,
+		txLogger:    txLogger,
+		wsToTcpDone: make(chan struct{}),
+		tcpToWsDone: make(chan struct{}),
+	}
+}
+
+// finish marks the wsToTcp or tcpToWs copy as done. If the other direction
+// is still active it blocks for up to the grace while that direction drains,
+// half closing the backend first when the client side is done so the
+// backend sees EOF.
+func (ct *connectionTeardown) finish(direction string) {
+	done, otherDone := ct.wsToTcpDone, ct.tcpToWsDone
+	otherCounter := &ct.byteCounts.tcpToWs
+	if direction == "tcpToWs" {
+		done, otherDone = ct.tcpToWsDone, ct.wsToTcpDone
+		otherCounter = &ct.byteCounts.wsToTcp
+	}
+
+	close(done)
+
+	if ct.grace <= 0 {
+		return
+	}
+
+	select {
+	case <-otherDone:
+		return
+	default:
+	}
+
+	if direction == "wsToTcp" {
+		ct.closeBackendWrite()
+	}
+
+	startBytes := otherCounter.Load()
+	startTime := time.Now()
+
+	timer := time.NewTimer(ct.grace)
+	defer timer.Stop()
+
+	drained := false
+	select {
+	case <-otherDone:
+		drained = true
+	case <-timer.C:
+	}
+
+	ct.txLogger.Info("teardown grace used",
+		"finishedDirection", direction,
+		"drained", drained,
+		"waited", time.Since(startTime).String(),
+		"bytesDrained", otherCounter.Load()-startBytes,
+	)
+}
+
+func (ct *connectionTeardown) closeBackendWrite() {
+	closeWriter, ok := ct.tcpConn.(interface{ CloseWrite() error })
+	if !ok {
+		return
+	}
+
+	if err := closeWriter.CloseWrite(); err != nil {
+		ct.txLogger.Debug("tcpConn.CloseWrite error",
+			"error", err,
+		)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tee directions
+const (
+	teeNone    = ""
+	teeWsToTcp = "wsToTcp"
+	teeTcpToWs = "tcpToWs"
+	teeBoth    = "both"
+)
+
+// file shared by all connections when teeTarget is a file, nil otherwise
+var teeFile *lockedWriter
+
+type lockedWriter struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	return lw.writer.Write(p)
+}
+
+// close closes the destination, discarding later writes from connections
+// still being force closed.
+func (lw *lockedWriter) close() {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	lw.closer.Close()
+	lw.writer = io.Discard
+}
+
+// teeFrameWriter writes each chunk to a tee destination as one frame, a
+// "txID direction length" header line followed by length bytes, so the
+// chunks of connections sharing the tee file can be told apart.
+type teeFrameWriter struct {
+	writer    io.Writer
+	txID      string
+	direction string
+}
+
+func newTeeFrameWriter(
+	writer io.Writer,
+	txID string,
+	direction string,
+) *teeFrameWriter {
+	return &teeFrameWriter{
+		writer:    writer,
+		txID:      txID,
+		direction: direction,
+	}
+}
+
+// Write writes the frame of p in a single write, so frames are never
+// interleaved by a lockedWriter.
+func (tfw *teeFrameWriter) Write(p []byte) (int, error) {
+	frame := fmt.Appendf(nil, "%s %s %d\n", tfw.txID, tfw.direction, len(p))
+	frame = append(frame, p...)
+
+	if _, err := tfw.writer.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// validateTeeFlags validates the tee flags and opens the tee file if there is one.
+func validateTeeFlags() error {
+	switch *tee {
+	case teeNone:
+		return nil
+	case teeWsToTcp, teeTcpToWs, teeBoth:
+	default:
+		return fmt.Errorf("invalid tee %q", *tee)
+	}
+
+	switch {
+	case strings.HasPrefix(*teeTarget, "file:"):
+		file, err := os.OpenFile(strings.TrimPrefix(*teeTarget, "file:"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return fmt.Errorf("os.OpenFile error: %w", err)
+		}
+		teeFile = &lockedWriter{
+			writer: file,
+			closer: file,
+		}
+		onShutdown(teeFile.close)
+
+	case strings.HasPrefix(*teeTarget, "tcp:"):
+
+	default:
+		return fmt.Errorf("invalid teeTarget %q, must begin with file: or tcp:", *teeTarget)
+	}
+
+	if *teeDropOnBlock && *teeDropQueueSize <= 0 {
+		return fmt.Errorf("teeDropQueueSize must be positive")
+	}
+
+	return nil
+}
+
+func teeEnabled(direction string) bool {
+	return *tee == direction || *tee == teeBoth
+}
+
+// openTee opens the tee destination for one connection, either the shared
+// tee file or a new connection to the tee tcp endpoint.
+// With teeDropOnBlock the destination is written asynchronously.
+// Returns a nil writer if tee is disabled or the endpoint cannot be dialed.
+func openTee(txLogger *slog.Logger) (io.Writer, func()) {
+	if *tee == teeNone {
+		return nil, func() {}
+	}
+
+	var writer io.Writer
+	closeWriter := func() {}
+
+	if teeFile != nil {
+		writer = teeFile
+	} else {
+		teeConn, err := net.DialTimeout("tcp", strings.TrimPrefix(*teeTarget, "tcp:"), *backendDialTimeout)
+		if err != nil {
+			txLogger.Warn("tee net.DialTimeout error, tee disabled for connection",
+				"error", err,
+			)
+			return nil, func() {}
+		}
+		writer = teeConn
+		closeWriter = func() { teeConn.Close() }
+	}
+
+	if *teeDropOnBlock {
+		asyncWriter := newDroppingTeeWriter(writer, closeWriter, *teeDropQueueSize, txLogger)
+		return asyncWriter, asyncWriter.close
+	}
+
+	return writer, closeWriter
+}
+
+// tee chunks and bytes dropped by droppingTeeWriters across all connections
+var (
+	teeDroppedChunks atomic.Uint64
+	teeDroppedBytes  atomic.Uint64
+)
+
+// droppingTeeWriter writes to a tee destination from its own goroutine through
+// a bounded queue, dropping data when the queue is full so a slow destination
+// never blocks the proxied connection.
+type droppingTeeWriter struct {
+	queue       chan []byte
+	writer      io.Writer
+	closeWriter func()
+	txLogger    *slog.Logger
+}
+
+func newDroppingTeeWriter(
+	writer io.Writer,
+	closeWriter func(),
+	queueSize int,
+	txLogger *slog.Logger,
+) *droppingTeeWriter {
+
+	dtw := &droppingTeeWriter{
+		queue:       make(chan []byte, queueSize),
+		writer:      writer,
+		closeWriter: closeWriter,
+		txLogger:    txLogger,
+	}
+
+	go dtw.run()
+
+	return dtw
+}
+
+// Write queues a copy of p, or drops it if the queue is full. It never fails.
+func (dtw *droppingTeeWriter) Write(p []byte) (int, error) {
+	select {
+	case dtw.queue <- slices.Clone(p):
+	default:
+		teeDroppedChunks.Add(1)
+		teeDroppedBytes.Add(uint64(len(p)))
+	}
+	return len(p), nil
+}
+
+// run writes queued data until close, discarding it after the first error.
+func (dtw *droppingTeeWriter) run() {
+	defer dtw.closeWriter()
+
+	failed := false
+	for p := range dtw.queue {
+		if failed {
+			continue
+		}
+
+		if _, err := dtw.writer.Write(p); err != nil {
+			failed = true
+			dtw.txLogger.Warn("tee write error, tee disabled for connection",
+				"error", err,
+			)
+		}
+	}
+}
+
+// close stops accepting data. Queued data is still written before the
+// destination is closed, without blocking the caller.
+func (dtw *droppingTeeWriter) close() {
+	close(dtw.queue)
+}
+
+// logTeeDrops logs the droppingTeeWriter drop counts every interval
+// in which more data was dropped.
+func logTeeDrops(
+	ctx context.Context,
+	interval time.Duration,
+) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastDroppedChunks uint64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			droppedChunks := teeDroppedChunks.Load()
+			if droppedChunks == lastDroppedChunks {
+				continue
+			}
+
+			slog.Warn("tee destination blocked, dropped tee data",
+				"droppedChunks", droppedChunks-lastDroppedChunks,
+				"totalDroppedChunks", droppedChunks,
+				"totalDroppedBytes", teeDroppedBytes.Load(),
+			)
+			lastDroppedChunks = droppedChunks
+		}
+	}
+}
+
+// bestEffortWriter writes to a tee destination without ever failing the caller.
+// After the first error it logs and discards all further writes.
+type bestEffortWriter struct {
+	writer    io.Writer
+	direction string
+	txLogger  *slog.Logger
+	failed    bool
+}
+
+func (bew *bestEffortWriter) Write(p []byte) (int, error) {
+	if !bew.failed {
+		if _, err := bew.writer.Write(p); err != nil {
+			bew.failed = true
+			bew.txLogger.Warn("tee write error, tee disabled for direction",
+				"direction", bew.direction,
+				"error", err,
+			)
+		}
+	}
+	return len(p), nil
+}
+
+func newBestEffortWriter(
+	writer io.Writer,
+	direction string,
+	txLogger *slog.Logger,
+) io.Writer {
+	return &bestEffortWriter{
+		writer:    writer,
+		direction: direction,
+		txLogger:  txLogger,
+	}
+}
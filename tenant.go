@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	errTenantUnauthorized = errors.New("missing or unknown bearer token")
+	errTenantNoBackend    = errors.New("token maps to no backend")
+)
+
+// tenant is a client identity established by its bearer token,
+// and the only backends its connections may reach.
+type tenant struct {
+	name     string
+	backends *backendPool
+}
+
+// tenants from tenantFile keyed by the sha256 of their token,
+// so lookups do not compare token bytes directly. nil if unset.
+var tenantsByTokenHash map[[sha256.Size]byte]*tenant
+
+// parseTenantFile parses tenant file contents, one tenant per line as
+// "name token [backends]", with backends as in tcpHostAndPort.
+// A tenant without a backend is authenticated but always rejected.
+// Blank lines and lines starting with # are ignored.
+func parseTenantFile(contents []byte) (map[[sha256.Size]byte]*tenant, error) {
+	tenants := make(map[[sha256.Size]byte]*tenant)
+
+	lineNumber := 0
+	for line := range strings.Lines(string(contents)) {
+		lineNumber++
+
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %v: expected name token [backends]", lineNumber)
+		}
+
+		t := &tenant{
+			name: fields[0],
+		}
+
+		if len(fields) == 3 {
+			backends, err := newBackendPool(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", lineNumber, err)
+			}
+			t.backends = backends
+		}
+
+		tokenHash := sha256.Sum256([]byte(fields[1]))
+		if _, ok := tenants[tokenHash]; ok {
+			return nil, fmt.Errorf("line %v: duplicate token", lineNumber)
+		}
+		tenants[tokenHash] = t
+	}
+
+	return tenants, nil
+}
+
+// loadTenantFile reads and parses the tenant file at path.
+func loadTenantFile(path string) (map[[sha256.Size]byte]*tenant, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile error: %w", err)
+	}
+
+	tenants, err := parseTenantFile(contents)
+	if err != nil {
+		return nil, fmt.Errorf("parseTenantFile error: %w", err)
+	}
+
+	return tenants, nil
+}
+
+// authenticateTenant returns the tenant for the request's
+// "Authorization: Bearer" token.
+func authenticateTenant(r *http.Request) (*tenant, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, errTenantUnauthorized
+	}
+
+	t, ok := tenantsByTokenHash[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, errTenantUnauthorized
+	}
+
+	if t.backends == nil {
+		return t, errTenantNoBackend
+	}
+
+	return t, nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// certReloader serves the most recently loaded certificate for new TLS handshakes.
+// Existing connections keep the certificate they negotiated.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	certificate atomic.Pointer[tls.Certificate]
+
+	lastCertModTime time.Time
+	lastKeyModTime  time.Time
+}
+
+func newCertReloader(
+	certFile string,
+	keyFile string,
+) (*certReloader, error) {
+
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// reload loads and validates the cert/key pair and swaps it in.
+// On error the current certificate is kept.
+func (cr *certReloader) reload() error {
+	certificate, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls.LoadX509KeyPair error: %w", err)
+	}
+
+	cr.certificate.Store(&certificate)
+
+	if certificate.Leaf != nil {
+		slog.Info("loaded tls certificate",
+			"subject", certificate.Leaf.Subject.String(),
+			"notAfter", certificate.Leaf.NotAfter,
+		)
+	}
+
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.certificate.Load(), nil
+}
+
+// modTimes returns the modification times of the cert and key files.
+func (cr *certReloader) modTimes() (certModTime, keyModTime time.Time, err error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return
+	}
+
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return
+	}
+
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// run reloads the certificate on SIGHUP, and when pollInterval > 0
+// whenever the cert or key file modification time changes.
+func (cr *certReloader) run(
+	ctx context.Context,
+	pollInterval time.Duration,
+) {
+
+	sighupChannel := make(chan os.Signal, 1)
+	signal.Notify(sighupChannel, syscall.SIGHUP)
+	defer signal.Stop(sighupChannel)
+
+	var pollChannel <-chan time.Time
+	if pollInterval > 0 {
+		cr.lastCertModTime, cr.lastKeyModTime, _ = cr.modTimes()
+
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		pollChannel = ticker.C
+	}
+
+	for {
+		var trigger string
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-sighupChannel:
+			trigger = "SIGHUP"
+
+		case <-pollChannel:
+			certModTime, keyModTime, err := cr.modTimes()
+			if err != nil {
+				slog.Warn("certReloader stat error",
+					"error", err,
+				)
+				continue
+			}
+
+			if certModTime.Equal(cr.lastCertModTime) && keyModTime.Equal(cr.lastKeyModTime) {
+				continue
+			}
+			cr.lastCertModTime, cr.lastKeyModTime = certModTime, keyModTime
+
+			trigger = "file change"
+		}
+
+		if err := cr.reload(); err != nil {
+			slog.Warn("certReloader reload error, keeping current certificate",
+				"trigger", trigger,
+				"error", err,
+			)
+			continue
+		}
+
+		slog.Info("certReloader reloaded certificate",
+			"trigger", trigger,
+		)
+	}
+}
+
+// withClientTLS returns txLogger with the tls version and cipher suite the
+// client negotiated, unchanged when the client did not connect over tls.
+func withClientTLS(
+	txLogger *slog.Logger,
+	state *tls.ConnectionState,
+) *slog.Logger {
+
+	if state == nil {
+		return txLogger
+	}
+
+	return txLogger.With(
+		"tlsVersion", tls.VersionName(state.Version),
+		"tlsCipherSuite", tls.CipherSuiteName(state.CipherSuite),
+	)
+}
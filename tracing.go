@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otlp span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// otlp status code of a span that failed
+const spanStatusError = 2
+
+// exporter for spans, nil if tracing is disabled
+var spanExporter *traceExporter
+
+// traceSpan is an in-progress span, exported to otlpTracesEndpoint when ended.
+// Its methods do nothing on a nil span, so callers need not check whether
+// tracing is enabled.
+type traceSpan struct {
+	traceID      [16]byte
+	spanID       [8]byte
+	parentSpanID [8]byte
+	name         string
+	kind         int
+	start        time.Time
+
+	mutex        sync.Mutex
+	attributes   []otlpKeyValue
+	errorMessage string
+	ended        bool
+}
+
+// startSessionSpan starts the span of a websocket session, continuing the
+// trace of a valid W3C traceparent request header if present.
+func startSessionSpan(
+	r *http.Request,
+	txID string,
+	start time.Time,
+) *traceSpan {
+
+	if spanExporter == nil {
+		return nil
+	}
+
+	span := &traceSpan{
+		name:  "websocket session",
+		kind:  spanKindServer,
+		start: start,
+	}
+
+	if traceID, parentSpanID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		span.traceID = traceID
+		span.parentSpanID = parentSpanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+
+	span.setString("wsproxy.tx_id", txID)
+	span.setString("url.path", r.URL.Path)
+
+	return span
+}
+
+// parseTraceparent parses a W3C traceparent header of version 00.
+func parseTraceparent(traceparent string) (traceID [16]byte, parentSpanID [8]byte, ok bool) {
+	parts := strings.Split(traceparent, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentSpanID, false
+	}
+
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentSpanID, false
+	}
+	if _, err := hex.Decode(parentSpanID[:], []byte(parts[2])); err != nil {
+		return traceID, parentSpanID, false
+	}
+
+	return traceID, parentSpanID, traceID != [16]byte{} && parentSpanID != [8]byte{}
+}
+
+// startChild starts a span within s of the given otlp kind.
+func (s *traceSpan) startChild(
+	name string,
+	kind int,
+) *traceSpan {
+
+	if s == nil {
+		return nil
+	}
+
+	child := &traceSpan{
+		traceID:      s.traceID,
+		parentSpanID: s.spanID,
+		name:         name,
+		kind:         kind,
+		start:        time.Now(),
+	}
+	rand.Read(child.spanID[:])
+
+	return child
+}
+
+func (s *traceSpan) setAttribute(key string, value otlpAnyValue) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.attributes = append(s.attributes, otlpKeyValue{
+		Key:   key,
+		Value: value,
+	})
+}
+
+func (s *traceSpan) setString(key string, value string) {
+	s.setAttribute(key, otlpAnyValue{StringValue: &value})
+}
+
+func (s *traceSpan) setInt(key string, value int64) {
+	intValue := strconv.FormatInt(value, 10)
+	s.setAttribute(key, otlpAnyValue{IntValue: &intValue})
+}
+
+// setError marks s as failed with err, if err is not nil.
+func (s *traceSpan) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.errorMessage = err.Error()
+}
+
+// end finishes s and queues it for export. Later calls do nothing.
+func (s *traceSpan) end() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ended {
+		return
+	}
+	s.ended = true
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attributes,
+	}
+	if s.parentSpanID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentSpanID[:])
+	}
+	if s.errorMessage != "" {
+		span.Status = &otlpStatus{
+			Code:    spanStatusError,
+			Message: s.errorMessage,
+		}
+	}
+
+	spanExporter.add([]otlpSpan{span}, false)
+}
+
+// otlp/http json encoding of spans, 64 bit integers are strings
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+// otlpTracesURL returns otlpTracesEndpoint, or when unset the traces endpoint
+// from the standard OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or
+// OTEL_EXPORTER_OTLP_ENDPOINT environment variables, empty if none is set.
+func otlpTracesURL() string {
+	if *otlpTracesEndpoint != "" {
+		return *otlpTracesEndpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// traceExporter batches ended spans and POSTs them as otlp/http json.
+// Like auditSink spans are buffered up to maxBuffered, dropping the oldest,
+// so a slow or failing collector never blocks the proxy path.
+type traceExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	maxBuffered int
+
+	mutex   sync.Mutex
+	spans   []otlpSpan
+	dropped uint64
+}
+
+func newTraceExporter(
+	url string,
+	maxBuffered int,
+) *traceExporter {
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "go-ws-proxy"
+	}
+
+	return &traceExporter{
+		url:         url,
+		serviceName: serviceName,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		maxBuffered: maxBuffered,
+	}
+}
+
+// add buffers spans at the end of the queue, or the front when requeuing
+// spans that failed to send, then drops the oldest spans over maxBuffered.
+func (te *traceExporter) add(
+	spans []otlpSpan,
+	front bool,
+) {
+
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+
+	if front {
+		te.spans = append(spans, te.spans...)
+	} else {
+		te.spans = append(te.spans, spans...)
+	}
+
+	if overflow := len(te.spans) - te.maxBuffered; overflow > 0 {
+		te.spans = te.spans[overflow:]
+		te.dropped += uint64(overflow)
+
+		slog.Warn("trace exporter buffer full, dropped oldest spans",
+			"dropped", overflow,
+			"totalDropped", te.dropped,
+		)
+	}
+}
+
+func (te *traceExporter) takeBatch() []otlpSpan {
+	te.mutex.Lock()
+	defer te.mutex.Unlock()
+
+	batch := te.spans
+	te.spans = nil
+
+	return batch
+}
+
+func (te *traceExporter) post(
+	ctx context.Context,
+	batch []otlpSpan,
+) error {
+
+	serviceName := te.serviceName
+	request := map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpKeyValue{{
+					Key:   "service.name",
+					Value: otlpAnyValue{StringValue: &serviceName},
+				}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{
+					"name": "github.com/aaronriekenberg/go-ws-proxy",
+				},
+				"spans": batch,
+			}},
+		}},
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("json.Marshal error: %w", err)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, te.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequestWithContext error: %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	response, err := te.client.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("client.Do error: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %v", response.Status)
+	}
+
+	return nil
+}
+
+// flush posts the buffered spans, requeuing them to retry if the post fails.
+func (te *traceExporter) flush(ctx context.Context) {
+	batch := te.takeBatch()
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := te.post(ctx, batch); err != nil {
+		slog.Warn("trace exporter post error, will retry",
+			"spans", len(batch),
+			"error", err,
+		)
+		te.add(batch, true)
+		return
+	}
+
+	slog.Debug("trace exporter posted spans",
+		"spans", len(batch),
+	)
+}
+
+// run flushes buffered spans every flushInterval.
+func (te *traceExporter) run(
+	ctx context.Context,
+	flushInterval time.Duration,
+) {
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			te.flush(ctx)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+const maxTxIDLength = 128
+
+// validTxID returns true if txID is non-empty, at most maxTxIDLength bytes,
+// and made of characters safe to log and echo in a response header.
+func validTxID(txID string) bool {
+	if txID == "" || len(txID) > maxTxIDLength {
+		return false
+	}
+
+	for _, c := range []byte(txID) {
+		switch {
+		case 'a' <= c && c <= 'z',
+			'A' <= c && c <= 'Z',
+			'0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// requestTxID returns the transaction id from txIDHeader when it is set and
+// the request carries a valid value, otherwise a new uuid.
+// rejected reports a header value that was present but invalid.
+func requestTxID(r *http.Request) (txID string, rejected bool) {
+	if *txIDHeader != "" {
+		if txID := r.Header.Get(*txIDHeader); txID != "" {
+			if validTxID(txID) {
+				return txID, false
+			}
+			rejected = true
+		}
+	}
+
+	return uuid.New().String(), rejected
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	backendProtocolTCP = "tcp"
+	backendProtocolUDP = "udp"
+)
+
+// largest udp payload, and so the largest client message relayed as a datagram
+const maxUDPPayload = 65507
+
+// dialUDPBackend returns a connected udp socket for backend, its own for
+// the session so responses come back to the client that caused them.
+func dialUDPBackend(
+	ctx context.Context,
+	backend *backend,
+) (*net.UDPConn, error) {
+
+	if err := checkBackendAllowed(backend.hostAndPort); err != nil {
+		return nil, err
+	}
+
+	network, address := splitNetworkAddress(backend.hostAndPort)
+	if network != "tcp" {
+		return nil, fmt.Errorf("%v backend %q is not supported with backendProtocol udp", network, backend.hostAndPort)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backend.effectiveDialTimeout())
+	defer cancel()
+
+	dialer := net.Dialer{
+		Resolver: backendResolver,
+	}
+	if backendSourceAddr != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: backendSourceAddr.IP}
+	}
+
+	conn, err := dialer.DialContext(ctx, backendProtocolUDP, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UDPConn), nil
+}
+
+// proxyToUDPBackend relays each client message to backend as one udp datagram,
+// and each datagram received back as one message of messageType, until the
+// client closes or no datagram moves in either direction for udpIdleTimeout.
+// releaseHandshakeSlot is called once the client is accepted.
+func proxyToUDPBackend(
+	w http.ResponseWriter,
+	r *http.Request,
+	txID string,
+	clientIPAddress string,
+	backend *backend,
+	messageType websocket.MessageType,
+	labels *connectionLabels,
+	releaseHandshakeSlot func(),
+	txLogger *slog.Logger,
+) {
+
+	if err := PreAcceptHook(r); err != nil {
+		status := rejectHookError(w, err)
+		txLogger.Warn("PreAcceptHook rejected request",
+			"status", status,
+			"error", err,
+		)
+		return
+	}
+
+	txLogger = txLogger.With(
+		"backend", backend.hostAndPort,
+		"backendProtocol", backendProtocolUDP,
+	)
+
+	udpConn, err := dialUDPBackend(r.Context(), backend)
+	if err != nil {
+		txLogger.Warn("dialUDPBackend error",
+			"error", err,
+		)
+		http.Error(w, "backend unavailable", http.StatusBadGateway)
+		return
+	}
+	defer udpConn.Close()
+
+	websocketConn, err := websocket.Accept(w, r, websocketAcceptOptions)
+	if err != nil {
+		txLogger.Warn("websocket.Accept error",
+			"error", err,
+		)
+		return
+	}
+	defer websocketConn.CloseNow()
+
+	releaseHandshakeSlot()
+
+	websocketConn.SetReadLimit(maxUDPPayload)
+
+	txLogger = withWebsocketExtensions(txLogger, r, w.Header())
+
+	var connectionCloseReason closeReason
+
+	closeWebsocket := func(class closeClass, code websocket.StatusCode, reason string) {
+		connectionCloseReason.set(class, reason)
+		websocketConn.Close(code, reason)
+	}
+
+	stopForceClose := context.AfterFunc(forceCloseContext, func() {
+		closeWebsocket(closeClassShutdown, websocket.StatusGoingAway, "server shutting down")
+	})
+	defer stopForceClose()
+
+	defer connectionOpened()()
+
+	connectionStartTime := time.Now()
+
+	byteCounts := newConnectionByteCounts(*maxBytesPerConnection, func() {
+		txLogger.Warn("byte limit exceeded",
+			"maxBytesPerConnection", *maxBytesPerConnection,
+		)
+		go closeWebsocket(closeClassPolicy, websocket.StatusPolicyViolation, "byte limit exceeded")
+	})
+	udpWriter := byteCounts.wsToTcpWriter(udpConn)
+	udpReader := byteCounts.tcpToWsReader(udpConn)
+
+	// limited per datagram, which bandwidthLimitedReader and
+	// bandwidthLimitedWriter would split
+	wsToUDPLimiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalWsToTcpBandwidth)
+	udpToWsLimiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalTcpToWsBandwidth)
+
+	adminSession := &session{
+		txID:       txID,
+		clientIP:   clientIPAddress,
+		startTime:  connectionStartTime,
+		byteCounts: byteCounts,
+		terminate: func() {
+			go closeWebsocket(closeClassAdminKill, websocket.StatusPolicyViolation, "terminated by admin")
+		},
+	}
+	adminSession.setBackend(backend.hostAndPort)
+	defer registerSession(adminSession)()
+
+	defer func() {
+		recordConnectionEnd(r, connectionRecord{
+			Time:            time.Now(),
+			TxID:            txID,
+			ClientIP:        clientIPAddress,
+			Backend:         backend.hostAndPort,
+			DurationSeconds: time.Since(connectionStartTime).Seconds(),
+			BytesWsToTcp:    byteCounts.wsToTcp.Load(),
+			BytesTcpToWs:    byteCounts.tcpToWs.Load(),
+			CloseReason:     connectionCloseReason.get(),
+			CloseClass:      string(connectionCloseReason.class()),
+		})
+	}()
+
+	txLogger.Info("connected to udp backend",
+		"backendLocalAddr", udpConn.LocalAddr().String(),
+	)
+
+	labels.backend = backend.hostAndPort
+	defer recordLabeledConnectionStart(labels)()
+	defer recordLabeledBytes(labels, byteCounts)
+
+	if lifetime := connectionLifetime(r, txLogger); lifetime > 0 {
+		txLogger.Info("applying connection lifetime",
+			"lifetime", lifetime.String(),
+		)
+
+		lifetimeLogger := txLogger
+		lifetimeTimer := time.AfterFunc(lifetime, func() {
+			lifetimeLogger.Info("connection lifetime reached")
+			closeWebsocket(closeClassLifetime, websocket.StatusGoingAway, "connection lifetime reached")
+		})
+		defer lifetimeTimer.Stop()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *proxyIdleTimeout > 0 {
+		go runIdleTimeout(ctx, *proxyIdleTimeout, byteCounts, func(idle time.Duration) {
+			logProxyIdleTimeout(idle, txLogger)
+			closeWebsocket(closeClassIdleTimeout, websocket.StatusGoingAway, "proxy idle timeout")
+		})
+	}
+
+	if *pingInterval > 0 {
+		go pingUntilDead(ctx, websocketConn, *pingInterval, effectivePongTimeout(), *maxMissedPongs, func() {
+			closeWebsocket(closeClassPingTimeout, websocket.StatusGoingAway, "ping timeout")
+		}, txLogger)
+	}
+
+	if *progressLogInterval > 0 {
+		go logConnectionProgress(ctx, *progressLogInterval, connectionStartTime, byteCounts, txLogger)
+	}
+
+	var datagramsSent, datagramsReceived atomic.Int64
+
+	var proxyWaitGroup sync.WaitGroup
+
+	proxyWaitGroup.Go(func() {
+		defer recoverConnectionPanic(txLogger)
+		defer udpConn.Close()
+
+		var err error
+		for {
+			var readType websocket.MessageType
+			var message []byte
+			readType, message, err = websocketConn.Read(ctx)
+			if err != nil {
+				break
+			}
+
+			if readType != messageType && !*acceptAnyMessageType {
+				err = fmt.Errorf("unexpected frame type read (expected %v): %v", messageType, readType)
+				closeWebsocket(closeClassPolicy, websocket.StatusUnsupportedData, err.Error())
+				break
+			}
+
+			if wsToUDPLimiter != nil {
+				wsToUDPLimiter.wait(len(message))
+			}
+
+			if _, err := udpWriter.Write(message); err != nil {
+				if errors.Is(err, errByteLimitExceeded) {
+					break
+				}
+				// a datagram refused by the backend is lost as on any udp path
+				txLogger.Debug("udp backend write error",
+					"error", err,
+				)
+				continue
+			}
+			datagramsSent.Add(1)
+		}
+
+		connectionCloseReason.set(closeClassClientEOF, "client closed")
+
+		txLogger.Info("after relay to udp backend",
+			"datagrams", datagramsSent.Load(),
+			"error", err,
+		)
+	})
+
+	proxyWaitGroup.Go(func() {
+		defer recoverConnectionPanic(txLogger)
+		defer cancel()
+
+		buf := make([]byte, maxUDPPayload)
+
+		var err error
+		for {
+			udpConn.SetReadDeadline(byteCounts.lastActivity().Add(*udpIdleTimeout))
+
+			var n int
+			n, err = udpReader.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if time.Since(byteCounts.lastActivity()) < *udpIdleTimeout {
+					continue
+				}
+				txLogger.Info("udp idle timeout",
+					"udpIdleTimeout", udpIdleTimeout.String(),
+				)
+				closeWebsocket(closeClassIdleTimeout, websocket.StatusNormalClosure, "udp idle timeout")
+				break
+			}
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			if err != nil {
+				closeWebsocket(closeClassBackendError, websocket.StatusGoingAway, "backend connection closed")
+				break
+			}
+
+			if udpToWsLimiter != nil {
+				udpToWsLimiter.wait(n)
+			}
+
+			if err = websocketConn.Write(ctx, messageType, buf[:n]); err != nil {
+				break
+			}
+			datagramsReceived.Add(1)
+		}
+
+		txLogger.Info("after relay from udp backend",
+			"datagrams", datagramsReceived.Load(),
+			"error", err,
+		)
+	})
+
+	proxyWaitGroup.Wait()
+
+	txLogger.Info("end websocket handler",
+		"duration", time.Since(connectionStartTime).String(),
+		"bytesWsToTcp", byteCounts.wsToTcp.Load(),
+		"bytesTcpToWs", byteCounts.tcpToWs.Load(),
+		"datagramsSent", datagramsSent.Load(),
+		"datagramsReceived", datagramsReceived.Load(),
+		"closeReason", connectionCloseReason.get(),
+		"closeClass", connectionCloseReason.class(),
+	)
+}
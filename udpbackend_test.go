@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// startUDPEcho returns the address of a udp server echoing each datagram.
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.ListenPacket error: %v", err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return udpConn.LocalAddr().String()
+}
+
+// startUDPBackendProxy serves proxyToUDPBackend with messageType in front of
+// a udp echo server, returning the client's end.
+func startUDPBackendProxy(
+	t *testing.T,
+	ctx context.Context,
+	messageType websocket.MessageType,
+) *websocket.Conn {
+
+	t.Helper()
+
+	backend, err := parseBackend(startUDPEcho(t))
+	if err != nil {
+		t.Fatalf("parseBackend error: %v", err)
+	}
+
+	txLogger := slog.New(slog.DiscardHandler)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyToUDPBackend(w, r, "tx-udp", "127.0.0.1", backend, messageType, newConnectionLabels(r.URL.Path, nil), func() {}, txLogger)
+	}))
+	t.Cleanup(proxy.Close)
+
+	clientConn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(proxy.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("websocket.Dial error: %v", err)
+	}
+	t.Cleanup(func() { clientConn.CloseNow() })
+
+	return clientConn
+}
+
+func TestUDPBackendRelaysMessageType(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn := startUDPBackendProxy(t, ctx, websocket.MessageText)
+
+	if err := clientConn.Write(ctx, websocket.MessageText, []byte("hello")); err != nil {
+		t.Fatalf("clientConn.Write error: %v", err)
+	}
+
+	readType, message, err := clientConn.Read(ctx)
+	if err != nil {
+		t.Fatalf("clientConn.Read error: %v", err)
+	}
+	if readType != websocket.MessageText || string(message) != "hello" {
+		t.Fatalf("client received %v %q, want %v %q", readType, message, websocket.MessageText, "hello")
+	}
+
+	// the session is listed for the admin endpoints while it is open
+	activeSessionsMutex.Lock()
+	_, registered := activeSessions["tx-udp"]
+	activeSessionsMutex.Unlock()
+	if !registered {
+		t.Error("udp session not registered")
+	}
+
+	// a message of the other type is rejected
+	if err := clientConn.Write(ctx, websocket.MessageBinary, []byte("hello")); err != nil {
+		t.Fatalf("clientConn.Write error: %v", err)
+	}
+
+	_, _, err = clientConn.Read(ctx)
+	var closeError websocket.CloseError
+	if !errors.As(err, &closeError) || closeError.Code != websocket.StatusUnsupportedData {
+		t.Fatalf("clientConn.Read error = %v, want close status 1003", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// prefix of listen and backend addresses that are unix domain socket paths
+const unixAddressPrefix = "unix:"
+
+// splitNetworkAddress returns the network and address to listen on or dial
+// for address, unix for the path of a unix: address and tcp otherwise.
+func splitNetworkAddress(address string) (network string, networkAddress string) {
+	if path, ok := strings.CutPrefix(address, unixAddressPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
+// parseUnixSocketMode parses the unixSocketMode flag as octal permissions.
+func parseUnixSocketMode(mode string) (fs.FileMode, error) {
+	permissions, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || permissions > 0o777 {
+		return 0, fmt.Errorf("invalid unixSocketMode %q, expected octal permissions such as 0660", mode)
+	}
+	return fs.FileMode(permissions), nil
+}
+
+// listenNetwork listens on address, either host:port or a unix: socket path.
+// A host:port socket has SO_REUSEPORT set with reusePort.
+// A socket file left at the path by an earlier process is removed first,
+// and the new socket is given unixSocketMode permissions. The socket file is
+// removed again when the listener is closed.
+func listenNetwork(address string) (net.Listener, error) {
+	network, networkAddress := splitNetworkAddress(address)
+	if network != "unix" {
+		var listenConfig net.ListenConfig
+		if *reusePort {
+			listenConfig.Control = reusePortControl
+		}
+		return listenConfig.Listen(context.Background(), network, networkAddress)
+	}
+
+	mode, err := parseUnixSocketMode(*unixSocketMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Lstat(networkAddress); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%q exists and is not a socket", networkAddress)
+		}
+		if err := os.Remove(networkAddress); err != nil {
+			return nil, fmt.Errorf("os.Remove error: %w", err)
+		}
+	}
+
+	listener, err := net.Listen(network, networkAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(networkAddress, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("os.Chmod error: %w", err)
+	}
+
+	return listener, nil
+}
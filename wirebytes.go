@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// wireCountingConn counts the bytes read from and written to a hijacked
+// client connection, including websocket framing and control frames.
+type wireCountingConn struct {
+	net.Conn
+
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+func (wc *wireCountingConn) Read(p []byte) (int, error) {
+	n, err := wc.Conn.Read(p)
+	wc.read.Add(int64(n))
+	return n, err
+}
+
+func (wc *wireCountingConn) Write(p []byte) (int, error) {
+	n, err := wc.Conn.Write(p)
+	wc.written.Add(int64(n))
+	return n, err
+}
+
+// compressionRatio returns application bytes per wire byte, 0 if no wire
+// bytes moved. Without compression it is just below 1 from framing overhead.
+func compressionRatio(
+	applicationBytes int64,
+	wireBytes int64,
+) float64 {
+
+	if wireBytes == 0 {
+		return 0
+	}
+	return float64(applicationBytes) / float64(wireBytes)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// writeBlockTracker accumulates the time the copy goroutines for one direction
+// spend in writes, which grows when the receiving side is slow to consume and
+// backpressure fills the sending side's buffers.
+type writeBlockTracker struct {
+	blockedWriters atomic.Int64
+
+	// sum of the start times of the writes in progress, in unix nanos
+	blockedStartNanosSum atomic.Int64
+
+	// total time of completed writes
+	blockedNanos atomic.Int64
+}
+
+// blockedSeconds returns the total time spent in writes,
+// including the time so far of writes still in progress.
+func (wbt *writeBlockTracker) blockedSeconds() float64 {
+	inProgressNanos := wbt.blockedWriters.Load()*time.Now().UnixNano() - wbt.blockedStartNanosSum.Load()
+
+	return time.Duration(wbt.blockedNanos.Load() + max(inProgressNanos, 0)).Seconds()
+}
+
+var (
+	wsToTcpWriteBlocks writeBlockTracker
+	tcpToWsWriteBlocks writeBlockTracker
+)
+
+var blockedWritesGauge = newFuncVec(
+	"wsproxy_blocked_writes",
+	"Copy goroutines currently blocked in a write, by direction.",
+	"gauge",
+	"direction",
+	blockedWriteCounts,
+)
+
+var writeBlockedSecondsCounter = newFuncVec(
+	"wsproxy_write_blocked_seconds_total",
+	"Total time copy goroutines have spent blocked in writes, by direction.",
+	"counter",
+	"direction",
+	writeBlockedSeconds,
+)
+
+// blockedWriteCounts returns the number of copy goroutines currently in a write.
+func blockedWriteCounts() map[string]float64 {
+	return map[string]float64{
+		"wsToTcp": float64(wsToTcpWriteBlocks.blockedWriters.Load()),
+		"tcpToWs": float64(tcpToWsWriteBlocks.blockedWriters.Load()),
+	}
+}
+
+// writeBlockedSeconds returns the total seconds spent in writes by direction.
+func writeBlockedSeconds() map[string]float64 {
+	return map[string]float64{
+		"wsToTcp": wsToTcpWriteBlocks.blockedSeconds(),
+		"tcpToWs": tcpToWsWriteBlocks.blockedSeconds(),
+	}
+}
+
+// blockTimingWriter times each write into tracker, and into blocked for the
+// connection. Only the copy goroutine that owns it may read blocked.
+type blockTimingWriter struct {
+	writer  io.Writer
+	tracker *writeBlockTracker
+	blocked time.Duration
+}
+
+func newBlockTimingWriter(
+	writer io.Writer,
+	tracker *writeBlockTracker,
+) *blockTimingWriter {
+	return &blockTimingWriter{
+		writer:  writer,
+		tracker: tracker,
+	}
+}
+
+func (btw *blockTimingWriter) Write(p []byte) (int, error) {
+	startTime := time.Now()
+	btw.tracker.blockedStartNanosSum.Add(startTime.UnixNano())
+	btw.tracker.blockedWriters.Add(1)
+
+	n, err := btw.writer.Write(p)
+
+	elapsed := time.Since(startTime)
+	btw.tracker.blockedWriters.Add(-1)
+	btw.tracker.blockedStartNanosSum.Add(-startTime.UnixNano())
+	btw.tracker.blockedNanos.Add(int64(elapsed))
+	btw.blocked += elapsed
+
+	return n, err
+}
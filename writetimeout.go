@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+var errMessageWriteTimeout = errors.New("message write timeout")
+
+// timedWebsocketWriter writes each Write to websocketConn as one message
+// of messageType, as websocket.NetConn does, bounding each by its own context.
+type timedWebsocketWriter struct {
+	websocketConn *websocket.Conn
+	messageType   websocket.MessageType
+	timeout       time.Duration
+}
+
+func (tww *timedWebsocketWriter) Write(p []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tww.timeout)
+	defer cancel()
+
+	if err := tww.websocketConn.Write(ctx, tww.messageType, p); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0, fmt.Errorf("%w: %w", errMessageWriteTimeout, err)
+		}
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// timedConnWriter bounds each Write to conn by a write deadline.
+// Conns that do not support deadlines are written without one.
+type timedConnWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (tcw *timedConnWriter) Write(p []byte) (int, error) {
+	tcw.conn.SetWriteDeadline(time.Now().Add(tcw.timeout))
+
+	n, err := tcw.conn.Write(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return n, fmt.Errorf("%w: %w", errMessageWriteTimeout, err)
+	}
+
+	return n, err
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// backend label of websocket backend connections, the host of backendURL
+// so that credentials in the url are not exported
+var websocketBackendLabel string
+
+// client that websocket backends are dialed with, verifying wss:// backends
+// with backendTLSConfig
+var websocketBackendHTTPClient *http.Client
+
+// newWebsocketBackendHTTPClient returns the client for backendURL, dialing
+// with backendResolver and backendSourceIP as tcp backends are, and without
+// HTTP proxies from the environment, which tcp backends do not use either.
+func newWebsocketBackendHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Resolver: backendResolver,
+	}
+	if backendSourceAddr != nil {
+		dialer.LocalAddr = backendSourceAddr
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:     dialer.DialContext,
+			TLSClientConfig: backendTLSConfig.Clone(),
+		},
+	}
+}
+
+// offeredSubprotocols returns the subprotocols the client offered in
+// Sec-WebSocket-Protocol, in order of preference.
+func offeredSubprotocols(r *http.Request) []string {
+	var subprotocols []string
+
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for subprotocol := range strings.SplitSeq(value, ",") {
+			if subprotocol = strings.TrimSpace(subprotocol); subprotocol != "" {
+				subprotocols = append(subprotocols, subprotocol)
+			}
+		}
+	}
+
+	return subprotocols
+}
+
+// proxyToWebsocketBackend relays messages between the client and the websocket
+// backend at backendURL, preserving message boundaries and types.
+// The backend is dialed first offering the client's subprotocols, and the
+// client is accepted with the subprotocol the backend selected.
+// releaseHandshakeSlot is called once the client is accepted.
+func proxyToWebsocketBackend(
+	w http.ResponseWriter,
+	r *http.Request,
+	txID string,
+	clientIPAddress string,
+	labels *connectionLabels,
+	releaseHandshakeSlot func(),
+	txLogger *slog.Logger,
+) {
+
+	if err := PreAcceptHook(r); err != nil {
+		status := rejectHookError(w, err)
+		txLogger.Warn("PreAcceptHook rejected request",
+			"status", status,
+			"error", err,
+		)
+		return
+	}
+
+	subprotocols := offeredSubprotocols(r)
+
+	txLogger = txLogger.With(
+		"backendURL", *backendURL,
+	)
+
+	dialCtx, cancelDial := context.WithTimeout(r.Context(), *backendDialTimeout)
+	defer cancelDial()
+
+	// websocket.Dial fails if the backend selects a subprotocol that was not offered
+	backendConn, _, err := websocket.Dial(dialCtx, *backendURL, &websocket.DialOptions{
+		HTTPClient:   websocketBackendHTTPClient,
+		Subprotocols: subprotocols,
+	})
+	if err != nil {
+		txLogger.Warn("websocket.Dial backend error",
+			"offeredSubprotocols", subprotocols,
+			"error", err,
+		)
+		http.Error(w, "backend unavailable", http.StatusBadGateway)
+		return
+	}
+	defer backendConn.CloseNow()
+
+	websocketConn, err := websocket.Accept(w, r, websocketBackendAcceptOptions(backendConn.Subprotocol()))
+	if err != nil {
+		txLogger.Warn("websocket.Accept error",
+			"error", err,
+		)
+		backendConn.Close(websocket.StatusGoingAway, "client handshake failed")
+		return
+	}
+	defer websocketConn.CloseNow()
+
+	releaseHandshakeSlot()
+
+	// messages are relayed whole, so neither side may send more than the proxy buffers
+	websocketConn.SetReadLimit(*backendURLReadLimit)
+	backendConn.SetReadLimit(*backendURLReadLimit)
+
+	txLogger = withWebsocketExtensions(txLogger, r, w.Header())
+
+	var connectionCloseReason closeReason
+
+	closeConnections := func(class closeClass, code websocket.StatusCode, reason string) {
+		connectionCloseReason.set(class, reason)
+		websocketConn.Close(code, reason)
+		backendConn.Close(code, reason)
+	}
+
+	stopForceClose := context.AfterFunc(forceCloseContext, func() {
+		closeConnections(closeClassShutdown, websocket.StatusGoingAway, "server shutting down")
+	})
+	defer stopForceClose()
+
+	defer connectionOpened()()
+
+	connectionStartTime := time.Now()
+
+	byteCounts := newConnectionByteCounts(*maxBytesPerConnection, func() {
+		txLogger.Warn("byte limit exceeded",
+			"maxBytesPerConnection", *maxBytesPerConnection,
+		)
+		go closeConnections(closeClassPolicy, websocket.StatusPolicyViolation, "byte limit exceeded")
+	})
+
+	adminSession := &session{
+		txID:       txID,
+		clientIP:   clientIPAddress,
+		startTime:  connectionStartTime,
+		byteCounts: byteCounts,
+		terminate: func() {
+			go closeConnections(closeClassAdminKill, websocket.StatusPolicyViolation, "terminated by admin")
+		},
+	}
+	adminSession.setBackend(websocketBackendLabel)
+	defer registerSession(adminSession)()
+
+	defer func() {
+		recordConnectionEnd(r, connectionRecord{
+			Time:            time.Now(),
+			TxID:            txID,
+			ClientIP:        clientIPAddress,
+			Backend:         websocketBackendLabel,
+			DurationSeconds: time.Since(connectionStartTime).Seconds(),
+			BytesWsToTcp:    byteCounts.wsToTcp.Load(),
+			BytesTcpToWs:    byteCounts.tcpToWs.Load(),
+			CloseReason:     connectionCloseReason.get(),
+			CloseClass:      string(connectionCloseReason.class()),
+		})
+	}()
+
+	txLogger.Info("connected to websocket backend",
+		"offeredSubprotocols", subprotocols,
+		"subprotocol", backendConn.Subprotocol(),
+	)
+
+	labels.backend = websocketBackendLabel
+	labels.subprotocol = backendConn.Subprotocol()
+	defer recordLabeledConnectionStart(labels)()
+	defer recordLabeledBytes(labels, byteCounts)
+
+	if lifetime := connectionLifetime(r, txLogger); lifetime > 0 {
+		txLogger.Info("applying connection lifetime",
+			"lifetime", lifetime.String(),
+		)
+
+		lifetimeLogger := txLogger
+		lifetimeTimer := time.AfterFunc(lifetime, func() {
+			lifetimeLogger.Info("connection lifetime reached")
+			closeConnections(closeClassLifetime, websocket.StatusGoingAway, "connection lifetime reached")
+		})
+		defer lifetimeTimer.Stop()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *proxyIdleTimeout > 0 {
+		go runIdleTimeout(ctx, *proxyIdleTimeout, byteCounts, func(idle time.Duration) {
+			logProxyIdleTimeout(idle, txLogger)
+			closeConnections(closeClassIdleTimeout, websocket.StatusGoingAway, "proxy idle timeout")
+		})
+	}
+
+	if *pingInterval > 0 {
+		go pingUntilDead(ctx, websocketConn, *pingInterval, effectivePongTimeout(), *maxMissedPongs, func() {
+			closeConnections(closeClassPingTimeout, websocket.StatusGoingAway, "ping timeout")
+		}, txLogger)
+	}
+
+	wsToBackendLimiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalWsToTcpBandwidth)
+	wsToBackendWriter := func(writer io.Writer) io.Writer {
+		writer = byteCounts.wsToTcpWriter(writer)
+		if wsToBackendLimiter != nil {
+			writer = &bandwidthLimitedWriter{
+				writer:  writer,
+				limiter: wsToBackendLimiter,
+			}
+		}
+		return writer
+	}
+
+	backendToWsLimiter := newBandwidthLimiter(*maxBytesPerSecondPerConn, globalTcpToWsBandwidth)
+	backendToWsWriter := func(writer io.Writer) io.Writer {
+		writer = byteCounts.tcpToWsWriter(writer)
+		if backendToWsLimiter != nil {
+			writer = &bandwidthLimitedWriter{
+				writer:  writer,
+				limiter: backendToWsLimiter,
+			}
+		}
+		return writer
+	}
+
+	var proxyWaitGroup sync.WaitGroup
+
+	proxyWaitGroup.Go(func() {
+		defer recoverConnectionPanic(txLogger)
+		defer cancel()
+
+		buf := wsReadBufferPool.get()
+		defer wsReadBufferPool.put(buf)
+
+		messages, err := relayMessages(ctx, websocketConn, backendConn, wsToBackendWriter, *buf)
+
+		if errors.Is(err, websocket.ErrMessageTooBig) {
+			connectionCloseReason.set(closeClassPolicy, "client message too big")
+		}
+		connectionCloseReason.set(closeClassClientEOF, "client closed")
+
+		txLogger.Info("after relayMessages(backendConn, websocketConn)",
+			"messages", messages,
+			"error", err,
+		)
+	})
+
+	proxyWaitGroup.Go(func() {
+		defer recoverConnectionPanic(txLogger)
+		defer cancel()
+
+		buf := wsWriteBufferPool.get()
+		defer wsWriteBufferPool.put(buf)
+
+		messages, err := relayMessages(ctx, backendConn, websocketConn, backendToWsWriter, *buf)
+
+		switch {
+		case errors.Is(err, websocket.ErrMessageTooBig):
+			connectionCloseReason.set(closeClassPolicy, "backend message too big")
+		case err != nil:
+			connectionCloseReason.set(closeClassBackendError, "backend connection lost")
+		default:
+			connectionCloseReason.set(closeClassBackendEOF, "backend closed")
+		}
+
+		txLogger.Info("after relayMessages(websocketConn, backendConn)",
+			"messages", messages,
+			"error", err,
+		)
+	})
+
+	proxyWaitGroup.Wait()
+
+	txLogger.Info("end websocket handler",
+		"duration", time.Since(connectionStartTime).String(),
+		"bytesWsToBackend", byteCounts.wsToTcp.Load(),
+		"bytesBackendToWs", byteCounts.tcpToWs.Load(),
+		"closeReason", connectionCloseReason.get(),
+		"closeClass", connectionCloseReason.class(),
+	)
+}
+
+// relayMessages copies messages from src to dst until src is closed,
+// then closes dst with the close code and reason src was closed with.
+// Each message is written through wrapWriter, which counts and limits it.
+func relayMessages(
+	ctx context.Context,
+	src *websocket.Conn,
+	dst *websocket.Conn,
+	wrapWriter func(io.Writer) io.Writer,
+	buf []byte,
+) (messages int64, err error) {
+
+	for {
+		messageType, reader, err := src.Reader(ctx)
+		if err != nil {
+			var closeError websocket.CloseError
+			if errors.As(err, &closeError) {
+				dst.Close(closeError.Code, closeError.Reason)
+				return messages, nil
+			}
+			dst.Close(websocket.StatusGoingAway, "peer connection lost")
+			return messages, err
+		}
+
+		writer, err := dst.Writer(ctx, messageType)
+		if err != nil {
+			return messages, err
+		}
+
+		if _, err := io.CopyBuffer(wrapWriter(writer), reader, buf); err != nil {
+			// src was closed with status 1009, and finishing the message would
+			// deliver it truncated
+			if errors.Is(err, websocket.ErrMessageTooBig) {
+				dst.Close(websocket.StatusMessageTooBig, "message too big")
+				return messages, err
+			}
+			writer.Close()
+			return messages, err
+		}
+
+		if err := writer.Close(); err != nil {
+			return messages, err
+		}
+
+		messages++
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// startWebsocketBackendProxy serves proxyToWebsocketBackend in front of a
+// backend echoing each message, returning the client's end.
+func startWebsocketBackendProxy(t *testing.T, ctx context.Context) *websocket.Conn {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendConn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer backendConn.CloseNow()
+		backendConn.SetReadLimit(-1)
+
+		for {
+			messageType, message, err := backendConn.Read(context.Background())
+			if err != nil {
+				return
+			}
+			if err := backendConn.Write(context.Background(), messageType, message); err != nil {
+				return
+			}
+		}
+	}))
+
+	previousBackendURL := *backendURL
+	t.Cleanup(func() { *backendURL = previousBackendURL })
+	t.Cleanup(backend.Close)
+
+	*backendURL = "ws" + strings.TrimPrefix(backend.URL, "http")
+	websocketBackendHTTPClient = http.DefaultClient
+	wsReadBufferPool = newBufferPool(32 * 1024)
+	wsWriteBufferPool = newBufferPool(32 * 1024)
+
+	txLogger := slog.New(slog.DiscardHandler)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyToWebsocketBackend(w, r, "tx", "127.0.0.1", newConnectionLabels(r.URL.Path, nil), func() {}, txLogger)
+	}))
+	t.Cleanup(proxy.Close)
+
+	clientConn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(proxy.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("websocket.Dial error: %v", err)
+	}
+	t.Cleanup(func() { clientConn.CloseNow() })
+	clientConn.SetReadLimit(-1)
+
+	return clientConn
+}
+
+func TestWebsocketBackendRelaysMessagesOverDefaultReadLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn := startWebsocketBackendProxy(t, ctx)
+
+	// larger than the 32KiB websocket read limit by default
+	message := bytes.Repeat([]byte("x"), 40*1024)
+	if err := clientConn.Write(ctx, websocket.MessageBinary, message); err != nil {
+		t.Fatalf("clientConn.Write error: %v", err)
+	}
+
+	_, echoed, err := clientConn.Read(ctx)
+	if err != nil {
+		t.Fatalf("clientConn.Read error: %v", err)
+	}
+	if !bytes.Equal(echoed, message) {
+		t.Fatalf("client received %v bytes, want the %v sent", len(echoed), len(message))
+	}
+}
+
+func TestWebsocketBackendClosesMessageOverReadLimit(t *testing.T) {
+	defer func(limit int64) { *backendURLReadLimit = limit }(*backendURLReadLimit)
+	*backendURLReadLimit = 1024
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientConn := startWebsocketBackendProxy(t, ctx)
+
+	if err := clientConn.Write(ctx, websocket.MessageBinary, bytes.Repeat([]byte("x"), 2048)); err != nil {
+		t.Fatalf("clientConn.Write error: %v", err)
+	}
+
+	_, _, err := clientConn.Read(ctx)
+	var closeError websocket.CloseError
+	if !errors.As(err, &closeError) || closeError.Code != websocket.StatusMessageTooBig {
+		t.Fatalf("clientConn.Read error = %v, want close status 1009", err)
+	}
+}